@@ -0,0 +1,257 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// accountDeletionGracePeriod is how long a deletion request can still be cancelled.
+	accountDeletionGracePeriod = 14 * 24 * time.Hour
+	// accountDeletionInterval is how often the deletion job looks for accounts that are due.
+	accountDeletionInterval = time.Hour
+)
+
+// userDataTables lists every table holding rows that belong to a user, with the
+// column that points at the user. deleteUserData removes all of them; tables
+// added later that reference users must be listed here as well.
+var userDataTables = []struct{ table, column string }{
+	{"privacy_settings", "user_id"},
+	{"gift_executors", "user_id"},
+	{"messages", "sender_id"},
+	{"messages", "receiver_id"},
+	{"recovery_codes", "user_id"},
+	{"password_resets", "user_id"},
+	{"security_questions", "user_id"},
+	{"verified_emails", "user_id"},
+	{"sessions", "user_id"},
+	{"api_keys", "user_id"},
+	{"tus_uploads", "user_id"},
+	{"user_data_keys", "user_id"},
+}
+
+// removeIDFromList drops id from a comma-separated list of user ids.
+func removeIDFromList(list string, id int) string {
+	target := strconv.Itoa(id)
+	var kept []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" && item != target {
+			kept = append(kept, item)
+		}
+	}
+	return strings.Join(kept, ",")
+}
+
+// deleteUserData removes the user and everything that belongs to them: their
+// gifts (with their attachments, stored files and executor assignments), messages in either
+// direction, settings, credentials, and their id in other users' follower lists.
+func deleteUserData(userID int) error {
+	storageKeys, err := giftStorageKeys("user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM gift_executors WHERE gift_id IN (SELECT id FROM gifts WHERE user_id = ?)", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM gift_thumbnails WHERE attachment_id IN
+		(SELECT id FROM gift_attachments WHERE gift_id IN (SELECT id FROM gifts WHERE user_id = ?))`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM gift_attachments WHERE gift_id IN (SELECT id FROM gifts WHERE user_id = ?)", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM gift_versions WHERE gift_id IN (SELECT id FROM gifts WHERE user_id = ?)", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM gifts WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, t := range userDataTables {
+		if _, err := tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = ?", t.table, t.column), userID); err != nil {
+			return fmt.Errorf("failed to delete from %s: %w", t.table, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM login_attempts WHERE attempt_key = ?", accountAttemptKey(userID)); err != nil {
+		return err
+	}
+
+	// Followers and following are stored as id lists on the other users' rows.
+	rows, err := tx.Query("SELECT id, COALESCE(followers, ''), COALESCE(following, '') FROM users WHERE id != ?", userID)
+	if err != nil {
+		return err
+	}
+	type followLists struct {
+		id                   int
+		followers, following string
+	}
+	var changed []followLists
+	for rows.Next() {
+		var f followLists
+		if err := rows.Scan(&f.id, &f.followers, &f.following); err != nil {
+			rows.Close()
+			return err
+		}
+		followers, following := removeIDFromList(f.followers, userID), removeIDFromList(f.following, userID)
+		if followers != f.followers || following != f.following {
+			changed = append(changed, followLists{f.id, followers, following})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+	for _, f := range changed {
+		if _, err := tx.Exec("UPDATE users SET followers = ?, following = ? WHERE id = ?", f.followers, f.following, f.id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	deleteGiftBlobs(storageKeys)
+	return nil
+}
+
+// purgeDueAccounts deletes every account whose grace period has ended and
+// returns how many were removed.
+func purgeDueAccounts() (int, error) {
+	rows, err := db.Query("SELECT id FROM users WHERE deletion_scheduled_for IS NOT NULL AND deletion_scheduled_for <= ?", timeNow().Unix())
+	if err != nil {
+		return 0, err
+	}
+	var due []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, id := range due {
+		if err := deleteUserData(id); err != nil {
+			log.Printf("Error deleting account %d: %v", id, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// runAccountDeletionJob periodically deletes accounts whose grace period has ended.
+func runAccountDeletionJob() {
+	for {
+		if deleted, err := purgeDueAccounts(); err != nil {
+			log.Printf("Error running account deletion job: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d accounts after their grace period", deleted)
+		}
+		time.Sleep(accountDeletionInterval)
+	}
+}
+
+// deleteAccountHandler reports (GET), requests (POST {password}) or cancels
+// (DELETE) the deletion of the signed-in user's account. A request takes
+// effect after accountDeletionGracePeriod; until then the user can still sign
+// in and cancel it.
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var hashedPassword string
+		if err := db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&hashedPassword); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password)) != nil {
+			http.Error(w, "Incorrect password", http.StatusUnauthorized)
+			return
+		}
+		scheduledFor := timeNow().Add(accountDeletionGracePeriod)
+		if _, err := db.Exec("UPDATE users SET deletion_scheduled_for = ? WHERE id = ?", scheduledFor.Unix(), userID); err != nil {
+			http.Error(w, "Failed to schedule account deletion", http.StatusInternalServerError)
+			return
+		}
+		sendAccountDeletionEmail(userID, scheduledFor)
+	case http.MethodDelete:
+		if _, err := db.Exec("UPDATE users SET deletion_scheduled_for = NULL WHERE id = ?", userID); err != nil {
+			http.Error(w, "Failed to cancel account deletion", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var scheduled sql.NullInt64
+	if err := db.QueryRow("SELECT deletion_scheduled_for FROM users WHERE id = ?", userID).Scan(&scheduled); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	response := map[string]interface{}{"deletionScheduled": scheduled.Valid}
+	if scheduled.Valid {
+		response["deletionScheduledFor"] = time.Unix(scheduled.Int64, 0).UTC().Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// sendAccountDeletionEmail lets the owner know the account is going away and how to stop it.
+func sendAccountDeletionEmail(userID int, scheduledFor time.Time) {
+	email, err := verifiedPrimaryEmail(userID)
+	if err != nil || email == "" {
+		return
+	}
+	subject := "Your Parting Gifts account is scheduled for deletion"
+	body := fmt.Sprintf("Hello,\n\nYour account and all of its gifts and messages will be permanently deleted on %s.\n\n"+
+		"If you change your mind, sign in before then and cancel the deletion from your account settings.",
+		scheduledFor.UTC().Format("January 2, 2006 15:04 MST"))
+	go func() {
+		if err := sendCheckEmail(email, subject, body); err != nil {
+			log.Printf("Error sending account deletion email for user %d: %v", userID, err)
+		}
+	}()
+}
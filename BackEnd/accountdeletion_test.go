@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAccountDeletionGracePeriodAndCancel(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "Sahil@1234")
+	clock := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFixedClock(t, clock)
+
+	if rec := performAuthenticatedRequest(deleteAccountHandler, "POST", "/delete-account", []byte(`{"password": "wrong"}`), 1); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong password to be rejected, got %d", rec.Code)
+	}
+	rec := performAuthenticatedRequest(deleteAccountHandler, "POST", "/delete-account", []byte(`{"password": "Sahil@1234"}`), 1)
+	var status map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &status)
+	if rec.Code != http.StatusOK || status["deletionScheduled"] != true {
+		t.Fatalf("Expected deletion to be scheduled, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Nothing happens during the grace period, and cancelling keeps the account.
+	useFixedClock(t, clock.Add(accountDeletionGracePeriod-time.Minute))
+	if n, _ := purgeDueAccounts(); n != 0 {
+		t.Errorf("Expected no deletions during the grace period, got %d", n)
+	}
+	performAuthenticatedRequest(deleteAccountHandler, "DELETE", "/delete-account", nil, 1)
+	useFixedClock(t, clock.Add(accountDeletionGracePeriod))
+	if n, _ := purgeDueAccounts(); n != 0 {
+		t.Errorf("Expected cancelled deletion not to run, got %d", n)
+	}
+}
+
+func TestDeleteUserDataCascades(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "Sahil@1234")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	_ = insertUserWithID(3, "Other_9999", "pass")
+	_, _ = db.Exec("UPDATE users SET followers = '1,3', following = '3,1' WHERE id = 2")
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name) VALUES (10, 1, 'mine.txt'), (20, 2, 'theirs.txt')")
+	_, _ = db.Exec("INSERT INTO gift_executors (gift_id, user_id) VALUES (10, 2), (20, 1)")
+	_, _ = db.Exec("INSERT INTO messages (sender_id, receiver_id, content) VALUES (1, 2, 'hi'), (2, 1, 'hello'), (2, 3, 'kept')")
+	_, _ = db.Exec("INSERT INTO privacy_settings (user_id) VALUES (1)")
+	_ = replaceSecurityQuestions(1, []securityQuestionInput{{Question: "Pet?", Answer: "rex"}})
+	_, _ = db.Exec("UPDATE users SET deletion_scheduled_for = 0 WHERE id = 1")
+
+	if n, err := purgeDueAccounts(); err != nil || n != 1 {
+		t.Fatalf("Expected one deletion, got %d %v", n, err)
+	}
+
+	counts := map[string]string{
+		"users":            "SELECT COUNT(*) FROM users WHERE id = 1",
+		"gifts":            "SELECT COUNT(*) FROM gifts WHERE user_id = 1",
+		"gift executors":   "SELECT COUNT(*) FROM gift_executors",
+		"messages":         "SELECT COUNT(*) FROM messages WHERE sender_id = 1 OR receiver_id = 1",
+		"privacy settings": "SELECT COUNT(*) FROM privacy_settings WHERE user_id = 1",
+		"security answers": "SELECT COUNT(*) FROM security_questions WHERE user_id = 1",
+	}
+	for name, query := range counts {
+		var n int
+		_ = db.QueryRow(query).Scan(&n)
+		if n != 0 {
+			t.Errorf("Expected %s of the deleted user to be gone, found %d", name, n)
+		}
+	}
+
+	var others int
+	_ = db.QueryRow("SELECT COUNT(*) FROM gifts WHERE id = 20").Scan(&others)
+	_ = db.QueryRow("SELECT COUNT(*) + ? FROM messages WHERE content = 'kept'", others).Scan(&others)
+	if others != 2 {
+		t.Errorf("Expected other users' gifts and messages to be kept")
+	}
+	var followers, following string
+	_ = db.QueryRow("SELECT followers, following FROM users WHERE id = 2").Scan(&followers, &following)
+	if followers != "3" || following != "3" {
+		t.Errorf("Expected deleted user removed from follow lists, got %q and %q", followers, following)
+	}
+}
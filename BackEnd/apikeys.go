@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every personal API key so it can be told apart from a session token.
+const apiKeyPrefix = "pgk_"
+
+// apiKeyScopes are the scopes a key can be granted. Each resource has a read
+// scope for GET requests and a write scope for everything else.
+var apiKeyScopes = map[string]bool{
+	"gifts:read":     true,
+	"gifts:write":    true,
+	"messages:read":  true,
+	"messages:write": true,
+	"profile:read":   true,
+	"profile:write":  true,
+	"friends:read":   true,
+	"friends:write":  true,
+}
+
+// isAPIKey reports whether the credential looks like a personal API key.
+func isAPIKey(credential string) bool {
+	return strings.HasPrefix(credential, apiKeyPrefix)
+}
+
+// apiKeyFromRequest returns the API key sent in X-API-Key or as a bearer token.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := strings.TrimSpace(r.Header.Get("X-API-Key")); key != "" {
+		return key
+	}
+	if token := sessionTokenFromRequest(r); isAPIKey(token) {
+		return token
+	}
+	return ""
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestScope returns the scope a request to the resource needs.
+func requestScope(resource string, r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return resource + ":read"
+	}
+	return resource + ":write"
+}
+
+// requireScope is requireAuth for endpoints that automation may use. Besides a
+// session it accepts a personal API key, provided the key has the read or
+// write scope for the resource that matches the request method.
+func requireScope(resource string, next http.HandlerFunc) http.HandlerFunc {
+	withSession := requireAuth(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := apiKeyFromRequest(r)
+		if r.Method == http.MethodOptions || key == "" {
+			withSession(w, r)
+			return
+		}
+		userID, scopes, err := authenticateAPIKey(key)
+		if err != nil {
+			enableCors(&w)
+			http.Error(w, "Invalid or revoked API key", http.StatusUnauthorized)
+			return
+		}
+		scope := requestScope(resource, r)
+		if !scopes[scope] {
+			enableCors(&w)
+			http.Error(w, "API key is missing the "+scope+" scope", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), userIDContextKey, userID)))
+	}
+}
+
+// authenticateAPIKey looks up an active key, records its use and returns the owner and scopes.
+func authenticateAPIKey(key string) (int, map[string]bool, error) {
+	var id, userID int
+	var scopeList string
+	var expiresAt sql.NullInt64
+	err := db.QueryRow(`
+		SELECT id, user_id, scopes, expires_at FROM api_keys
+		WHERE key_hash = ? AND revoked_at IS NULL`, hashAPIKey(key)).Scan(&id, &userID, &scopeList, &expiresAt)
+	if err != nil {
+		return 0, nil, err
+	}
+	now := timeNow()
+	if expiresAt.Valid && !now.Before(time.Unix(expiresAt.Int64, 0)) {
+		return 0, nil, errExpiredToken
+	}
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = ? WHERE id = ?", now.Unix(), id); err != nil {
+		log.Printf("Error recording API key use: %v", err)
+	}
+	scopes := map[string]bool{}
+	for _, scope := range strings.Fields(scopeList) {
+		scopes[scope] = true
+	}
+	return userID, scopes, nil
+}
+
+// createAPIKey stores a new key for the user and returns the key itself,
+// which is only ever shown this once.
+func createAPIKey(userID int, name string, scopes []string, expiresAt *time.Time) (int64, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return 0, "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	var expires sql.NullInt64
+	if expiresAt != nil {
+		expires = sql.NullInt64{Int64: expiresAt.Unix(), Valid: true}
+	}
+	res, err := db.Exec(`
+		INSERT INTO api_keys (user_id, name, key_prefix, key_hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		userID, name, key[:len(apiKeyPrefix)+6], hashAPIKey(key), strings.Join(scopes, " "), timeNow().Unix(), expires)
+	if err != nil {
+		return 0, "", err
+	}
+	id, err := res.LastInsertId()
+	return id, key, err
+}
+
+// apiKeysHandler lists (GET), creates (POST) and revokes (DELETE ?id=) the
+// signed-in user's API keys. It only accepts sessions, so a key cannot mint more keys.
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(`
+			SELECT id, name, key_prefix, scopes, created_at, last_used_at, expires_at FROM api_keys
+			WHERE user_id = ? AND revoked_at IS NULL ORDER BY id`, userID)
+		if err != nil {
+			http.Error(w, "Error retrieving API keys", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		type apiKey struct {
+			ID         int      `json:"id"`
+			Name       string   `json:"name"`
+			Prefix     string   `json:"prefix"`
+			Scopes     []string `json:"scopes"`
+			CreatedAt  string   `json:"createdAt"`
+			LastUsedAt string   `json:"lastUsedAt,omitempty"`
+			ExpiresAt  string   `json:"expiresAt,omitempty"`
+		}
+		keys := []apiKey{}
+		for rows.Next() {
+			var k apiKey
+			var scopes string
+			var created int64
+			var lastUsed, expires sql.NullInt64
+			if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &created, &lastUsed, &expires); err != nil {
+				http.Error(w, "Error retrieving API keys", http.StatusInternalServerError)
+				return
+			}
+			k.Scopes = strings.Fields(scopes)
+			k.CreatedAt = time.Unix(created, 0).UTC().Format(time.RFC3339)
+			if lastUsed.Valid {
+				k.LastUsedAt = time.Unix(lastUsed.Int64, 0).UTC().Format(time.RFC3339)
+			}
+			if expires.Valid {
+				k.ExpiresAt = time.Unix(expires.Int64, 0).UTC().Format(time.RFC3339)
+			}
+			keys = append(keys, k)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+
+	case http.MethodPost:
+		var req struct {
+			Name          string   `json:"name"`
+			Scopes        []string `json:"scopes"`
+			ExpiresInDays int      `json:"expiresInDays"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			http.Error(w, "A name is required", http.StatusBadRequest)
+			return
+		}
+		seen := map[string]bool{}
+		var scopes []string
+		for _, scope := range req.Scopes {
+			if !apiKeyScopes[scope] {
+				http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+				return
+			}
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+		if len(scopes) == 0 {
+			http.Error(w, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		sort.Strings(scopes)
+		var expiresAt *time.Time
+		if req.ExpiresInDays < 0 {
+			http.Error(w, "expiresInDays must not be negative", http.StatusBadRequest)
+			return
+		} else if req.ExpiresInDays > 0 {
+			at := timeNow().AddDate(0, 0, req.ExpiresInDays)
+			expiresAt = &at
+		}
+
+		id, key, err := createAPIKey(userID, req.Name, scopes, expiresAt)
+		if err != nil {
+			log.Printf("Error creating API key for user %d: %v", userID, err)
+			http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":     id,
+			"name":   req.Name,
+			"scopes": scopes,
+			"key":    key,
+		})
+
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Invalid key id", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+			timeNow().Unix(), id, userID)
+		if err != nil {
+			http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "API key not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	useFixedClock(t, time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	rec := performAuthenticatedRequest(apiKeysHandler, "POST", "/api-keys", []byte(`{"name": "uploader", "scopes": ["gifts:read"]}`), 1)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Create failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		ID  int    `json:"id"`
+		Key string `json:"key"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &created)
+
+	var stored int
+	_ = db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE key_hash = ?", created.Key).Scan(&stored)
+	if stored != 0 {
+		t.Errorf("API keys must not be stored in plaintext")
+	}
+
+	withKey := func(handler http.HandlerFunc, method, url string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, nil)
+		req.Header.Set("Authorization", "Bearer "+created.Key)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	if rec := withKey(requireScope("gifts", giftCountHandler), "GET", "/gift-count"); rec.Code != http.StatusOK {
+		t.Errorf("Expected key with gifts:read to read gifts, got %d", rec.Code)
+	}
+	if rec := withKey(requireScope("gifts", stopPendingGiftHandler), "POST", "/stop-pending-gift"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected key without gifts:write to be refused, got %d", rec.Code)
+	}
+	if rec := withKey(requireScope("messages", getMessagesHandler), "GET", "/get-messages"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected key without messages:read to be refused, got %d", rec.Code)
+	}
+	if rec := withKey(requireAuth(apiKeysHandler), "GET", "/api-keys"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected session-only endpoint to refuse API keys, got %d", rec.Code)
+	}
+
+	rec = performAuthenticatedRequest(apiKeysHandler, "GET", "/api-keys", nil, 1)
+	var keys []struct {
+		Prefix     string `json:"prefix"`
+		LastUsedAt string `json:"lastUsedAt"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &keys)
+	if len(keys) != 1 || keys[0].LastUsedAt == "" || keys[0].Prefix != created.Key[:len(keys[0].Prefix)] {
+		t.Errorf("Unexpected key listing: %s", rec.Body.String())
+	}
+
+	if rec := performAuthenticatedRequest(apiKeysHandler, "DELETE", "/api-keys?id=1", nil, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Revoke failed: %d", rec.Code)
+	}
+	if rec := withKey(requireScope("gifts", giftCountHandler), "GET", "/gift-count"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked key to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestAPIKeyRejectsUnknownScope(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	rec := performAuthenticatedRequest(apiKeysHandler, "POST", "/api-keys", []byte(`{"name": "x", "scopes": ["admin"]}`), 1)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown scope to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionCookieName is the cookie that carries the session token for browser clients.
+const sessionCookieName = "session"
+
+// sessionTTL is how long a freshly issued session token stays valid.
+var sessionTTL = 24 * time.Hour
+
+// timeNow is the clock used for expiry, TOTP and lockout checks; tests replace it with a fixed time.
+var timeNow = time.Now
+
+// sessionSecret signs session tokens. It is read from SESSION_SECRET so tokens
+// survive restarts; otherwise a random key is generated and every restart logs users out.
+var sessionSecret = loadSessionSecret()
+
+var (
+	errInvalidToken = errors.New("invalid session token")
+	errExpiredToken = errors.New("session token expired")
+)
+
+type contextKey string
+
+const (
+	userIDContextKey    contextKey = "userID"
+	sessionIDContextKey contextKey = "sessionID"
+)
+
+func loadSessionSecret() []byte {
+	if secret := os.Getenv("SESSION_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Failed to generate session secret: %v", err)
+	}
+	log.Println("SESSION_SECRET not set; using a random key, sessions will not survive a restart")
+	return secret
+}
+
+// issueSessionToken creates a signed token of the form payload.signature where the
+// payload encodes the user id, the expiry time and a random session id, which is
+// also returned. Use createSession to get a token that requireAuth accepts.
+func issueSessionToken(userID int) (string, string, time.Time, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", time.Time{}, err
+	}
+	sid := hex.EncodeToString(raw)
+	expiresAt := timeNow().Add(sessionTTL)
+	payload := fmt.Sprintf("%d.%d.%s", userID, expiresAt.Unix(), sid)
+	return signPayload(payload), sid, expiresAt, nil
+}
+
+// signPayload encodes the payload and appends an HMAC so it can be handed to
+// clients and verified later with verifySignedPayload.
+func signPayload(payload string) string {
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + signToken(encoded)
+}
+
+func signToken(encoded string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(encoded))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedPayload checks the signature produced by signPayload and returns the payload.
+func verifySignedPayload(token string) (string, error) {
+	encoded, signature, found := strings.Cut(token, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signToken(encoded))) {
+		return "", errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", errInvalidToken
+	}
+	return string(payload), nil
+}
+
+// issuePurposeToken signs a short-lived token that is only valid for one purpose
+// (for example "2fa" or "unlock") and one user.
+func issuePurposeToken(purpose string, userID int, ttl time.Duration) string {
+	return signPayload(fmt.Sprintf("%s:%d:%d", purpose, userID, timeNow().Add(ttl).Unix()))
+}
+
+// parsePurposeToken verifies a token from issuePurposeToken and returns its user id.
+func parsePurposeToken(token, purpose string, now time.Time) (int, error) {
+	userID, _, err := parsePurposeClaims(token, purpose, now)
+	return userID, err
+}
+
+// parsePurposeClaims is parsePurposeToken that also returns the expiry.
+func parsePurposeClaims(token, purpose string, now time.Time) (int, time.Time, error) {
+	payload, err := verifySignedPayload(token)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 || parts[0] != purpose {
+		return 0, time.Time{}, errInvalidToken
+	}
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, time.Time{}, errInvalidToken
+	}
+	expiresUnix, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, errInvalidToken
+	}
+	expiresAt := time.Unix(expiresUnix, 0)
+	if !now.Before(expiresAt) {
+		return 0, time.Time{}, errExpiredToken
+	}
+	return userID, expiresAt, nil
+}
+
+// consumePurposeToken is parsePurposeToken for tokens that work only once. The
+// token is recorded as used until it expires, and refused from then on.
+func consumePurposeToken(token, purpose string) (int, error) {
+	now := timeNow()
+	userID, expiresAt, err := parsePurposeClaims(token, purpose, now)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec("DELETE FROM used_tokens WHERE expires_at <= ?", now.Unix()); err != nil {
+		return 0, err
+	}
+	res, err := db.Exec("INSERT OR IGNORE INTO used_tokens (token_hash, expires_at) VALUES (?, ?)",
+		hashResetSecret(token), expiresAt.Unix())
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, errInvalidToken
+	}
+	return userID, nil
+}
+
+// purposeTokenUsed reports whether a single-use token was already consumed.
+func purposeTokenUsed(token string) (bool, error) {
+	var used bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM used_tokens WHERE token_hash = ?)", hashResetSecret(token)).Scan(&used)
+	return used, err
+}
+
+// parseSessionToken verifies the signature and expiry of a token and returns the user id it was issued to.
+func parseSessionToken(token string, now time.Time) (int, error) {
+	userID, _, err := parseSessionClaims(token, now)
+	return userID, err
+}
+
+// parseSessionClaims is parseSessionToken that also returns the session id.
+func parseSessionClaims(token string, now time.Time) (int, string, error) {
+	payload, err := verifySignedPayload(token)
+	if err != nil {
+		return 0, "", err
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 3 || parts[2] == "" {
+		return 0, "", errInvalidToken
+	}
+	userID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", errInvalidToken
+	}
+	expiresUnix, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, "", errInvalidToken
+	}
+	if !now.Before(time.Unix(expiresUnix, 0)) {
+		return 0, "", errExpiredToken
+	}
+	return userID, parts[2], nil
+}
+
+// sessionTokenFromRequest reads the token from an "Authorization: Bearer" header,
+// falling back to the session cookie.
+func sessionTokenFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if scheme, token, found := strings.Cut(auth, " "); found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// setSessionCookie stores the token in an HttpOnly cookie for browser clients.
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   os.Getenv("SESSION_COOKIE_SECURE") == "1",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   os.Getenv("SESSION_COOKIE_SECURE") == "1",
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// requireAuth resolves the signed-in user from the session token and makes it
+// available to the wrapped handler through currentUserID. The session must
+// still be active in the sessions table. CORS preflight requests are passed
+// through untouched.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		if apiKeyFromRequest(r) != "" {
+			enableCors(&w)
+			http.Error(w, "This endpoint requires signing in; API keys are not accepted", http.StatusForbidden)
+			return
+		}
+		token := sessionTokenFromRequest(r)
+		if token == "" {
+			enableCors(&w)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		userID, sid, err := parseSessionClaims(token, timeNow())
+		if err != nil || !sessionActive(sid, userID, r) {
+			enableCors(&w)
+			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userIDContextKey, userID)
+		ctx = context.WithValue(ctx, sessionIDContextKey, sid)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// currentUserID returns the id of the authenticated user. Handlers must be
+// wrapped in requireAuth; otherwise a 401 is written and false is returned.
+func currentUserID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	userID, ok := r.Context().Value(userIDContextKey).(int)
+	if !ok {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return 0, false
+	}
+	return userID, true
+}
+
+// currentUsername returns the username of the authenticated user.
+func currentUsername(w http.ResponseWriter, r *http.Request) (int, string, bool) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return 0, "", false
+	}
+	var username string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return 0, "", false
+	}
+	return userID, username, true
+}
+
+// startSession creates a session for the user, sets the cookie and returns the token.
+func startSession(w http.ResponseWriter, r *http.Request, userID int) (string, time.Time, error) {
+	token, expiresAt, err := createSession(r, userID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	setSessionCookie(w, token, expiresAt)
+	return token, expiresAt, nil
+}
+
+// writeLoginSuccess starts a session and writes the response shared by every
+// way of logging in.
+func writeLoginSuccess(w http.ResponseWriter, r *http.Request, userID int, forceChange bool) {
+	token, expiresAt, err := startSession(w, r, userID)
+	if err != nil {
+		log.Printf("Failed to start session for user %d: %v", userID, err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Login error"})
+		return
+	}
+
+	response := struct {
+		Message     string `json:"message"`
+		ForceChange bool   `json:"forceChange"`
+		Token       string `json:"token"`
+		ExpiresAt   string `json:"expiresAt"`
+	}{
+		Message:     "Login successful",
+		ForceChange: forceChange,
+		Token:       token,
+		ExpiresAt:   expiresAt.UTC().Format(time.RFC3339),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	if userID, sid, err := parseSessionClaims(sessionTokenFromRequest(r), timeNow()); err == nil {
+		revokeSession(userID, sid)
+	}
+	clearSessionCookie(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSessionTokenRoundTrip(t *testing.T) {
+	token, _, expiresAt, err := issueSessionToken(42)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	userID, err := parseSessionToken(token, time.Now())
+	if err != nil || userID != 42 {
+		t.Errorf("Expected user 42, got %d (%v)", userID, err)
+	}
+
+	if _, err := parseSessionToken(token, expiresAt.Add(time.Second)); err != errExpiredToken {
+		t.Errorf("Expected expired token error, got %v", err)
+	}
+
+	tampered := token[:len(token)-2] + "xx"
+	if _, err := parseSessionToken(tampered, time.Now()); err != errInvalidToken {
+		t.Errorf("Expected invalid token error for tampered signature, got %v", err)
+	}
+}
+
+func TestRequireAuthRejectsMissingToken(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	rec := performRequest(requireAuth(giftCountHandler), "GET", "/gift-count?username=Sahil_1234", nil)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without a session, got %d", rec.Code)
+	}
+}
+
+func TestRequireAuthAcceptsCookie(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	req := httptest.NewRequest("GET", "/gift-count", nil)
+	token, expiresAt, _ := createSession(req, 1)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: token, Expires: expiresAt})
+	rec := httptest.NewRecorder()
+	requireAuth(giftCountHandler)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 with a session cookie, got %d", rec.Code)
+	}
+}
+
+func TestQueryUsernameIsIgnored(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	_, _ = db.Exec("UPDATE users SET followers = '1' WHERE id = 2")
+
+	// Signed in as user 1 but asking for user 2's followers.
+	rec := performAuthenticatedRequest(getFollowersHandler, "GET", "/friends/followers?username=Friend_5678", nil, 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 OK, got %d", rec.Code)
+	}
+	if rec.Body.String() != "[]\n" {
+		t.Errorf("Expected the caller's own (empty) follower list, got %s", rec.Body.String())
+	}
+}
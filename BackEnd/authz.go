@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// giftRoles describes how a user is related to a single gift.
+//   - Owner: the user who uploaded the gift.
+//   - Executor: a user the owner trusts to manage the gift on their behalf.
+//   - Receiver: a user whose contact email is one of the gift's receivers.
+type giftRoles struct {
+	Owner    bool
+	Executor bool
+	Receiver bool
+	Pending  bool
+}
+
+// giftAction is an operation a user may attempt on a gift.
+type giftAction int
+
+const (
+	// giftActionView reads the gift contents (download).
+	giftActionView giftAction = iota
+	// giftActionManage changes how the gift is delivered (receivers, schedule, stop).
+	giftActionManage
+	// giftActionAdminister changes who may manage the gift (executors) or
+	// deletes it.
+	giftActionAdminister
+)
+
+var errGiftNotFound = errors.New("gift not found")
+
+// any reports whether the user has any relationship with the gift at all.
+func (roles giftRoles) any() bool {
+	return roles.Owner || roles.Executor || roles.Receiver
+}
+
+// can reports whether the roles allow the action. Receivers only see a gift
+// once it has been delivered.
+func (roles giftRoles) can(action giftAction) bool {
+	switch action {
+	case giftActionView:
+		return roles.Owner || roles.Executor || (roles.Receiver && !roles.Pending)
+	case giftActionManage:
+		return roles.Owner || roles.Executor
+	case giftActionAdminister:
+		return roles.Owner
+	}
+	return false
+}
+
+// loadGiftRoles works out the roles a user holds on a gift.
+func loadGiftRoles(userID, giftID int) (giftRoles, error) {
+	var roles giftRoles
+	var ownerID int
+	var receivers sql.NullString
+	// Gifts in the trash only show up in /gift-trash.
+	err := db.QueryRow("SELECT user_id, receivers, pending FROM gifts WHERE id = ? AND deleted_at IS NULL", giftID).
+		Scan(&ownerID, &receivers, &roles.Pending)
+	if err == sql.ErrNoRows {
+		return roles, errGiftNotFound
+	}
+	if err != nil {
+		return roles, err
+	}
+	roles.Owner = ownerID == userID
+
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM gift_executors WHERE gift_id = ? AND user_id = ?)",
+		giftID, userID).Scan(&roles.Executor); err != nil {
+		return roles, err
+	}
+
+	// Only addresses the user has verified count; anyone can enter a
+	// receiver's address as one of their contact emails.
+	if receivers.Valid && receivers.String != "" {
+		emails, err := verifiedEmails(userID)
+		if err != nil {
+			return roles, err
+		}
+		roles.Receiver = emailListsIntersect(receivers.String, strings.Join(emails, ","))
+	}
+	return roles, nil
+}
+
+// emailListsIntersect reports whether two comma-separated email lists share an address.
+func emailListsIntersect(a, b string) bool {
+	seen := make(map[string]bool)
+	for _, email := range strings.Split(a, ",") {
+		if email = strings.ToLower(strings.TrimSpace(email)); email != "" {
+			seen[email] = true
+		}
+	}
+	for _, email := range strings.Split(b, ",") {
+		if seen[strings.ToLower(strings.TrimSpace(email))] {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeGift checks that the signed-in user may perform the action on the gift.
+// Users with no relationship to the gift get a 404 so gift ids cannot be probed;
+// users who can see the gift but not perform the action get a 403.
+func authorizeGift(w http.ResponseWriter, r *http.Request, giftID int, action giftAction) (giftRoles, bool) {
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return giftRoles{}, false
+	}
+	roles, err := loadGiftRoles(userID, giftID)
+	if err != nil && err != errGiftNotFound {
+		log.Printf("Error loading roles for gift %d: %v", giftID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return roles, false
+	}
+	if err == errGiftNotFound || !roles.any() {
+		http.Error(w, "Gift not found", http.StatusNotFound)
+		return roles, false
+	}
+	if !roles.can(action) {
+		http.Error(w, "You do not have permission to perform this action on this gift", http.StatusForbidden)
+		return roles, false
+	}
+	return roles, true
+}
+
+// giftExecutorsHandler lists (GET), adds (POST) and removes (DELETE) the
+// executors of a gift. Only the owner may change executors.
+func giftExecutorsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		giftID, err := strconv.Atoi(r.URL.Query().Get("giftId"))
+		if err != nil {
+			http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+			return
+		}
+		if _, ok := authorizeGift(w, r, giftID, giftActionManage); !ok {
+			return
+		}
+		rows, err := db.Query(`
+			SELECT u.username FROM gift_executors e
+			JOIN users u ON u.id = e.user_id
+			WHERE e.gift_id = ?
+			ORDER BY u.username`, giftID)
+		if err != nil {
+			http.Error(w, "Error retrieving executors", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		executors := []string{}
+		for rows.Next() {
+			var username string
+			if err := rows.Scan(&username); err != nil {
+				continue
+			}
+			executors = append(executors, username)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(executors)
+
+	case http.MethodPost:
+		var req struct {
+			GiftID   int    `json:"giftId"`
+			Username string `json:"username"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if _, ok := authorizeGift(w, r, req.GiftID, giftActionAdminister); !ok {
+			return
+		}
+		ownerID, _ := currentUserID(w, r)
+		var executorID int
+		if err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&executorID); err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if executorID == ownerID {
+			http.Error(w, "You already own this gift", http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec("INSERT OR IGNORE INTO gift_executors (gift_id, user_id) VALUES (?, ?)", req.GiftID, executorID); err != nil {
+			log.Printf("Error adding executor to gift %d: %v", req.GiftID, err)
+			http.Error(w, "Failed to add executor", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Executor added"})
+
+	case http.MethodDelete:
+		giftID, err := strconv.Atoi(r.URL.Query().Get("giftId"))
+		if err != nil {
+			http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+			return
+		}
+		if _, ok := authorizeGift(w, r, giftID, giftActionAdminister); !ok {
+			return
+		}
+		_, err = db.Exec(`
+			DELETE FROM gift_executors
+			WHERE gift_id = ? AND user_id = (SELECT id FROM users WHERE username = ?)`,
+			giftID, r.URL.Query().Get("username"))
+		if err != nil {
+			http.Error(w, "Failed to remove executor", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Executor removed"})
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
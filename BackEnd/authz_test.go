@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+// setupGiftRolesDB creates an owner (1), a stranger (2), an executor (3), a
+// receiver (4) and a user who claims the receiver's address without having
+// verified it (5) around a single gift with id 1.
+func setupGiftRolesDB(t *testing.T, pending bool) {
+	var err error
+	db, err = setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	_ = insertUserWithID(1, "owner_1", "pass")
+	_ = insertUserWithID(2, "stranger_2", "pass")
+	_ = insertUserWithID(3, "executor_3", "pass")
+	_ = insertUserWithID(4, "receiver_4", "pass")
+	_ = insertUserWithID(5, "claimer_5", "pass")
+	_, _ = db.Exec("UPDATE users SET primary_contact_email = 'receiver@example.com' WHERE id = 4")
+	_ = markEmailVerified(4, "receiver@example.com")
+	_, _ = db.Exec("UPDATE users SET secondary_contact_emails = 'receiver@example.com' WHERE id = 5")
+	_, err = db.Exec("INSERT INTO gifts (id, user_id, file_name, file_data, receivers, pending) VALUES (1, 1, 'gift.txt', ?, 'Receiver@example.com', ?)",
+		[]byte("gift contents"), pending)
+	if err != nil {
+		t.Fatalf("Failed to insert test gift: %v", err)
+	}
+	_, _ = db.Exec("INSERT INTO gift_executors (gift_id, user_id) VALUES (1, 3)")
+}
+
+func TestDownloadGiftAuthorization(t *testing.T) {
+	cases := []struct {
+		name    string
+		userID  int
+		pending bool
+		want    int
+	}{
+		{"owner", 1, true, http.StatusOK},
+		{"executor", 3, true, http.StatusOK},
+		{"stranger", 2, false, http.StatusNotFound},
+		{"receiver before delivery", 4, true, http.StatusForbidden},
+		{"receiver after delivery", 4, false, http.StatusOK},
+		{"unverified receiver address", 5, false, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		setupGiftRolesDB(t, tc.pending)
+		rec := performAuthenticatedRequest(downloadGiftHandler, "GET", "/download-gift?id=1", nil, tc.userID)
+		if rec.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+	}
+
+	setupGiftRolesDB(t, true)
+	rec := performAuthenticatedRequest(downloadGiftHandler, "GET", "/download-gift?id=99", nil, 1)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("missing gift: expected 404, got %d", rec.Code)
+	}
+}
+
+func TestStopPendingGiftAuthorization(t *testing.T) {
+	cases := []struct {
+		name   string
+		userID int
+		want   int
+	}{
+		{"stranger", 2, http.StatusNotFound},
+		{"receiver", 4, http.StatusForbidden},
+		{"executor", 3, http.StatusOK},
+		{"owner", 1, http.StatusOK},
+	}
+	for _, tc := range cases {
+		setupGiftRolesDB(t, false)
+		rec := performAuthenticatedRequest(stopPendingGiftHandler, "DELETE", "/stop-pending-gift?id=1", nil, tc.userID)
+		if rec.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+		var cancelled bool
+		_ = db.QueryRow("SELECT cancelled FROM gifts WHERE id = 1").Scan(&cancelled)
+		if cancelled != (tc.want == http.StatusOK) {
+			t.Errorf("%s: unexpected gift cancellation state %v", tc.name, cancelled)
+		}
+	}
+}
+
+func TestDeleteGiftAuthorization(t *testing.T) {
+	cases := []struct {
+		name   string
+		userID int
+		want   int
+	}{
+		{"stranger", 2, http.StatusNotFound},
+		{"receiver", 4, http.StatusForbidden},
+		{"executor", 3, http.StatusForbidden},
+		{"owner", 1, http.StatusOK},
+	}
+	for _, tc := range cases {
+		setupGiftRolesDB(t, false)
+		rec := performAuthenticatedRequest(deleteGiftHandler, "DELETE", "/delete-gift?id=1", nil, tc.userID)
+		if rec.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+		var trashed bool
+		_ = db.QueryRow("SELECT deleted_at IS NOT NULL FROM gifts WHERE id = 1").Scan(&trashed)
+		if trashed != (tc.want == http.StatusOK) {
+			t.Errorf("%s: unexpected trash state %v", tc.name, trashed)
+		}
+	}
+}
+
+func TestSetupReceiversAuthorization(t *testing.T) {
+	cases := []struct {
+		name   string
+		userID int
+		want   int
+	}{
+		{"stranger", 2, http.StatusNotFound},
+		{"receiver", 4, http.StatusForbidden},
+		{"executor", 3, http.StatusOK},
+		{"owner", 1, http.StatusOK},
+	}
+	for _, tc := range cases {
+		setupGiftRolesDB(t, false)
+		body := []byte(`{"giftId": 1, "receivers": "attacker@example.com"}`)
+		rec := performAuthenticatedRequest(setupReceiversHandler, "POST", "/setup-receivers", body, tc.userID)
+		if rec.Code != tc.want {
+			t.Errorf("%s: expected %d, got %d", tc.name, tc.want, rec.Code)
+		}
+	}
+}
+
+func TestGiftExecutorsAuthorization(t *testing.T) {
+	setupGiftRolesDB(t, true)
+
+	body := []byte(`{"giftId": 1, "username": "stranger_2"}`)
+	rec := performAuthenticatedRequest(giftExecutorsHandler, "POST", "/gift-executors", body, 3)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("executor adding executor: expected 403, got %d", rec.Code)
+	}
+	rec = performAuthenticatedRequest(giftExecutorsHandler, "POST", "/gift-executors", body, 2)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("stranger adding executor: expected 404, got %d", rec.Code)
+	}
+	rec = performAuthenticatedRequest(giftExecutorsHandler, "POST", "/gift-executors", body, 1)
+	if rec.Code != http.StatusOK {
+		t.Errorf("owner adding executor: expected 200, got %d", rec.Code)
+	}
+
+	rec = performAuthenticatedRequest(giftExecutorsHandler, "GET", "/gift-executors?giftId=1", nil, 3)
+	if rec.Code != http.StatusOK || rec.Body.String() != "[\"executor_3\",\"stranger_2\"]\n" {
+		t.Errorf("listing executors: got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = performAuthenticatedRequest(giftExecutorsHandler, "DELETE", "/gift-executors?giftId=1&username=stranger_2", nil, 1)
+	if rec.Code != http.StatusOK {
+		t.Errorf("owner removing executor: expected 200, got %d", rec.Code)
+	}
+	rec = performAuthenticatedRequest(downloadGiftHandler, "GET", "/download-gift?id=1", nil, 2)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("removed executor downloading: expected 404, got %d", rec.Code)
+	}
+}
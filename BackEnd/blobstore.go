@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// blobStore keeps gift payloads outside the gifts table. Keys are generated by
+// the server (see newGiftStorageKey) and use "/" as a separator.
+type blobStore interface {
+	// Put stores everything read from r under key and returns the number of bytes written.
+	Put(key string, r io.Reader) (int64, error)
+	// Open returns the blob stored under key, or errBlobNotFound.
+	Open(key string) (io.ReadCloser, error)
+	// OpenRange returns length bytes of the blob starting at offset, or errBlobNotFound.
+	OpenRange(key string, offset, length int64) (io.ReadCloser, error)
+	// Delete removes the blob; deleting a missing blob is not an error.
+	Delete(key string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// giftStore is where new gift payloads are written. main configures it from
+// the environment with newBlobStoreFromEnv.
+var giftStore blobStore
+
+// newBlobStoreFromEnv builds the store selected by STORAGE_BACKEND:
+// "sqlite" (the default), "fs" or "s3".
+func newBlobStoreFromEnv() (blobStore, error) {
+	switch backend := envOrDefault("STORAGE_BACKEND", "sqlite"); backend {
+	case "sqlite":
+		blobDB, err := sql.Open("sqlite3", envOrDefault("STORAGE_SQLITE_PATH", "./blobs.db"))
+		if err != nil {
+			return nil, err
+		}
+		return newSQLiteBlobStore(blobDB)
+	case "fs":
+		return newFSBlobStore(envOrDefault("STORAGE_DIR", "./gift-files"))
+	case "s3":
+		return newS3BlobStoreFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", backend)
+	}
+}
+
+// newGiftStorageKey returns a fresh, unguessable key for a gift payload.
+func newGiftStorageKey() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return "gifts/" + hex.EncodeToString(raw), nil
+}
+
+// openGiftData returns the gift's file name and a reader for its payload, which
+// lives in giftStore or, for gifts stored before blob storage existed, in the
+// gifts.file_data column.
+func openGiftData(giftID int) (string, io.ReadCloser, error) {
+	var fileName string
+	var storageKey sql.NullString
+	var fileData []byte
+	err := db.QueryRow("SELECT file_name, storage_key, file_data FROM gifts WHERE id = ?", giftID).
+		Scan(&fileName, &storageKey, &fileData)
+	if err != nil {
+		return "", nil, err
+	}
+	if storageKey.Valid && storageKey.String != "" {
+		rc, err := openGiftBlob(storageKey.String)
+		return fileName, rc, err
+	}
+	return fileName, io.NopCloser(bytes.NewReader(fileData)), nil
+}
+
+// readGiftData is openGiftData for callers that need the whole payload in memory.
+func readGiftData(giftID int) (string, []byte, error) {
+	fileName, rc, err := openGiftData(giftID)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	return fileName, data, err
+}
+
+// giftStorageKeys returns the storage keys of the gifts matched by where,
+// e.g. "id = ?", including the files of every attachment in their bundles,
+// their thumbnails and the files of their earlier versions.
+func giftStorageKeys(where string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(
+		"SELECT storage_key FROM gifts WHERE storage_key IS NOT NULL AND "+where+
+			" UNION SELECT storage_key FROM gift_attachments WHERE storage_key IS NOT NULL AND gift_id IN (SELECT id FROM gifts WHERE "+where+")"+
+			" UNION SELECT t.storage_key FROM gift_thumbnails t JOIN gift_attachments a ON a.id = t.attachment_id WHERE a.gift_id IN (SELECT id FROM gifts WHERE "+where+")"+
+			" UNION SELECT storage_key FROM gift_versions WHERE storage_key IS NOT NULL AND gift_id IN (SELECT id FROM gifts WHERE "+where+")",
+		append(append(append(args, args...), args...), args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// migrateGiftBlobs moves payloads still held in gifts.file_data into the store
+// and clears the column. It returns how many gifts were moved.
+func migrateGiftBlobs(store blobStore) (int, error) {
+	rows, err := db.Query("SELECT id FROM gifts WHERE storage_key IS NULL AND file_data IS NOT NULL")
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	moved := 0
+	for _, id := range ids {
+		var data []byte
+		if err := db.QueryRow("SELECT file_data FROM gifts WHERE id = ?", id).Scan(&data); err != nil {
+			return moved, err
+		}
+		key, err := newGiftStorageKey()
+		if err != nil {
+			return moved, err
+		}
+		n, err := store.Put(key, bytes.NewReader(data))
+		if err != nil {
+			return moved, fmt.Errorf("failed to store gift %d: %w", id, err)
+		}
+		sum := sha256.Sum256(data)
+		mimeType, checksum := detectContentType(data), hex.EncodeToString(sum[:])
+		if _, err := db.Exec("UPDATE gifts SET storage_key = ?, file_size = ?, mime_type = ?, sha256 = ?, file_data = NULL WHERE id = ?",
+			key, n, mimeType, checksum, id); err != nil {
+			store.Delete(key)
+			return moved, err
+		}
+		if _, err := db.Exec("UPDATE gift_attachments SET storage_key = ?, file_size = ?, mime_type = ?, sha256 = ? WHERE gift_id = ? AND storage_key IS NULL",
+			key, n, mimeType, checksum, id); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// sqliteBlobStore keeps blobs in tables of their own, normally in a separate
+// database file so the main database stays small. blobs has a row per blob
+// and blob_chunks its content in pieces of sqliteBlobChunkSize, so that
+// neither writing nor reading a blob holds all of it in memory.
+type sqliteBlobStore struct {
+	db *sql.DB
+}
+
+const sqliteBlobChunkSize = 1 << 20
+
+func newSQLiteBlobStore(db *sql.DB) (*sqliteBlobStore, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS blobs (
+		key TEXT PRIMARY KEY,
+		data BLOB NOT NULL  -- empty; blobs stored before chunking kept their content here
+	);
+	CREATE TABLE IF NOT EXISTS blob_chunks (
+		key TEXT NOT NULL,
+		start INTEGER NOT NULL,  -- offset of the chunk's first byte in the blob
+		data BLOB NOT NULL,
+		PRIMARY KEY (key, start)
+	);
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create blobs table: %w", err)
+	}
+	if err := addColumnIfMissing(db, "blobs", "size", "INTEGER"); err != nil {
+		return nil, err
+	}
+	s := &sqliteBlobStore{db: db}
+	if err := s.chunkLegacyBlobs(); err != nil {
+		return nil, fmt.Errorf("failed to split stored blobs into chunks: %w", err)
+	}
+	return s, nil
+}
+
+// chunkLegacyBlobs moves blobs stored whole, before chunking, into blob_chunks.
+func (s *sqliteBlobStore) chunkLegacyBlobs() error {
+	rows, err := s.db.Query("SELECT key FROM blobs WHERE size IS NULL")
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		var data []byte
+		if err := s.db.QueryRow("SELECT data FROM blobs WHERE key = ?", key).Scan(&data); err != nil {
+			return err
+		}
+		if _, err := s.Put(key, bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put writes the chunks under a temporary key and switches them in at the
+// end, so readers never see a partial blob.
+func (s *sqliteBlobStore) Put(key string, r io.Reader) (int64, error) {
+	tmp, err := newGiftStorageKey()
+	if err != nil {
+		return 0, err
+	}
+	tmp = ".upload/" + tmp
+	discard := func() { s.db.Exec("DELETE FROM blob_chunks WHERE key = ?", tmp) }
+
+	buf := make([]byte, sqliteBlobChunkSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := s.db.Exec("INSERT INTO blob_chunks (key, start, data) VALUES (?, ?, ?)", tmp, size, buf[:n]); err != nil {
+				discard()
+				return 0, err
+			}
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			discard()
+			return 0, err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		discard()
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []struct {
+		sql  string
+		args []interface{}
+	}{
+		{"DELETE FROM blob_chunks WHERE key = ?", []interface{}{key}},
+		{"UPDATE blob_chunks SET key = ? WHERE key = ?", []interface{}{key, tmp}},
+		{"INSERT OR REPLACE INTO blobs (key, data, size) VALUES (?, X'', ?)", []interface{}{key, size}},
+	} {
+		if _, err := tx.Exec(stmt.sql, stmt.args...); err != nil {
+			discard()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		discard()
+		return 0, err
+	}
+	return size, nil
+}
+
+func (s *sqliteBlobStore) Open(key string) (io.ReadCloser, error) {
+	return s.OpenRange(key, 0, -1)
+}
+
+// OpenRange reads the blob a chunk at a time; a negative length reads to the end.
+func (s *sqliteBlobStore) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+	var size int64
+	err := s.db.QueryRow("SELECT size FROM blobs WHERE key = ?", key).Scan(&size)
+	if err == sql.ErrNoRows {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	end := size
+	if length >= 0 && offset+length < size {
+		end = offset + length
+	}
+	return io.NopCloser(&sqliteChunkReader{s: s, key: key, pos: offset, end: end}), nil
+}
+
+// sqliteChunkReader reads the bytes from pos to end of a chunked blob.
+type sqliteChunkReader struct {
+	s        *sqliteBlobStore
+	key      string
+	pos, end int64
+	chunk    []byte // the rest of the current chunk
+}
+
+func (c *sqliteChunkReader) Read(p []byte) (int, error) {
+	if c.pos >= c.end {
+		return 0, io.EOF
+	}
+	if len(c.chunk) == 0 {
+		var start int64
+		var data []byte
+		err := c.s.db.QueryRow("SELECT start, data FROM blob_chunks WHERE key = ? AND start <= ? ORDER BY start DESC LIMIT 1",
+			c.key, c.pos).Scan(&start, &data)
+		if err == sql.ErrNoRows || err == nil && start+int64(len(data)) <= c.pos {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		c.chunk = data[c.pos-start:]
+	}
+	n := copy(p, c.chunk[:min(int64(len(c.chunk)), c.end-c.pos)])
+	c.chunk = c.chunk[n:]
+	c.pos += int64(n)
+	return n, nil
+}
+
+func (s *sqliteBlobStore) Delete(key string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM blob_chunks WHERE key = ?", key); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM blobs WHERE key = ?", key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fsBlobStore keeps each blob in a file below root.
+type fsBlobStore struct {
+	root string
+}
+
+func newFSBlobStore(root string) (*fsBlobStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &fsBlobStore{root: root}, nil
+}
+
+// path maps a key to a file, refusing keys that would escape the root.
+func (s *fsBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if key == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+// Put writes to a temporary file first so readers never see a partial blob.
+func (s *fsBlobStore) Put(key string, r io.Reader) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *fsBlobStore) Open(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *fsBlobStore) OpenRange(key string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := s.Open(key)
+	if err != nil {
+		return nil, err
+	}
+	f := rc.(*os.File)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, nil
+}
+
+func (s *fsBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
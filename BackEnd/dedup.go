@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"sync"
+)
+
+// Gift payloads are stored once per distinct content. content_blobs maps each
+// SHA-256 to the blob holding it, and any number of gifts and attachments may
+// point at that blob. A blob is only deleted once no row refers to it.
+// Encrypted blobs can only be read with their owner's data key (see
+// giftcrypto.go), so they are shared between that owner's files only.
+//
+// contentBlobsMu serialises looking up or registering a blob together with
+// inserting the row that refers to it, and checking references before a
+// delete, so a blob can never be deleted while a new reference is being added.
+var contentBlobsMu sync.Mutex
+
+// blobReferencesSQL lists one row per stored file a user sees: every
+// attachment, plus gifts from before bundles that have no attachment rows yet.
+// A gift with attachments only mirrors its first one, so it is not counted.
+const blobReferencesSQL = `
+	SELECT a.storage_key, a.file_size, g.user_id FROM gift_attachments a JOIN gifts g ON g.id = a.gift_id
+	WHERE a.storage_key IS NOT NULL
+	UNION ALL
+	SELECT storage_key, file_size, user_id FROM gifts g
+	WHERE storage_key IS NOT NULL AND NOT EXISTS (SELECT 1 FROM gift_attachments a WHERE a.gift_id = g.id)`
+
+// versionReferencesSQL lists the files kept for earlier versions of edited
+// gifts (see giftversions.go), in the same shape as blobReferencesSQL. They
+// stay stored until pruned, so they count against the quota too.
+const versionReferencesSQL = `
+	SELECT v.storage_key, v.file_size, g.user_id FROM gift_versions v JOIN gifts g ON g.id = v.gift_id
+	WHERE v.storage_key IS NOT NULL`
+
+// resolveContentBlob points the upload at an existing blob with the same
+// content, returning the now unneeded key it was stored under, or registers
+// the upload's blob as the one holding that content. contentBlobsMu must be held.
+func resolveContentBlob(upload *giftUpload) (string, error) {
+	if upload.SHA256 == "" {
+		return "", nil
+	}
+	var existing string
+	err := db.QueryRow("SELECT storage_key FROM content_blobs WHERE sha256 = ? AND owner_id = ?",
+		upload.SHA256, upload.EncryptedFor).Scan(&existing)
+	if err == nil {
+		if existing == upload.StorageKey {
+			return "", nil
+		}
+		duplicate := upload.StorageKey
+		upload.StorageKey = existing
+		return duplicate, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	_, err = db.Exec("INSERT INTO content_blobs (sha256, owner_id, storage_key, size, created_at) VALUES (?, ?, ?, ?, ?)",
+		upload.SHA256, upload.EncryptedFor, upload.StorageKey, upload.Size, timeNow().Unix())
+	return "", err
+}
+
+// storeDeduplicated runs insert, which adds the row referring to the upload,
+// after swapping the upload's blob for an identical one already stored. If
+// insert fails the blob is released again.
+func storeDeduplicated(upload *giftUpload, insert func() error) error {
+	contentBlobsMu.Lock()
+	duplicate, err := resolveContentBlob(upload)
+	if err == nil {
+		err = insert()
+	}
+	if err != nil {
+		deleteUnreferencedBlobs([]string{upload.StorageKey})
+	}
+	contentBlobsMu.Unlock()
+
+	if duplicate != "" {
+		if err := giftStore.Delete(duplicate); err != nil {
+			log.Printf("Error deleting duplicate gift blob %s: %v", duplicate, err)
+		}
+	}
+	return err
+}
+
+// deleteGiftBlobs removes stored payloads after their gifts, attachments or
+// thumbnails have been deleted, keeping any that other rows still refer to.
+func deleteGiftBlobs(keys []string) {
+	contentBlobsMu.Lock()
+	defer contentBlobsMu.Unlock()
+	deleteUnreferencedBlobs(keys)
+}
+
+// deleteUnreferencedBlobs is deleteGiftBlobs with contentBlobsMu already held.
+func deleteUnreferencedBlobs(keys []string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		var referenced bool
+		err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM gifts WHERE storage_key = ?)
+			OR EXISTS(SELECT 1 FROM gift_attachments WHERE storage_key = ?)
+			OR EXISTS(SELECT 1 FROM gift_thumbnails WHERE storage_key = ?)
+			OR EXISTS(SELECT 1 FROM gift_versions WHERE storage_key = ?)`, key, key, key, key).Scan(&referenced)
+		if err != nil {
+			log.Printf("Error checking references to gift blob %s: %v", key, err)
+			continue
+		}
+		if referenced {
+			continue
+		}
+		if err := giftStore.Delete(key); err != nil {
+			log.Printf("Error deleting gift blob %s: %v", key, err)
+			continue
+		}
+		if _, err := db.Exec("DELETE FROM content_blobs WHERE storage_key = ?", key); err != nil {
+			log.Printf("Error removing content index for gift blob %s: %v", key, err)
+		}
+	}
+}
+
+// storageReport compares what users have uploaded with what is actually stored.
+type storageReport struct {
+	Files        int   `json:"files"`        // stored files as users see them
+	Blobs        int   `json:"blobs"`        // distinct blobs holding them
+	LogicalBytes int64 `json:"logicalBytes"` // total size of all files
+	StoredBytes  int64 `json:"storedBytes"`  // total size of the distinct blobs
+	SavedBytes   int64 `json:"savedBytes"`   // space deduplication saves
+}
+
+// storageSavings reports storage use across all users. Gifts still kept in
+// gifts.file_data are not included; they are never deduplicated.
+func storageSavings() (storageReport, error) {
+	var report storageReport
+	err := db.QueryRow(`
+		SELECT COUNT(*), COUNT(DISTINCT storage_key), COALESCE(SUM(file_size), 0)
+		FROM (`+blobReferencesSQL+` UNION ALL `+versionReferencesSQL+`)`).Scan(&report.Files, &report.Blobs, &report.LogicalBytes)
+	if err != nil {
+		return report, err
+	}
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(size), 0) FROM (
+			SELECT MAX(file_size) AS size FROM (` + blobReferencesSQL + ` UNION ALL ` + versionReferencesSQL + `) GROUP BY storage_key)`).Scan(&report.StoredBytes)
+	report.SavedBytes = report.LogicalBytes - report.StoredBytes
+	return report, err
+}
+
+// dedupStoredBlobs brings blobs stored before deduplication into the content
+// index: it checksums any that have no SHA-256 yet, then points every file
+// with the same content at a single blob and deletes the copies. It returns
+// how many copies were removed.
+func dedupStoredBlobs() (int, error) {
+	if err := checksumStoredBlobs(); err != nil {
+		return 0, err
+	}
+
+	contentBlobsMu.Lock()
+	defer contentBlobsMu.Unlock()
+
+	type storedBlob struct {
+		sha256, key string
+		owner       int
+		size        int64
+	}
+	rows, err := db.Query(`
+		SELECT f.sha256, f.storage_key, COALESCE(c.owner_id, 0), MAX(COALESCE(f.file_size, 0)) FROM (
+			SELECT sha256, storage_key, file_size FROM gift_attachments WHERE storage_key IS NOT NULL AND sha256 IS NOT NULL
+			UNION ALL
+			SELECT sha256, storage_key, file_size FROM gifts WHERE storage_key IS NOT NULL AND sha256 IS NOT NULL) f
+		LEFT JOIN content_blobs c ON c.storage_key = f.storage_key
+		GROUP BY f.sha256, f.storage_key ORDER BY f.sha256, f.storage_key`)
+	if err != nil {
+		return 0, err
+	}
+	var blobs []storedBlob
+	for rows.Next() {
+		var b storedBlob
+		if err := rows.Scan(&b.sha256, &b.key, &b.owner, &b.size); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		blobs = append(blobs, b)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	removed := 0
+	for _, b := range blobs {
+		upload := giftUpload{StorageKey: b.key, SHA256: b.sha256, Size: b.size, EncryptedFor: b.owner}
+		duplicate, err := resolveContentBlob(&upload)
+		if err != nil {
+			return removed, err
+		}
+		if duplicate == "" {
+			continue
+		}
+		for _, table := range []string{"gifts", "gift_attachments", "gift_versions"} {
+			if _, err := db.Exec("UPDATE "+table+" SET storage_key = ? WHERE storage_key = ?", upload.StorageKey, duplicate); err != nil {
+				return removed, err
+			}
+		}
+		deleteUnreferencedBlobs([]string{duplicate})
+		removed++
+	}
+	return removed, nil
+}
+
+// checksumStoredBlobs fills in the SHA-256, and the type where missing, of
+// stored blobs uploaded before checksums were recorded.
+func checksumStoredBlobs() error {
+	rows, err := db.Query(`
+		SELECT storage_key FROM gifts WHERE storage_key IS NOT NULL AND sha256 IS NULL
+		UNION SELECT storage_key FROM gift_attachments WHERE storage_key IS NOT NULL AND sha256 IS NULL`)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		rc, err := openGiftBlob(key)
+		if err == errBlobNotFound {
+			log.Printf("Gift blob %s is missing from storage; skipping", key)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		head := make([]byte, sniffLength)
+		n, _ := io.ReadFull(rc, head)
+		hash := sha256.New()
+		hash.Write(head[:n])
+		rest, err := io.Copy(hash, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		checksum, mimeType, size := hex.EncodeToString(hash.Sum(nil)), detectContentType(head[:n]), int64(n)+rest
+		for _, table := range []string{"gifts", "gift_attachments"} {
+			_, err := db.Exec("UPDATE "+table+` SET sha256 = ?, mime_type = COALESCE(mime_type, ?), file_size = COALESCE(file_size, ?)
+				WHERE storage_key = ?`, checksum, mimeType, size, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func countRows(table string) int {
+	var n int
+	_ = db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n)
+	return n
+}
+
+func TestIdenticalUploadsAreStoredOnce(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	photo := "GIF89a the same photo for two people"
+
+	for i := 0; i < 2; i++ {
+		if rec := uploadTestFile("photo.gif", photo); rec.Code != http.StatusOK {
+			t.Fatalf("Upload %d failed: %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	addTestAttachment(t, "2", "again.gif", photo, "")
+	if n := countRows("blobs"); n != 1 {
+		t.Fatalf("Expected identical files to share one blob, found %d", n)
+	}
+
+	report, err := storageSavings()
+	if err != nil || report.Files != 3 || report.Blobs != 1 || report.SavedBytes != int64(2*len(photo)) {
+		t.Errorf("Unexpected storage report %+v %v", report, err)
+	}
+
+	// The blob stays until the last gift using it is gone.
+	purgeTestGift(t, "1")
+	rec := performAuthenticatedRequest(downloadGiftHandler, "GET", "/download-gift?id=2", nil, 1)
+	if rec.Code != http.StatusOK || rec.Body.String() != photo {
+		t.Fatalf("Expected the remaining gift to keep its file, got %d", rec.Code)
+	}
+	purgeTestGift(t, "2")
+	if blobs, index := countRows("blobs"), countRows("content_blobs"); blobs != 0 || index != 0 {
+		t.Errorf("Expected the blob to be deleted with its last gift, found %d blobs and %d index rows", blobs, index)
+	}
+}
+
+func TestDedupStoredBlobs(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	// Two copies stored before deduplication, without checksums.
+	_, _ = giftStore.Put("gifts/aaaa", strings.NewReader("same bytes"))
+	_, _ = giftStore.Put("gifts/bbbb", strings.NewReader("same bytes"))
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, storage_key) VALUES (1, 1, 'a.txt', 'gifts/aaaa'), (2, 1, 'b.txt', 'gifts/bbbb')")
+
+	if removed, err := dedupStoredBlobs(); err != nil || removed != 1 {
+		t.Fatalf("Expected one copy removed, got %d %v", removed, err)
+	}
+	var keys int
+	_ = db.QueryRow("SELECT COUNT(DISTINCT storage_key) FROM gifts").Scan(&keys)
+	if keys != 1 || countRows("blobs") != 1 {
+		t.Errorf("Expected both gifts to share one blob, got %d keys and %d blobs", keys, countRows("blobs"))
+	}
+	for _, id := range []int{1, 2} {
+		if _, data, err := readGiftData(id); err != nil || string(data) != "same bytes" {
+			t.Errorf("Gift %d unreadable after dedup: %q %v", id, data, err)
+		}
+	}
+}
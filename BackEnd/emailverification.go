@@ -0,0 +1,375 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// emailVerificationTTL is how long the link in a verification email stays valid.
+var emailVerificationTTL = 72 * time.Hour
+
+// verificationEmailPolicy limits how often verification emails go out, both
+// per account and per address, so listing someone's address cannot be used to
+// flood their inbox. Each email counts as an attempt in login_attempts.
+var verificationEmailPolicy = attemptPolicy{freeFailures: 3, maxDelay: time.Hour, lockAfter: 10, lockDuration: 24 * time.Hour}
+
+// verificationEmailKeys are the login_attempts keys that throttle
+// verification emails from the account and to the address.
+func verificationEmailKeys(userID int, email string) []string {
+	return []string{"verify-email:user:" + strconv.Itoa(userID), "verify-email:" + normalizeEmail(email)}
+}
+
+// normalizeEmail lowercases and trims an address so it can be compared and stored.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// contactEmailList returns the distinct, normalized addresses from the primary
+// and comma-separated secondary contact fields, primary first.
+func contactEmailList(primary, secondary string) []string {
+	var emails []string
+	seen := map[string]bool{}
+	for _, email := range append([]string{primary}, strings.Split(secondary, ",")...) {
+		email = normalizeEmail(email)
+		if email != "" && !seen[email] {
+			seen[email] = true
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// userContactEmails returns the user's current primary and secondary addresses.
+func userContactEmails(userID int) (primary string, emails []string, err error) {
+	var p, s sql.NullString
+	if err := db.QueryRow("SELECT primary_contact_email, secondary_contact_emails FROM users WHERE id = ?", userID).Scan(&p, &s); err != nil {
+		return "", nil, err
+	}
+	return normalizeEmail(p.String), contactEmailList(p.String, s.String), nil
+}
+
+// isEmailVerified reports whether the user has confirmed they own the address.
+func isEmailVerified(userID int, email string) (bool, error) {
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM verified_emails WHERE user_id = ? AND email = ?)",
+		userID, normalizeEmail(email)).Scan(&exists)
+	return exists, err
+}
+
+// markEmailVerified records that the user owns the address.
+func markEmailVerified(userID int, email string) error {
+	_, err := db.Exec("INSERT OR IGNORE INTO verified_emails (user_id, email, verified_at) VALUES (?, ?, ?)",
+		userID, normalizeEmail(email), timeNow().Unix())
+	return err
+}
+
+// verifiedEmails returns the addresses the user has verified. Removing an
+// address from the account forgets it, so they are all current contacts.
+func verifiedEmails(userID int) ([]string, error) {
+	rows, err := db.Query("SELECT email FROM verified_emails WHERE user_id = ? ORDER BY email", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+// verifiedPrimaryEmail returns the user's primary contact email, or "" when it has not been verified.
+func verifiedPrimaryEmail(userID int) (string, error) {
+	primary, _, err := userContactEmails(userID)
+	if err != nil || primary == "" {
+		return "", err
+	}
+	verified, err := isEmailVerified(userID, primary)
+	if err != nil || !verified {
+		return "", err
+	}
+	return primary, nil
+}
+
+// findUserIDByVerifiedEmail returns the account that has verified the address
+// as its primary or one of its secondary contact emails.
+func findUserIDByVerifiedEmail(email string) (int, error) {
+	rows, err := db.Query("SELECT user_id FROM verified_emails WHERE email = ?", normalizeEmail(email))
+	if err != nil {
+		return 0, err
+	}
+	var candidates []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		candidates = append(candidates, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	// Make sure the address is still one of the account's contacts.
+	for _, id := range candidates {
+		_, emails, err := userContactEmails(id)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		for _, e := range emails {
+			if e == normalizeEmail(email) {
+				return id, nil
+			}
+		}
+	}
+	return 0, sql.ErrNoRows
+}
+
+// updateContactEmailVerification is called after the user's contact addresses
+// change; previous holds the addresses from before. Addresses that were removed
+// lose their verified state and newly added ones are sent a verification link.
+// Addresses that were already listed are left alone; their owner can ask for
+// another link through /contact-emails.
+func updateContactEmailVerification(userID int, previous []string) {
+	_, emails, err := userContactEmails(userID)
+	if err != nil {
+		log.Printf("Error loading contact emails for user %d: %v", userID, err)
+		return
+	}
+
+	rows, err := db.Query("SELECT email FROM verified_emails WHERE user_id = ?", userID)
+	if err != nil {
+		log.Printf("Error loading verified emails for user %d: %v", userID, err)
+		return
+	}
+	verified := map[string]bool{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err == nil {
+			verified[email] = true
+		}
+	}
+	rows.Close()
+
+	listed := map[string]bool{}
+	for _, email := range previous {
+		listed[email] = true
+	}
+	current := map[string]bool{}
+	for _, email := range emails {
+		current[email] = true
+		if verified[email] || listed[email] {
+			continue
+		}
+		if wait, err := sendEmailVerification(userID, email); err != nil {
+			log.Printf("Error sending verification email for user %d: %v", userID, err)
+		} else if wait > 0 {
+			log.Printf("Not sending a verification email for user %d yet; throttled for %v", userID, wait)
+		}
+	}
+	for email := range verified {
+		if !current[email] {
+			if _, err := db.Exec("DELETE FROM verified_emails WHERE user_id = ? AND email = ?", userID, email); err != nil {
+				log.Printf("Error removing verified email for user %d: %v", userID, err)
+			}
+		}
+	}
+}
+
+// issueEmailVerificationToken signs "verify-email:userID:expiry:email". The
+// address goes last because it may itself contain a colon.
+func issueEmailVerificationToken(userID int, email string) string {
+	exp := timeNow().Add(emailVerificationTTL).Unix()
+	return signPayload(fmt.Sprintf("verify-email:%d:%d:%s", userID, exp, normalizeEmail(email)))
+}
+
+// parseEmailVerificationToken returns the user id and address from a verification token.
+func parseEmailVerificationToken(token string, now time.Time) (int, string, error) {
+	payload, err := verifySignedPayload(token)
+	if err != nil {
+		return 0, "", errInvalidToken
+	}
+	parts := strings.SplitN(payload, ":", 4)
+	if len(parts) != 4 || parts[0] != "verify-email" || parts[3] == "" {
+		return 0, "", errInvalidToken
+	}
+	userID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, "", errInvalidToken
+	}
+	exp, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return 0, "", errInvalidToken
+	}
+	if !now.Before(time.Unix(exp, 0)) {
+		return 0, "", errExpiredToken
+	}
+	return userID, parts[3], nil
+}
+
+// sendEmailVerification emails a link that confirms the user owns the address.
+// While the account or the address is throttled nothing is sent and the
+// remaining wait is returned.
+func sendEmailVerification(userID int, email string) (time.Duration, error) {
+	keys := verificationEmailKeys(userID, email)
+	wait, err := attemptRetryAfter(keys...)
+	if err != nil || wait > 0 {
+		return wait, err
+	}
+	for _, key := range keys {
+		if _, err := recordFailedAttempt(key, verificationEmailPolicy); err != nil {
+			return 0, err
+		}
+	}
+
+	token := issueEmailVerificationToken(userID, email)
+	link := fmt.Sprintf("%s/verify-email?token=%s", apiBaseURL, url.QueryEscape(token))
+	subject := "Confirm your email address for Parting Gifts"
+	body := fmt.Sprintf("Hello,\n\nThis address was added as a contact email for a Parting Gifts account. "+
+		"Please confirm it by opening this link:\n%s\n\n"+
+		"Password resets and check-in emails are only sent to confirmed addresses. "+
+		"If you did not expect this email you can ignore it.", link)
+	go func() {
+		if err := sendCheckEmail(email, subject, body); err != nil {
+			log.Printf("Error sending verification email for user %d: %v", userID, err)
+		}
+	}()
+	return 0, nil
+}
+
+// verifyEmailHandler confirms an address using the link from a verification email.
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, email, err := parseEmailVerificationToken(r.URL.Query().Get("token"), timeNow())
+	if err == errExpiredToken {
+		http.Error(w, "This verification link has expired", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid verification link", http.StatusBadRequest)
+		return
+	}
+
+	// The link only counts while the address is still on the account.
+	_, emails, err := userContactEmails(userID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading contact emails for user %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	found := false
+	for _, e := range emails {
+		found = found || e == email
+	}
+	if !found {
+		http.Error(w, "This address is no longer used by the account", http.StatusBadRequest)
+		return
+	}
+
+	if err := markEmailVerified(userID, email); err != nil {
+		log.Printf("Error verifying email for user %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Your email address has been verified."))
+}
+
+// contactEmailsHandler lists the signed-in user's contact addresses with their
+// verification state (GET) or resends the verification link for one (POST {email}).
+func contactEmailsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	primary, emails, err := userContactEmails(userID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		type contactEmail struct {
+			Email    string `json:"email"`
+			Primary  bool   `json:"primary"`
+			Verified bool   `json:"verified"`
+		}
+		result := []contactEmail{}
+		for _, email := range emails {
+			verified, err := isEmailVerified(userID, email)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			result = append(result, contactEmail{Email: email, Primary: email == primary, Verified: verified})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	case http.MethodPost:
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		email := normalizeEmail(req.Email)
+		found := false
+		for _, e := range emails {
+			found = found || e == email
+		}
+		if !found {
+			http.Error(w, "That address is not one of your contact emails", http.StatusNotFound)
+			return
+		}
+		if verified, _ := isEmailVerified(userID, email); verified {
+			http.Error(w, "That address is already verified", http.StatusConflict)
+			return
+		}
+		wait, err := sendEmailVerification(userID, email)
+		if err != nil {
+			log.Printf("Error sending verification email for user %d: %v", userID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if wait > 0 {
+			writeTooManyAttempts(w, wait)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Verification email sent."))
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
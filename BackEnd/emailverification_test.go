@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestEmailVerificationFlow(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	clock := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFixedClock(t, clock)
+
+	body := []byte(`{"primary_contact_email": "Me@Example.com", "secondary_contact_emails": "alt@example.com"}`)
+	if rec := performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", body, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Update failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// New addresses start out pending, so check-ins and resets are refused.
+	if rec := performAuthenticatedRequest(scheduleInactivityCheckHandler, "POST", "/schedule-check", []byte(`{}`), 1); rec.Code != http.StatusConflict {
+		t.Errorf("Expected check-in to need a verified address, got %d", rec.Code)
+	}
+	if _, err := findUserIDByVerifiedEmail("me@example.com"); err == nil {
+		t.Errorf("Expected unverified address not to be used for resets")
+	}
+
+	token := issueEmailVerificationToken(1, "me@example.com")
+	if rec := performRequest(verifyEmailHandler, "GET", "/verify-email?token="+url.QueryEscape(token), nil); rec.Code != http.StatusOK {
+		t.Fatalf("Verification failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := performAuthenticatedRequest(contactEmailsHandler, "GET", "/contact-emails", nil, 1)
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &emails)
+	if len(emails) != 2 || !emails[0].Primary || !emails[0].Verified || emails[1].Verified {
+		t.Errorf("Unexpected contact emails: %+v", emails)
+	}
+	if id, err := findUserIDByVerifiedEmail("ME@example.com"); err != nil || id != 1 {
+		t.Errorf("Expected verified address to find the account, got %d %v", id, err)
+	}
+
+	// Removing an address drops its verified state, and stale links stop working.
+	body = []byte(`{"primary_contact_email": "new@example.com", "secondary_contact_emails": "alt@example.com"}`)
+	performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", body, 1)
+	if verified, _ := isEmailVerified(1, "me@example.com"); verified {
+		t.Errorf("Expected removed address to lose its verified state")
+	}
+	if rec := performRequest(verifyEmailHandler, "GET", "/verify-email?token="+url.QueryEscape(token), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected link for a removed address to be rejected, got %d", rec.Code)
+	}
+
+	// Links expire.
+	token = issueEmailVerificationToken(1, "alt@example.com")
+	useFixedClock(t, clock.Add(emailVerificationTTL))
+	if rec := performRequest(verifyEmailHandler, "GET", "/verify-email?token="+url.QueryEscape(token), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected expired link to be rejected, got %d", rec.Code)
+	}
+}
+
+// verificationEmailsSent counts the verification emails sent to the address.
+func verificationEmailsSent(email string) int {
+	var sent int
+	_ = db.QueryRow("SELECT failures FROM login_attempts WHERE attempt_key = ?", "verify-email:"+email).Scan(&sent)
+	return sent
+}
+
+func TestVerificationEmailsOnlyForNewAddresses(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	body := []byte(`{"primary_contact_email": "me@example.com", "secondary_contact_emails": "victim@example.com"}`)
+	for i := 0; i < 3; i++ {
+		if rec := performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", body, 1); rec.Code != http.StatusOK {
+			t.Fatalf("Update failed: %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	if sent := verificationEmailsSent("victim@example.com"); sent != 1 {
+		t.Errorf("Expected saving again not to mail the address again, sent %d", sent)
+	}
+
+	body = []byte(`{"primary_contact_email": "me@example.com", "secondary_contact_emails": "victim@example.com, other@example.com"}`)
+	performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", body, 1)
+	if sent := verificationEmailsSent("other@example.com"); sent != 1 {
+		t.Errorf("Expected the new address to be mailed once, sent %d", sent)
+	}
+	if sent := verificationEmailsSent("victim@example.com"); sent != 1 {
+		t.Errorf("Expected the listed address not to be mailed again, sent %d", sent)
+	}
+}
+
+func TestVerificationEmailResendsAreThrottled(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	useFixedClock(t, time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	body := []byte(`{"primary_contact_email": "victim@example.com"}`)
+	performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", body, 1)
+
+	// The first email and the free resends go out, then the next one waits.
+	resend := []byte(`{"email": "victim@example.com"}`)
+	for i := 1; i <= verificationEmailPolicy.freeFailures; i++ {
+		if rec := performAuthenticatedRequest(contactEmailsHandler, "POST", "/contact-emails", resend, 1); rec.Code != http.StatusOK {
+			t.Fatalf("Resend %d: expected 200, got %d", i, rec.Code)
+		}
+	}
+	rec := performAuthenticatedRequest(contactEmailsHandler, "POST", "/contact-emails", resend, 1)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected resends to be throttled, got %d", rec.Code)
+	}
+	if sent := verificationEmailsSent("victim@example.com"); sent != verificationEmailPolicy.freeFailures+1 {
+		t.Errorf("Expected the throttled resend not to be sent, sent %d", sent)
+	}
+}
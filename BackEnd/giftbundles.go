@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/gomail.v2"
+)
+
+// maxGiftAttachments caps how many files one gift can bundle.
+const maxGiftAttachments = 50
+
+var errLastAttachment = errors.New("a gift needs at least one attachment")
+
+// giftAttachment is one file of a gift bundle. A gift's own file_name,
+// storage_key and file_size always mirror its first attachment, so code that
+// only knows about single-file gifts keeps seeing the bundle's first file.
+type giftAttachment struct {
+	ID       int    `json:"id"`
+	Position int    `json:"position"`
+	FileName string `json:"fileName"`
+	Caption  string `json:"caption"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	SHA256   string `json:"sha256"`
+	// Thumbnail is set once /gift-thumbnail can show a preview of the file.
+	Thumbnail bool `json:"thumbnail"`
+	// MetadataRemoved lists the kinds of photo metadata stripped at upload.
+	MetadataRemoved []string `json:"metadataRemoved,omitempty"`
+
+	giftID     int
+	storageKey sql.NullString // NULL for a file still kept in gifts.file_data
+}
+
+// ensureGiftAttachments turns the file of a gift created before bundles
+// existed into its first attachment. It does nothing for gifts that already
+// have attachments or have no file at all.
+func ensureGiftAttachments(giftID int) error {
+	_, err := db.Exec(`
+		INSERT INTO gift_attachments (gift_id, position, file_name, storage_key, file_size, mime_type, sha256, caption, created_at)
+		SELECT id, 0, COALESCE(file_name, ''), storage_key, COALESCE(file_size, length(file_data)), mime_type, sha256, '', ?
+		FROM gifts
+		WHERE id = ? AND (storage_key IS NOT NULL OR file_data IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM gift_attachments WHERE gift_id = gifts.id)`,
+		timeNow().Unix(), giftID)
+	return err
+}
+
+// loadGiftAttachments returns the gift's attachments in order, without their data.
+func loadGiftAttachments(giftID int) ([]giftAttachment, error) {
+	if err := ensureGiftAttachments(giftID); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`
+		SELECT id, position, file_name, caption, COALESCE(file_size, 0), COALESCE(mime_type, ''), COALESCE(sha256, ''),
+			COALESCE(thumbnail_state = 'ready', 0), COALESCE(metadata_removed, ''), storage_key
+		FROM gift_attachments WHERE gift_id = ? ORDER BY position, id`, giftID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attachments := []giftAttachment{}
+	for rows.Next() {
+		var a giftAttachment
+		var metadataRemoved string
+		if err := rows.Scan(&a.ID, &a.Position, &a.FileName, &a.Caption, &a.Size, &a.MimeType, &a.SHA256, &a.Thumbnail, &metadataRemoved, &a.storageKey); err != nil {
+			return nil, err
+		}
+		if metadataRemoved != "" {
+			a.MetadataRemoved = strings.Split(metadataRemoved, ",")
+		}
+		a.giftID = giftID
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// openAttachmentData returns a reader for an attachment's payload.
+func openAttachmentData(giftID int, a giftAttachment) (io.ReadCloser, error) {
+	if a.storageKey.Valid && a.storageKey.String != "" {
+		return openGiftBlob(a.storageKey.String)
+	}
+	var fileData []byte
+	if err := db.QueryRow("SELECT file_data FROM gifts WHERE id = ?", giftID).Scan(&fileData); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(fileData)), nil
+}
+
+// attachmentCaptions lists the captions of a bundle for an email body, in the
+// order the files are attached.
+func attachmentCaptions(attachments []giftAttachment) string {
+	var b strings.Builder
+	for _, a := range attachments {
+		if a.Caption != "" {
+			fmt.Fprintf(&b, "\n%s: %s", a.FileName, a.Caption)
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	return "\n" + b.String()
+}
+
+// attachBundle attaches every file of a bundle to the message, in order. The
+// files are only opened, one at a time, while the message is written out, so
+// an email never holds them in memory.
+func attachBundle(m *gomail.Message, attachments []giftAttachment) {
+	for _, a := range attachments {
+		m.Attach(a.FileName, gomail.SetCopyFunc(func(w io.Writer) error {
+			rc, err := openAttachmentData(a.giftID, a)
+			if err != nil {
+				return fmt.Errorf("failed to open %s of gift %d: %w", a.FileName, a.giftID, err)
+			}
+			defer rc.Close()
+			_, err = io.Copy(w, rc)
+			return err
+		}))
+	}
+}
+
+// addGiftAttachment appends an uploaded file to the end of the gift's bundle.
+// If that fails the stored blob is removed again.
+func addGiftAttachment(giftID int, upload giftUpload, caption string) (int64, error) {
+	if err := ensureGiftAttachments(giftID); err != nil {
+		deleteGiftBlobs([]string{upload.StorageKey})
+		return 0, err
+	}
+	var id int64
+	err := storeDeduplicated(&upload, func() (err error) {
+		id, err = insertGiftAttachment(giftID, upload, caption)
+		return err
+	})
+	return id, err
+}
+
+func insertGiftAttachment(giftID int, upload giftUpload, caption string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var count, nextPosition int
+	if err := tx.QueryRow("SELECT COUNT(*), COALESCE(MAX(position) + 1, 0) FROM gift_attachments WHERE gift_id = ?", giftID).
+		Scan(&count, &nextPosition); err != nil {
+		return 0, err
+	}
+	if count >= maxGiftAttachments {
+		return 0, errTooManyAttachments
+	}
+	result, err := tx.Exec(`
+		INSERT INTO gift_attachments (gift_id, position, file_name, storage_key, file_size, mime_type, sha256, caption, created_at, metadata_removed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		giftID, nextPosition, upload.FileName, upload.StorageKey, upload.Size, upload.MimeType, upload.SHA256, caption, timeNow().Unix(),
+		upload.Metadata.column())
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := syncGiftPrimaryFile(tx, giftID); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+var errTooManyAttachments = errors.New("too many attachments")
+
+// syncGiftPrimaryFile copies the first attachment's file onto the gift row.
+func syncGiftPrimaryFile(tx *sql.Tx, giftID int) error {
+	_, err := tx.Exec(`
+		UPDATE gifts SET (file_name, storage_key, file_size, mime_type, sha256) = (
+			SELECT file_name, storage_key, file_size, mime_type, sha256 FROM gift_attachments
+			WHERE gift_id = gifts.id ORDER BY position, id LIMIT 1)
+		WHERE id = ? AND EXISTS (SELECT 1 FROM gift_attachments WHERE gift_id = gifts.id)`, giftID)
+	return err
+}
+
+// removeGiftAttachment deletes one attachment and its stored file. The last
+// attachment of a gift cannot be removed; stop the gift instead.
+func removeGiftAttachment(giftID, attachmentID int) error {
+	thumbnailKeys, err := thumbnailStorageKeys("attachment_id = ?", attachmentID)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var storageKey sql.NullString
+	err = tx.QueryRow("SELECT storage_key FROM gift_attachments WHERE id = ? AND gift_id = ?", attachmentID, giftID).Scan(&storageKey)
+	if err != nil {
+		return err
+	}
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM gift_attachments WHERE gift_id = ?", giftID).Scan(&count); err != nil {
+		return err
+	}
+	if count <= 1 {
+		return errLastAttachment
+	}
+	if _, err := tx.Exec("DELETE FROM gift_thumbnails WHERE attachment_id = ?", attachmentID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM gift_attachments WHERE id = ?", attachmentID); err != nil {
+		return err
+	}
+	if !storageKey.Valid {
+		// The file lived in the gift row itself.
+		if _, err := tx.Exec("UPDATE gifts SET file_data = NULL WHERE id = ?", giftID); err != nil {
+			return err
+		}
+	}
+	if err := renumberGiftAttachments(tx, giftID, nil); err != nil {
+		return err
+	}
+	if err := syncGiftPrimaryFile(tx, giftID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if storageKey.Valid {
+		thumbnailKeys = append(thumbnailKeys, storageKey.String)
+	}
+	deleteGiftBlobs(thumbnailKeys)
+	return nil
+}
+
+// renumberGiftAttachments stores positions 0..n-1. Attachments listed in order
+// come first, in that order; the rest keep their relative order after them.
+func renumberGiftAttachments(tx *sql.Tx, giftID int, order []int) error {
+	rows, err := tx.Query("SELECT id FROM gift_attachments WHERE gift_id = ? ORDER BY position, id", giftID)
+	if err != nil {
+		return err
+	}
+	var current []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		current = append(current, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	known := map[int]bool{}
+	for _, id := range current {
+		known[id] = true
+	}
+	var ordered []int
+	placed := map[int]bool{}
+	for _, id := range order {
+		if !known[id] || placed[id] {
+			return errUnknownAttachment
+		}
+		placed[id] = true
+		ordered = append(ordered, id)
+	}
+	for _, id := range current {
+		if !placed[id] {
+			ordered = append(ordered, id)
+		}
+	}
+	for position, id := range ordered {
+		if _, err := tx.Exec("UPDATE gift_attachments SET position = ? WHERE id = ?", position, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errUnknownAttachment = errors.New("attachment does not belong to the gift")
+
+// reorderGiftAttachments puts the gift's attachments in the given order.
+func reorderGiftAttachments(giftID int, order []int) error {
+	if err := ensureGiftAttachments(giftID); err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := renumberGiftAttachments(tx, giftID, order); err != nil {
+		return err
+	}
+	if err := syncGiftPrimaryFile(tx, giftID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// attachmentGiftID returns the gift an attachment belongs to.
+func attachmentGiftID(attachmentID int) (int, error) {
+	var giftID int
+	err := db.QueryRow("SELECT gift_id FROM gift_attachments WHERE id = ?", attachmentID).Scan(&giftID)
+	return giftID, err
+}
+
+// giftAttachmentsHandler manages the files of a gift bundle:
+//
+//	GET    /gift-attachments?giftId=1  lists them in order
+//	POST   /gift-attachments?giftId=1  adds one (multipart "file" and optional "caption")
+//	PATCH  /gift-attachments?id=5      changes its caption ({"caption": "..."})
+//	DELETE /gift-attachments?id=5      removes it
+//
+// Each file can be downloaded with /download-gift?id=<giftId>&attachment=<id>.
+func giftAttachmentsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+
+	var giftID, attachmentID int
+	var err error
+	if r.Method == http.MethodGet || r.Method == http.MethodPost {
+		giftID, err = strconv.Atoi(r.URL.Query().Get("giftId"))
+	} else {
+		attachmentID, err = strconv.Atoi(r.URL.Query().Get("id"))
+		if err == nil {
+			giftID, err = attachmentGiftID(attachmentID)
+			if err == sql.ErrNoRows {
+				http.Error(w, "Attachment not found", http.StatusNotFound)
+				return
+			}
+		}
+	}
+	if err != nil {
+		http.Error(w, "Invalid gift or attachment ID", http.StatusBadRequest)
+		return
+	}
+
+	action := giftActionManage
+	if r.Method == http.MethodGet {
+		action = giftActionView
+	}
+	if _, ok := authorizeGift(w, r, giftID, action); !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Listed below.
+	case http.MethodPost:
+		// Files added by an executor still count against the owner's quota.
+		var ownerID int
+		if err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ?", giftID).Scan(&ownerID); err != nil {
+			http.Error(w, "Gift not found", http.StatusNotFound)
+			return
+		}
+		upload, err := receiveGiftUpload(w, r, ownerID)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		if _, err := addGiftAttachment(giftID, upload, upload.Fields["caption"]); err != nil {
+			if err == errTooManyAttachments {
+				http.Error(w, "A gift can hold at most "+strconv.Itoa(maxGiftAttachments)+" attachments", http.StatusConflict)
+				return
+			}
+			log.Printf("Error adding attachment to gift %d: %v", giftID, err)
+			http.Error(w, "Failed to add attachment", http.StatusInternalServerError)
+			return
+		}
+		queueThumbnails(int64(giftID))
+	case http.MethodPatch:
+		var req struct {
+			Caption string `json:"caption"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(req.Caption)) > maxGiftFieldBytes {
+			http.Error(w, "Caption is too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, err := db.Exec("UPDATE gift_attachments SET caption = ? WHERE id = ?", req.Caption, attachmentID); err != nil {
+			http.Error(w, "Failed to update attachment", http.StatusInternalServerError)
+			return
+		}
+	case http.MethodDelete:
+		if err := removeGiftAttachment(giftID, attachmentID); err != nil {
+			if err == errLastAttachment {
+				http.Error(w, "A gift needs at least one attachment; stop the gift to remove it entirely", http.StatusConflict)
+				return
+			}
+			log.Printf("Error removing attachment %d: %v", attachmentID, err)
+			http.Error(w, "Failed to remove attachment", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeGiftAttachments(w, giftID)
+}
+
+// giftAttachmentsReorderHandler handles POST /gift-attachments/reorder with
+// {"giftId": 1, "order": [7, 5, 6]}. Attachments left out keep their relative
+// order after the listed ones.
+func giftAttachmentsReorderHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	var req struct {
+		GiftID int   `json:"giftId"`
+		Order  []int `json:"order"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorizeGift(w, r, req.GiftID, giftActionManage); !ok {
+		return
+	}
+	if err := reorderGiftAttachments(req.GiftID, req.Order); err != nil {
+		if err == errUnknownAttachment {
+			http.Error(w, "Order lists an attachment that is not part of this gift", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error reordering attachments of gift %d: %v", req.GiftID, err)
+		http.Error(w, "Failed to reorder attachments", http.StatusInternalServerError)
+		return
+	}
+	writeGiftAttachments(w, req.GiftID)
+}
+
+func writeGiftAttachments(w http.ResponseWriter, giftID int) {
+	attachments, err := loadGiftAttachments(giftID)
+	if err != nil {
+		log.Printf("Error loading attachments of gift %d: %v", giftID, err)
+		http.Error(w, "Error retrieving attachments", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attachments)
+}
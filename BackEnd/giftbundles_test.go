@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+
+	"gopkg.in/gomail.v2"
+)
+
+// emailedBundle writes an email with the gift's files attached, as deliveries
+// do, and returns the attached files in order.
+func emailedBundle(t *testing.T, giftID int) []string {
+	t.Helper()
+	attachments, err := loadGiftAttachments(giftID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := gomail.NewMessage()
+	m.SetBody("text/plain", "Hello")
+	attachBundle(m, attachments)
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("Writing the email failed: %v", err)
+	}
+
+	msg, _ := mail.ReadMessage(&buf)
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var files []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.FileName() != "" {
+			data, _ := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
+			files = append(files, string(data))
+		}
+	}
+}
+
+func addAttachmentRequest(giftID, name, content, caption string) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("caption", caption)
+	part, _ := writer.CreateFormFile("file", name)
+	_, _ = part.Write([]byte(content))
+	writer.Close()
+	req := httptest.NewRequest("POST", "/gift-attachments?giftId="+giftID, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	authenticate(req, 1)
+	rec := httptest.NewRecorder()
+	requireAuth(giftAttachmentsHandler)(rec, req)
+	return rec
+}
+
+func addTestAttachment(t *testing.T, giftID, name, content, caption string) {
+	if rec := addAttachmentRequest(giftID, name, content, caption); rec.Code != http.StatusOK {
+		t.Fatalf("Expected attachment %s to be added, got %d: %s", name, rec.Code, rec.Body.String())
+	}
+}
+
+func listTestAttachments(t *testing.T) []giftAttachment {
+	rec := performAuthenticatedRequest(giftAttachmentsHandler, "GET", "/gift-attachments?giftId=1", nil, 1)
+	var attachments []giftAttachment
+	if err := json.Unmarshal(rec.Body.Bytes(), &attachments); err != nil {
+		t.Fatalf("Unexpected attachment list %d: %s", rec.Code, rec.Body.String())
+	}
+	return attachments
+}
+
+func attachmentNames(attachments []giftAttachment) string {
+	names := make([]string, len(attachments))
+	for i, a := range attachments {
+		names[i] = a.FileName
+	}
+	return strings.Join(names, ",")
+}
+
+func TestGiftBundleAddReorderRemove(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	req := giftUploadRequest([][2]string{{"file", "letter.txt"}}, "Dear friend")
+	requireAuth(uploadGiftHandler)(httptest.NewRecorder(), req)
+
+	addTestAttachment(t, "1", "beach.jpg", "jpeg bytes", "Summer 2019")
+	addTestAttachment(t, "1", "cake.jpg", "more jpeg", "")
+	attachments := listTestAttachments(t)
+	if attachmentNames(attachments) != "letter.txt,beach.jpg,cake.jpg" || attachments[1].Caption != "Summer 2019" {
+		t.Fatalf("Unexpected bundle: %+v", attachments)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"giftId": 1, "order": []int{attachments[2].ID, attachments[0].ID}})
+	performAuthenticatedRequest(giftAttachmentsReorderHandler, "POST", "/gift-attachments/reorder", body, 1)
+	attachments = listTestAttachments(t)
+	if attachmentNames(attachments) != "cake.jpg,letter.txt,beach.jpg" {
+		t.Fatalf("Expected the new order, got %s", attachmentNames(attachments))
+	}
+	// The gift row always describes the first file.
+	var fileName string
+	_ = db.QueryRow("SELECT file_name FROM gifts WHERE id = 1").Scan(&fileName)
+	if fileName != "cake.jpg" {
+		t.Errorf("Expected the gift to show its first attachment, got %q", fileName)
+	}
+
+	rec := performAuthenticatedRequest(downloadGiftHandler, "GET", "/download-gift?id=1&attachment="+strconv.Itoa(attachments[2].ID), nil, 1)
+	if rec.Body.String() != "jpeg bytes" {
+		t.Errorf("Expected a single attachment to download, got %q", rec.Body.String())
+	}
+	if rec := performAuthenticatedRequest(giftAttachmentsHandler, "DELETE", "/gift-attachments?id="+strconv.Itoa(attachments[0].ID), nil, 2); rec.Code != http.StatusForbidden && rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user to be refused, got %d", rec.Code)
+	}
+
+	performAuthenticatedRequest(giftAttachmentsHandler, "DELETE", "/gift-attachments?id="+strconv.Itoa(attachments[0].ID), nil, 1)
+	performAuthenticatedRequest(giftAttachmentsHandler, "DELETE", "/gift-attachments?id="+strconv.Itoa(attachments[1].ID), nil, 1)
+	rec = performAuthenticatedRequest(giftAttachmentsHandler, "DELETE", "/gift-attachments?id="+strconv.Itoa(attachments[2].ID), nil, 1)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected the last attachment to be kept, got %d", rec.Code)
+	}
+	var blobs int
+	_ = db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	if blobs != 1 {
+		t.Errorf("Expected removed attachments' files to be deleted, %d blobs left", blobs)
+	}
+
+	purgeTestGift(t, "1")
+	_ = db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	if blobs != 0 {
+		t.Errorf("Expected deleting the gift to delete its files, %d blobs left", blobs)
+	}
+}
+
+func TestLegacyGiftBecomesBundle(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, file_data) VALUES (1, 1, 'old.txt', ?)", []byte("legacy bytes"))
+
+	addTestAttachment(t, "1", "new.jpg", "new bytes", "Added later")
+	bundle, err := loadGiftAttachments(1)
+	if err != nil || len(bundle) != 2 {
+		t.Fatalf("Expected a two-file bundle, got %d %v", len(bundle), err)
+	}
+	if files := emailedBundle(t, 1); len(files) != 2 || files[0] != "legacy bytes" || files[1] != "new bytes" {
+		t.Errorf("Unexpected emailed files %q", files)
+	}
+	if got := attachmentCaptions(bundle); got != "\n\nnew.jpg: Added later" {
+		t.Errorf("Unexpected caption text %q", got)
+	}
+}
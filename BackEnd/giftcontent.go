@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Uploads are checked against these lists, which take comma-separated MIME
+// types ("video/*" matches any video) or file extensions. An empty allowlist
+// lets through every type that is not denied.
+var (
+	giftAllowedTypes     = splitList(envOrDefault("GIFT_ALLOWED_TYPES", ""))
+	giftDeniedTypes      = splitList(envOrDefault("GIFT_DENIED_TYPES", defaultDeniedGiftTypes))
+	giftDeniedExtensions = splitList(envOrDefault("GIFT_DENIED_EXTENSIONS", defaultDeniedGiftExtensions))
+)
+
+const (
+	defaultDeniedGiftTypes = "application/vnd.microsoft.portable-executable,application/x-executable," +
+		"application/x-mach-binary,text/x-shellscript"
+	defaultDeniedGiftExtensions = ".exe,.dll,.com,.scr,.msi,.bat,.cmd,.ps1,.vbs,.sh,.jar,.apk,.app,.dmg"
+)
+
+// sniffLength is how much of a file is looked at to detect its type.
+const sniffLength = 512
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// detectContentType works out a file's type from its first bytes. On top of
+// http.DetectContentType it recognises executables, which it would otherwise
+// report as application/octet-stream.
+func detectContentType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/vnd.microsoft.portable-executable"
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable"
+	case bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xce}), bytes.HasPrefix(head, []byte{0xfe, 0xed, 0xfa, 0xcf}),
+		bytes.HasPrefix(head, []byte{0xce, 0xfa, 0xed, 0xfe}), bytes.HasPrefix(head, []byte{0xcf, 0xfa, 0xed, 0xfe}),
+		bytes.HasPrefix(head, []byte{0xca, 0xfe, 0xba, 0xbe}):
+		return "application/x-mach-binary"
+	case bytes.HasPrefix(head, []byte("#!")):
+		return "text/x-shellscript"
+	}
+	return http.DetectContentType(head)
+}
+
+// mediaTypeMatches reports whether the type (parameters ignored) matches any pattern.
+func mediaTypeMatches(contentType string, patterns []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	for _, pattern := range patterns {
+		if pattern == mediaType || strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGiftFileName refuses file names with a denied extension.
+func checkGiftFileName(fileName string) error {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, denied := range giftDeniedExtensions {
+		if ext != "" && ext == denied {
+			return &uploadError{http.StatusUnsupportedMediaType, "Files ending in " + ext + " are not allowed"}
+		}
+	}
+	return nil
+}
+
+// checkGiftContentType applies the deny and allow lists to a detected type.
+func checkGiftContentType(contentType string) error {
+	if mediaTypeMatches(contentType, giftDeniedTypes) ||
+		len(giftAllowedTypes) > 0 && !mediaTypeMatches(contentType, giftAllowedTypes) {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		return &uploadError{http.StatusUnsupportedMediaType, "Files of type " + mediaType + " are not allowed"}
+	}
+	return nil
+}
+
+// giftContentInfo is what inspectGiftContent learns about a file as it is stored.
+type giftContentInfo struct {
+	MimeType string
+	Metadata *metadataReport // what was stripped from a photo, see photometadata.go; nil for other files
+	hash     hash.Hash
+}
+
+// SHA256 returns the hex digest of everything read so far.
+func (info *giftContentInfo) SHA256() string {
+	return hex.EncodeToString(info.hash.Sum(nil))
+}
+
+// inspectGiftContent detects the type of the file about to be read from r and
+// checks it against the upload policy. The returned reader yields the whole
+// file, with photo metadata removed unless privacy keeps it, and hashes it on
+// the way through, so the checksum is ready once the file has been stored.
+func inspectGiftContent(fileName string, r io.Reader, privacy photoPrivacy) (io.Reader, *giftContentInfo, error) {
+	if err := checkGiftFileName(fileName); err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReaderSize(r, sniffLength)
+	head, err := br.Peek(sniffLength)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	info := &giftContentInfo{MimeType: detectContentType(head), hash: sha256.New()}
+	if err := checkGiftContentType(info.MimeType); err != nil {
+		return nil, nil, err
+	}
+	var content io.Reader = br
+	if !privacy.KeepMetadata {
+		content, info.Metadata = stripPhotoMetadata(info.MimeType, br, privacy.KeepOrientation)
+	}
+	return io.TeeReader(content, info.hash), info, nil
+}
+
+// contentTypeFromName guesses the type of a legacy gift, stored before types
+// were detected at upload, from its file extension.
+func contentTypeFromName(fileName string) string {
+	lowerName := strings.ToLower(fileName)
+	switch {
+	case strings.HasSuffix(lowerName, ".jpg"), strings.HasSuffix(lowerName, ".jpeg"):
+		return "image/jpeg"
+	case strings.HasSuffix(lowerName, ".png"):
+		return "image/png"
+	case strings.HasSuffix(lowerName, ".gif"):
+		return "image/gif"
+	case strings.HasSuffix(lowerName, ".pdf"):
+		return "application/pdf"
+	case strings.HasSuffix(lowerName, ".txt"):
+		return "text/plain"
+	case strings.HasSuffix(lowerName, ".mp4"):
+		return "video/mp4"
+	case strings.HasSuffix(lowerName, ".webm"):
+		return "video/webm"
+	}
+	return "application/octet-stream"
+}
+
+// inlineTypes are shown in the browser; anything else, HTML and SVG in
+// particular, is served as a download so it cannot run in the site's origin.
+var inlineTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/bmp",
+	"video/*", "audio/*", "application/pdf", "text/plain"}
+
+// contentDisposition builds a Content-Disposition header for a gift file.
+// mime.FormatMediaType quotes the name and switches to RFC 2231 encoding for
+// names that are not plain ASCII, so no name can break out of the header.
+func contentDisposition(contentType, fileName string) string {
+	disposition := "attachment"
+	if mediaTypeMatches(contentType, inlineTypes) {
+		disposition = "inline"
+	}
+	if header := mime.FormatMediaType(disposition, map[string]string{"filename": fileName}); header != "" {
+		return header
+	}
+	return disposition
+}
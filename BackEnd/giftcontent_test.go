@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func uploadTestFile(name, content string) *httptest.ResponseRecorder {
+	req := giftUploadRequest([][2]string{{"file", name}}, content)
+	rec := httptest.NewRecorder()
+	requireAuth(uploadGiftHandler)(rec, req)
+	return rec
+}
+
+func TestUploadDetectsTypeAndChecksum(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	png := "\x89PNG\r\n\x1a\n" + "rest of the image"
+
+	// The extension says text, the content says PNG.
+	if rec := uploadTestFile("photo.txt", png); rec.Code != http.StatusOK {
+		t.Fatalf("Expected upload to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var mimeType, checksum string
+	_ = db.QueryRow("SELECT mime_type, sha256 FROM gifts WHERE id = 1").Scan(&mimeType, &checksum)
+	sum := sha256.Sum256([]byte(png))
+	if mimeType != "image/png" || checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected stored type and checksum: %q %q", mimeType, checksum)
+	}
+
+	rec := performAuthenticatedRequest(downloadGiftHandler, "GET", "/download-gift?id=1", nil, 1)
+	if rec.Header().Get("Content-Type") != "image/png" || rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Expected the stored type with nosniff, got %v", rec.Header())
+	}
+}
+
+func TestUploadRejectsExecutables(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	cases := map[string]string{
+		"setup.exe":     "MZ\x90\x00 windows program",
+		"holiday.jpg":   "\x7fELF\x02\x01\x01 linux program",
+		"notes.txt":     "#!/bin/sh\nrm -rf ~\n",
+		"installer.bat": "echo hello",
+	}
+	for name, content := range cases {
+		if rec := uploadTestFile(name, content); rec.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: expected 415, got %d", name, rec.Code)
+		}
+	}
+	var gifts, blobs int
+	_ = db.QueryRow("SELECT COUNT(*) FROM gifts").Scan(&gifts)
+	_ = db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	if gifts != 0 || blobs != 0 {
+		t.Errorf("Expected nothing stored for rejected files, got %d gifts and %d blobs", gifts, blobs)
+	}
+}
+
+func TestUploadAllowlist(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	previous := giftAllowedTypes
+	giftAllowedTypes = splitList("image/*, video/mp4")
+	t.Cleanup(func() { giftAllowedTypes = previous })
+
+	if rec := uploadTestFile("letter.txt", "plain words"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected text to be refused by the allowlist, got %d", rec.Code)
+	}
+	if rec := uploadTestFile("photo.gif", "GIF89a..."); rec.Code != http.StatusOK {
+		t.Errorf("Expected an image to be allowed, got %d", rec.Code)
+	}
+}
+
+func TestTusUploadRejectsExecutableContent(t *testing.T) {
+	setupTusTest(t)
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("video.mp4"))
+	rec := tusRequest("POST", "/uploads", 1, map[string]string{"Upload-Length": "8", "Upload-Metadata": metadata}, "")
+	target := rec.Header().Get("Location")[len(apiBaseURL):]
+
+	if rec := tusRequest("PATCH", target, 1, patchHeaders("0"), "MZ\x90\x00abcd"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 once the content arrived, got %d", rec.Code)
+	}
+	if rec := tusRequest("HEAD", target, 1, nil, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the rejected upload to be dropped, got %d", rec.Code)
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	cases := []struct{ contentType, name, want string }{
+		{"image/jpeg", "beach day.jpg", `inline; filename="beach day.jpg"`},
+		{"text/html; charset=utf-8", "page.html", "attachment; filename=page.html"},
+		{"video/mp4", "für dich.mp4", "inline; filename*=utf-8''f%C3%BCr%20dich.mp4"},
+		{"text/plain; charset=utf-8", "a\"b\r\nSet-Cookie: x.txt", "inline; filename*=utf-8''a%22b%0D%0ASet-Cookie%3A%20x.txt"},
+	}
+	for _, tc := range cases {
+		if got := contentDisposition(tc.contentType, tc.name); got != tc.want {
+			t.Errorf("contentDisposition(%q, %q) = %q, want %q", tc.contentType, tc.name, got, tc.want)
+		}
+	}
+}
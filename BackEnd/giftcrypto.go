@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Gift files are encrypted at rest with envelope encryption. Every user has a
+// random data key, kept in user_data_keys wrapped (encrypted) by the master
+// key from GIFT_MASTER_KEY, and each file is sealed with a key derived from
+// its owner's data key. Rotating the master key only means re-wrapping the
+// data keys, never re-encrypting files, and deleting an account deletes its
+// data key, which leaves any copy of its files unreadable.
+
+// masterKey wraps and unwraps data keys.
+type masterKey struct {
+	id   string // stored with each wrapped data key; derived from the key, does not reveal it
+	aead cipher.AEAD
+}
+
+var (
+	// giftMasterKey wraps new data keys. While it is nil new gift files are
+	// stored unencrypted.
+	giftMasterKey *masterKey
+	// previousMasterKeys still unwrap data keys during a rotation, until
+	// "rewrap-keys" has moved them all to giftMasterKey.
+	previousMasterKeys []*masterKey
+)
+
+var (
+	errNoMasterKey        = errors.New("GIFT_MASTER_KEY is not set")
+	errSealedBlobCorrupt  = errors.New("encrypted gift file is corrupt or was tampered with")
+	errMasterKeyNotLoaded = errors.New("data key is wrapped by a master key that is not configured")
+)
+
+// parseMasterKey decodes a base64 encoded 256-bit key, as printed by
+// "openssl rand -base64 32".
+func parseMasterKey(encoded string) (*masterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("master keys must be 32 bytes, base64 encoded")
+	}
+	aead, err := newAESGCM(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &masterKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadMasterKeysFromEnv reads GIFT_MASTER_KEY and the comma-separated
+// GIFT_PREVIOUS_MASTER_KEYS.
+func loadMasterKeysFromEnv() error {
+	if value := os.Getenv("GIFT_MASTER_KEY"); value != "" {
+		key, err := parseMasterKey(value)
+		if err != nil {
+			return fmt.Errorf("GIFT_MASTER_KEY: %w", err)
+		}
+		giftMasterKey = key
+	}
+	for _, value := range strings.Split(os.Getenv("GIFT_PREVIOUS_MASTER_KEYS"), ",") {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		key, err := parseMasterKey(value)
+		if err != nil {
+			return fmt.Errorf("GIFT_PREVIOUS_MASTER_KEYS: %w", err)
+		}
+		previousMasterKeys = append(previousMasterKeys, key)
+	}
+	return nil
+}
+
+// findMasterKey returns the configured master key with the given id.
+func findMasterKey(id string) (*masterKey, error) {
+	for _, key := range append([]*masterKey{giftMasterKey}, previousMasterKeys...) {
+		if key != nil && key.id == id {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w (%s)", errMasterKeyNotLoaded, id)
+}
+
+// dataKeyAAD binds a wrapped data key to its user, so a key copied to another
+// user's row does not unwrap.
+func dataKeyAAD(userID int) []byte {
+	return []byte("user-data-key:" + strconv.Itoa(userID))
+}
+
+func wrapDataKey(master *masterKey, userID int, dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, master.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return master.aead.Seal(nonce, nonce, dataKey, dataKeyAAD(userID)), nil
+}
+
+func unwrapDataKey(userID int, masterKeyID string, wrapped []byte) ([]byte, error) {
+	master, err := findMasterKey(masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := master.aead.NonceSize()
+	if len(wrapped) < nonceSize {
+		return nil, errors.New("invalid wrapped data key")
+	}
+	return master.aead.Open(nil, wrapped[:nonceSize], wrapped[nonceSize:], dataKeyAAD(userID))
+}
+
+// userDataKey returns the user's data key, creating one first if create is
+// set and the user has none yet.
+func userDataKey(userID int, create bool) ([]byte, error) {
+	var wrapped []byte
+	var masterKeyID string
+	err := db.QueryRow("SELECT wrapped_key, master_key_id FROM user_data_keys WHERE user_id = ?", userID).
+		Scan(&wrapped, &masterKeyID)
+	if err == sql.ErrNoRows && create {
+		if giftMasterKey == nil {
+			return nil, errNoMasterKey
+		}
+		dataKey := make([]byte, 32)
+		if _, err := rand.Read(dataKey); err != nil {
+			return nil, err
+		}
+		wrapped, err := wrapDataKey(giftMasterKey, userID, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		// A concurrent upload may have created the key first; use whichever won.
+		_, err = db.Exec("INSERT OR IGNORE INTO user_data_keys (user_id, wrapped_key, master_key_id, created_at) VALUES (?, ?, ?, ?)",
+			userID, wrapped, giftMasterKey.id, timeNow().Unix())
+		if err != nil {
+			return nil, err
+		}
+		return userDataKey(userID, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unwrapDataKey(userID, masterKeyID, wrapped)
+}
+
+// rewrapDataKeys re-encrypts every data key not yet wrapped by giftMasterKey,
+// unwrapping it with one of previousMasterKeys. It returns how many were
+// re-wrapped.
+func rewrapDataKeys() (int, error) {
+	if giftMasterKey == nil {
+		return 0, errNoMasterKey
+	}
+	type wrappedKey struct {
+		userID      int
+		wrapped     []byte
+		masterKeyID string
+	}
+	rows, err := db.Query("SELECT user_id, wrapped_key, master_key_id FROM user_data_keys WHERE master_key_id != ?", giftMasterKey.id)
+	if err != nil {
+		return 0, err
+	}
+	var keys []wrappedKey
+	for rows.Next() {
+		var k wrappedKey
+		if err := rows.Scan(&k.userID, &k.wrapped, &k.masterKeyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	rewrapped := 0
+	for _, k := range keys {
+		dataKey, err := unwrapDataKey(k.userID, k.masterKeyID, k.wrapped)
+		if err != nil {
+			return rewrapped, fmt.Errorf("user %d: %w", k.userID, err)
+		}
+		wrapped, err := wrapDataKey(giftMasterKey, k.userID, dataKey)
+		if err != nil {
+			return rewrapped, err
+		}
+		if _, err := db.Exec("UPDATE user_data_keys SET wrapped_key = ?, master_key_id = ? WHERE user_id = ? AND master_key_id = ?",
+			wrapped, giftMasterKey.id, k.userID, k.masterKeyID); err != nil {
+			return rewrapped, err
+		}
+		rewrapped++
+	}
+	return rewrapped, nil
+}
+
+// An encrypted blob starts with a magic string and a random salt; the salt and
+// the owner's data key give the file's own AES-256-GCM key. The content
+// follows in segments of sealedSegmentSize bytes, each sealed separately, so
+// any byte range can be decrypted without reading the whole file. A segment's
+// nonce is its index plus a flag marking the last one, so segments cannot be
+// reordered, dropped or cut off at the end without failing to decrypt.
+const (
+	sealedMagic       = "PGE1"
+	sealedSaltSize    = 32
+	sealedHeaderSize  = len(sealedMagic) + sealedSaltSize
+	sealedSegmentSize = 64 << 10
+	sealedTagSize     = 16
+)
+
+func sealedFileAEAD(dataKey, salt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write(salt)
+	return newAESGCM(mac.Sum(nil))
+}
+
+func segmentNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealingReader yields the encrypted form of everything read from src.
+type sealingReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	index   int64
+	plain   []byte
+	sealed  []byte
+	pending []byte
+	done    bool
+	n       int64 // plaintext bytes read from src
+}
+
+func newSealingReader(dataKey []byte, src io.Reader) (*sealingReader, error) {
+	salt := make([]byte, sealedSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := sealedFileAEAD(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &sealingReader{
+		src:     bufio.NewReaderSize(src, sealedSegmentSize),
+		aead:    aead,
+		plain:   make([]byte, sealedSegmentSize),
+		sealed:  make([]byte, 0, sealedSegmentSize+sealedTagSize),
+		pending: append([]byte(sealedMagic), salt...),
+	}, nil
+}
+
+func (s *sealingReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := s.sealNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+func (s *sealingReader) sealNext() error {
+	n, err := io.ReadFull(s.src, s.plain)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		if _, err := s.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	s.n += int64(n)
+	s.pending = s.aead.Seal(s.sealed[:0], segmentNonce(s.index, last), s.plain[:n], nil)
+	s.index++
+	s.done = last
+	return nil
+}
+
+// unsealingReader decrypts a whole encrypted blob as it is read.
+type unsealingReader struct {
+	src    *bufio.Reader
+	closer io.Closer
+	aead   cipher.AEAD
+	index  int64
+	buf    []byte
+	plain  []byte
+	done   bool
+}
+
+func newUnsealingReader(dataKey []byte, rc io.ReadCloser) (*unsealingReader, error) {
+	src := bufio.NewReaderSize(rc, sealedSegmentSize+sealedTagSize)
+	aead, err := readSealedHeader(src, dataKey)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return &unsealingReader{src: src, closer: rc, aead: aead, buf: make([]byte, sealedSegmentSize+sealedTagSize)}, nil
+}
+
+func readSealedHeader(r io.Reader, dataKey []byte) (cipher.AEAD, error) {
+	header := make([]byte, sealedHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(sealedMagic)]) != sealedMagic {
+		return nil, errSealedBlobCorrupt
+	}
+	return sealedFileAEAD(dataKey, header[len(sealedMagic):])
+}
+
+func (u *unsealingReader) Read(p []byte) (int, error) {
+	for len(u.plain) == 0 {
+		if u.done {
+			return 0, io.EOF
+		}
+		if err := u.openNext(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, u.plain)
+	u.plain = u.plain[n:]
+	return n, nil
+}
+
+func (u *unsealingReader) openNext() error {
+	n, err := io.ReadFull(u.src, u.buf)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		if _, err := u.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := u.aead.Open(u.buf[:0], segmentNonce(u.index, last), u.buf[:n], nil)
+	if err != nil {
+		return errSealedBlobCorrupt
+	}
+	u.plain, u.index, u.done = plain, u.index+1, last
+	return nil
+}
+
+func (u *unsealingReader) Close() error {
+	return u.closer.Close()
+}
+
+// sealedReadSeeker decrypts an encrypted blob whose plaintext size is known,
+// fetching only the segments that cover the bytes read.
+type sealedReadSeeker struct {
+	store   blobStore
+	key     string
+	size    int64 // plaintext
+	dataKey []byte
+	aead    cipher.AEAD // set once the header has been read
+	offset  int64
+	segment int64 // index of the segment in plain, or -1
+	plain   []byte
+}
+
+func (s *sealedReadSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+	if s.aead == nil {
+		rc, err := s.store.OpenRange(s.key, 0, int64(sealedHeaderSize))
+		if err != nil {
+			return 0, err
+		}
+		s.aead, err = readSealedHeader(rc, s.dataKey)
+		rc.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+	index := s.offset / sealedSegmentSize
+	start := index * sealedSegmentSize
+	if index != s.segment {
+		if err := s.loadSegment(index, min(sealedSegmentSize, s.size-start)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, s.plain[s.offset-start:])
+	s.offset += int64(n)
+	return n, nil
+}
+
+func (s *sealedReadSeeker) loadSegment(index, plainLength int64) error {
+	rc, err := s.store.OpenRange(s.key, int64(sealedHeaderSize)+index*(sealedSegmentSize+sealedTagSize), plainLength+sealedTagSize)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	buf := make([]byte, plainLength+sealedTagSize)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		return errSealedBlobCorrupt
+	}
+	last := index == (s.size-1)/sealedSegmentSize
+	plain, err := s.aead.Open(buf[:0], segmentNonce(index, last), buf, nil)
+	if err != nil {
+		return errSealedBlobCorrupt
+	}
+	s.plain, s.segment = plain, index
+	return nil
+}
+
+func (s *sealedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+// putGiftBlob stores content under a new key, encrypted with the owner's data
+// key when a master key is configured, and records the key, the plaintext
+// size and the encryption on upload. The upload must then be registered with
+// storeDeduplicated, which records how the blob is encrypted.
+func putGiftBlob(upload *giftUpload, ownerID int, content io.Reader) error {
+	key, err := newGiftStorageKey()
+	if err != nil {
+		return err
+	}
+	var sealer *sealingReader
+	if giftMasterKey != nil {
+		dataKey, err := userDataKey(ownerID, true)
+		if err != nil {
+			return err
+		}
+		if sealer, err = newSealingReader(dataKey, content); err != nil {
+			return err
+		}
+		content = sealer
+	}
+	n, err := giftStore.Put(key, content)
+	if err != nil {
+		giftStore.Delete(key)
+		return err
+	}
+	upload.StorageKey, upload.Size, upload.EncryptedFor = key, n, 0
+	if sealer != nil {
+		upload.Size, upload.EncryptedFor = sealer.n, ownerID
+	}
+	return nil
+}
+
+// blobOwner returns the user whose data key encrypts a blob, or 0 if the blob
+// is stored in the clear.
+func blobOwner(key string) (int, error) {
+	var owner int
+	err := db.QueryRow("SELECT owner_id FROM content_blobs WHERE storage_key = ?", key).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return owner, err
+}
+
+// openGiftBlob returns the content of a stored gift file, decrypting it if needed.
+func openGiftBlob(key string) (io.ReadCloser, error) {
+	owner, err := blobOwner(key)
+	if err != nil {
+		return nil, err
+	}
+	var dataKey []byte
+	if owner != 0 {
+		if dataKey, err = userDataKey(owner, false); err != nil {
+			return nil, err
+		}
+	}
+	rc, err := giftStore.Open(key)
+	if err != nil || owner == 0 {
+		return rc, err
+	}
+	return newUnsealingReader(dataKey, rc)
+}
+
+// giftBlobReadSeeker is openGiftBlob for serving byte ranges of a file whose
+// size is known, reading only the parts requested.
+func giftBlobReadSeeker(key string, size int64) (io.ReadSeeker, error) {
+	owner, err := blobOwner(key)
+	if err != nil {
+		return nil, err
+	}
+	if owner == 0 {
+		return &blobReadSeeker{store: giftStore, key: key, size: size}, nil
+	}
+	dataKey, err := userDataKey(owner, false)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReadSeeker{store: giftStore, key: key, size: size, dataKey: dataKey, segment: -1}, nil
+}
+
+// Text memories are kept in the gifts and gift_versions rows rather than in
+// blob storage, but are sealed with their owner's data key all the same, in
+// the format of an encrypted file. A sealed memory is stored as a BLOB and a
+// memory stored in the clear as TEXT, so the two are never confused.
+
+// sealMemory returns what to store for a memory belonging to ownerID: its
+// sealed form, or the memory itself while no master key is configured.
+func sealMemory(ownerID int, memory string) (interface{}, error) {
+	if giftMasterKey == nil {
+		return memory, nil
+	}
+	dataKey, err := userDataKey(ownerID, true)
+	if err != nil {
+		return nil, err
+	}
+	sealer, err := newSealingReader(dataKey, strings.NewReader(memory))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(sealer)
+}
+
+// openMemory returns a memory of ownerID's as stored by sealMemory, scanned
+// into an interface{}. A NULL column is an empty memory.
+func openMemory(ownerID int, stored interface{}) (string, error) {
+	switch stored := stored.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return stored, nil
+	case []byte:
+		dataKey, err := userDataKey(ownerID, false)
+		if err != nil {
+			return "", err
+		}
+		rc, err := newUnsealingReader(dataKey, io.NopCloser(bytes.NewReader(stored)))
+		if err != nil {
+			return "", err
+		}
+		defer rc.Close()
+		memory, err := io.ReadAll(rc)
+		return string(memory), err
+	}
+	return "", fmt.Errorf("unexpected stored memory of type %T", stored)
+}
+
+// encryptStoredBlobs encrypts files stored in the clear, from before a master
+// key was configured, with their owners' data keys. A file that several users
+// share through deduplication gets a copy per owner. Thumbnails stored in the
+// clear are deleted for the thumbnail job to make again. It returns how many
+// copies were encrypted.
+func encryptStoredBlobs() (int, error) {
+	if giftMasterKey == nil {
+		return 0, nil
+	}
+	contentBlobsMu.Lock()
+	defer contentBlobsMu.Unlock()
+
+	type clearBlob struct {
+		key, sha256 string
+		owner       int
+	}
+	rows, err := db.Query(`
+		SELECT DISTINCT f.storage_key, f.sha256, f.user_id FROM (
+			SELECT a.storage_key, a.sha256, g.user_id FROM gift_attachments a JOIN gifts g ON g.id = a.gift_id
+			UNION ALL
+			SELECT v.storage_key, v.sha256, g.user_id FROM gift_versions v JOIN gifts g ON g.id = v.gift_id
+			UNION ALL
+			SELECT storage_key, sha256, user_id FROM gifts) f
+		WHERE f.storage_key IS NOT NULL AND f.sha256 IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM content_blobs c WHERE c.storage_key = f.storage_key AND c.owner_id != 0)
+		ORDER BY f.storage_key, f.user_id`)
+	if err != nil {
+		return 0, err
+	}
+	var blobs []clearBlob
+	for rows.Next() {
+		var b clearBlob
+		if err := rows.Scan(&b.key, &b.sha256, &b.owner); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		blobs = append(blobs, b)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	encrypted := 0
+	for _, b := range blobs {
+		rc, err := giftStore.Open(b.key)
+		if err == errBlobNotFound {
+			continue
+		}
+		if err != nil {
+			return encrypted, err
+		}
+		upload := giftUpload{SHA256: b.sha256}
+		err = putGiftBlob(&upload, b.owner, rc)
+		rc.Close()
+		if err != nil {
+			return encrypted, err
+		}
+		duplicate, err := resolveContentBlob(&upload)
+		if err != nil {
+			giftStore.Delete(upload.StorageKey)
+			return encrypted, err
+		}
+		if duplicate != "" {
+			giftStore.Delete(duplicate)
+		}
+		if _, err := db.Exec("UPDATE gifts SET storage_key = ? WHERE storage_key = ? AND user_id = ?",
+			upload.StorageKey, b.key, b.owner); err != nil {
+			return encrypted, err
+		}
+		for _, table := range []string{"gift_attachments", "gift_versions"} {
+			if _, err := db.Exec("UPDATE "+table+" SET storage_key = ? WHERE storage_key = ? AND gift_id IN (SELECT id FROM gifts WHERE user_id = ?)",
+				upload.StorageKey, b.key, b.owner); err != nil {
+				return encrypted, err
+			}
+		}
+		deleteUnreferencedBlobs([]string{b.key})
+		encrypted++
+	}
+	_, err = discardClearThumbnails()
+	return encrypted, err
+}
+
+// sealStoredMemories seals the text memories of gifts and their versions
+// stored in the clear, from before a master key was configured, with their
+// owners' data keys, and gives sealed memories their search terms. It
+// returns how many rows were sealed.
+func sealStoredMemories() (int, error) {
+	if giftMasterKey == nil {
+		return 0, nil
+	}
+	type clearMemory struct {
+		rowID, owner int
+		html, text   interface{}
+	}
+	sealed := 0
+	for _, table := range []string{"gifts", "gift_versions"} {
+		owner := "user_id"
+		if table == "gift_versions" {
+			owner = "(SELECT user_id FROM gifts WHERE gifts.id = gift_versions.gift_id)"
+		}
+		rows, err := db.Query("SELECT rowid, " + owner + ", memory_html, memory_text FROM " + table +
+			" WHERE typeof(memory_html) = 'text' OR typeof(memory_text) = 'text'")
+		if err != nil {
+			return sealed, err
+		}
+		var memories []clearMemory
+		for rows.Next() {
+			var m clearMemory
+			if err := rows.Scan(&m.rowID, &m.owner, &m.html, &m.text); err != nil {
+				rows.Close()
+				return sealed, err
+			}
+			memories = append(memories, m)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return sealed, err
+		}
+		rows.Close()
+
+		for _, m := range memories {
+			for _, column := range []*interface{}{&m.html, &m.text} {
+				if memory, ok := (*column).(string); ok {
+					if *column, err = sealMemory(m.owner, memory); err != nil {
+						return sealed, err
+					}
+				}
+			}
+			if _, err := db.Exec("UPDATE "+table+" SET memory_html = ?, memory_text = ? WHERE rowid = ?",
+				m.html, m.text, m.rowID); err != nil {
+				return sealed, err
+			}
+			sealed++
+		}
+	}
+	if err := indexSealedMemories(); err != nil {
+		return sealed, err
+	}
+	if sealed == 0 {
+		return 0, nil
+	}
+	// Sealing re-indexed the memories without their text; optimizing drops
+	// what the search index still kept of the old entries.
+	_, err := db.Exec("INSERT INTO gift_search (gift_search) VALUES ('optimize')")
+	return sealed, err
+}
+
+// indexSealedMemories fills in memory_terms for gifts whose memory is sealed
+// but has no search terms yet, like memories sealed before they existed.
+func indexSealedMemories() error {
+	type sealedMemory struct {
+		giftID, owner int
+		text          interface{}
+	}
+	rows, err := db.Query("SELECT id, user_id, memory_text FROM gifts WHERE typeof(memory_text) = 'blob' AND memory_terms IS NULL")
+	if err != nil {
+		return err
+	}
+	var memories []sealedMemory
+	for rows.Next() {
+		var m sealedMemory
+		if err := rows.Scan(&m.giftID, &m.owner, &m.text); err != nil {
+			rows.Close()
+			return err
+		}
+		memories = append(memories, m)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	for _, m := range memories {
+		text, err := openMemory(m.owner, m.text)
+		if err != nil {
+			return fmt.Errorf("gift %d: %w", m.giftID, err)
+		}
+		terms, err := memorySearchTerms(m.owner, text)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE gifts SET memory_terms = ? WHERE id = ?", terms, m.giftID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func useTestMasterKey(t *testing.T) *masterKey {
+	raw := make([]byte, 32)
+	_, _ = rand.Read(raw)
+	key, err := parseMasterKey(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, oldPrevious := giftMasterKey, previousMasterKeys
+	giftMasterKey, previousMasterKeys = key, nil
+	t.Cleanup(func() { giftMasterKey, previousMasterKeys = oldKey, oldPrevious })
+	return key
+}
+
+// storedBlob returns the stored bytes of the first blob and its key.
+func storedBlob(t *testing.T) ([]byte, string) {
+	var key string
+	if err := db.QueryRow("SELECT key FROM blobs").Scan(&key); err != nil {
+		t.Fatalf("Expected one stored blob: %v", err)
+	}
+	rc, err := giftStore.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, _ := io.ReadAll(rc)
+	return data, key
+}
+
+func TestEncryptedGiftRoundTrip(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	useTestMasterKey(t)
+	// Spans three segments, the last one partial.
+	letter := strings.Repeat("Dear Ana, thank you for everything. ", 5000)
+
+	if rec := uploadTestFile("letter.txt", letter); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d %s", rec.Code, rec.Body.String())
+	}
+	stored, storedKey := storedBlob(t)
+	if bytes.Contains(stored, []byte("Dear Ana")) || !bytes.HasPrefix(stored, []byte(sealedMagic)) {
+		t.Fatal("Expected the stored file to be encrypted")
+	}
+	var size int
+	_ = db.QueryRow("SELECT file_size FROM gifts WHERE id = 1").Scan(&size)
+	if size != len(letter) {
+		t.Errorf("Expected the plaintext size %d to be recorded, got %d", len(letter), size)
+	}
+
+	if rec := downloadGift(nil); rec.Body.String() != letter {
+		t.Fatalf("Expected the decrypted file, got %d bytes", rec.Body.Len())
+	}
+	rec := downloadGift(map[string]string{"Range": "bytes=65530-65545"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != letter[65530:65546] {
+		t.Errorf("Expected a range across two segments, got %d %q", rec.Code, rec.Body.String())
+	}
+	if files := emailedBundle(t, 1); len(files) != 1 || files[0] != letter {
+		t.Errorf("Expected emails to get the decrypted file")
+	}
+	bundle, _ := loadGiftAttachments(1)
+
+	// Any change to the stored bytes is detected.
+	stored[len(stored)-1] ^= 1
+	_, _ = giftStore.Put(storedKey, bytes.NewReader(stored))
+	rc, err := openGiftBlob(bundle[0].storageKey.String)
+	if err == nil {
+		_, err = io.ReadAll(rc)
+		rc.Close()
+	}
+	if err != errSealedBlobCorrupt {
+		t.Errorf("Expected tampering to be detected, got %v", err)
+	}
+}
+
+func TestEncryptedFilesAreOnlySharedByTheirOwner(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	useTestMasterKey(t)
+	photo := "GIF89a the same photo for two people"
+
+	for _, userID := range []int{1, 1, 2} {
+		req := giftUploadRequest([][2]string{{"file", "photo.gif"}}, photo)
+		authenticate(req, userID)
+		rec := httptest.NewRecorder()
+		requireAuth(uploadGiftHandler)(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Upload by user %d failed: %d", userID, rec.Code)
+		}
+	}
+	if n := countRows("blobs"); n != 2 {
+		t.Errorf("Expected one encrypted copy per user, found %d blobs", n)
+	}
+	if n := countRows("user_data_keys"); n != 2 {
+		t.Errorf("Expected a data key per user, found %d", n)
+	}
+}
+
+func TestRewrapDataKeys(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	oldKey := useTestMasterKey(t)
+	if rec := uploadTestFile("note.txt", "kept safe across rotations"); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+
+	// Until the keys are re-wrapped the old master key is still needed.
+	useTestMasterKey(t)
+	if rec := downloadGift(nil); rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected the file to be unreadable without the old master key, got %d", rec.Code)
+	}
+	previousMasterKeys = []*masterKey{oldKey}
+	if n, err := rewrapDataKeys(); n != 1 || err != nil {
+		t.Fatalf("Expected one key re-wrapped, got %d %v", n, err)
+	}
+	previousMasterKeys = nil
+	if rec := downloadGift(nil); rec.Body.String() != "kept safe across rotations" {
+		t.Errorf("Expected the file to be readable with the new master key alone, got %d", rec.Code)
+	}
+}
+
+func TestEncryptStoredBlobs(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	if rec := uploadTestFile("old.txt", "uploaded before encryption"); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+
+	useTestMasterKey(t)
+	if n, err := encryptStoredBlobs(); n != 1 || err != nil {
+		t.Fatalf("Expected one file encrypted, got %d %v", n, err)
+	}
+	if stored, _ := storedBlob(t); bytes.Contains(stored, []byte("uploaded before")) {
+		t.Error("Expected the plaintext copy to be replaced")
+	}
+	if rec := downloadGift(nil); rec.Body.String() != "uploaded before encryption" {
+		t.Errorf("Expected the encrypted file to download, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+// storedMemories returns every memory column of gifts and gift_versions as
+// stored, one string per column.
+func storedMemories(t *testing.T) []string {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT memory_html, memory_text FROM gifts
+		UNION ALL
+		SELECT memory_html, memory_text FROM gift_versions`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var stored []string
+	for rows.Next() {
+		var memoryHTML, memoryText []byte
+		_ = rows.Scan(&memoryHTML, &memoryText)
+		stored = append(stored, string(memoryHTML), string(memoryText))
+	}
+	return stored
+}
+
+func TestEncryptedTextMemories(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	useTestMasterKey(t)
+	createTestMemory(t, `{"title": "Lake", "html": "<p>Summer at the lake</p>"}`)
+	rec := performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1", []byte(`{"html": "<p>Winter by the fire</p>"}`), 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the memory to be edited, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	stored := storedMemories(t)
+	if len(stored) != 4 {
+		t.Fatalf("Expected the memory and one version, got %d columns", len(stored))
+	}
+	for _, column := range stored {
+		if !strings.HasPrefix(column, sealedMagic) || strings.Contains(column, "lake") || strings.Contains(column, "fire") {
+			t.Errorf("Expected every stored memory to be sealed, got %q", column)
+		}
+	}
+	if memory := loadTestMemory(t); memory.HTML != "<p>Winter by the fire</p>" || memory.Text != "Winter by the fire" {
+		t.Errorf("Expected the memory to be decrypted, got %+v", memory)
+	}
+	if versions := listTestVersions(t); len(versions) != 1 || versions[0].HTML != "<p>Summer at the lake</p>" {
+		t.Errorf("Expected the version to be decrypted, got %+v", versions)
+	}
+	// The memory is found through hashed terms, without its text in the index.
+	for _, query := range []string{"fire", "WINT", "winter fire"} {
+		if results := searchTestGifts(t, 1, query); len(results) != 1 || results[0].Snippet != "" {
+			t.Errorf("Expected %q to find the sealed memory without a snippet, got %+v", query, results)
+		}
+	}
+	if results := searchTestGifts(t, 1, "summer"); len(results) != 0 {
+		t.Errorf("Expected the earlier version not to be found, got %+v", results)
+	}
+	if results := searchTestGifts(t, 1, "lake"); len(results) != 1 {
+		t.Errorf("Expected the title to be searchable, got %+v", results)
+	}
+	assertSearchIndexOmits(t, "winter", "fire")
+
+	// Another user's key hashes the words differently.
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	performAuthenticatedRequest(textGiftHandler, "POST", "/text-gift", []byte(`{"title": "Other", "html": "<p>Nothing to see</p>"}`), 2)
+	if results := searchTestGifts(t, 2, "fire"); len(results) != 0 {
+		t.Errorf("Expected another user's search not to find the memory, got %+v", results)
+	}
+}
+
+// assertSearchIndexOmits fails if any of the words is in the search index.
+func assertSearchIndexOmits(t *testing.T, words ...string) {
+	t.Helper()
+	rows, err := db.Query("SELECT memory_text || ' ' || memory_terms FROM gift_search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var indexed string
+		_ = rows.Scan(&indexed)
+		for _, word := range words {
+			if strings.Contains(strings.ToLower(indexed), word) {
+				t.Errorf("Expected %q not to be indexed in the clear, got %q", word, indexed)
+			}
+		}
+	}
+}
+
+func TestSealStoredMemories(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	createTestMemory(t, `{"title": "Letter", "html": "<p>Written before encryption</p>"}`)
+	_ = performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1", []byte(`{"html": "<p>Edited before encryption</p>"}`), 1)
+	if results := searchTestGifts(t, 1, "edited"); len(results) != 1 {
+		t.Fatalf("Expected memories in the clear to be searchable, got %+v", results)
+	}
+
+	useTestMasterKey(t)
+	if n, err := sealStoredMemories(); n != 2 || err != nil {
+		t.Fatalf("Expected the memory and its version sealed, got %d %v", n, err)
+	}
+	for _, column := range storedMemories(t) {
+		if strings.Contains(column, "encryption") {
+			t.Errorf("Expected the plaintext memory to be replaced, got %q", column)
+		}
+	}
+	if memory := loadTestMemory(t); memory.Text != "Edited before encryption" {
+		t.Errorf("Expected the sealed memory to load, got %+v", memory)
+	}
+	if versions := listTestVersions(t); len(versions) != 1 || versions[0].HTML != "<p>Written before encryption</p>" {
+		t.Errorf("Expected the sealed version to load, got %+v", versions)
+	}
+	if results := searchTestGifts(t, 1, "edited"); len(results) != 1 {
+		t.Errorf("Expected the sealed memory to stay searchable, got %+v", results)
+	}
+	assertSearchIndexOmits(t, "edited", "encryption")
+
+	// Memories sealed before search terms existed get them too.
+	_, _ = db.Exec("UPDATE gifts SET memory_terms = NULL")
+	if results := searchTestGifts(t, 1, "edited"); len(results) != 0 {
+		t.Fatalf("Expected the memory to need its terms, got %+v", results)
+	}
+	if n, err := sealStoredMemories(); n != 0 || err != nil {
+		t.Errorf("Expected nothing left to seal, got %d %v", n, err)
+	}
+	if results := searchTestGifts(t, 1, "edited"); len(results) != 1 {
+		t.Errorf("Expected the memory to be given its terms, got %+v", results)
+	}
+}
+
+func TestSealedBlobSegmentBoundaries(t *testing.T) {
+	db, _ = setupTestDB()
+	dataKey := make([]byte, 32)
+	for _, size := range []int{0, 1, sealedSegmentSize, sealedSegmentSize + 1, 2 * sealedSegmentSize} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		sealer, _ := newSealingReader(dataKey, bytes.NewReader(plain))
+		if _, err := giftStore.Put("gifts/sealed", sealer); err != nil || sealer.n != int64(size) {
+			t.Fatalf("size %d: sealing failed: %v", size, err)
+		}
+
+		rc, _ := giftStore.Open("gifts/sealed")
+		unsealer, err := newUnsealingReader(dataKey, rc)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		got, err := io.ReadAll(unsealer)
+		unsealer.Close()
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("size %d: streaming decryption returned %d bytes, %v", size, len(got), err)
+		}
+
+		seeker := &sealedReadSeeker{store: giftStore, key: "gifts/sealed", size: int64(size), dataKey: dataKey, segment: -1}
+		if got, err := io.ReadAll(seeker); err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("size %d: ranged decryption returned %d bytes, %v", size, len(got), err)
+		}
+	}
+}
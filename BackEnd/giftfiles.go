@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+var (
+	// maxGiftUploadBytes caps the size of a single uploaded gift file.
+	maxGiftUploadBytes = envBytes("GIFT_MAX_UPLOAD_BYTES", 200<<20)
+	// maxGiftFieldBytes caps each text field sent along with an upload, such as emailMessage.
+	maxGiftFieldBytes = envBytes("GIFT_MAX_FIELD_BYTES", 64<<10)
+)
+
+// envBytes reads a byte count from the environment, falling back when it is unset or invalid.
+func envBytes(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %d", key, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// giftUpload is what receiveGiftUpload read from a multipart upload request.
+type giftUpload struct {
+	FileName      string
+	StorageKey    string
+	Size          int64
+	CustomMessage string
+	Fields        map[string]string // other text fields, such as an attachment caption
+	MimeType      string            // detected from the content, see inspectGiftContent
+	SHA256        string
+	EncryptedFor  int             // user whose data key encrypts the stored file, 0 if stored in the clear
+	Metadata      *metadataReport // photo metadata removed from the file, nil if none was looked for
+}
+
+// canReceiveGifts reports whether the user's privacy settings allow storing gifts for them.
+func canReceiveGifts(userID int) bool {
+	allowed := true // default to true
+	err := db.QueryRow("SELECT can_receive_gifts FROM privacy_settings WHERE user_id = ?", userID).Scan(&allowed)
+	return err != nil || allowed
+}
+
+// insertGift records an uploaded file as a new pending gift whose bundle holds
+// just that file. If that fails the stored blob is removed again.
+func insertGift(userID int, upload giftUpload) (int64, error) {
+	var giftID int64
+	err := storeDeduplicated(&upload, func() (err error) {
+		giftID, err = insertGiftRows(userID, upload)
+		return err
+	})
+	if err != nil {
+		log.Printf("Database insert error: %v", err)
+		return 0, err
+	}
+	return giftID, nil
+}
+
+func insertGiftRows(userID int, upload giftUpload) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(
+		"INSERT INTO gifts (user_id, file_name, storage_key, file_size, mime_type, sha256, custom_message, pending) VALUES (?, ?, ?, ?, ?, ?, ?, 1)",
+		userID, upload.FileName, upload.StorageKey, upload.Size, upload.MimeType, upload.SHA256, upload.CustomMessage,
+	)
+	if err != nil {
+		return 0, err
+	}
+	giftID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO gift_attachments (gift_id, position, file_name, storage_key, file_size, mime_type, sha256, caption, created_at, metadata_removed)
+		VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		giftID, upload.FileName, upload.StorageKey, upload.Size, upload.MimeType, upload.SHA256, upload.Fields["caption"], timeNow().Unix(),
+		upload.Metadata.column())
+	if err != nil {
+		return 0, err
+	}
+	return giftID, tx.Commit()
+}
+
+// uploadError carries the status to answer a failed upload with.
+type uploadError struct {
+	status  int
+	message string
+}
+
+func (e *uploadError) Error() string { return e.message }
+
+// receiveGiftUpload streams the "file" part of a multipart request straight
+// into giftStore, without buffering it in memory or on disk. Text fields may
+// come before or after the file. The file counts against ownerID's storage
+// quota. On error nothing is left in the store.
+func receiveGiftUpload(w http.ResponseWriter, r *http.Request, ownerID int) (giftUpload, error) {
+	var upload giftUpload
+	tooLarge := &uploadError{http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("File is too large; the limit is %d bytes", maxGiftUploadBytes)}
+
+	usage, err := loadStorageUsage(ownerID)
+	if err != nil {
+		return upload, err
+	}
+	// When less than a full upload fits in the quota, the quota is the limit.
+	fileLimit, fileTooLarge := maxGiftUploadBytes, error(tooLarge)
+	if remaining, limited := usage.remaining(); limited && remaining < fileLimit {
+		if remaining == 0 {
+			return upload, quotaExceededError(usage)
+		}
+		fileLimit, fileTooLarge = remaining, quotaExceededError(usage)
+	}
+
+	// Leave room for the text fields and multipart framing around the file.
+	bodyLimit := maxGiftUploadBytes + 4*maxGiftFieldBytes + 64<<10
+	if r.ContentLength > bodyLimit {
+		return upload, tooLarge
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, bodyLimit)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return upload, &uploadError{http.StatusBadRequest, "Error parsing form"}
+	}
+	fail := func(err error) (giftUpload, error) {
+		if upload.StorageKey != "" {
+			deleteGiftBlobs([]string{upload.StorageKey})
+		}
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return giftUpload{}, tooLarge
+		}
+		return giftUpload{}, err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(&uploadError{http.StatusBadRequest, "Error parsing form"})
+		}
+		switch part.FormName() {
+		case "file":
+			if upload.StorageKey != "" {
+				part.Close()
+				return fail(&uploadError{http.StatusBadRequest, "Only one file can be uploaded per gift"})
+			}
+			if err := storeGiftPart(part, &upload, ownerID, fileLimit); err != nil {
+				part.Close()
+				if errors.Is(err, errGiftTooLarge) {
+					return fail(fileTooLarge)
+				}
+				return fail(err)
+			}
+		case "emailMessage":
+			value, err := readFormField(part)
+			if err != nil {
+				part.Close()
+				return fail(err)
+			}
+			upload.CustomMessage = value
+		default:
+			value, err := readFormField(part)
+			if err != nil {
+				part.Close()
+				return fail(err)
+			}
+			if upload.Fields == nil {
+				upload.Fields = map[string]string{}
+			}
+			upload.Fields[part.FormName()] = value
+		}
+		part.Close()
+	}
+
+	if upload.StorageKey == "" {
+		return upload, &uploadError{http.StatusBadRequest, "Error retrieving file"}
+	}
+	return upload, nil
+}
+
+var errGiftTooLarge = errors.New("gift file too large")
+
+// storeGiftPart copies one file part of ownerID's into giftStore, stopping at limit bytes.
+func storeGiftPart(part *multipart.Part, upload *giftUpload, ownerID int, limit int64) error {
+	limited := &io.LimitedReader{R: part, N: limit + 1}
+	content, info, err := inspectGiftContent(part.FileName(), limited, loadPhotoPrivacy(ownerID))
+	if err != nil {
+		return err
+	}
+	if err := putGiftBlob(upload, ownerID, content); err != nil {
+		var maxErr *http.MaxBytesError
+		if !errors.As(err, &maxErr) {
+			log.Printf("Error storing gift file: %v", err)
+			err = &uploadError{http.StatusInternalServerError, "Error reading file"}
+		}
+		return err
+	}
+	upload.FileName = part.FileName()
+	upload.MimeType = info.MimeType
+	upload.SHA256 = info.SHA256()
+	upload.Metadata = info.Metadata
+	if upload.Size > limit {
+		return errGiftTooLarge
+	}
+	return nil
+}
+
+// readFormField reads a text part, refusing values longer than maxGiftFieldBytes.
+func readFormField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxGiftFieldBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(value)) > maxGiftFieldBytes {
+		return "", &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Form field %q is too long; the limit is %d bytes", part.FormName(), maxGiftFieldBytes)}
+	}
+	return string(value), nil
+}
+
+// writeUploadError answers a failed upload, hiding unexpected errors from the client.
+func writeUploadError(w http.ResponseWriter, err error) {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		http.Error(w, ue.message, ue.status)
+		return
+	}
+	log.Printf("Error receiving gift upload: %v", err)
+	http.Error(w, "Error reading file", http.StatusBadRequest)
+}
+
+// giftFile is a gift payload prepared for http.ServeContent.
+type giftFile struct {
+	Name     string
+	Size     int64
+	MimeType string // empty for files stored before types were detected
+	ModTime  time.Time
+	ETag     string
+	Content  io.ReadSeeker
+}
+
+func (f *giftFile) Close() error {
+	if c, ok := f.Content.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// openGiftFile looks up a gift's payload without reading it. Blobs are read
+// lazily and only for the byte ranges requested, so seeking through a large
+// video does not load the whole file.
+func openGiftFile(giftID int) (*giftFile, error) {
+	var (
+		f          giftFile
+		storageKey sql.NullString
+		fileSize   sql.NullInt64
+		uploadTime sql.NullTime
+	)
+	err := db.QueryRow("SELECT file_name, storage_key, file_size, COALESCE(mime_type, ''), upload_time FROM gifts WHERE id = ?", giftID).
+		Scan(&f.Name, &storageKey, &fileSize, &f.MimeType, &uploadTime)
+	if err != nil {
+		return nil, err
+	}
+	if uploadTime.Valid {
+		f.ModTime = uploadTime.Time
+	}
+
+	// Text memories download as an HTML document.
+	memory, err := loadTextMemory(giftID)
+	if err != nil {
+		return nil, err
+	}
+	if memory != nil {
+		f.Name, f.MimeType = memory.Title+".html", "text/html; charset=utf-8"
+		f.setContent([]byte(memoryDocument("", []textMemory{*memory})))
+		return &f, nil
+	}
+
+	if storageKey.Valid && storageKey.String != "" && fileSize.Valid {
+		if err := f.setStoredContent(storageKey.String, fileSize.Int64); err != nil {
+			return nil, err
+		}
+		return &f, nil
+	}
+
+	// Legacy gifts keep their payload in file_data, and gifts stored before
+	// sizes were recorded need one full read to learn it.
+	_, data, err := readGiftData(giftID)
+	if err != nil {
+		return nil, err
+	}
+	if storageKey.Valid && storageKey.String != "" {
+		if _, err := db.Exec("UPDATE gifts SET file_size = ? WHERE id = ?", len(data), giftID); err != nil {
+			log.Printf("Error recording size of gift %d: %v", giftID, err)
+		}
+	}
+	f.setContent(data)
+	return &f, nil
+}
+
+// openGiftAttachmentFile is openGiftFile for one attachment of a gift bundle.
+func openGiftAttachmentFile(giftID, attachmentID int) (*giftFile, error) {
+	if err := ensureGiftAttachments(giftID); err != nil {
+		return nil, err
+	}
+	var (
+		f         giftFile
+		a         giftAttachment
+		fileSize  sql.NullInt64
+		createdAt int64
+	)
+	err := db.QueryRow("SELECT file_name, storage_key, file_size, COALESCE(mime_type, ''), created_at FROM gift_attachments WHERE id = ? AND gift_id = ?",
+		attachmentID, giftID).Scan(&f.Name, &a.storageKey, &fileSize, &f.MimeType, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	f.ModTime = time.Unix(createdAt, 0)
+
+	if a.storageKey.Valid && a.storageKey.String != "" && fileSize.Valid {
+		if err := f.setStoredContent(a.storageKey.String, fileSize.Int64); err != nil {
+			return nil, err
+		}
+		return &f, nil
+	}
+	rc, err := openAttachmentData(giftID, a)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("UPDATE gift_attachments SET file_size = ? WHERE id = ?", len(data), attachmentID); err != nil {
+		log.Printf("Error recording size of attachment %d: %v", attachmentID, err)
+	}
+	f.setContent(data)
+	return &f, nil
+}
+
+// setStoredContent serves the file from giftStore, reading only the ranges requested.
+func (f *giftFile) setStoredContent(storageKey string, size int64) error {
+	content, err := giftBlobReadSeeker(storageKey, size)
+	if err != nil {
+		return err
+	}
+	f.Size = size
+	// Storage keys are never reused, so the key identifies the content.
+	f.ETag = `"` + path.Base(storageKey) + `"`
+	f.Content = content
+	return nil
+}
+
+// setContent serves a file that has already been read into memory.
+func (f *giftFile) setContent(data []byte) {
+	sum := sha256.Sum256(data)
+	f.Size = int64(len(data))
+	f.ETag = `"` + hex.EncodeToString(sum[:16]) + `"`
+	f.Content = bytes.NewReader(data)
+}
+
+// blobReadSeeker reads a blob of known size through blobStore.OpenRange,
+// reopening the stored object at the new offset after each Seek.
+type blobReadSeeker struct {
+	store  blobStore
+	key    string
+	size   int64
+	offset int64
+	rc     io.ReadCloser
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.rc == nil {
+		rc, err := b.store.OpenRange(b.key, b.offset, b.size-b.offset)
+		if err != nil {
+			return 0, err
+		}
+		b.rc = rc
+	}
+	n, err := b.rc.Read(p)
+	b.offset += int64(n)
+	if err == io.EOF && b.offset < b.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	if offset != b.offset {
+		b.Close()
+		b.offset = offset
+	}
+	return offset, nil
+}
+
+func (b *blobReadSeeker) Close() error {
+	if b.rc == nil {
+		return nil
+	}
+	err := b.rc.Close()
+	b.rc = nil
+	return err
+}
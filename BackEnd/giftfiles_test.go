@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func giftUploadRequest(fields [][2]string, fileContent string) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for _, field := range fields {
+		if field[0] == "file" {
+			part, _ := writer.CreateFormFile("file", field[1])
+			_, _ = part.Write([]byte(fileContent))
+			continue
+		}
+		_ = writer.WriteField(field[0], field[1])
+	}
+	writer.Close()
+	req := httptest.NewRequest("POST", "/upload-gift", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	authenticate(req, 1)
+	return req
+}
+
+func TestUploadGiftStreamsFileBeforeFields(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	req := giftUploadRequest([][2]string{{"file", "memory.mp4"}, {"emailMessage", "Sent after the file"}}, "video bytes")
+	rec := httptest.NewRecorder()
+	requireAuth(uploadGiftHandler)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var name, message string
+	var size int64
+	_ = db.QueryRow("SELECT file_name, custom_message, file_size FROM gifts WHERE user_id = 1").Scan(&name, &message, &size)
+	if name != "memory.mp4" || message != "Sent after the file" || size != int64(len("video bytes")) {
+		t.Errorf("Unexpected stored gift: %q %q %d", name, message, size)
+	}
+}
+
+func TestUploadGiftRejectsOversizedFile(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	previous := maxGiftUploadBytes
+	maxGiftUploadBytes = 10
+	t.Cleanup(func() { maxGiftUploadBytes = previous })
+
+	req := giftUploadRequest([][2]string{{"file", "big.txt"}}, strings.Repeat("x", 11))
+	rec := httptest.NewRecorder()
+	requireAuth(uploadGiftHandler)(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected status 413, got %d", rec.Code)
+	}
+
+	var gifts, blobs int
+	_ = db.QueryRow("SELECT COUNT(*) FROM gifts").Scan(&gifts)
+	_ = db.QueryRow("SELECT COUNT(*) FROM blobs").Scan(&blobs)
+	if gifts != 0 || blobs != 0 {
+		t.Errorf("Expected nothing stored for a rejected upload, got %d gifts and %d blobs", gifts, blobs)
+	}
+}
+
+func downloadGift(headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/download-gift?id=1", nil)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	authenticate(req, 1)
+	rec := httptest.NewRecorder()
+	requireAuth(downloadGiftHandler)(rec, req)
+	return rec
+}
+
+func TestDownloadGiftRangeAndConditionalRequests(t *testing.T) {
+	for name, store := range testBlobStores(t) {
+		_, _ = db.Exec("DELETE FROM gifts")
+		_ = insertUserWithID(1, "Sahil_1234", "pass")
+		giftStore = store
+		_, _ = store.Put("gifts/0123abcd", strings.NewReader("0123456789"))
+		_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, storage_key, file_size) VALUES (1, 1, 'clip.mp4', 'gifts/0123abcd', 10)")
+
+		rec := downloadGift(map[string]string{"Range": "bytes=2-5"})
+		if rec.Code != http.StatusPartialContent || rec.Body.String() != "2345" {
+			t.Errorf("%s: expected 206 with bytes 2-5, got %d %q", name, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+			t.Errorf("%s: unexpected Content-Range %q", name, got)
+		}
+
+		rec = downloadGift(map[string]string{"Range": "bytes=7-"})
+		if rec.Body.String() != "789" {
+			t.Errorf("%s: expected the tail of the file, got %q", name, rec.Body.String())
+		}
+
+		full := downloadGift(nil)
+		if full.Code != http.StatusOK || full.Body.String() != "0123456789" || full.Header().Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s: expected the whole file, got %d %q", name, full.Code, full.Body.String())
+		}
+		rec = downloadGift(map[string]string{"If-None-Match": full.Header().Get("ETag")})
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s: expected 304 for a matching ETag, got %d", name, rec.Code)
+		}
+		rec = downloadGift(map[string]string{"If-Modified-Since": full.Header().Get("Last-Modified")})
+		if rec.Code != http.StatusNotModified {
+			t.Errorf("%s: expected 304 for an unchanged file, got %d", name, rec.Code)
+		}
+	}
+}
+
+func TestDownloadLegacyGiftSupportsRanges(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, file_data) VALUES (1, 1, 'old.txt', ?)", []byte("legacy bytes"))
+
+	rec := downloadGift(map[string]string{"Range": "bytes=0-5"})
+	if rec.Code != http.StatusPartialContent || rec.Body.String() != "legacy" {
+		t.Errorf("Expected 206 with the first six bytes, got %d %q", rec.Code, rec.Body.String())
+	}
+}
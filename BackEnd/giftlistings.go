@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /gifts and /gift-calendar list the signed-in user's gifts a page at a
+// time. Both take the same filters and sort options and answer with a
+// giftListPage. Pages are cursor based: a cursor holds the sort value and id
+// of the last gift of a page, and the next page starts after that gift, so
+// gifts added or removed meanwhile do not shift the pages.
+
+const (
+	defaultGiftPageSize = 50
+	maxGiftPageSize     = 200
+)
+
+// giftSorts maps the sort option to the SQL it sorts by. NULLs become empty
+// strings so that cursors can compare them.
+var giftSorts = map[string]string{
+	"uploadTime":       "COALESCE(g.upload_time, '')",
+	"scheduledRelease": "COALESCE(g.scheduled_release, '')",
+	"name":             "COALESCE(g.file_name, '') COLLATE NOCASE",
+}
+
+// giftStatusFilters maps the status option to its condition.
+var giftStatusFilters = map[string]string{
+	"pending":   "g.pending = 1 AND g.cancelled = 0",
+	"delivered": "g.pending = 0",
+	"cancelled": "g.pending = 1 AND g.cancelled = 1",
+}
+
+// giftListPage is the response of the gift listings.
+type giftListPage struct {
+	Items      interface{} `json:"items"`
+	NextCursor *string     `json:"nextCursor"` // null on the last page
+	Total      int         `json:"total"`      // gifts matching the filters, on all pages
+}
+
+// giftListQuery is a parsed listing request.
+type giftListQuery struct {
+	where   []string
+	args    []interface{}
+	sortSQL string
+	desc    bool
+	limit   int
+	key     string // the filters and sort, which a cursor must match
+	after   *giftCursor
+}
+
+type giftCursor struct {
+	Key   string `json:"k"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+// parseGiftListQuery reads the filters, sort, limit and cursor of a listing
+// of userID's gifts. Errors are meant for the client.
+//
+//	status=pending|delivered|cancelled
+//	receiver=a@b.com                  gifts sent to that address
+//	type=file|text
+//	scheduledFrom, scheduledTo        dates (2006-01-02, inclusive) or RFC 3339 times
+//	sort=uploadTime|scheduledRelease|name, order=asc|desc
+//	limit, cursor
+func parseGiftListQuery(values url.Values, userID int, defaultSort, defaultOrder string) (giftListQuery, error) {
+	q := giftListQuery{
+		where: []string{"g.user_id = ?", "g.deleted_at IS NULL"},
+		args:  []interface{}{userID},
+		limit: defaultGiftPageSize,
+	}
+	key := url.Values{}
+
+	if status := values.Get("status"); status != "" {
+		condition, ok := giftStatusFilters[status]
+		if !ok {
+			return q, errors.New("Invalid status; use pending, delivered or cancelled")
+		}
+		q.where = append(q.where, condition)
+		key.Set("status", status)
+	}
+	if receiver := strings.TrimSpace(values.Get("receiver")); receiver != "" {
+		// receivers is a comma separated list of addresses.
+		q.where = append(q.where, "instr(',' || lower(replace(COALESCE(g.receivers, ''), ' ', '')) || ',', ',' || lower(?) || ',') > 0")
+		q.args = append(q.args, receiver)
+		key.Set("receiver", strings.ToLower(receiver))
+	}
+	if giftType := values.Get("type"); giftType != "" {
+		if giftType != giftTypeFile && giftType != giftTypeText {
+			return q, errors.New("Invalid type; use file or text")
+		}
+		q.where = append(q.where, "COALESCE(g.gift_type, 'file') = ?")
+		q.args = append(q.args, giftType)
+		key.Set("type", giftType)
+	}
+	for _, bound := range []struct {
+		param, op string
+		endOfDay  bool
+	}{{"scheduledFrom", ">=", false}, {"scheduledTo", "<", true}} {
+		value := values.Get(bound.param)
+		if value == "" {
+			continue
+		}
+		t, err := parseScheduleBound(value, bound.endOfDay)
+		if err != nil {
+			return q, errors.New("Invalid " + bound.param + "; use a date like 2030-01-31 or an RFC 3339 time")
+		}
+		q.where = append(q.where, "g.scheduled_release IS NOT NULL AND g.scheduled_release "+bound.op+" ?")
+		q.args = append(q.args, t.Format("2006-01-02 15:04:05"))
+		key.Set(bound.param, value)
+	}
+
+	sort := values.Get("sort")
+	if sort == "" {
+		sort = defaultSort
+	}
+	var ok bool
+	if q.sortSQL, ok = giftSorts[sort]; !ok {
+		return q, errors.New("Invalid sort; use uploadTime, scheduledRelease or name")
+	}
+	order := values.Get("order")
+	if order == "" {
+		order = defaultOrder
+	}
+	if order != "asc" && order != "desc" {
+		return q, errors.New("Invalid order; use asc or desc")
+	}
+	q.desc = order == "desc"
+	key.Set("sort", sort)
+	key.Set("order", order)
+	q.key = key.Encode()
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return q, errors.New("Invalid limit")
+		}
+		q.limit = min(n, maxGiftPageSize)
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return q, errInvalidCursor
+		}
+		q.after = &giftCursor{}
+		if err := json.Unmarshal(data, q.after); err != nil {
+			return q, errInvalidCursor
+		}
+		if q.after.Key != q.key {
+			return q, errors.New("Cursor is for different filters or sort order")
+		}
+	}
+	return q, nil
+}
+
+// parseScheduleBound parses a scheduledFrom or scheduledTo value. A date
+// given as the end of a range includes that whole day.
+func parseScheduleBound(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil && endOfDay {
+		// The range includes the given time itself.
+		t = t.Add(time.Second)
+	}
+	return t, err
+}
+
+// listGiftPage selects columns (of gifts g) for one page of q, calling scan
+// for each row; scan returns the row's gift id. It returns the page without
+// its items.
+func listGiftPage(q giftListQuery, columns string, scan func(*sql.Rows) (int, error)) (giftListPage, error) {
+	var page giftListPage
+	where := strings.Join(q.where, " AND ")
+	if err := db.QueryRow("SELECT COUNT(*) FROM gifts g WHERE "+where, q.args...).Scan(&page.Total); err != nil {
+		return page, err
+	}
+
+	direction, compare := "ASC", ">"
+	if q.desc {
+		direction, compare = "DESC", "<"
+	}
+	args := append([]interface{}{}, q.args...)
+	if q.after != nil {
+		where += " AND (" + q.sortSQL + " " + compare + " ? OR (" + q.sortSQL + " = ? AND g.id " + compare + " ?))"
+		args = append(args, q.after.Value, q.after.Value, q.after.ID)
+	}
+	rows, err := db.Query("SELECT "+columns+" FROM gifts g WHERE "+where+
+		" ORDER BY "+q.sortSQL+" "+direction+", g.id "+direction+" LIMIT ?", append(args, q.limit+1)...)
+	if err != nil {
+		return page, err
+	}
+	defer rows.Close()
+	lastID, count := 0, 0
+	for rows.Next() {
+		if count == q.limit {
+			// There is another page after this one.
+			cursor := giftCursor{Key: q.key, ID: lastID}
+			rows.Close()
+			if err := db.QueryRow("SELECT "+q.sortSQL+" FROM gifts g WHERE g.id = ?", lastID).Scan(&cursor.Value); err != nil {
+				return page, err
+			}
+			data, _ := json.Marshal(cursor)
+			next := base64.RawURLEncoding.EncodeToString(data)
+			page.NextCursor = &next
+			return page, nil
+		}
+		if lastID, err = scan(rows); err != nil {
+			return page, err
+		}
+		count++
+	}
+	return page, rows.Err()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+type testGiftPage struct {
+	Items      []Gift  `json:"items"`
+	NextCursor *string `json:"nextCursor"`
+	Total      int     `json:"total"`
+}
+
+func listTestGifts(t *testing.T, query string) testGiftPage {
+	t.Helper()
+	rec := performAuthenticatedRequest(getGiftsHandler, "GET", "/gifts"+query, nil, 1)
+	var page testGiftPage
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected listing of %q %d: %s", query, rec.Code, rec.Body.String())
+	}
+	return page
+}
+
+func testGiftIDs(gifts []Gift) []int {
+	ids := []int{}
+	for _, g := range gifts {
+		ids = append(ids, g.ID)
+	}
+	return ids
+}
+
+func sameIDs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func insertListingTestGifts() {
+	_, _ = db.Exec(`INSERT INTO gifts (id, user_id, file_name, upload_time, pending, cancelled, receivers, scheduled_release, gift_type) VALUES
+		(1, 1, 'b.txt', '2025-01-01 10:00:00', 1, 0, 'Ann@example.com, bob@example.com', '2030-03-01 09:00:00', 'file'),
+		(2, 1, 'A.txt', '2025-01-02 10:00:00', 0, 0, 'bob@example.com', '2030-01-15 09:00:00', 'file'),
+		(3, 1, 'c memory', '2025-01-02 10:00:00', 1, 1, 'annie@example.com', NULL, 'text'),
+		(4, 1, 'd.txt', '2025-01-03 10:00:00', 1, 0, NULL, '2030-01-31 23:00:00', 'file'),
+		(5, 2, 'other.txt', '2025-01-04 10:00:00', 1, 0, 'ann@example.com', NULL, 'file')`)
+}
+
+func TestListGiftsPagesWithCursor(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	insertListingTestGifts()
+
+	var ids []int
+	query := "?limit=2"
+	for pages := 0; ; pages++ {
+		page := listTestGifts(t, query)
+		// Totals count gifts as of each page.
+		if page.Total != 4+pages || len(page.Items) > 2 {
+			t.Fatalf("Unexpected page %+v", page)
+		}
+		ids = append(ids, testGiftIDs(page.Items)...)
+		if page.NextCursor == nil {
+			break
+		}
+		if pages > 2 {
+			t.Fatal("Expected the cursor to reach the last page")
+		}
+		// Gifts added meanwhile do not shift the pages.
+		_, _ = db.Exec("INSERT INTO gifts (user_id, file_name, upload_time, pending) VALUES (1, 'new.txt', '2026-01-01 10:00:00', 1)")
+		query = "?limit=2&cursor=" + *page.NextCursor
+	}
+	// Newest first, ties broken by id.
+	if want := []int{4, 3, 2, 1}; !sameIDs(ids, want) {
+		t.Errorf("Expected %v, got %v", want, ids)
+	}
+}
+
+func TestListGiftsFiltersAndSorts(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	insertListingTestGifts()
+
+	cases := []struct {
+		query string
+		want  []int
+	}{
+		{"?status=pending", []int{4, 1}},
+		{"?status=delivered", []int{2}},
+		{"?status=cancelled", []int{3}},
+		{"?receiver=ANN@example.com", []int{1}}, // whole addresses only
+		{"?receiver=bob@example.com&status=pending", []int{1}},
+		{"?type=text", []int{3}},
+		{"?scheduledFrom=2030-01-15&scheduledTo=2030-01-31", []int{4, 2}},
+		{"?scheduledTo=2030-01-31T22:00:00Z", []int{2}},
+		{"?sort=name", []int{4, 3, 1, 2}},
+		{"?sort=name&order=asc", []int{2, 1, 3, 4}},
+		{"?sort=scheduledRelease&order=asc&limit=3", []int{3, 2, 4}},
+	}
+	for _, c := range cases {
+		if got := testGiftIDs(listTestGifts(t, c.query).Items); !sameIDs(got, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.query, c.want, got)
+		}
+	}
+
+	// The calendar takes the same options, soonest release first.
+	rec := performAuthenticatedRequest(giftCalendarHandler, "GET", "/gift-calendar?status=pending&limit=1", nil, 1)
+	var calendar struct {
+		Items []struct {
+			ID int `json:"id"`
+		} `json:"items"`
+		NextCursor *string `json:"nextCursor"`
+		Total      int     `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &calendar); err != nil || calendar.Total != 2 ||
+		len(calendar.Items) != 1 || calendar.Items[0].ID != 4 || calendar.NextCursor == nil {
+		t.Errorf("Unexpected calendar %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestListGiftsRefusesInvalidOptions(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	insertListingTestGifts()
+
+	cursor := *listTestGifts(t, "?limit=1").NextCursor
+	for _, query := range []string{"?status=lost", "?type=video", "?sort=size", "?order=up", "?limit=0", "?limit=x",
+		"?scheduledFrom=tomorrow", "?cursor=***", "?cursor=bm90IGpzb24", "?sort=name&cursor=" + cursor} {
+		if rec := performAuthenticatedRequest(getGiftsHandler, "GET", "/gifts"+query, nil, 1); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, rec.Code)
+		}
+		if rec := performAuthenticatedRequest(giftCalendarHandler, "GET", "/gift-calendar"+query, nil, 1); rec.Code != http.StatusBadRequest {
+			t.Errorf("calendar %s: expected 400, got %d", query, rec.Code)
+		}
+	}
+	if page := listTestGifts(t, "?limit=1000"); len(page.Items) != 4 {
+		t.Errorf("Expected large limits to be capped, got %d gifts", len(page.Items))
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Gifts are searchable by their name, the names of their files, their
+// message and the text of memories. gift_search is a full-text index with one
+// row per gift, its rowid being the gift's id, kept in sync by triggers on
+// gifts and gift_attachments so that every insert, update and delete is
+// reflected however it is made.
+//
+// The index uses SQLite's FTS5, which ranks results with bm25. The driver
+// only includes it when built with "-tags sqlite_fts5", as the Makefile does,
+// and the server refuses to start without it (see requireGiftSearchFTS5).
+// Tests and tools built without the tag get an FTS4 index, which finds the
+// same gifts but cannot rank them, so results come newest first.
+//
+// Memories sealed with their owner's data key (see sealMemory) cannot be
+// indexed as text without keeping it in the clear. For those, memory_terms
+// holds a keyed hash of every prefix of every word (see memorySearchTerms),
+// and a search hashes its words with the same key, so it still finds them,
+// without a snippet. Accents in sealed memories have to be typed as written.
+
+// giftSearchFTS5 is set by setupGiftSearch when the index uses FTS5.
+var giftSearchFTS5 bool
+
+const (
+	defaultGiftSearchLimit = 20
+	maxGiftSearchLimit     = 100
+	maxGiftSearchTerms     = 16
+	// maxMemoryTermPrefix is the longest word prefix hashed into memory_terms;
+	// longer search words are matched on their first this many letters.
+	maxMemoryTermPrefix = 16
+)
+
+// giftSearchColumns are the columns of gift_search, and giftSearchTextColumns
+// the ones holding searchable text rather than hashes.
+const giftSearchColumns = "file_name, attachment_names, custom_message, memory_text, memory_terms"
+
+var giftSearchTextColumns = []string{"file_name", "attachment_names", "custom_message", "memory_text"}
+
+// Snippets are marked with control characters, which cannot occur in the
+// indexed text, and the marks are turned into <mark> after escaping.
+const (
+	snippetMatchStart = "\x02"
+	snippetMatchEnd   = "\x03"
+)
+
+// giftSearchRowSQL selects a gift's row for gift_search. The text of sealed
+// memories is left out, and only their memory_terms are indexed.
+const giftSearchRowSQL = `
+	SELECT id, COALESCE(file_name, ''),
+		COALESCE((SELECT group_concat(file_name, ' ') FROM gift_attachments WHERE gift_id = gifts.id), ''),
+		COALESCE(custom_message, ''), CASE typeof(memory_text) WHEN 'text' THEN memory_text ELSE '' END,
+		COALESCE(memory_terms, '')
+	FROM gifts`
+
+// giftSearchTriggersSQL re-indexes a gift whenever it or its files change.
+var giftSearchTriggersSQL = []string{
+	`CREATE TRIGGER IF NOT EXISTS gift_search_insert AFTER INSERT ON gifts BEGIN
+		INSERT INTO gift_search (rowid, ` + giftSearchColumns + `) ` + giftSearchRowSQL + ` WHERE id = new.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS gift_search_update AFTER UPDATE OF file_name, custom_message, memory_text, memory_terms ON gifts BEGIN
+		DELETE FROM gift_search WHERE rowid = old.id;
+		INSERT INTO gift_search (rowid, ` + giftSearchColumns + `) ` + giftSearchRowSQL + ` WHERE id = new.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS gift_search_delete AFTER DELETE ON gifts BEGIN
+		DELETE FROM gift_search WHERE rowid = old.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS gift_search_attachment_insert AFTER INSERT ON gift_attachments BEGIN
+		DELETE FROM gift_search WHERE rowid = new.gift_id;
+		INSERT INTO gift_search (rowid, ` + giftSearchColumns + `) ` + giftSearchRowSQL + ` WHERE id = new.gift_id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS gift_search_attachment_update AFTER UPDATE OF file_name ON gift_attachments BEGIN
+		DELETE FROM gift_search WHERE rowid = new.gift_id;
+		INSERT INTO gift_search (rowid, ` + giftSearchColumns + `) ` + giftSearchRowSQL + ` WHERE id = new.gift_id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS gift_search_attachment_delete AFTER DELETE ON gift_attachments BEGIN
+		DELETE FROM gift_search WHERE rowid = old.gift_id;
+		INSERT INTO gift_search (rowid, ` + giftSearchColumns + `) ` + giftSearchRowSQL + ` WHERE id = old.gift_id;
+	END`,
+}
+
+var giftSearchTriggers = []string{"gift_search_insert", "gift_search_update", "gift_search_delete",
+	"gift_search_attachment_insert", "gift_search_attachment_update", "gift_search_attachment_delete"}
+
+// requireGiftSearchFTS5 fails unless the SQLite driver includes FTS5, so a
+// server built without the tag stops at startup instead of serving unranked
+// search results.
+func requireGiftSearchFTS5(db *sql.DB) error {
+	var fts5 bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&fts5); err != nil {
+		return err
+	}
+	if !fts5 {
+		return errors.New(`this server was built without SQLite FTS5, which gift search needs; build it with "make build" or "go build -tags sqlite_fts5"`)
+	}
+	return nil
+}
+
+// setupGiftSearch creates gift_search and its triggers, switching an FTS4
+// index to FTS5 once the driver supports it, and indexes any gifts missing
+// from it.
+func setupGiftSearch(db *sql.DB) error {
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&giftSearchFTS5); err != nil {
+		return err
+	}
+	module := "fts4"
+	createSQL := `CREATE VIRTUAL TABLE gift_search USING fts4(` + giftSearchColumns + `, tokenize=unicode61 "remove_diacritics=2")`
+	if giftSearchFTS5 {
+		module = "fts5"
+		createSQL = `CREATE VIRTUAL TABLE gift_search USING fts5(` + giftSearchColumns + `, tokenize = 'unicode61 remove_diacritics 2')`
+	}
+
+	// The triggers are made afresh every time, so changes to them apply to
+	// existing databases.
+	for _, trigger := range giftSearchTriggers {
+		if _, err := db.Exec("DROP TRIGGER IF EXISTS " + trigger); err != nil {
+			return err
+		}
+	}
+
+	var existing string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'gift_search'").Scan(&existing)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return err
+	case strings.Contains(strings.ToLower(existing), "using "+module) && strings.Contains(existing, "memory_terms"):
+		createSQL = ""
+	case strings.Contains(strings.ToLower(existing), "using "+module) || giftSearchFTS5:
+		// Rebuilt below with the current columns, as FTS5 if supported.
+		log.Println("Rebuilding the gift search index")
+		if _, err := db.Exec("DROP TABLE gift_search"); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("the gift search index uses FTS5; build with -tags sqlite_fts5")
+	}
+	if createSQL != "" {
+		if _, err := db.Exec(createSQL); err != nil {
+			return fmt.Errorf("failed to create gift_search table: %w", err)
+		}
+	}
+	for _, trigger := range giftSearchTriggersSQL {
+		if _, err := db.Exec(trigger); err != nil {
+			return fmt.Errorf("failed to create gift_search triggers: %w", err)
+		}
+	}
+
+	// Gifts stored before the index existed.
+	_, err = db.Exec(`INSERT INTO gift_search (rowid, ` + giftSearchColumns + `) ` +
+		giftSearchRowSQL + ` WHERE id NOT IN (SELECT rowid FROM gift_search)`)
+	return err
+}
+
+// giftSearchWords splits text into lowercase words, dropping punctuation.
+func giftSearchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// memoryTermPrefixes returns the prefixes of word hashed into memory_terms.
+func memoryTermPrefixes(word string) []string {
+	runes := []rune(word)
+	prefixes := make([]string, 0, min(len(runes), maxMemoryTermPrefix))
+	for n := 1; n <= len(runes) && n <= maxMemoryTermPrefix; n++ {
+		prefixes = append(prefixes, string(runes[:n]))
+	}
+	return prefixes
+}
+
+// memoryTermHasher returns the function hashing word prefixes for
+// memory_terms with a user's data key. Hashes are hex, so they are single
+// tokens to the index.
+func memoryTermHasher(dataKey []byte) func(prefix string) string {
+	return func(prefix string) string {
+		mac := hmac.New(sha256.New, dataKey)
+		mac.Write([]byte("memory-search:" + prefix))
+		return hex.EncodeToString(mac.Sum(nil)[:12])
+	}
+}
+
+// memorySearchTerms returns the memory_terms of a memory of ownerID's: the
+// sorted, distinct hashes of its word prefixes when memories are sealed, or
+// nil while encryption is off and the text itself is indexed.
+func memorySearchTerms(ownerID int, text string) (interface{}, error) {
+	if giftMasterKey == nil {
+		return nil, nil
+	}
+	dataKey, err := userDataKey(ownerID, true)
+	if err != nil {
+		return nil, err
+	}
+	hash := memoryTermHasher(dataKey)
+	seen := map[string]bool{}
+	for _, word := range giftSearchWords(text) {
+		for _, prefix := range memoryTermPrefixes(word) {
+			seen[hash(prefix)] = true
+		}
+	}
+	terms := make([]string, 0, len(seen))
+	for term := range seen {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, " "), nil
+}
+
+// giftSearchMatch turns what a user typed into an FTS query: every word must
+// occur, as a prefix, in any of the text columns, or, given the user's
+// memoryTerm hasher, as a hashed prefix in memory_terms. Punctuation and FTS
+// operators are dropped, so no input is a syntax error.
+func giftSearchMatch(query string, memoryTerm func(prefix string) string) string {
+	words := giftSearchWords(query)
+	if len(words) > maxGiftSearchTerms {
+		words = words[:maxGiftSearchTerms]
+	}
+	for i, word := range words {
+		var alternatives []string
+		for _, column := range giftSearchTextColumns {
+			alternatives = append(alternatives, column+":"+word+"*")
+		}
+		if memoryTerm != nil {
+			prefixes := memoryTermPrefixes(word)
+			alternatives = append(alternatives, "memory_terms:"+memoryTerm(prefixes[len(prefixes)-1]))
+		}
+		words[i] = "(" + strings.Join(alternatives, " OR ") + ")"
+	}
+	return strings.Join(words, " AND ")
+}
+
+// giftSearchResult is a gift found by /gifts/search.
+type giftSearchResult struct {
+	ID         int    `json:"id"`
+	FileName   string `json:"fileName"`
+	Type       string `json:"type"`
+	Pending    bool   `json:"pending"`
+	Cancelled  bool   `json:"cancelled"`
+	UploadTime string `json:"uploadTime"`
+	// Snippet is HTML: escaped text around the matches, which are in <mark>.
+	Snippet string `json:"snippet"`
+}
+
+// searchGifts returns the user's gifts matching query, best matches first,
+// leaving out gifts in the trash.
+func searchGifts(userID int, query string, limit int) ([]giftSearchResult, error) {
+	results := []giftSearchResult{}
+	// Users without a data key have no sealed memories.
+	var memoryTerm func(prefix string) string
+	dataKey, err := userDataKey(userID, false)
+	switch {
+	case err == nil:
+		memoryTerm = memoryTermHasher(dataKey)
+	case err != sql.ErrNoRows:
+		return nil, err
+	}
+	match := giftSearchMatch(query, memoryTerm)
+	if match == "" {
+		return results, nil
+	}
+	// The snippet comes from the first text column with a match; a match
+	// only in memory_terms has none.
+	snippet := "CASE"
+	for column := range giftSearchTextColumns {
+		columnSnippet := fmt.Sprintf("snippet(gift_search, '%s', '%s', '…', %d, 12)", snippetMatchStart, snippetMatchEnd, column)
+		if giftSearchFTS5 {
+			columnSnippet = fmt.Sprintf("snippet(gift_search, %d, '%s', '%s', '…', 12)", column, snippetMatchStart, snippetMatchEnd)
+		}
+		snippet += fmt.Sprintf(" WHEN instr(%s, '%s') THEN %s", columnSnippet, snippetMatchStart, columnSnippet)
+	}
+	snippet += " ELSE '' END"
+	order := "g.upload_time DESC, g.id DESC"
+	if giftSearchFTS5 {
+		// Names weigh more than messages, and messages more than memories.
+		order = "bm25(gift_search, 10.0, 5.0, 2.0, 1.0, 1.0), " + order
+	}
+	rows, err := db.Query(`
+		SELECT g.id, COALESCE(g.file_name, ''), COALESCE(g.gift_type, ?), g.pending, g.cancelled, COALESCE(g.upload_time, ''), `+snippet+`
+		FROM gift_search JOIN gifts g ON g.id = gift_search.rowid
+		WHERE gift_search MATCH ? AND g.user_id = ? AND g.deleted_at IS NULL
+		ORDER BY `+order+`
+		LIMIT ?`,
+		giftTypeFile, match, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r giftSearchResult
+		if err := rows.Scan(&r.ID, &r.FileName, &r.Type, &r.Pending, &r.Cancelled, &r.UploadTime, &r.Snippet); err != nil {
+			return nil, err
+		}
+		r.Snippet = strings.NewReplacer(snippetMatchStart, "<mark>", snippetMatchEnd, "</mark>").Replace(html.EscapeString(r.Snippet))
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// giftSearchHandler handles GET /gifts/search?q=summer+lake&limit=20,
+// searching the signed-in user's gifts.
+func giftSearchHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handleGet(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		http.Error(w, "Search query is required", http.StatusBadRequest)
+		return
+	}
+	limit := defaultGiftSearchLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxGiftSearchLimit)
+	}
+	results, err := searchGifts(userID, query, limit)
+	if err != nil {
+		log.Printf("Error searching gifts of user %d: %v", userID, err)
+		http.Error(w, "Error searching gifts", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func searchTestGifts(t *testing.T, userID int, query string) []giftSearchResult {
+	t.Helper()
+	rec := performAuthenticatedRequest(giftSearchHandler, "GET", "/gifts/search?q="+url.QueryEscape(query), nil, userID)
+	var results []giftSearchResult
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatalf("Unexpected search results for %q %d: %s", query, rec.Code, rec.Body.String())
+	}
+	return results
+}
+
+func searchResultIDs(results []giftSearchResult) []int {
+	ids := []int{}
+	for _, r := range results {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func TestSearchGifts(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	_ = uploadTestFile("lake-house.jpg", "photo")
+	_, _ = db.Exec("UPDATE gifts SET custom_message = 'For the <family> reunion' WHERE id = 1")
+	performAuthenticatedRequest(textGiftHandler, "POST", "/text-gift",
+		[]byte(`{"title": "Letter", "html": "<p>Remember the summer we spent at the café by the river?</p>"}`), 1)
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, custom_message, pending) VALUES (3, 2, 'summer.txt', 'summer', 1)")
+	if rec := addAttachmentRequest("1", "boat-trip.mp4", "video", "Sailing"); rec.Code != http.StatusOK {
+		t.Fatalf("Attachment failed: %d", rec.Code)
+	}
+
+	cases := []struct {
+		query string
+		want  []int
+	}{
+		{"lake", []int{1}},
+		{"REUNION", []int{1}},
+		{"summ", []int{2}},         // prefixes match; user 2's gift is not listed
+		{"cafe river", []int{2}},   // every word must match, accents are ignored
+		{"river reunion", []int{}}, // in different gifts
+		{"boat", []int{1}},         // files of a bundle
+		{`"summer*" (`, []int{2}},  // FTS syntax is ignored rather than an error
+		{"?!", []int{}},
+	}
+	for _, c := range cases {
+		got := searchResultIDs(searchTestGifts(t, 1, c.query))
+		if len(got) != len(c.want) || len(got) > 0 && got[0] != c.want[0] {
+			t.Errorf("Search %q: expected %v, got %v", c.query, c.want, got)
+		}
+	}
+
+	results := searchTestGifts(t, 1, "family")
+	if len(results) != 1 || results[0].Snippet != "For the &lt;<mark>family</mark>&gt; reunion" || results[0].Type != giftTypeFile {
+		t.Errorf("Unexpected result %+v", results)
+	}
+	if results := searchTestGifts(t, 1, "river"); len(results) != 1 || results[0].Type != giftTypeText || results[0].FileName != "Letter" {
+		t.Errorf("Unexpected memory result %+v", results)
+	}
+	if rec := performAuthenticatedRequest(giftSearchHandler, "GET", "/gifts/search?q=+", nil, 1); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty query to be refused, got %d", rec.Code)
+	}
+	if rec := performRequest(giftSearchHandler, "OPTIONS", "/gifts/search?q=lake", nil); rec.Code != http.StatusOK {
+		t.Errorf("Expected the CORS preflight to be answered, got %d", rec.Code)
+	}
+}
+
+func TestSearchIndexFollowsChanges(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = uploadTestFile("draft.txt", "first draft")
+	_ = uploadTestFile("other.txt", "other")
+
+	performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1", []byte(`{"fileName": "wedding.txt", "customMessage": "vows"}`), 1)
+	if ids := searchResultIDs(searchTestGifts(t, 1, "draft")); len(ids) != 0 {
+		t.Errorf("Expected the old name to be gone, got %v", ids)
+	}
+	if ids := searchResultIDs(searchTestGifts(t, 1, "wedding vows")); len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("Expected the new name and message to be found, got %v", ids)
+	}
+
+	// Trashed gifts are left out, and purged ones leave the index.
+	performAuthenticatedRequest(deleteGiftHandler, "DELETE", "/delete-gift?id=1", nil, 1)
+	if ids := searchResultIDs(searchTestGifts(t, 1, "wedding")); len(ids) != 0 {
+		t.Errorf("Expected trashed gifts to be left out, got %v", ids)
+	}
+	performAuthenticatedRequest(giftTrashHandler, "DELETE", "/gift-trash", nil, 1)
+	var indexed int
+	_ = db.QueryRow("SELECT COUNT(*) FROM gift_search").Scan(&indexed)
+	if indexed != 1 {
+		t.Errorf("Expected only the remaining gift indexed, found %d rows", indexed)
+	}
+
+	// Gifts stored before the index existed are indexed when it is created.
+	for _, trigger := range giftSearchTriggers {
+		_, _ = db.Exec("DROP TRIGGER " + trigger)
+	}
+	_, _ = db.Exec("DROP TABLE gift_search")
+	_, _ = db.Exec("INSERT INTO gifts (user_id, file_name, pending) VALUES (1, 'legacy.txt', 1)")
+	if err := setupGiftSearch(db); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchResultIDs(searchTestGifts(t, 1, "legacy")); len(ids) != 1 {
+		t.Errorf("Expected existing gifts to be indexed, got %v", ids)
+	}
+	if ids := searchResultIDs(searchTestGifts(t, 1, "other")); len(ids) != 1 {
+		t.Errorf("Expected existing gifts to be indexed once, got %v", ids)
+	}
+
+	// An index from before memory_terms is rebuilt with it.
+	_, _ = db.Exec("DROP TABLE gift_search")
+	module := "fts4"
+	if giftSearchFTS5 {
+		module = "fts5"
+	}
+	_, _ = db.Exec("CREATE VIRTUAL TABLE gift_search USING " + module + "(file_name, attachment_names, custom_message, memory_text)")
+	if err := setupGiftSearch(db); err != nil {
+		t.Fatal(err)
+	}
+	if ids := searchResultIDs(searchTestGifts(t, 1, "legacy")); len(ids) != 1 {
+		t.Errorf("Expected the rebuilt index to find gifts, got %v", ids)
+	}
+}
+
+func TestSearchRanksNamesFirst(t *testing.T) {
+	db, _ = setupTestDB()
+	if !giftSearchFTS5 {
+		t.Skip("ranking needs FTS5; run with -tags sqlite_fts5")
+	}
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, custom_message, pending, upload_time) VALUES (1, 1, 'a.txt', 'grandma made this', 1, '2025-01-01'), (2, 1, 'grandma.txt', '', 1, '2024-01-01')")
+	if ids := searchResultIDs(searchTestGifts(t, 1, "grandma")); len(ids) != 2 || ids[0] != 2 {
+		t.Errorf("Expected the gift named after the search first, got %v", ids)
+	}
+}
+
+func TestServerRequiresFTS5(t *testing.T) {
+	db, _ = setupTestDB()
+	if err := requireGiftSearchFTS5(db); (err == nil) != giftSearchFTS5 {
+		t.Errorf("Expected the server to start only with FTS5 (FTS5 %v), got %v", giftSearchFTS5, err)
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Gifts can be edited until they are delivered: the name and message can be
+// changed and the first file replaced. Each edit first saves the gift as it
+// was into gift_versions, so any earlier state can be listed and restored.
+// A version keeps its file in giftStore for as long as the version exists,
+// and only the newest maxGiftVersions versions of a gift are kept.
+
+const maxGiftVersions = 20
+
+var errGiftDelivered = errors.New("gift has already been delivered")
+
+// giftVersion is a saved earlier state of a gift.
+type giftVersion struct {
+	Version         int      `json:"version"`
+	FileName        string   `json:"fileName"`
+	CustomMessage   string   `json:"customMessage"`
+	HTML            string   `json:"html,omitempty"` // memory of a text gift
+	Size            int64    `json:"size"`
+	MimeType        string   `json:"mimeType"`
+	SHA256          string   `json:"sha256"`
+	MetadataRemoved []string `json:"metadataRemoved,omitempty"`
+	EditedBy        int      `json:"editedBy"`  // user whose edit replaced this version
+	CreatedAt       int64    `json:"createdAt"` // unix seconds the version was replaced
+
+	storageKey sql.NullString
+}
+
+// giftEdit is a change to a gift; nil fields are left as they are.
+type giftEdit struct {
+	FileName      *string
+	CustomMessage *string
+	File          *giftUpload // replaces the gift's first file
+	MemoryHTML    *string     // replaces a text gift's memory; sanitized by checkGiftEdit
+}
+
+// editGift applies an edit made by editorID, keeping the gift's previous
+// state as a new version, and returns that version's number. A new File is
+// registered in the content index as it is stored; on error it is released.
+func editGift(giftID, editorID int, edit giftEdit) (int, error) {
+	if err := ensureGiftAttachments(giftID); err != nil {
+		return 0, err
+	}
+	if err := storeLegacyGiftFile(giftID); err != nil {
+		return 0, err
+	}
+	var version int
+	var released []string
+	apply := func() (err error) {
+		version, released, err = applyGiftEdit(giftID, editorID, edit)
+		return err
+	}
+	var err error
+	if edit.File != nil {
+		err = storeDeduplicated(edit.File, apply)
+	} else {
+		err = apply()
+	}
+	if err != nil {
+		return 0, err
+	}
+	deleteGiftBlobs(released)
+	return version, nil
+}
+
+// applyGiftEdit saves the gift's current state as a version and applies the
+// edit in one transaction. It returns the storage keys no longer needed: the
+// replaced file's thumbnails and the files of versions pruned from the history.
+func applyGiftEdit(giftID, editorID int, edit giftEdit) (int, []string, error) {
+	// A new memory is sealed first, since sealing may create the owner's
+	// data key, which cannot be done inside the transaction.
+	var memoryHTML, memoryText, memoryTerms interface{}
+	if edit.MemoryHTML != nil {
+		var ownerID int
+		if err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ?", giftID).Scan(&ownerID); err != nil {
+			return 0, nil, err
+		}
+		var err error
+		if memoryHTML, memoryText, memoryTerms, err = sealTextMemory(ownerID, *edit.MemoryHTML, memoryPlainText(*edit.MemoryHTML)); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var pending bool
+	var giftType string
+	if err := tx.QueryRow("SELECT pending, COALESCE(gift_type, ?) FROM gifts WHERE id = ?", giftTypeFile, giftID).
+		Scan(&pending, &giftType); err != nil {
+		return 0, nil, err
+	}
+	if !pending {
+		return 0, nil, errGiftDelivered
+	}
+	isText := giftType == giftTypeText
+	if isText && edit.File != nil || !isText && edit.MemoryHTML != nil {
+		return 0, nil, errGiftType
+	}
+
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) + 1 FROM gift_versions WHERE gift_id = ?", giftID).Scan(&version); err != nil {
+		return 0, nil, err
+	}
+	if isText {
+		// Text memories have no attachments; the gift row holds everything.
+		_, err = tx.Exec(`
+			INSERT INTO gift_versions (gift_id, version, file_name, custom_message, memory_html, memory_text, edited_by, created_at)
+			SELECT id, ?, file_name, COALESCE(custom_message, ''), memory_html, memory_text, ?, ?
+			FROM gifts WHERE id = ?`,
+			version, editorID, timeNow().Unix(), giftID)
+		if err != nil {
+			return 0, nil, err
+		}
+		if edit.FileName != nil {
+			if _, err := tx.Exec("UPDATE gifts SET file_name = ? WHERE id = ?", *edit.FileName, giftID); err != nil {
+				return 0, nil, err
+			}
+		}
+		if edit.MemoryHTML != nil {
+			if _, err := tx.Exec("UPDATE gifts SET memory_html = ?, memory_text = ?, memory_terms = ? WHERE id = ?",
+				memoryHTML, memoryText, memoryTerms, giftID); err != nil {
+				return 0, nil, err
+			}
+		}
+		if edit.CustomMessage != nil {
+			if _, err := tx.Exec("UPDATE gifts SET custom_message = ? WHERE id = ?", *edit.CustomMessage, giftID); err != nil {
+				return 0, nil, err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM gift_versions WHERE gift_id = ? AND version <= ?", giftID, version-maxGiftVersions); err != nil {
+			return 0, nil, err
+		}
+		return version, nil, tx.Commit()
+	}
+
+	var attachmentID int
+	if err := tx.QueryRow("SELECT id FROM gift_attachments WHERE gift_id = ? ORDER BY position, id LIMIT 1", giftID).
+		Scan(&attachmentID); err != nil {
+		return 0, nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO gift_versions (gift_id, version, file_name, custom_message, storage_key, file_size, mime_type, sha256, metadata_removed, edited_by, created_at)
+		SELECT g.id, ?, a.file_name, COALESCE(g.custom_message, ''), a.storage_key, a.file_size, a.mime_type, a.sha256, a.metadata_removed, ?, ?
+		FROM gifts g JOIN gift_attachments a ON a.id = ?
+		WHERE g.id = ?`,
+		version, editorID, timeNow().Unix(), attachmentID, giftID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if edit.CustomMessage != nil {
+		if _, err := tx.Exec("UPDATE gifts SET custom_message = ? WHERE id = ?", *edit.CustomMessage, giftID); err != nil {
+			return 0, nil, err
+		}
+	}
+	if edit.FileName != nil {
+		if _, err := tx.Exec("UPDATE gift_attachments SET file_name = ? WHERE id = ?", *edit.FileName, attachmentID); err != nil {
+			return 0, nil, err
+		}
+	}
+	var released []string
+	if file := edit.File; file != nil {
+		// The old file's thumbnails go; the thumbnail job makes new ones.
+		released, err = queryStorageKeys(tx, "SELECT storage_key FROM gift_thumbnails WHERE attachment_id = ?", attachmentID)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, err := tx.Exec("DELETE FROM gift_thumbnails WHERE attachment_id = ?", attachmentID); err != nil {
+			return 0, nil, err
+		}
+		_, err = tx.Exec(`
+			UPDATE gift_attachments SET storage_key = ?, file_size = ?, mime_type = ?, sha256 = ?, metadata_removed = ?, thumbnail_state = NULL
+			WHERE id = ?`,
+			file.StorageKey, file.Size, file.MimeType, file.SHA256, file.Metadata.column(), attachmentID)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := syncGiftPrimaryFile(tx, giftID); err != nil {
+		return 0, nil, err
+	}
+
+	pruned, err := queryStorageKeys(tx, "SELECT storage_key FROM gift_versions WHERE gift_id = ? AND version <= ? AND storage_key IS NOT NULL",
+		giftID, version-maxGiftVersions)
+	if err != nil {
+		return 0, nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM gift_versions WHERE gift_id = ? AND version <= ?", giftID, version-maxGiftVersions); err != nil {
+		return 0, nil, err
+	}
+	return version, append(released, pruned...), tx.Commit()
+}
+
+// queryStorageKeys runs a query returning one storage key per row inside tx.
+func queryStorageKeys(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// storeLegacyGiftFile moves a gift's file still kept in gifts.file_data into
+// giftStore, so that versions can keep referring to it once it is replaced.
+func storeLegacyGiftFile(giftID int) error {
+	var ownerID int
+	var data []byte
+	err := db.QueryRow("SELECT user_id, file_data FROM gifts WHERE id = ? AND file_data IS NOT NULL", giftID).Scan(&ownerID, &data)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var upload giftUpload
+	if err := putGiftBlob(&upload, ownerID, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	upload.SHA256, upload.MimeType = hex.EncodeToString(sum[:]), detectContentType(data)
+	return storeDeduplicated(&upload, func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec("UPDATE gift_attachments SET storage_key = ?, file_size = ?, mime_type = COALESCE(mime_type, ?), sha256 = ? WHERE gift_id = ? AND storage_key IS NULL",
+			upload.StorageKey, upload.Size, upload.MimeType, upload.SHA256, giftID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE gifts SET file_data = NULL WHERE id = ?", giftID); err != nil {
+			return err
+		}
+		if err := syncGiftPrimaryFile(tx, giftID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// loadGiftVersions returns the gift's saved versions, newest first.
+func loadGiftVersions(giftID int) ([]giftVersion, error) {
+	var ownerID int
+	if err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ?", giftID).Scan(&ownerID); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`
+		SELECT version, file_name, custom_message, memory_html, COALESCE(file_size, 0), COALESCE(mime_type, ''), COALESCE(sha256, ''),
+			COALESCE(metadata_removed, ''), COALESCE(edited_by, 0), created_at, storage_key
+		FROM gift_versions WHERE gift_id = ? ORDER BY version DESC`, giftID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := []giftVersion{}
+	var memories []interface{}
+	for rows.Next() {
+		var v giftVersion
+		var metadataRemoved string
+		var memoryHTML interface{}
+		if err := rows.Scan(&v.Version, &v.FileName, &v.CustomMessage, &memoryHTML, &v.Size, &v.MimeType, &v.SHA256,
+			&metadataRemoved, &v.EditedBy, &v.CreatedAt, &v.storageKey); err != nil {
+			return nil, err
+		}
+		if metadataRemoved != "" {
+			v.MetadataRemoved = strings.Split(metadataRemoved, ",")
+		}
+		versions = append(versions, v)
+		memories = append(memories, memoryHTML)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	// Memories are opened once the rows are read, as that may load the data key.
+	for i := range versions {
+		if versions[i].HTML, err = openMemory(ownerID, memories[i]); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+var errUnknownVersion = errors.New("no such version of the gift")
+
+// restoreGiftVersion puts a saved version back, keeping the current state as
+// a new version in turn, and returns that new version's number.
+func restoreGiftVersion(giftID, editorID, version int) (int, error) {
+	versions, err := loadGiftVersions(giftID)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range versions {
+		if v.Version != version {
+			continue
+		}
+		edit := giftEdit{FileName: &v.FileName, CustomMessage: &v.CustomMessage}
+		if v.HTML != "" {
+			edit.MemoryHTML = &v.HTML
+		}
+		if v.storageKey.Valid {
+			// The restored file is counted again as the gift's current file,
+			// like any replacement, so it has to fit in the owner's quota.
+			var ownerID int
+			if err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ?", giftID).Scan(&ownerID); err != nil {
+				return 0, err
+			}
+			if err := checkStorageQuota(ownerID, v.Size); err != nil {
+				return 0, err
+			}
+			edit.File = &giftUpload{StorageKey: v.storageKey.String, Size: v.Size, MimeType: v.MimeType, SHA256: v.SHA256}
+			if v.MetadataRemoved != nil {
+				edit.File.Metadata = &metadataReport{Removed: v.MetadataRemoved}
+			}
+		}
+		// The file is already stored and referenced by the version, so it
+		// does not go through storeDeduplicated again.
+		saved, released, err := applyGiftEdit(giftID, editorID, edit)
+		if err != nil {
+			return 0, err
+		}
+		deleteGiftBlobs(released)
+		return saved, nil
+	}
+	return 0, errUnknownVersion
+}
+
+// editGiftHandler handles PATCH /edit-gift?id=1 for gifts not yet delivered.
+// A JSON body {"fileName": "...", "customMessage": "..."} changes either or
+// both; a multipart body with a "file" part replaces the gift's first file,
+// with optional "fileName" and "customMessage" fields. The gift as it was
+// before is kept as a version, see /gift-versions.
+func editGiftHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	giftID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+		return
+	}
+	roles, ok := authorizeGift(w, r, giftID, giftActionManage)
+	if !ok {
+		return
+	}
+	if !roles.Pending {
+		http.Error(w, "Delivered gifts cannot be edited", http.StatusConflict)
+		return
+	}
+	userID, _ := currentUserID(w, r)
+
+	var edit giftEdit
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); strings.HasPrefix(mediaType, "multipart/") {
+		// A replacement counts against the owner's quota, like an attachment.
+		var ownerID int
+		if err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ?", giftID).Scan(&ownerID); err != nil {
+			http.Error(w, "Gift not found", http.StatusNotFound)
+			return
+		}
+		upload, err := receiveGiftUpload(w, r, ownerID)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		edit.File, edit.FileName = &upload, &upload.FileName
+		if name, ok := upload.Fields["fileName"]; ok {
+			edit.FileName = &name
+		}
+		if message, ok := upload.Fields["customMessage"]; ok {
+			edit.CustomMessage = &message
+		}
+	} else {
+		var req struct {
+			FileName      *string `json:"fileName"`
+			CustomMessage *string `json:"customMessage"`
+			HTML          *string `json:"html"` // text memories only
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.FileName == nil && req.CustomMessage == nil && req.HTML == nil {
+			http.Error(w, "Nothing to change", http.StatusBadRequest)
+			return
+		}
+		edit.FileName, edit.CustomMessage, edit.MemoryHTML = req.FileName, req.CustomMessage, req.HTML
+	}
+
+	if err := checkGiftEdit(&edit); err != nil {
+		if edit.File != nil {
+			deleteGiftBlobs([]string{edit.File.StorageKey})
+		}
+		writeUploadError(w, err)
+		return
+	}
+	version, err := editGift(giftID, userID, edit)
+	if err != nil {
+		if err == errGiftDelivered {
+			http.Error(w, "Delivered gifts cannot be edited", http.StatusConflict)
+			return
+		}
+		if err == errGiftType {
+			http.Error(w, "Only files can be replaced in file gifts and only text in text memories", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Error editing gift %d: %v", giftID, err)
+		http.Error(w, "Failed to update gift", http.StatusInternalServerError)
+		return
+	}
+	if edit.File != nil {
+		queueThumbnails(int64(giftID))
+	}
+
+	response := map[string]interface{}{
+		"message": "Gift updated successfully",
+		"giftId":  giftID,
+		"version": version,
+	}
+	if edit.File != nil && edit.File.Metadata != nil {
+		response["metadata"] = edit.File.Metadata
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// checkGiftEdit validates the new name and message of an edit, trimming the name.
+func checkGiftEdit(edit *giftEdit) error {
+	if edit.FileName != nil {
+		name := strings.TrimSpace(*edit.FileName)
+		if name == "" {
+			return &uploadError{http.StatusBadRequest, "File name cannot be empty"}
+		}
+		if int64(len(name)) > maxGiftFieldBytes {
+			return &uploadError{http.StatusRequestEntityTooLarge, "File name is too long"}
+		}
+		if err := checkGiftFileName(name); err != nil {
+			return err
+		}
+		edit.FileName = &name
+	}
+	if edit.CustomMessage != nil && int64(len(*edit.CustomMessage)) > maxGiftFieldBytes {
+		return &uploadError{http.StatusRequestEntityTooLarge, "Message is too long"}
+	}
+	if edit.MemoryHTML != nil {
+		sanitized, _, err := sanitizeMemory(*edit.MemoryHTML)
+		if err != nil {
+			return err
+		}
+		edit.MemoryHTML = &sanitized
+	}
+	return nil
+}
+
+// giftVersionsHandler handles GET /gift-versions?giftId=1, listing the saved
+// versions of a gift newest first.
+func giftVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handleGet(w, r) {
+		return
+	}
+	giftID, err := strconv.Atoi(r.URL.Query().Get("giftId"))
+	if err != nil {
+		http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorizeGift(w, r, giftID, giftActionManage); !ok {
+		return
+	}
+	versions, err := loadGiftVersions(giftID)
+	if err != nil {
+		log.Printf("Error loading versions of gift %d: %v", giftID, err)
+		http.Error(w, "Error retrieving versions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(versions)
+}
+
+// giftVersionRestoreHandler handles POST /gift-versions/restore with
+// {"giftId": 1, "version": 2}. The state replaced by the restore is saved as
+// a new version, so a restore can itself be undone.
+func giftVersionRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	var req struct {
+		GiftID  int `json:"giftId"`
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	roles, ok := authorizeGift(w, r, req.GiftID, giftActionManage)
+	if !ok {
+		return
+	}
+	if !roles.Pending {
+		http.Error(w, "Delivered gifts cannot be edited", http.StatusConflict)
+		return
+	}
+	userID, _ := currentUserID(w, r)
+	version, err := restoreGiftVersion(req.GiftID, userID, req.Version)
+	switch {
+	case err == errUnknownVersion:
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	case err == errGiftDelivered:
+		http.Error(w, "Delivered gifts cannot be edited", http.StatusConflict)
+		return
+	case errors.As(err, new(*uploadError)):
+		writeUploadError(w, err)
+		return
+	case err != nil:
+		log.Printf("Error restoring version %d of gift %d: %v", req.Version, req.GiftID, err)
+		http.Error(w, "Failed to restore version", http.StatusInternalServerError)
+		return
+	}
+	queueThumbnails(int64(req.GiftID))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Version restored successfully",
+		"giftId":  req.GiftID,
+		"version": version,
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func replaceGiftFileRequest(giftID, name, content string, fields map[string]string) *httptest.ResponseRecorder {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for field, value := range fields {
+		_ = writer.WriteField(field, value)
+	}
+	part, _ := writer.CreateFormFile("file", name)
+	_, _ = part.Write([]byte(content))
+	writer.Close()
+	req := httptest.NewRequest("PATCH", "/edit-gift?id="+giftID, body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	authenticate(req, 1)
+	rec := httptest.NewRecorder()
+	requireAuth(editGiftHandler)(rec, req)
+	return rec
+}
+
+func listTestVersions(t *testing.T) []giftVersion {
+	rec := performAuthenticatedRequest(giftVersionsHandler, "GET", "/gift-versions?giftId=1", nil, 1)
+	var versions []giftVersion
+	if err := json.Unmarshal(rec.Body.Bytes(), &versions); err != nil {
+		t.Fatalf("Unexpected version list %d: %s", rec.Code, rec.Body.String())
+	}
+	return versions
+}
+
+func giftNameAndMessage() (string, string) {
+	var name, message string
+	_ = db.QueryRow("SELECT file_name, custom_message FROM gifts WHERE id = 1").Scan(&name, &message)
+	return name, message
+}
+
+func TestEditGiftKeepsVersions(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	if rec := uploadTestFile("draft.txt", "first draft"); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+
+	rec := performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1", []byte(`{"customMessage": "Read this first"}`), 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the message to be changed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = replaceGiftFileRequest("1", "final.txt", "final letter", map[string]string{"fileName": " letter.txt "})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the file to be replaced, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if name, message := giftNameAndMessage(); name != "letter.txt" || message != "Read this first" {
+		t.Errorf("Unexpected gift %q %q", name, message)
+	}
+	if body := downloadGift(nil).Body.String(); body != "final letter" {
+		t.Errorf("Expected the new file to download, got %q", body)
+	}
+
+	versions := listTestVersions(t)
+	if len(versions) != 2 || versions[0].Version != 2 || versions[0].CustomMessage != "Read this first" ||
+		versions[1].FileName != "draft.txt" || versions[1].CustomMessage != "" || versions[1].EditedBy != 1 {
+		t.Fatalf("Unexpected versions %+v", versions)
+	}
+
+	// Restoring saves the current state as a version too.
+	rec = performAuthenticatedRequest(giftVersionRestoreHandler, "POST", "/gift-versions/restore", []byte(`{"giftId": 1, "version": 1}`), 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the version to be restored, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if name, message := giftNameAndMessage(); name != "draft.txt" || message != "" || downloadGift(nil).Body.String() != "first draft" {
+		t.Errorf("Expected the first version back, got %q %q", name, message)
+	}
+	if versions := listTestVersions(t); len(versions) != 3 || versions[0].FileName != "letter.txt" {
+		t.Errorf("Expected the replaced state to be kept, got %+v", versions)
+	}
+	if blobs := countRows("blobs"); blobs != 2 {
+		t.Errorf("Expected both files to be kept for the history, found %d", blobs)
+	}
+
+	// Deleting the gift for good deletes its history and files.
+	purgeTestGift(t, "1")
+	if blobs, versions := countRows("blobs"), countRows("gift_versions"); blobs != 0 || versions != 0 {
+		t.Errorf("Expected everything deleted, found %d blobs and %d versions", blobs, versions)
+	}
+}
+
+func TestEditGiftRefusals(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, file_data, custom_message, pending) VALUES (1, 1, 'old.txt', 'legacy', 'hi', 1)")
+
+	cases := []struct {
+		body   string
+		userID int
+		status int
+	}{
+		{`{}`, 1, http.StatusBadRequest},
+		{`{"fileName": "  "}`, 1, http.StatusBadRequest},
+		{`{"fileName": "run.exe"}`, 1, http.StatusUnsupportedMediaType},
+		{`{"fileName": "mine.txt"}`, 2, http.StatusNotFound},
+		{`{"fileName": "new.txt"}`, 1, http.StatusOK},
+	}
+	for _, c := range cases {
+		rec := performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1", []byte(c.body), c.userID)
+		if rec.Code != c.status {
+			t.Errorf("%s by user %d: expected %d, got %d", c.body, c.userID, c.status, rec.Code)
+		}
+	}
+	// The legacy file moved into the store so the version can keep it.
+	var fileData []byte
+	_ = db.QueryRow("SELECT file_data FROM gifts WHERE id = 1").Scan(&fileData)
+	if versions := listTestVersions(t); len(versions) != 1 || fileData != nil || downloadGift(nil).Body.String() != "legacy" {
+		t.Errorf("Expected the legacy file in the store and one version, got %+v", versions)
+	}
+
+	_, _ = db.Exec("UPDATE gifts SET pending = 0 WHERE id = 1")
+	if rec := performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1", []byte(`{"customMessage": "late"}`), 1); rec.Code != http.StatusConflict {
+		t.Errorf("Expected delivered gifts to be refused, got %d", rec.Code)
+	}
+	rec := performAuthenticatedRequest(giftVersionRestoreHandler, "POST", "/gift-versions/restore", []byte(`{"giftId": 1, "version": 1}`), 1)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Expected restoring a delivered gift to be refused, got %d", rec.Code)
+	}
+}
+
+func TestGiftVersionsArePruned(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	if rec := uploadTestFile("v0.txt", "version 0"); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+	for i := 1; i <= maxGiftVersions+2; i++ {
+		if rec := replaceGiftFileRequest("1", "v.txt", "version "+string(rune('a'+i)), nil); rec.Code != http.StatusOK {
+			t.Fatalf("Edit %d failed: %d", i, rec.Code)
+		}
+	}
+	versions := listTestVersions(t)
+	if len(versions) != maxGiftVersions || versions[len(versions)-1].Version != 3 {
+		t.Errorf("Expected the newest %d versions, got %d from version %d", maxGiftVersions, len(versions), versions[len(versions)-1].Version)
+	}
+	if blobs := countRows("blobs"); blobs != maxGiftVersions+1 {
+		t.Errorf("Expected the files of pruned versions deleted, found %d blobs", blobs)
+	}
+}
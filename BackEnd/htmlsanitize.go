@@ -0,0 +1,469 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Text memories are written in the rich text editor on the write-memory page
+// and arrive as HTML. They are shown to receivers in emails and in the app, so
+// the HTML is rebuilt from an allowlist before it is stored: only the
+// formatting the editor produces survives, every attribute value is checked,
+// and everything else is dropped. Elements that are not allowed lose their
+// tags but keep their text, except for script-like elements, which are
+// dropped whole.
+
+// allowedMemoryTags lists the elements a memory may contain, with the
+// attributes each may keep.
+var allowedMemoryTags = map[string][]string{
+	"p": {"style"}, "h1": {"style"}, "h2": {"style"}, "h3": {"style"},
+	"h4": {"style"}, "h5": {"style"}, "h6": {"style"},
+	"blockquote": nil, "pre": nil, "code": nil, "hr": nil, "br": nil,
+	"ul": nil, "ol": {"start"}, "li": {"style"},
+	"strong": nil, "b": nil, "em": nil, "i": nil, "u": nil, "s": nil, "strike": nil, "del": nil,
+	"mark": nil, "sub": nil, "sup": nil, "span": nil,
+	"a": {"href", "title"},
+}
+
+// voidMemoryTags have no content and no end tag.
+var voidMemoryTags = map[string]bool{"br": true, "hr": true}
+
+// droppedMemoryTags are removed together with everything inside them.
+var droppedMemoryTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true, "embed": true,
+	"noscript": true, "template": true, "textarea": true, "select": true,
+	"svg": true, "math": true, "head": true, "title": true, "xmp": true,
+}
+
+// allowedLinkSchemes are the URL schemes links in a memory may use.
+var allowedLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// htmlToken is a piece of an HTML document: text, a start tag or an end tag.
+// Text is raw, with its character references not yet decoded.
+type htmlToken struct {
+	text       string
+	tag        string // lower case; empty for text
+	end        bool
+	selfClosed bool
+	attrs      [][2]string // decoded name and value pairs
+}
+
+// tokenizeHTML splits an HTML fragment into tokens. It is lenient the way
+// browsers are: a "<" that does not start a tag is text, comments, doctypes
+// and processing instructions are skipped, and the content of raw text
+// elements such as script is returned as a single text token.
+func tokenizeHTML(s string) []htmlToken {
+	var tokens []htmlToken
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			tokens = append(tokens, htmlToken{text: s})
+			break
+		}
+		if i > 0 {
+			tokens = append(tokens, htmlToken{text: s[:i]})
+			s = s[i:]
+		}
+		switch {
+		case strings.HasPrefix(s, "<!--"):
+			end := strings.Index(s[4:], "-->")
+			if end < 0 {
+				return tokens
+			}
+			s = s[4+end+3:]
+		case strings.HasPrefix(s, "<!") || strings.HasPrefix(s, "<?"):
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return tokens
+			}
+			s = s[end+1:]
+		case len(s) > 2 && s[1] == '/' && isASCIILetter(s[2]):
+			name, rest := readTagName(s[2:])
+			end := strings.IndexByte(rest, '>')
+			if end < 0 {
+				return tokens
+			}
+			tokens = append(tokens, htmlToken{tag: name, end: true})
+			s = rest[end+1:]
+		case len(s) > 1 && isASCIILetter(s[1]):
+			var tok htmlToken
+			var ok bool
+			tok, s, ok = readStartTag(s[1:])
+			if !ok {
+				return tokens
+			}
+			tokens = append(tokens, tok)
+			if droppedMemoryTags[tok.tag] && !tok.selfClosed {
+				// Raw text elements end at their end tag, whatever they contain.
+				end := indexFold(s, "</"+tok.tag)
+				if end < 0 {
+					return tokens
+				}
+				tokens = append(tokens, htmlToken{text: s[:end]})
+				s = s[end:]
+			}
+		default:
+			tokens = append(tokens, htmlToken{text: "<"})
+			s = s[1:]
+		}
+	}
+	return tokens
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func isHTMLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// indexFold is strings.Index ignoring ASCII case.
+func indexFold(s, substr string) int {
+	return strings.Index(strings.ToLower(s), strings.ToLower(substr))
+}
+
+func readTagName(s string) (string, string) {
+	i := 0
+	for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '/' && s[i] != '>' {
+		i++
+	}
+	return strings.ToLower(s[:i]), s[i:]
+}
+
+// readStartTag parses a start tag after its "<" and returns the rest of s.
+func readStartTag(s string) (htmlToken, string, bool) {
+	var tok htmlToken
+	tok.tag, s = readTagName(s)
+	for {
+		for len(s) > 0 && isHTMLSpace(s[0]) {
+			s = s[1:]
+		}
+		if len(s) == 0 {
+			return tok, s, false
+		}
+		switch {
+		case s[0] == '>':
+			return tok, s[1:], true
+		case strings.HasPrefix(s, "/>"):
+			tok.selfClosed = true
+			return tok, s[2:], true
+		case s[0] == '/':
+			s = s[1:]
+			continue
+		}
+		i := 0
+		for i < len(s) && !isHTMLSpace(s[i]) && s[i] != '=' && s[i] != '>' && (s[i] != '/' || i == 0) {
+			i++
+		}
+		name := strings.ToLower(s[:i])
+		s = s[i:]
+		for len(s) > 0 && isHTMLSpace(s[0]) {
+			s = s[1:]
+		}
+		value := ""
+		if strings.HasPrefix(s, "=") {
+			s = s[1:]
+			for len(s) > 0 && isHTMLSpace(s[0]) {
+				s = s[1:]
+			}
+			if len(s) > 0 && (s[0] == '"' || s[0] == '\'') {
+				end := strings.IndexByte(s[1:], s[0])
+				if end < 0 {
+					return tok, "", false
+				}
+				value, s = s[1:1+end], s[2+end:]
+			} else {
+				j := 0
+				for j < len(s) && !isHTMLSpace(s[j]) && s[j] != '>' {
+					j++
+				}
+				value, s = s[:j], s[j:]
+			}
+		}
+		tok.attrs = append(tok.attrs, [2]string{name, html.UnescapeString(value)})
+	}
+}
+
+// sanitizeMemoryHTML rebuilds a memory's HTML from allowedMemoryTags. The
+// result is well formed: every element it opens is closed, in order.
+func sanitizeMemoryHTML(s string) string {
+	var b strings.Builder
+	var open []string
+	dropping := ""
+	for _, tok := range tokenizeHTML(s) {
+		switch {
+		case dropping != "":
+			if tok.end && tok.tag == dropping {
+				dropping = ""
+			}
+		case tok.tag == "":
+			b.WriteString(html.EscapeString(html.UnescapeString(tok.text)))
+		case droppedMemoryTags[tok.tag]:
+			if !tok.end && !tok.selfClosed {
+				dropping = tok.tag
+			}
+		case !hasMemoryTag(tok.tag):
+			// Unknown elements keep their content only.
+		case tok.end:
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] != tok.tag {
+					continue
+				}
+				for j := len(open) - 1; j >= i; j-- {
+					b.WriteString("</" + open[j] + ">")
+				}
+				open = open[:i]
+				break
+			}
+		default:
+			b.WriteString("<" + tok.tag)
+			for _, attr := range sanitizeMemoryAttrs(tok) {
+				b.WriteString(" " + attr[0] + `="` + html.EscapeString(attr[1]) + `"`)
+			}
+			b.WriteString(">")
+			if !voidMemoryTags[tok.tag] {
+				open = append(open, tok.tag)
+			}
+		}
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		b.WriteString("</" + open[i] + ">")
+	}
+	return b.String()
+}
+
+func hasMemoryTag(tag string) bool {
+	_, ok := allowedMemoryTags[tag]
+	return ok
+}
+
+// sanitizeMemoryAttrs returns the allowed attributes of a start tag with
+// values that are safe to keep. Links get a rel attribute so a receiver
+// following one does not give the opened page access to the memory.
+func sanitizeMemoryAttrs(tok htmlToken) [][2]string {
+	var attrs [][2]string
+	seen := map[string]bool{}
+	for _, attr := range tok.attrs {
+		name, value := attr[0], attr[1]
+		if seen[name] || !containsString(allowedMemoryTags[tok.tag], name) {
+			continue
+		}
+		switch name {
+		case "href":
+			if !safeMemoryLink(value) {
+				continue
+			}
+		case "style":
+			if value = memoryTextAlign(value); value == "" {
+				continue
+			}
+		case "start":
+			if !isDigits(value) || len(value) > 9 {
+				continue
+			}
+		}
+		seen[name] = true
+		attrs = append(attrs, [2]string{name, value})
+	}
+	if tok.tag == "a" && seen["href"] {
+		attrs = append(attrs, [2]string{"rel", "noopener noreferrer nofollow"})
+	}
+	return attrs
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// safeMemoryLink reports whether a link is absolute with an allowed scheme.
+// Control characters and spaces are rejected outright, since browsers strip
+// them from schemes ("java\tscript:").
+func safeMemoryLink(link string) bool {
+	for i := 0; i < len(link); i++ {
+		if link[i] <= ' ' || link[i] == 0x7F {
+			return false
+		}
+	}
+	u, err := url.Parse(link)
+	return err == nil && allowedLinkSchemes[strings.ToLower(u.Scheme)]
+}
+
+// memoryTextAlign keeps only a text-align declaration from a style attribute,
+// which is the only style the editor writes.
+func memoryTextAlign(style string) string {
+	for _, declaration := range strings.Split(style, ";") {
+		property, value, ok := strings.Cut(declaration, ":")
+		if !ok || strings.ToLower(strings.TrimSpace(property)) != "text-align" {
+			continue
+		}
+		switch value = strings.ToLower(strings.TrimSpace(value)); value {
+		case "left", "right", "center", "justify":
+			return "text-align: " + value
+		}
+	}
+	return ""
+}
+
+// memoryBlockTags start on a new line in the plain text rendering.
+var memoryBlockTags = map[string]bool{
+	"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"blockquote": true, "pre": true, "ul": true, "ol": true, "hr": true,
+}
+
+// memoryPlainText renders sanitized memory HTML as plain text for email
+// clients that do not show HTML: paragraphs are separated by blank lines,
+// list items start with "- " or their number, and links are followed by
+// their address.
+func memoryPlainText(s string) string {
+	var b strings.Builder
+	type list struct{ next int } // next is 0 for bullet lists
+	type link struct {
+		href  string
+		start int // where the link's text starts in b
+	}
+	var lists []list
+	var links []link
+	// newlines makes the text end in at least n line breaks, unless it is empty.
+	// Trailing spaces are dropped, so open links that started in them start at
+	// the new end of the text.
+	newlines := func(n int) {
+		text := strings.TrimRight(b.String(), " ")
+		for i := range links {
+			links[i].start = min(links[i].start, len(text))
+		}
+		if text == "" {
+			b.Reset()
+			return
+		}
+		have := len(text) - len(strings.TrimRight(text, "\n"))
+		b.Reset()
+		b.WriteString(text)
+		for ; have < n; have++ {
+			b.WriteByte('\n')
+		}
+	}
+	pre := 0
+	markerEnd := -1 // where the text of the current list item starts
+	for _, tok := range tokenizeHTML(s) {
+		if tok.tag == "" {
+			text := html.UnescapeString(tok.text)
+			if pre == 0 {
+				text = strings.Join(strings.FieldsFunc(text, func(r rune) bool { return r < 0x80 && isHTMLSpace(byte(r)) }), " ")
+				if len(tok.text) > 0 && isHTMLSpace(tok.text[0]) {
+					text = " " + text
+				}
+				if len(tok.text) > 1 && isHTMLSpace(tok.text[len(tok.text)-1]) && text != " " {
+					text += " "
+				}
+				if current := b.String(); current == "" || strings.HasSuffix(current, "\n") || strings.HasSuffix(current, " ") {
+					text = strings.TrimLeft(text, " ")
+				}
+			}
+			b.WriteString(text)
+			continue
+		}
+		switch tok.tag {
+		case "br":
+			b.WriteByte('\n')
+		case "hr":
+			newlines(2)
+			b.WriteString("---")
+			newlines(2)
+		case "pre":
+			if tok.end {
+				pre--
+			} else {
+				pre++
+			}
+			newlines(2)
+		case "ul", "ol":
+			if tok.end {
+				if len(lists) > 0 {
+					lists = lists[:len(lists)-1]
+				}
+			} else {
+				l := list{}
+				if tok.tag == "ol" {
+					l.next = 1
+					for _, attr := range tok.attrs {
+						if n, err := strconv.Atoi(attr[1]); attr[0] == "start" && err == nil {
+							l.next = n
+						}
+					}
+				}
+				lists = append(lists, l)
+			}
+			if len(lists) == 0 {
+				newlines(2)
+			} else {
+				newlines(1)
+			}
+		case "li":
+			newlines(1)
+			if tok.end || len(lists) == 0 {
+				continue
+			}
+			l := &lists[len(lists)-1]
+			b.WriteString(strings.Repeat("  ", len(lists)-1))
+			if l.next > 0 {
+				b.WriteString(strconv.Itoa(l.next) + ". ")
+				l.next++
+			} else {
+				b.WriteString("- ")
+			}
+			markerEnd = b.Len()
+		case "a":
+			if !tok.end {
+				l := link{start: b.Len()}
+				for _, attr := range tok.attrs {
+					if attr[0] == "href" {
+						l.href = attr[1]
+					}
+				}
+				links = append(links, l)
+				continue
+			}
+			if len(links) == 0 {
+				continue
+			}
+			l := links[len(links)-1]
+			links = links[:len(links)-1]
+			// Links whose text is their address are not repeated.
+			address := strings.TrimPrefix(l.href, "mailto:")
+			if text := strings.TrimSpace(b.String()[l.start:]); l.href != "" && text != l.href && text != address {
+				b.WriteString(" (" + address + ")")
+			}
+		default:
+			// Paragraphs in list items stay on the item's lines.
+			switch {
+			case !memoryBlockTags[tok.tag] || b.Len() == markerEnd:
+			case len(lists) > 0:
+				newlines(1)
+			default:
+				newlines(2)
+			}
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
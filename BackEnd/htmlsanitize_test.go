@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeMemoryHTMLKeepsEditorFormatting(t *testing.T) {
+	// As written by the editor on the write-memory page.
+	editor := `<h1 style="text-align: center">Dear Sam</h1><p>I <strong>loved</strong> our <em>walks</em>, <u>truly</u> &amp; <s>never</s> <mark>forgot</mark>.</p>` +
+		`<ul><li><p>One</p></li></ul><ol start="3"><li><p>Three</p></li></ol><blockquote><p>Quote</p></blockquote><pre><code>a &lt; b</code></pre><hr><p>Bye<br>Me</p>`
+	if got := sanitizeMemoryHTML(editor); got != editor {
+		t.Errorf("Expected the editor's HTML unchanged, got\n%s", got)
+	}
+}
+
+func TestSanitizeMemoryHTMLRemovesUnsafeContent(t *testing.T) {
+	cases := []struct{ in, want string }{
+		{`<p>hi<script>alert(1)</script></p>`, `<p>hi</p>`},
+		{`<p onclick="steal()" style="color: red; text-align: right">x</p>`, `<p style="text-align: right">x</p>`},
+		{`<p style="background: url(javascript:x)">x</p>`, `<p>x</p>`},
+		{`<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href="java&#9;script:alert(1)">x</a>`, `<a>x</a>`},
+		{`<a href=" https://example.com">x</a>`, `<a>x</a>`},
+		{`<a href="https://example.com/?a=1&amp;b=&quot;2" target="_top">x</a>`,
+			`<a href="https://example.com/?a=1&amp;b=&#34;2" rel="noopener noreferrer nofollow">x</a>`},
+		{`<img src=x onerror=alert(1)>text`, `text`},
+		{`<div><iframe src="https://evil"></iframe>kept</div>`, `kept`},
+		{`<STYLE>p{}</style><P>x</P>`, `<p>x</p>`},
+		{`<svg><script>alert(1)</script></svg>after`, `after`},
+		{`<p>unclosed <strong>bold`, `<p>unclosed <strong>bold</strong></p>`},
+		{`<p><em>x</p>y</em>`, `<p><em>x</em></p>y`},
+		{`</p>stray`, `stray`},
+		{`a < b > c <!-- hidden --> d`, `a &lt; b &gt; c  d`},
+		{`<p title="x" >x</p>`, `<p>x</p>`},
+		{`<ol start="1e9">`, `<ol></ol>`},
+		{`<p>"quoted" it's</p>`, `<p>&#34;quoted&#34; it&#39;s</p>`},
+		{`<a href="x" title='a"b'>`, `<a title="a&#34;b"></a>`},
+		{`<p a=">x`, ``},
+	}
+	for _, c := range cases {
+		if got := sanitizeMemoryHTML(c.in); got != c.want {
+			t.Errorf("sanitizeMemoryHTML(%q) = %q, want %q", c.in, got, c.want)
+		}
+		// Sanitizing is stable, so stored memories can be sanitized again.
+		if twice := sanitizeMemoryHTML(c.want); twice != c.want {
+			t.Errorf("Sanitizing %q again changed it to %q", c.want, twice)
+		}
+	}
+}
+
+func TestMemoryPlainText(t *testing.T) {
+	in := `<h1>Dear Sam</h1><p>I  loved
+our <strong>walks</strong>.</p><ul><li><p>One</p></li><li><p>Two</p><ul><li><p>Nested</p></li></ul></li></ul>` +
+		`<ol start="3"><li><p>Three</p></li></ol><p><a href="https://example.com">our photos</a> and <a href="mailto:me@example.com">me@example.com</a></p>` +
+		`<pre><code>keep   spacing</code></pre><hr><p>Bye<br>Me &amp; you</p>`
+	want := strings.Join([]string{
+		"Dear Sam",
+		"",
+		"I loved our walks.",
+		"",
+		"- One",
+		"- Two",
+		"  - Nested",
+		"",
+		"3. Three",
+		"",
+		"our photos (https://example.com) and me@example.com",
+		"",
+		"keep   spacing",
+		"",
+		"---",
+		"",
+		"Bye",
+		"Me & you",
+	}, "\n")
+	if got := memoryPlainText(in); got != want {
+		t.Errorf("Unexpected plain text:\n%s\nwant:\n%s", got, want)
+	}
+	if got := memoryPlainText("<p> </p><p><br></p>"); got != "" {
+		t.Errorf("Expected no text, got %q", got)
+	}
+	// Blocks inside a link drop the spaces its text started in.
+	if got := memoryPlainText(sanitizeMemoryHTML("<pre>a\n   <a href=\"http://x\"><p></p></a></pre>")); got != "a\n\n (http://x)" {
+		t.Errorf("Unexpected plain text for a link in preformatted text: %q", got)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// attemptPolicy controls how repeated failures from one source are slowed down.
+// The first freeFailures failures are free; after that each failure doubles the
+// wait before the next attempt, up to maxDelay. Reaching lockAfter failures
+// locks the source for lockDuration (0 disables the hard lock).
+type attemptPolicy struct {
+	freeFailures int
+	maxDelay     time.Duration
+	lockAfter    int
+	lockDuration time.Duration
+}
+
+var (
+	// accountAttemptPolicy applies to guesses against a single account, whatever the client.
+	accountAttemptPolicy = attemptPolicy{freeFailures: 3, maxDelay: 15 * time.Minute, lockAfter: 10, lockDuration: 30 * time.Minute}
+	// ipAttemptPolicy applies to every guess from one client address, across accounts.
+	ipAttemptPolicy = attemptPolicy{freeFailures: 10, maxDelay: 15 * time.Minute}
+	// attemptWindow is how long failures are remembered after the last one.
+	attemptWindow = 24 * time.Hour
+	// unlockTokenTTL is how long the link in an unlock email stays valid.
+	unlockTokenTTL = 24 * time.Hour
+)
+
+// trustProxyHeaders makes clientIP honour X-Forwarded-For; only enable it behind a trusted proxy.
+var trustProxyHeaders = os.Getenv("TRUST_PROXY") == "1"
+
+func accountAttemptKey(userID int) string { return "user:" + strconv.Itoa(userID) }
+func ipAttemptKey(ip string) string       { return "ip:" + ip }
+
+// clientIP returns the address of the client making the request.
+func clientIP(r *http.Request) string {
+	if trustProxyHeaders {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// attemptRetryAfter returns how long the caller must wait before the next attempt
+// for any of the keys, or zero if it may try now.
+func attemptRetryAfter(keys ...string) (time.Duration, error) {
+	now := timeNow()
+	var wait time.Duration
+	for _, key := range keys {
+		var blockedUntil int64
+		err := db.QueryRow("SELECT blocked_until FROM login_attempts WHERE attempt_key = ?", key).Scan(&blockedUntil)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if remaining := time.Unix(blockedUntil, 0).Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// recordFailedAttempt counts a failure for the key and returns true when this
+// failure triggered a hard lock.
+func recordFailedAttempt(key string, policy attemptPolicy) (bool, error) {
+	now := timeNow()
+	var failures int
+	var lastFailure int64
+	err := db.QueryRow("SELECT failures, last_failure FROM login_attempts WHERE attempt_key = ?", key).Scan(&failures, &lastFailure)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == sql.ErrNoRows || now.Sub(time.Unix(lastFailure, 0)) > attemptWindow {
+		failures = 0
+	}
+	failures++
+
+	var blockedUntil time.Time
+	locked := false
+	if policy.lockAfter > 0 && failures >= policy.lockAfter {
+		blockedUntil = now.Add(policy.lockDuration)
+		locked = failures == policy.lockAfter
+	} else if failures > policy.freeFailures {
+		delay := time.Duration(math.Pow(2, float64(failures-policy.freeFailures-1))) * time.Second
+		if delay > policy.maxDelay || delay <= 0 {
+			delay = policy.maxDelay
+		}
+		blockedUntil = now.Add(delay)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO login_attempts (attempt_key, failures, last_failure, blocked_until)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(attempt_key) DO UPDATE SET
+		failures = excluded.failures,
+		last_failure = excluded.last_failure,
+		blocked_until = excluded.blocked_until
+	`, key, failures, now.Unix(), blockedUntil.Unix())
+	return locked, err
+}
+
+// clearFailedAttempts forgets the failures recorded for the keys.
+func clearFailedAttempts(keys ...string) {
+	for _, key := range keys {
+		if _, err := db.Exec("DELETE FROM login_attempts WHERE attempt_key = ?", key); err != nil {
+			log.Printf("Error clearing failed attempts for %s: %v", key, err)
+		}
+	}
+}
+
+// writeTooManyAttempts answers with 429 and a Retry-After header in whole seconds.
+func writeTooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":      "Too many failed attempts. Please try again later.",
+		"retryAfter": seconds,
+	})
+}
+
+// throttled writes a 429 and returns true when any of the keys is currently blocked.
+func throttled(w http.ResponseWriter, keys ...string) bool {
+	wait, err := attemptRetryAfter(keys...)
+	if err != nil {
+		log.Printf("Error checking failed attempts: %v", err)
+		return false
+	}
+	if wait > 0 {
+		writeTooManyAttempts(w, wait)
+		return true
+	}
+	return false
+}
+
+// recordAccountFailure counts a failed guess against both the account and the
+// client address, emailing the owner an unlock link when the account locks.
+func recordAccountFailure(userID int, ip string) {
+	locked, err := recordFailedAttempt(accountAttemptKey(userID), accountAttemptPolicy)
+	if err != nil {
+		log.Printf("Error recording failed attempt for user %d: %v", userID, err)
+	}
+	if _, err := recordFailedAttempt(ipAttemptKey(ip), ipAttemptPolicy); err != nil {
+		log.Printf("Error recording failed attempt for %s: %v", ip, err)
+	}
+	if locked {
+		sendUnlockEmail(userID)
+	}
+}
+
+// sendUnlockEmail tells the account owner about the lock and gives them a link to lift it.
+func sendUnlockEmail(userID int) {
+	email, err := verifiedPrimaryEmail(userID)
+	if err != nil || email == "" {
+		log.Printf("Account %d locked but no verified contact email is available", userID)
+		return
+	}
+	token := issuePurposeToken("unlock", userID, unlockTokenTTL)
+	link := fmt.Sprintf("%s/unlock-account?token=%s", apiBaseURL, url.QueryEscape(token))
+	subject := "Your Parting Gifts account has been locked"
+	body := fmt.Sprintf("Hello,\n\nWe locked your account for %d minutes after several failed sign-in attempts.\n\n"+
+		"If this was you, you can unlock it right away by opening this link:\n%s\n\n"+
+		"If it was not you, consider changing your password once you are signed in.",
+		int(accountAttemptPolicy.lockDuration.Minutes()), link)
+	go func() {
+		if err := sendCheckEmail(email, subject, body); err != nil {
+			log.Printf("Error sending unlock email for user %d: %v", userID, err)
+		}
+	}()
+}
+
+// unlockPageHTML asks the owner to confirm before the lock is lifted. Mail
+// scanners and link previews open links as soon as an email arrives, so only
+// the form's POST uses up the link.
+const unlockPageHTML = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Unlock your Parting Gifts account</title></head>
+<body>
+<p>Your account was locked after several failed sign-in attempts.</p>
+<form method="post" action="/unlock-account?token=%s">
+<button type="submit">Unlock my account</button>
+</form>
+</body>
+</html>
+`
+
+// unlockAccountHandler lifts an account lock using the link from the unlock
+// email. Opening the link (GET) shows a page with a button, and its POST
+// lifts the lock. Each link works once.
+func unlockAccountHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	var userID int
+	var err error
+	if r.Method == http.MethodGet {
+		_, err = parsePurposeToken(token, "unlock", timeNow())
+		if err == nil {
+			var used bool
+			if used, err = purposeTokenUsed(token); err == nil && used {
+				err = errInvalidToken
+			}
+		}
+	} else {
+		userID, err = consumePurposeToken(token, "unlock")
+	}
+	if err == errExpiredToken {
+		http.Error(w, "This unlock link has expired", http.StatusBadRequest)
+		return
+	}
+	if err == errInvalidToken {
+		http.Error(w, "This unlock link is invalid or has already been used", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Error checking unlock token: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, unlockPageHTML, html.EscapeString(url.QueryEscape(token)))
+		return
+	}
+
+	clearFailedAttempts(accountAttemptKey(userID))
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Your account has been unlocked. You can sign in again."))
+}
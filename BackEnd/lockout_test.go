@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginBackoffAndLockout(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "Sahil@1234")
+	clock := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFixedClock(t, clock)
+
+	wrong := []byte(`{"username": "Sahil_1234", "password": "wrong"}`)
+	right := []byte(`{"username": "Sahil_1234", "password": "Sahil@1234"}`)
+
+	// The first few failures are free.
+	for i := 0; i < accountAttemptPolicy.freeFailures; i++ {
+		if rec := performRequest(loginHandler, "POST", "/login", wrong); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %d: expected 401, got %d", i+1, rec.Code)
+		}
+	}
+
+	// After that each failure doubles the wait.
+	for i, wantWait := range []string{"1", "2", "4"} {
+		if rec := performRequest(loginHandler, "POST", "/login", wrong); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Back-off attempt %d: expected 401, got %d", i+1, rec.Code)
+		}
+		rec := performRequest(loginHandler, "POST", "/login", right)
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != wantWait {
+			t.Fatalf("Back-off attempt %d: expected 429 with Retry-After %s, got %d %q", i+1, wantWait, rec.Code, rec.Header().Get("Retry-After"))
+		}
+		clock = clock.Add(time.Hour)
+		useFixedClock(t, clock)
+	}
+
+	// Reaching the limit locks the account for the lock duration.
+	for i := 3 + accountAttemptPolicy.freeFailures; i < accountAttemptPolicy.lockAfter; i++ {
+		performRequest(loginHandler, "POST", "/login", wrong)
+		clock = clock.Add(time.Hour)
+		useFixedClock(t, clock)
+	}
+	clock = clock.Add(-time.Hour)
+	useFixedClock(t, clock)
+	rec := performRequest(loginHandler, "POST", "/login", right)
+	wantRetry := int(accountAttemptPolicy.lockDuration.Seconds())
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != strconv.Itoa(wantRetry) {
+		t.Fatalf("Expected locked account, got %d Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Confirming on the unlock link's page lifts the lock.
+	token := issuePurposeToken("unlock", 1, unlockTokenTTL)
+	if rec := performRequest(unlockAccountHandler, "POST", "/unlock-account?token="+url.QueryEscape(token), nil); rec.Code != http.StatusOK {
+		t.Fatalf("Unlock failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := performRequest(loginHandler, "POST", "/login", right); rec.Code != http.StatusOK {
+		t.Errorf("Expected login after unlock, got %d", rec.Code)
+	}
+
+	// The link cannot be used again to clear later failures.
+	for i := 0; i < accountAttemptPolicy.lockAfter; i++ {
+		performRequest(loginHandler, "POST", "/login", wrong)
+	}
+	if rec := performRequest(unlockAccountHandler, "POST", "/unlock-account?token="+url.QueryEscape(token), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a used unlock link to be refused, got %d", rec.Code)
+	}
+	if rec := performRequest(unlockAccountHandler, "GET", "/unlock-account?token="+url.QueryEscape(token), nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a used unlock link's page to say so, got %d", rec.Code)
+	}
+	if rec := performRequest(loginHandler, "POST", "/login", right); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the account to stay locked, got %d", rec.Code)
+	}
+}
+
+func TestOpeningUnlockLinkDoesNotUseIt(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "Sahil@1234")
+	_, _ = recordFailedAttempt(accountAttemptKey(1), attemptPolicy{lockAfter: 1, lockDuration: time.Hour})
+
+	// A mail scanner opening the link only gets the confirmation page.
+	link := "/unlock-account?token=" + url.QueryEscape(issuePurposeToken("unlock", 1, unlockTokenTTL))
+	for i := 0; i < 2; i++ {
+		rec := performRequest(unlockAccountHandler, "GET", link, nil)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<form method="post"`) {
+			t.Fatalf("Expected the confirmation page, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	if wait, _ := attemptRetryAfter(accountAttemptKey(1)); wait == 0 {
+		t.Errorf("Expected the account to stay locked until the owner confirms")
+	}
+
+	if rec := performRequest(unlockAccountHandler, "POST", link, nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the confirmation to unlock the account, got %d %s", rec.Code, rec.Body.String())
+	}
+	if wait, _ := attemptRetryAfter(accountAttemptKey(1)); wait != 0 {
+		t.Errorf("Expected the account to be unlocked, still locked for %v", wait)
+	}
+}
+
+func TestLoginThrottlesClientIP(t *testing.T) {
+	db, _ = setupTestDB()
+	useFixedClock(t, time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	// Guessing many different usernames from one address is slowed down too.
+	for i := 0; i < ipAttemptPolicy.freeFailures+1; i++ {
+		body := []byte(`{"username": "nobody` + strconv.Itoa(i) + `", "password": "x"}`)
+		performRequest(loginHandler, "POST", "/login", body)
+	}
+	rec := performRequest(loginHandler, "POST", "/login", []byte(`{"username": "nobody", "password": "x"}`))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After for the client address, got %d", rec.Code)
+	}
+}
+
+func TestSecurityAnswerAttemptsAreThrottled(t *testing.T) {
+	db, _ = setupTestDB()
+	_, _ = db.Exec("INSERT INTO users (id, username) VALUES (1, 'testuser')")
+	_ = replaceSecurityQuestions(1, []securityQuestionInput{{Question: "Pet?", Answer: "fluffy"}})
+	useFixedClock(t, time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	wrong := []byte(`{"username": "testuser", "securityAnswer": "rex"}`)
+	for i := 0; i <= accountAttemptPolicy.freeFailures; i++ {
+		performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", wrong)
+	}
+	right := []byte(`{"username": "testuser", "securityAnswer": "fluffy"}`)
+	rec := performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", right)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 after repeated wrong answers, got %d", rec.Code)
+	}
+}
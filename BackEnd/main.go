@@ -9,11 +9,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"math/big"
 	"net/http"
+	"os"
 	"regexp"
 	"strconv"
 	"strings" // required for splitting secondary emails
@@ -41,19 +40,38 @@ type User struct {
 
 // Gift represents a gift record in the system.
 type Gift struct {
-	ID               int    `json:"id"`
-	FileName         string `json:"file_name"`
-	CustomMessage    string `json:"custom_message"`
-	UploadTime       string `json:"upload_time"`
-	Pending          bool   `json:"pending"`
-	FileData         []byte `json:"-"`
-	ScheduledRelease string `json:"scheduled_release,omitempty"` // Using consistent naming format (camelCase for JSON)
+	ID               int              `json:"id"`
+	FileName         string           `json:"file_name"`
+	CustomMessage    string           `json:"custom_message"`
+	UploadTime       string           `json:"upload_time"`
+	Pending          bool             `json:"pending"`
+	Cancelled        bool             `json:"cancelled"` // delivery stopped with /stop-pending-gift
+	Type             string           `json:"type"`      // giftTypeFile or giftTypeText
+	Attachments      []giftAttachment `json:"-"`
+	Memory           *textMemory      `json:"-"`                           // set for text gifts
+	ScheduledRelease string           `json:"scheduled_release,omitempty"` // Using consistent naming format (camelCase for JSON)
 }
 
 var db *sql.DB
 
 var secretKey = []byte("mysecretkey12345") // Must be 16, 24, or 32 bytes for AES
 
+// allowedOrigin is the frontend origin allowed to make credentialed requests.
+var allowedOrigin = envOrDefault("CORS_ALLOWED_ORIGIN", "http://localhost:4200")
+
+// frontendBaseURL is the address of the web app, used for links users open in a browser.
+var frontendBaseURL = envOrDefault("FRONTEND_URL", "http://localhost:4200")
+
+// apiBaseURL is the public address of this server, used in links sent by email.
+var apiBaseURL = envOrDefault("API_BASE_URL", "http://localhost:8080")
+
+func envOrDefault(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
 func encrypt(text string) (string, error) {
 	block, err := aes.NewCipher(secretKey)
 	if err != nil {
@@ -105,6 +123,148 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := requireGiftSearchFTS5(db); err != nil {
+		log.Fatal(err)
+	}
+	if err := createTables(db); err != nil {
+		log.Fatalf("Failed to set up database: %v", err)
+	}
+
+	fmt.Println("SQLite database is set up and the tables are ready!")
+
+	giftStore, err = newBlobStoreFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to set up gift storage: %v", err)
+	}
+	if err := loadMasterKeysFromEnv(); err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	if giftMasterKey == nil {
+		log.Println("GIFT_MASTER_KEY is not set; new gift files will be stored unencrypted")
+	}
+
+	// "migrate-blobs" moves gift files still kept in the gifts table into the configured storage,
+	// stores identical files only once, encrypts files and memories stored in the clear if a master key is set, and exits.
+	if len(os.Args) > 1 && os.Args[1] == "migrate-blobs" {
+		moved, err := migrateGiftBlobs(giftStore)
+		if err != nil {
+			log.Fatalf("Blob migration stopped after %d gifts: %v", moved, err)
+		}
+		fmt.Printf("Moved %d gift files to %s storage. Run VACUUM on app.db to reclaim the space.\n", moved, envOrDefault("STORAGE_BACKEND", "sqlite"))
+		removed, err := dedupStoredBlobs()
+		if err != nil {
+			log.Fatalf("Deduplication stopped after %d copies: %v", removed, err)
+		}
+		fmt.Printf("Removed %d duplicate copies.\n", removed)
+		encrypted, err := encryptStoredBlobs()
+		if err != nil {
+			log.Fatalf("Encryption stopped after %d files: %v", encrypted, err)
+		}
+		fmt.Printf("Encrypted %d gift files.\n", encrypted)
+		sealed, err := sealStoredMemories()
+		if err != nil {
+			log.Fatalf("Encryption stopped after %d memories: %v", sealed, err)
+		}
+		fmt.Printf("Encrypted %d text memories.\n", sealed)
+		return
+	}
+
+	// "rewrap-keys" re-encrypts every user's data key with GIFT_MASTER_KEY after a
+	// master key rotation, and exits. The old key must be in GIFT_PREVIOUS_MASTER_KEYS.
+	if len(os.Args) > 1 && os.Args[1] == "rewrap-keys" {
+		rewrapped, err := rewrapDataKeys()
+		if err != nil {
+			log.Fatalf("Re-wrapping stopped after %d keys: %v", rewrapped, err)
+		}
+		fmt.Printf("Re-wrapped %d data keys. The previous master keys are no longer needed.\n", rewrapped)
+		return
+	}
+
+	// "storage-report" prints how much space deduplication saves and exits.
+	if len(os.Args) > 1 && os.Args[1] == "storage-report" {
+		report, err := storageSavings()
+		if err != nil {
+			log.Fatalf("Failed to build storage report: %v", err)
+		}
+		fmt.Printf("%d files in %d stored blobs: %d bytes uploaded, %d bytes stored, %d bytes saved.\n",
+			report.Files, report.Blobs, report.LogicalBytes, report.StoredBytes, report.SavedBytes)
+		return
+	}
+
+	go runAccountDeletionJob()
+	go runTusCleanupJob()
+	go runThumbnailJob()
+	go runGiftTrashJob()
+
+	// Register endpoints.
+	http.HandleFunc("/create-account", createAccountHandler)
+	http.HandleFunc("/update-emails", requireAuth(personalDetailsHandler))
+	http.HandleFunc("/upload-gift", requireScope("gifts", uploadGiftHandler))
+	http.HandleFunc("/text-gift", requireScope("gifts", textGiftHandler))
+	http.HandleFunc("/uploads", requireScope("gifts", tusUploadHandler))
+	http.HandleFunc("/uploads/", requireScope("gifts", tusUploadHandler))
+	http.HandleFunc("/login", loginHandler)
+	http.HandleFunc("/logout", logoutHandler)
+	http.HandleFunc("/sessions", requireAuth(sessionsHandler))
+	http.HandleFunc("/sessions/revoke-all", requireAuth(revokeAllSessionsHandler))
+	http.HandleFunc("/api-keys", requireAuth(apiKeysHandler))
+	http.HandleFunc("/delete-account", requireAuth(deleteAccountHandler))
+	http.HandleFunc("/login/2fa", loginTwoFactorHandler)
+	http.HandleFunc("/unlock-account", unlockAccountHandler)
+	http.HandleFunc("/2fa/enroll", requireAuth(twoFactorEnrollHandler))
+	http.HandleFunc("/2fa/confirm", requireAuth(twoFactorConfirmHandler))
+	http.HandleFunc("/2fa/disable", requireAuth(twoFactorDisableHandler))
+	http.HandleFunc("/2fa/recovery-codes", requireAuth(recoveryCodesHandler))
+	http.HandleFunc("/reset-password", resetPasswordHandler)
+	http.HandleFunc("/reset-password/confirm", confirmPasswordResetHandler)
+	http.HandleFunc("/change-password", requireAuth(changePasswordHandler))
+	http.HandleFunc("/setup-receivers", requireScope("gifts", setupReceiversHandler))
+	http.HandleFunc("/gift-count", requireScope("gifts", giftCountHandler))
+	http.HandleFunc("/gift-usage", requireScope("gifts", giftUsageHandler))
+	http.HandleFunc("/gifts", requireScope("gifts", getGiftsHandler))
+	http.HandleFunc("/gifts/search", requireScope("gifts", giftSearchHandler))
+	http.HandleFunc("/download-gift", requireScope("gifts", downloadGiftHandler))
+	http.HandleFunc("/gift-thumbnail", requireScope("gifts", giftThumbnailHandler))
+	http.HandleFunc("/gift-attachments", requireScope("gifts", giftAttachmentsHandler))
+	http.HandleFunc("/gift-attachments/reorder", requireScope("gifts", giftAttachmentsReorderHandler))
+	http.HandleFunc("/edit-gift", requireScope("gifts", editGiftHandler))
+	http.HandleFunc("/gift-versions", requireScope("gifts", giftVersionsHandler))
+	http.HandleFunc("/gift-versions/restore", requireScope("gifts", giftVersionRestoreHandler))
+	http.HandleFunc("/dashboard/pending-gifts", requireScope("gifts", pendingGiftsHandler))
+	http.HandleFunc("/get-receivers", requireScope("gifts", GetReceiverHandler))
+	http.HandleFunc("/schedule-check", requireScope("gifts", scheduleInactivityCheckHandler))
+	http.HandleFunc("/stop-pending-gift", requireScope("gifts", stopPendingGiftHandler))
+	http.HandleFunc("/delete-gift", requireScope("gifts", deleteGiftHandler))
+	http.HandleFunc("/gift-trash", requireScope("gifts", giftTrashHandler))
+	http.HandleFunc("/gift-trash/restore", requireScope("gifts", giftTrashRestoreHandler))
+	http.HandleFunc("/gift-executors", requireScope("gifts", giftExecutorsHandler))
+	http.HandleFunc("/swagger.json", swaggerHandler)
+	http.HandleFunc("/verify-security-answer", verifySecurityAnswerHandler)
+	http.HandleFunc("/security-questions", requireAuth(securityQuestionsHandler))
+	http.HandleFunc("/get-security-info", getSecurityInfoHandler)
+	http.HandleFunc("/verify-email", verifyEmailHandler)
+	http.HandleFunc("/contact-emails", requireAuth(contactEmailsHandler))
+	http.HandleFunc("/send-message", requireScope("messages", sendMessageHandler))
+	http.HandleFunc("/get-messages", requireScope("messages", getMessagesHandler))
+	http.HandleFunc("/get-privacy", requireScope("profile", getPrivacyHandler))
+	http.HandleFunc("/update-privacy", requireScope("profile", updatePrivacyHandler))
+	http.HandleFunc("/notifications", requireScope("messages", getMessageNotificationHandler))
+	http.HandleFunc("/gift-calendar", requireScope("gifts", giftCalendarHandler))
+	http.HandleFunc("/friends/following", requireScope("friends", getFollowingHandler))
+	http.HandleFunc("/friends/followers", requireScope("friends", getFollowersHandler))
+	http.HandleFunc("/users/discover", requireScope("friends", discoverUsersHandler))
+	http.HandleFunc("/users/search", requireScope("friends", searchUsersHandler))
+	http.HandleFunc("/users/follow", requireScope("friends", followUserHandler))
+	http.HandleFunc("/users/unfollow", requireScope("friends", unfollowUserHandler))
+	http.HandleFunc("/users/eligible-messaging", requireScope("messages", getEligibleMessagingUsersHandler))
+	fmt.Println("Server listening on http://localhost:8080")
+	if err := http.ListenAndServe(":8080", nil); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+// createTables creates every table the server needs if it does not exist yet.
+func createTables(db *sql.DB) error {
 	// Create tables if they do not exist.
 	createUsersTableSQL := `
         CREATE TABLE IF NOT EXISTS users (
@@ -123,7 +283,7 @@ func main() {
     `
 
 	if _, err := db.Exec(createUsersTableSQL); err != nil {
-		log.Fatalf("Failed to create users table: %v", err)
+		return fmt.Errorf("failed to create users table: %w", err)
 	}
 
 	createPrivacyTableSQL := `
@@ -136,7 +296,7 @@ func main() {
 	);
 	`
 	if _, err := db.Exec(createPrivacyTableSQL); err != nil {
-		log.Fatalf("Failed to create privacy_settings table: %v", err)
+		return fmt.Errorf("failed to create privacy_settings table: %w", err)
 	}
 
 	createGiftsTableSQL := `
@@ -154,7 +314,7 @@ func main() {
     );
     `
 	if _, err := db.Exec(createGiftsTableSQL); err != nil {
-		log.Fatalf("Failed to create gifts table: %v", err)
+		return fmt.Errorf("failed to create gifts table: %w", err)
 	}
 
 	createMessagesTableSQL := `
@@ -171,46 +331,383 @@ func main() {
 	);
 	`
 	if _, err := db.Exec(createMessagesTableSQL); err != nil {
-		log.Fatalf("Failed to create messages table: %v", err)
+		return fmt.Errorf("failed to create messages table: %w", err)
 	}
 
-	fmt.Println("SQLite database is set up and the tables are ready!")
+	createGiftExecutorsTableSQL := `
+	CREATE TABLE IF NOT EXISTS gift_executors (
+		gift_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY(gift_id, user_id),
+		FOREIGN KEY(gift_id) REFERENCES gifts(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createGiftExecutorsTableSQL); err != nil {
+		return fmt.Errorf("failed to create gift_executors table: %w", err)
+	}
 
-	// Register endpoints.
-	http.HandleFunc("/create-account", createAccountHandler)
-	http.HandleFunc("/update-emails", personalDetailsHandler)
-	http.HandleFunc("/upload-gift", uploadGiftHandler)
-	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/reset-password", resetPasswordHandler)
-	http.HandleFunc("/change-password", changePasswordHandler)
-	http.HandleFunc("/setup-receivers", setupReceiversHandler)
-	http.HandleFunc("/gift-count", giftCountHandler)
-	http.HandleFunc("/gifts", getGiftsHandler)
-	http.HandleFunc("/download-gift", downloadGiftHandler)
-	http.HandleFunc("/dashboard/pending-gifts", pendingGiftsHandler)
-	http.HandleFunc("/get-receivers", GetReceiverHandler)
-	http.HandleFunc("/schedule-check", scheduleInactivityCheckHandler)
-	http.HandleFunc("/stop-pending-gift", stopPendingGiftHandler)
-	http.HandleFunc("/swagger.json", swaggerHandler)
-	http.HandleFunc("/verify-security-answer", verifySecurityAnswerHandler)
-	http.HandleFunc("/get-security-info", getSecurityInfoHandler)
-	http.HandleFunc("/send-message", sendMessageHandler)
-	http.HandleFunc("/get-messages", getMessagesHandler)
-	http.HandleFunc("/get-privacy", getPrivacyHandler)
-	http.HandleFunc("/update-privacy", updatePrivacyHandler)
-	http.HandleFunc("/notifications", getMessageNotificationHandler)
-	http.HandleFunc("/gift-calendar", giftCalendarHandler)
-	http.HandleFunc("/friends/following", getFollowingHandler)
-	http.HandleFunc("/friends/followers", getFollowersHandler)
-	http.HandleFunc("/users/discover", discoverUsersHandler)
-	http.HandleFunc("/users/search", searchUsersHandler)
-	http.HandleFunc("/users/follow", followUserHandler)
-	http.HandleFunc("/users/unfollow", unfollowUserHandler)
-	http.HandleFunc("/users/eligible-messaging", getEligibleMessagingUsersHandler)
-	fmt.Println("Server listening on http://localhost:8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	createRecoveryCodesTableSQL := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createRecoveryCodesTableSQL); err != nil {
+		return fmt.Errorf("failed to create recovery_codes table: %w", err)
+	}
+	if err := upgradeRecoveryCodeHashes(db); err != nil {
+		return fmt.Errorf("failed to upgrade recovery code hashes: %w", err)
+	}
+
+	createPasswordResetsTableSQL := `
+	CREATE TABLE IF NOT EXISTS password_resets (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		expires_at INTEGER NOT NULL,  -- unix seconds
+		used_at DATETIME,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createPasswordResetsTableSQL); err != nil {
+		return fmt.Errorf("failed to create password_resets table: %w", err)
+	}
+
+	createUsedTokensTableSQL := `
+	CREATE TABLE IF NOT EXISTS used_tokens (
+		token_hash TEXT PRIMARY KEY,  -- single-use purpose tokens that were used
+		expires_at INTEGER NOT NULL  -- unix seconds; the row is dropped after this
+	);
+	`
+	if _, err := db.Exec(createUsedTokensTableSQL); err != nil {
+		return fmt.Errorf("failed to create used_tokens table: %w", err)
+	}
+
+	createLoginAttemptsTableSQL := `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		attempt_key TEXT PRIMARY KEY,  -- "user:<id>" or "ip:<address>"
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure INTEGER NOT NULL DEFAULT 0,  -- unix seconds
+		blocked_until INTEGER NOT NULL DEFAULT 0  -- unix seconds
+	);
+	`
+	if _, err := db.Exec(createLoginAttemptsTableSQL); err != nil {
+		return fmt.Errorf("failed to create login_attempts table: %w", err)
 	}
+
+	createSecurityQuestionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS security_questions (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		question TEXT NOT NULL,
+		answer_hash TEXT NOT NULL,  -- bcrypt of the normalized answer
+		UNIQUE(user_id, position),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createSecurityQuestionsTableSQL); err != nil {
+		return fmt.Errorf("failed to create security_questions table: %w", err)
+	}
+
+	createVerifiedEmailsTableSQL := `
+	CREATE TABLE IF NOT EXISTS verified_emails (
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL,  -- lowercased
+		verified_at INTEGER NOT NULL,  -- unix seconds
+		PRIMARY KEY(user_id, email),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createVerifiedEmailsTableSQL); err != nil {
+		return fmt.Errorf("failed to create verified_emails table: %w", err)
+	}
+
+	createSessionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,  -- session id embedded in the signed token
+		user_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,  -- unix seconds
+		last_seen_at INTEGER NOT NULL,  -- unix seconds
+		expires_at INTEGER NOT NULL,  -- unix seconds
+		ip TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		revoked_at INTEGER,  -- unix seconds
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createSessionsTableSQL); err != nil {
+		return fmt.Errorf("failed to create sessions table: %w", err)
+	}
+
+	createAPIKeysTableSQL := `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		key_prefix TEXT NOT NULL,  -- first characters of the key, to tell keys apart
+		key_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,  -- space separated
+		created_at INTEGER NOT NULL,  -- unix seconds
+		last_used_at INTEGER,  -- unix seconds
+		expires_at INTEGER,  -- unix seconds
+		revoked_at INTEGER,  -- unix seconds
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createAPIKeysTableSQL); err != nil {
+		return fmt.Errorf("failed to create api_keys table: %w", err)
+	}
+
+	createGiftAttachmentsTableSQL := `
+	CREATE TABLE IF NOT EXISTS gift_attachments (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		gift_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,  -- 0 is the first file of the bundle
+		file_name TEXT NOT NULL,
+		storage_key TEXT,  -- NULL while the file is still in gifts.file_data
+		file_size INTEGER,
+		caption TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,  -- unix seconds
+		FOREIGN KEY(gift_id) REFERENCES gifts(id)
+	);
+	CREATE INDEX IF NOT EXISTS gift_attachments_gift ON gift_attachments(gift_id, position);
+	`
+	if _, err := db.Exec(createGiftAttachmentsTableSQL); err != nil {
+		return fmt.Errorf("failed to create gift_attachments table: %w", err)
+	}
+
+	createGiftThumbnailsTableSQL := `
+	CREATE TABLE IF NOT EXISTS gift_thumbnails (
+		attachment_id INTEGER NOT NULL,
+		size TEXT NOT NULL,  -- see thumbnailSizes
+		storage_key TEXT NOT NULL,  -- JPEG in giftStore
+		width INTEGER NOT NULL,
+		height INTEGER NOT NULL,
+		file_size INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,  -- unix seconds
+		PRIMARY KEY (attachment_id, size),
+		FOREIGN KEY(attachment_id) REFERENCES gift_attachments(id)
+	);
+	`
+	if _, err := db.Exec(createGiftThumbnailsTableSQL); err != nil {
+		return fmt.Errorf("failed to create gift_thumbnails table: %w", err)
+	}
+
+	createGiftVersionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS gift_versions (
+		id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+		gift_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,  -- counts up from 1 for each gift
+		file_name TEXT NOT NULL,
+		custom_message TEXT NOT NULL,
+		storage_key TEXT,  -- the gift's first file as it was, in giftStore
+		file_size INTEGER,
+		mime_type TEXT,
+		sha256 TEXT,
+		metadata_removed TEXT,
+		memory_html TEXT,  -- the memory of a text gift as it was
+		memory_text TEXT,
+		edited_by INTEGER,  -- user whose edit replaced this version
+		created_at INTEGER NOT NULL,  -- unix seconds the version was replaced
+		UNIQUE (gift_id, version),
+		FOREIGN KEY(gift_id) REFERENCES gifts(id)
+	);
+	`
+	if _, err := db.Exec(createGiftVersionsTableSQL); err != nil {
+		return fmt.Errorf("failed to create gift_versions table: %w", err)
+	}
+
+	createContentBlobsTableSQL := `
+	CREATE TABLE IF NOT EXISTS content_blobs (
+		sha256 TEXT NOT NULL,  -- hex digest of the content
+		owner_id INTEGER NOT NULL DEFAULT 0,  -- user whose data key encrypts the blob, 0 if stored in the clear
+		storage_key TEXT NOT NULL UNIQUE,  -- the one blob in giftStore holding it
+		size INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,  -- unix seconds
+		PRIMARY KEY (sha256, owner_id)
+	);
+	`
+	if _, err := db.Exec(createContentBlobsTableSQL); err != nil {
+		return fmt.Errorf("failed to create content_blobs table: %w", err)
+	}
+	if err := migrateContentBlobsOwner(db); err != nil {
+		return err
+	}
+
+	createUserDataKeysTableSQL := `
+	CREATE TABLE IF NOT EXISTS user_data_keys (
+		user_id INTEGER NOT NULL PRIMARY KEY,
+		wrapped_key BLOB NOT NULL,  -- the user's data key, encrypted with a master key
+		master_key_id TEXT NOT NULL,  -- which master key wrapped it
+		created_at INTEGER NOT NULL,  -- unix seconds
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createUserDataKeysTableSQL); err != nil {
+		return fmt.Errorf("failed to create user_data_keys table: %w", err)
+	}
+
+	createTusUploadsTableSQL := `
+	CREATE TABLE IF NOT EXISTS tus_uploads (
+		id TEXT NOT NULL PRIMARY KEY,  -- random hex, also the staging file name
+		user_id INTEGER NOT NULL,
+		file_name TEXT NOT NULL,
+		custom_message TEXT NOT NULL,
+		length INTEGER NOT NULL,  -- declared size in bytes
+		upload_offset INTEGER NOT NULL,  -- bytes received so far
+		created_at INTEGER NOT NULL,  -- unix seconds
+		expires_at INTEGER NOT NULL,  -- unix seconds; pushed back by every chunk
+		gift_id INTEGER,  -- set once the upload is complete
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	if _, err := db.Exec(createTusUploadsTableSQL); err != nil {
+		return fmt.Errorf("failed to create tus_uploads table: %w", err)
+	}
+
+	// Columns added after the original users table was created.
+	userColumns := []struct{ name, definition string }{
+		{"totp_secret", "TEXT"},
+		{"totp_enabled", "BOOLEAN DEFAULT 0"},
+		{"totp_last_step", "INTEGER DEFAULT 0"},
+		{"deletion_scheduled_for", "INTEGER"}, // unix seconds; set while a deletion request is pending
+		{"plan", "TEXT"},                      // storage plan, see quota.go; NULL means the free plan
+		{"storage_quota", "INTEGER"},          // bytes; overrides the plan's quota when set, 0 for unlimited
+	}
+	for _, column := range userColumns {
+		if err := addColumnIfMissing(db, "users", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	// Columns added after the original gifts table was created.
+	giftColumns := []struct{ name, definition string }{
+		{"storage_key", "TEXT"}, // key in giftStore; NULL for gifts whose payload is still in file_data
+		{"file_size", "INTEGER"},
+		{"mime_type", "TEXT"},                        // detected from the content at upload
+		{"sha256", "TEXT"},                           // hex digest of the file
+		{"cancelled", "BOOLEAN DEFAULT 0"},           // delivery stopped; cleared when receivers are set up again
+		{"deleted_at", "INTEGER"},                    // unix seconds; set while the gift is in the trash, see trash.go
+		{"gift_type", "TEXT DEFAULT 'file'"},         // 'file' or 'text', see textgifts.go
+		{"memory_html", "TEXT"},                      // sanitized HTML of a text memory
+		{"memory_text", "TEXT"},                      // plain text rendering of memory_html
+		{"memory_terms", "TEXT"},                     // search hashes of a sealed memory's words, see giftsearch.go
+		{"schedule_generation", "INTEGER DEFAULT 0"}, // bumped by each /setup-receivers; older scheduled sends give up
+	}
+	for _, column := range giftColumns {
+		if err := addColumnIfMissing(db, "gifts", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	attachmentColumns := []struct{ name, definition string }{
+		{"mime_type", "TEXT"},
+		{"sha256", "TEXT"},
+		{"thumbnail_state", "TEXT"},  // see thumbnails.go; NULL until the thumbnail job has looked at the file
+		{"metadata_removed", "TEXT"}, // comma separated kinds of photo metadata stripped at upload, see photometadata.go
+	}
+	for _, column := range attachmentColumns {
+		if err := addColumnIfMissing(db, "gift_attachments", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	versionColumns := []struct{ name, definition string }{
+		{"memory_html", "TEXT"}, // the memory of a text gift as it was
+		{"memory_text", "TEXT"},
+	}
+	for _, column := range versionColumns {
+		if err := addColumnIfMissing(db, "gift_versions", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	privacyColumns := []struct{ name, definition string }{
+		{"keep_photo_metadata", "BOOLEAN DEFAULT 0"},    // store uploaded photos without stripping EXIF, XMP and GPS data
+		{"keep_photo_orientation", "BOOLEAN DEFAULT 1"}, // keep the EXIF orientation when stripping
+	}
+	for _, column := range privacyColumns {
+		if err := addColumnIfMissing(db, "privacy_settings", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	if err := setupGiftSearch(db); err != nil {
+		return err
+	}
+
+	return migrateSecurityAnswers(db)
+}
+
+// addColumnIfMissing adds a column to an existing table so older databases pick up new fields.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %w", table, column, err)
+	}
+	return nil
+}
+
+// hasColumn reports whether the table has the column.
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect %s table: %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// migrateContentBlobsOwner rebuilds a content_blobs table from before
+// encryption, whose primary key was the checksum alone, so that each owner
+// can have their own encrypted copy of the same content.
+func migrateContentBlobsOwner(db *sql.DB) error {
+	exists, err := hasColumn(db, "content_blobs", "owner_id")
+	if err != nil || exists {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range []string{
+		"ALTER TABLE content_blobs RENAME TO content_blobs_old",
+		`CREATE TABLE content_blobs (
+			sha256 TEXT NOT NULL,
+			owner_id INTEGER NOT NULL DEFAULT 0,
+			storage_key TEXT NOT NULL UNIQUE,
+			size INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (sha256, owner_id)
+		)`,
+		"INSERT INTO content_blobs (sha256, owner_id, storage_key, size, created_at) SELECT sha256, 0, storage_key, size, created_at FROM content_blobs_old",
+		"DROP TABLE content_blobs_old",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return fmt.Errorf("failed to migrate content_blobs table: %w", err)
+		}
+	}
+	return tx.Commit()
 }
 
 func getMessageNotificationHandler(w http.ResponseWriter, r *http.Request) {
@@ -218,7 +715,7 @@ func getMessageNotificationHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleGet(w, r) {
 		return
 	}
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
@@ -242,16 +739,17 @@ func getPrivacyHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleGet(w, r) {
 		return
 	}
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
 
 	var canReceiveMessages, canBeSeen, canReceiveGifts bool
+	photos := photoPrivacy{KeepOrientation: true}
 	err := db.QueryRow(`
-		SELECT can_receive_messages, can_be_seen, can_receive_gifts
+		SELECT can_receive_messages, can_be_seen, can_receive_gifts, keep_photo_metadata, keep_photo_orientation
 		FROM privacy_settings WHERE user_id = ?`, userID).Scan(
-		&canReceiveMessages, &canBeSeen, &canReceiveGifts)
+		&canReceiveMessages, &canBeSeen, &canReceiveGifts, &photos.KeepMetadata, &photos.KeepOrientation)
 
 	if err == sql.ErrNoRows {
 		// Return default settings if none exist
@@ -262,9 +760,11 @@ func getPrivacyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	json.NewEncoder(w).Encode(map[string]bool{
-		"canReceiveMessages": canReceiveMessages,
-		"canBeSeen":          canBeSeen,
-		"canReceiveGifts":    canReceiveGifts,
+		"canReceiveMessages":   canReceiveMessages,
+		"canBeSeen":            canBeSeen,
+		"canReceiveGifts":      canReceiveGifts,
+		"keepPhotoMetadata":    photos.KeepMetadata,
+		"keepPhotoOrientation": photos.KeepOrientation,
 	})
 }
 
@@ -275,29 +775,42 @@ func updatePrivacyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Username           string `json:"username"`
-		CanReceiveMessages bool   `json:"canReceiveMessages"`
-		CanBeSeen          bool   `json:"canBeSeen"`
-		CanReceiveGifts    bool   `json:"canReceiveGifts"`
+		CanReceiveMessages bool `json:"canReceiveMessages"`
+		CanBeSeen          bool `json:"canBeSeen"`
+		CanReceiveGifts    bool `json:"canReceiveGifts"`
+		// The photo settings are left as they are when omitted, so older
+		// clients do not turn orientation keeping off.
+		KeepPhotoMetadata    *bool `json:"keepPhotoMetadata"`
+		KeepPhotoOrientation *bool `json:"keepPhotoOrientation"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
 
+	photos := loadPhotoPrivacy(userID)
+	if req.KeepPhotoMetadata != nil {
+		photos.KeepMetadata = *req.KeepPhotoMetadata
+	}
+	if req.KeepPhotoOrientation != nil {
+		photos.KeepOrientation = *req.KeepPhotoOrientation
+	}
+
 	_, err := db.Exec(`
-		INSERT INTO privacy_settings (user_id, can_receive_messages, can_be_seen, can_receive_gifts)
-		VALUES (?, ?, ?, ?)
+		INSERT INTO privacy_settings (user_id, can_receive_messages, can_be_seen, can_receive_gifts, keep_photo_metadata, keep_photo_orientation)
+		VALUES (?, ?, ?, ?, ?, ?)
 		ON CONFLICT(user_id) DO UPDATE SET 
 		can_receive_messages = excluded.can_receive_messages,
 		can_be_seen = excluded.can_be_seen,
-		can_receive_gifts = excluded.can_receive_gifts
-	`, userID, req.CanReceiveMessages, req.CanBeSeen, req.CanReceiveGifts)
+		can_receive_gifts = excluded.can_receive_gifts,
+		keep_photo_metadata = excluded.keep_photo_metadata,
+		keep_photo_orientation = excluded.keep_photo_orientation
+	`, userID, req.CanReceiveMessages, req.CanBeSeen, req.CanReceiveGifts, photos.KeepMetadata, photos.KeepOrientation)
 
 	if err != nil {
 		http.Error(w, "Failed to update privacy settings", http.StatusInternalServerError)
@@ -320,7 +833,6 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Sender   string `json:"sender"`
 		Receiver string `json:"receiver"`
 		Content  string `json:"content"`
 	}
@@ -330,14 +842,16 @@ func sendMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Debug logs to help troubleshoot
-	log.Printf("Message from %s to %s: %s", req.Sender, req.Receiver, req.Content)
-
-	var senderID, receiverID int
-	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Sender).Scan(&senderID); err != nil {
-		http.Error(w, "Sender not found", http.StatusNotFound)
+	// The sender is always the signed-in user.
+	senderID, senderName, ok := currentUsername(w, r)
+	if !ok {
 		return
 	}
+
+	// Debug logs to help troubleshoot
+	log.Printf("Message from %s to %s: %s", senderName, req.Receiver, req.Content)
+
+	var receiverID int
 	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Receiver).Scan(&receiverID); err != nil {
 		http.Error(w, "Receiver not found", http.StatusNotFound)
 		return
@@ -390,7 +904,7 @@ func getMessagesHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleGet(w, r) {
 		return
 	}
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
@@ -460,24 +974,14 @@ func swaggerHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func generateRandomPassword(length int) (string, error) {
-	const charset = "abcdefghijklmnopqrstuvwxyz" +
-		"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789!@#$%^&*()_+"
-	password := make([]byte, length)
-	for i := range password {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
-		if err != nil {
-			return "", err
-		}
-		password[i] = charset[num.Int64()]
-	}
-	return string(password), nil
-}
-
 func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, DELETE")
-	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	(*w).Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+	(*w).Header().Set("Access-Control-Allow-Credentials", "true")
+	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, DELETE, HEAD, PATCH")
+	(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range, If-None-Match, If-Modified-Since, "+
+		"Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+	(*w).Header().Set("Access-Control-Expose-Headers", "Content-Range, Content-Length, Accept-Ranges, ETag, Last-Modified, "+
+		"Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Upload-Offset, Upload-Length, Upload-Expires, Gift-Id")
 	(*w).Header().Set("Access-Control-Max-Age", "3600")
 }
 
@@ -523,11 +1027,14 @@ func createAccountHandler(w http.ResponseWriter, r *http.Request) {
 	defer stmt.Close()
 
 	// If SecondaryContactEmails is empty, pass an empty string.
-	_, err = stmt.Exec(user.Username, hashedPassword, user.PrimaryContactEmail, user.SecondaryContactEmails)
+	res, err := stmt.Exec(user.Username, hashedPassword, user.PrimaryContactEmail, user.SecondaryContactEmails)
 	if err != nil {
 		http.Error(w, "Registration failed", http.StatusInternalServerError)
 		return
 	}
+	if userID, err := res.LastInsertId(); err == nil {
+		updateContactEmailVerification(int(userID), nil)
+	}
 
 	w.WriteHeader(http.StatusCreated)
 	w.Write([]byte("Account created successfully"))
@@ -542,14 +1049,14 @@ func giftCountHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleGet(w, r) {
 		return
 	}
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
 
 	// Count the number of gifts for this user.
 	var count int
-	err := db.QueryRow("SELECT COUNT(*) FROM gifts WHERE user_id = ?", userID).Scan(&count)
+	err := db.QueryRow("SELECT COUNT(*) FROM gifts WHERE user_id = ? AND deleted_at IS NULL", userID).Scan(&count)
 	if err != nil {
 		http.Error(w, "Error retrieving gift count", http.StatusInternalServerError)
 		return
@@ -568,13 +1075,13 @@ func pendingGiftsHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleGet(w, r) {
 		return
 	}
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
-	// Count pending gifts using the pending boolean.
+	// Count gifts still waiting to be sent.
 	var pendingCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM gifts WHERE user_id = ? AND pending = 1", userID).Scan(&pendingCount)
+	err := db.QueryRow("SELECT COUNT(*) FROM gifts WHERE user_id = ? AND "+deliverableGiftSQL, userID).Scan(&pendingCount)
 	if err != nil {
 		log.Printf("Error retrieving pending messages count: %v", err)
 		http.Error(w, "Error retrieving pending messages count", http.StatusInternalServerError)
@@ -596,48 +1103,64 @@ func downloadGiftHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Gift id is required", http.StatusBadRequest)
 		return
 	}
+	giftID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "Invalid gift ID format", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorizeGift(w, r, giftID, giftActionView); !ok {
+		return
+	}
 
-	var fileName string
-	var fileData []byte
 	// Log the ID being requested
 	log.Printf("Attempting to download gift with ID: %s", id)
 
-	err := db.QueryRow("SELECT file_name, file_data FROM gifts WHERE id = ?", id).Scan(&fileName, &fileData)
+	// A single file of a bundle can be requested with attachment=<id>.
+	var file *giftFile
+	if attachment := r.URL.Query().Get("attachment"); attachment != "" {
+		attachmentID, convErr := strconv.Atoi(attachment)
+		if convErr != nil {
+			http.Error(w, "Invalid attachment ID format", http.StatusBadRequest)
+			return
+		}
+		file, err = openGiftAttachmentFile(giftID, attachmentID)
+	} else {
+		file, err = openGiftFile(giftID)
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "Gift not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
+		// For example an encrypted file whose data key cannot be unwrapped.
 		log.Printf("Error retrieving gift (ID: %s): %v", id, err)
-		http.Error(w, "Gift not found", http.StatusNotFound)
+		http.Error(w, "Error retrieving gift", http.StatusInternalServerError)
 		return
 	}
+	defer file.Close()
 
-	if len(fileData) == 0 {
+	if file.Size == 0 {
 		log.Printf("Empty file data for gift ID: %s", id)
 		http.Error(w, "No file data available", http.StatusInternalServerError)
 		return
 	}
 
-	// Determine Content-Type
-	contentType := "application/octet-stream"
-	lowerName := strings.ToLower(fileName)
-	switch {
-	case strings.HasSuffix(lowerName, ".jpg"), strings.HasSuffix(lowerName, ".jpeg"):
-		contentType = "image/jpeg"
-	case strings.HasSuffix(lowerName, ".png"):
-		contentType = "image/png"
-	case strings.HasSuffix(lowerName, ".gif"):
-		contentType = "image/gif"
-	case strings.HasSuffix(lowerName, ".pdf"):
-		contentType = "application/pdf"
-	case strings.HasSuffix(lowerName, ".txt"):
-		contentType = "text/plain"
+	// Use the type detected at upload; older gifts fall back to their extension
+	contentType := file.MimeType
+	if contentType == "" {
+		contentType = contentTypeFromName(file.Name)
 	}
 
 	// Log successful retrieval
-	log.Printf("Serving file: %s (Type: %s, Size: %d bytes)", fileName, contentType, len(fileData))
+	log.Printf("Serving file: %s (Type: %s, Size: %d bytes)", file.Name, contentType, file.Size)
 
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"%s\"", fileName)) // Added quotes for filenames with spaces
-	w.WriteHeader(http.StatusOK)
-	w.Write(fileData)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition(contentType, file.Name))
+	w.Header().Set("ETag", file.ETag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	// ServeContent answers Range, If-None-Match and If-Modified-Since requests.
+	http.ServeContent(w, r, file.Name, file.ModTime, file.Content)
 }
 
 func getGiftsHandler(w http.ResponseWriter, r *http.Request) {
@@ -651,39 +1174,36 @@ func getGiftsHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request method"})
 		return
 	}
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Username is required"})
+	userID, ok := currentUserID(w, r)
+	if !ok {
 		return
 	}
-	var userID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	// Newest first unless asked otherwise, see giftlistings.go.
+	query, err := parseGiftListQuery(r.URL.Query(), userID, "uploadTime", "desc")
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
 		return
 	}
-	rows, err := db.Query("SELECT id, file_name, custom_message, upload_time, pending FROM gifts WHERE user_id = ? ORDER BY upload_time DESC", userID)
+	gifts := []Gift{}
+	page, err := listGiftPage(query, "g.id, COALESCE(g.file_name, ''), COALESCE(g.custom_message, ''), g.upload_time, g.pending, g.cancelled, COALESCE(g.gift_type, 'file'), COALESCE(g.scheduled_release, '')",
+		func(rows *sql.Rows) (int, error) {
+			var gift Gift
+			err := rows.Scan(&gift.ID, &gift.FileName, &gift.CustomMessage, &gift.UploadTime, &gift.Pending, &gift.Cancelled, &gift.Type, &gift.ScheduledRelease)
+			gifts = append(gifts, gift)
+			return gift.ID, err
+		})
 	if err != nil {
+		log.Printf("Error listing gifts of user %d: %v", userID, err)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Error retrieving gifts"})
 		return
 	}
-	defer rows.Close()
-	var gifts []Gift
-	for rows.Next() {
-		var gift Gift
-		if err := rows.Scan(&gift.ID, &gift.FileName, &gift.CustomMessage, &gift.UploadTime, &gift.Pending); err != nil {
-			continue
-		}
-		gifts = append(gifts, gift)
-	}
+	page.Items = gifts
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(gifts)
+	json.NewEncoder(w).Encode(page)
 }
 func isValidUsername(username string) bool {
 	matched, _ := regexp.MatchString(`^[a-zA-Z0-9_]{4,20}$`, username)
@@ -713,10 +1233,9 @@ func personalDetailsHandler(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodGet:
-		// Retrieve user details.
-		username := r.URL.Query().Get("username")
-		if username == "" {
-			http.Error(w, "Username is required", http.StatusBadRequest)
+		// Retrieve the signed-in user's details.
+		userID, username, ok := currentUsername(w, r)
+		if !ok {
 			return
 		}
 
@@ -727,16 +1246,12 @@ func personalDetailsHandler(w http.ResponseWriter, r *http.Request) {
 			Username               string         `json:"username"`
 			PrimaryContactEmail    sql.NullString `json:"-"`
 			SecondaryContactEmails sql.NullString `json:"-"`
-			SecurityQuestion       sql.NullString `json:"-"`
-			SecurityAnswer         sql.NullString `json:"-"`
 		}
 
 		err := db.QueryRow(`
-            SELECT username, primary_contact_email, secondary_contact_emails, 
-                   security_question, security_answer 
-            FROM users WHERE username = ?`, username).
-			Scan(&user.Username, &user.PrimaryContactEmail, &user.SecondaryContactEmails,
-				&user.SecurityQuestion, &user.SecurityAnswer)
+            SELECT username, primary_contact_email, secondary_contact_emails 
+            FROM users WHERE id = ?`, userID).
+			Scan(&user.Username, &user.PrimaryContactEmail, &user.SecondaryContactEmails)
 
 		if err != nil {
 			log.Printf("Error retrieving user details for %s: %v", username, err)
@@ -754,7 +1269,6 @@ func personalDetailsHandler(w http.ResponseWriter, r *http.Request) {
 			"primary_contact_email":    "",
 			"secondary_contact_emails": "",
 			"security_question":        "",
-			"security_answer":          "",
 		}
 
 		// Only set values if they're valid (not NULL)
@@ -764,11 +1278,15 @@ func personalDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		if user.SecondaryContactEmails.Valid {
 			response["secondary_contact_emails"] = user.SecondaryContactEmails.String
 		}
-		if user.SecurityQuestion.Valid {
-			response["security_question"] = user.SecurityQuestion.String
+		// Only the first question is shown here; answers are never returned.
+		questions, err := loadSecurityQuestions(userID)
+		if err != nil {
+			log.Printf("Error retrieving security questions for %s: %v", username, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
 		}
-		if user.SecurityAnswer.Valid {
-			response["security_answer"] = user.SecurityAnswer.String
+		if len(questions) > 0 {
+			response["security_question"] = questions[0].Question
 		}
 
 		// Log retrieved data for debugging
@@ -783,24 +1301,49 @@ func personalDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 	case http.MethodPost:
-		// Rest of your POST code remains the same
+		userID, username, ok := currentUsername(w, r)
+		if !ok {
+			return
+		}
 		var user User
 		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
+		user.Username = username
 
 		log.Printf("POST /update-emails - Updating details for user: %s", user.Username)
 		log.Printf("Received data: primaryEmail=%s, secondaryEmails=%s",
 			user.PrimaryContactEmail, user.SecondaryContactEmails)
 
+		// The form's single question maps to the user's first security question.
+		// Leaving the answer blank keeps the stored one if the question is unchanged.
+		if strings.TrimSpace(user.SecurityQuestion) != "" {
+			err := setPrimarySecurityQuestion(userID, securityQuestionInput{Question: user.SecurityQuestion, Answer: user.SecurityAnswer})
+			if err == errSecurityAnswerRequired {
+				http.Error(w, "Please provide an answer for the new security question", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				log.Printf("Error saving security question for %s: %v", user.Username, err)
+				http.Error(w, "Update failed", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		// Only addresses added by this update are sent a verification link.
+		_, previousEmails, err := userContactEmails(userID)
+		if err != nil {
+			log.Printf("Error loading contact emails for %s: %v", user.Username, err)
+			http.Error(w, "Update failed", http.StatusInternalServerError)
+			return
+		}
+
 		stmt, err := db.Prepare(`
             UPDATE users SET 
                 primary_contact_email = ?, 
-                secondary_contact_emails = ?, 
-                security_question = ?,
-                security_answer = ? 
-            WHERE username = ?`)
+                secondary_contact_emails = ? 
+            WHERE id = ?`)
 		if err != nil {
 			log.Printf("Error preparing update statement: %v", err)
 			http.Error(w, fmt.Sprintf("Update failed: %v", err), http.StatusInternalServerError)
@@ -811,9 +1354,7 @@ func personalDetailsHandler(w http.ResponseWriter, r *http.Request) {
 		res, err := stmt.Exec(
 			user.PrimaryContactEmail,
 			user.SecondaryContactEmails,
-			user.SecurityQuestion,
-			user.SecurityAnswer,
-			user.Username)
+			userID)
 		if err != nil {
 			log.Printf("Error executing update: %v", err)
 			http.Error(w, fmt.Sprintf("Update failed: %v", err), http.StatusInternalServerError)
@@ -833,6 +1374,8 @@ func personalDetailsHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		updateContactEmailVerification(userID, previousEmails)
+
 		log.Printf("Successfully updated details for user: %s", user.Username)
 		w.Header().Set("Content-Type", "text/plain")
 		w.WriteHeader(http.StatusOK)
@@ -853,8 +1396,12 @@ func verifySecurityAnswerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		Username       string `json:"username"`
+		Username string `json:"username"`
+		// Email identifies the account instead of username, as in /get-security-info.
+		Email          string `json:"email"`
 		SecurityAnswer string `json:"securityAnswer"`
+		// Answers keyed by question id, for users with more than one question.
+		Answers map[int]string `json:"answers"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -862,15 +1409,49 @@ func verifySecurityAnswerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Log the received values for debugging
-	log.Printf("Verifying security answer for %s: '%s'", req.Username, req.SecurityAnswer)
+	ip := clientIP(r)
+	if throttled(w, ipAttemptKey(ip)) {
+		return
+	}
+
+	writeIncorrectAnswer := func() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Incorrect security answer"})
+	}
+	// Asked by email, addresses without an account or questions fail like wrong
+	// answers, so that they do not reveal which addresses have accounts.
+	refuseUnknownEmail := func() {
+		checkDecoySecurityAnswer(req.SecurityAnswer)
+		if _, err := recordFailedAttempt(ipAttemptKey(ip), ipAttemptPolicy); err != nil {
+			log.Printf("Error recording failed attempt for %s: %v", ip, err)
+		}
+		writeIncorrectAnswer()
+	}
 
-	var storedQuestion, storedAnswer string
-	err := db.QueryRow("SELECT security_question, security_answer FROM users WHERE username = ?",
-		req.Username).Scan(&storedQuestion, &storedAnswer)
+	var userID int
+	var err error
+	byEmail := req.Username == "" && req.Email != ""
+	if byEmail {
+		log.Printf("Verifying security answers by email")
+		if userID, err = findUserIDByVerifiedEmail(strings.TrimSpace(req.Email)); err == sql.ErrNoRows {
+			refuseUnknownEmail()
+			return
+		}
+	} else {
+		log.Printf("Verifying security answers for %s", req.Username)
+		err = db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID)
+	}
+	var totpEnabled bool
+	if err == nil {
+		err = db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&totpEnabled)
+	}
 	if err != nil {
 		log.Printf("Error retrieving security info: %v", err)
 		if err == sql.ErrNoRows {
+			if _, err := recordFailedAttempt(ipAttemptKey(ip), ipAttemptPolicy); err != nil {
+				log.Printf("Error recording failed attempt for %s: %v", ip, err)
+			}
 			http.Error(w, "User not found", http.StatusNotFound)
 		} else {
 			http.Error(w, "Database error", http.StatusInternalServerError)
@@ -878,44 +1459,57 @@ func verifySecurityAnswerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Log the values from database for debugging
-	log.Printf("Stored security answer for %s: '%s'", req.Username, storedAnswer)
+	// Security answers share the account's failed-attempt counter with passwords.
+	if throttled(w, accountAttemptKey(userID)) {
+		return
+	}
 
-	if storedQuestion == "" || storedAnswer == "" {
+	questions, err := loadSecurityQuestions(userID)
+	if err != nil {
+		log.Printf("Error retrieving security questions: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if len(questions) == 0 && byEmail {
+		refuseUnknownEmail()
+		return
+	}
+	if len(questions) == 0 {
 		http.Error(w, "Security question not set up for this user", http.StatusBadRequest)
 		return
 	}
 
-	// Case-insensitive comparison and trim spaces
-	userAnswer := strings.TrimSpace(strings.ToLower(req.SecurityAnswer))
-	dbAnswer := strings.TrimSpace(strings.ToLower(storedAnswer))
-
-	// Log the trimmed and lowercased values for comparison
-	log.Printf("Comparing: '%s' with '%s'", userAnswer, dbAnswer)
+	// The single answer field answers the first question.
+	answers := req.Answers
+	if answers == nil {
+		answers = map[int]string{}
+	}
+	if _, ok := answers[questions[0].ID]; !ok {
+		answers[questions[0].ID] = req.SecurityAnswer
+	}
 
-	if userAnswer != dbAnswer {
-		log.Printf("Security answer mismatch for %s", req.Username)
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Incorrect security answer"})
+	correct, err := checkSecurityAnswers(userID, answers)
+	if err != nil {
+		log.Printf("Error checking security answers: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !correct {
+		log.Printf("Security answer mismatch for user %d", userID)
+		recordAccountFailure(userID, ip)
+		writeIncorrectAnswer()
 		return
 	}
 
-	// Set force_password_change to true when security answer is used for login
-	_, err = db.Exec("UPDATE users SET force_password_change = 1 WHERE username = ?", req.Username)
-	if err != nil {
-		log.Printf("Failed to set force_password_change: %v", err)
-		// Continue anyway, as authentication was successful
+	// A security answer does not bypass two-factor authentication.
+	if totpEnabled {
+		writeTwoFactorChallenge(w, userID, twoFactorResetPurpose)
+		return
 	}
 
-	// If answer is correct, return success
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message":     "Security answer verified successfully",
-		"username":    req.Username,
-		"forceChange": "true",
-	})
+	// The answer only lets the user choose a new password; it does not sign them in.
+	clearFailedAttempts(accountAttemptKey(userID))
+	writeSecurityResetToken(w, userID)
 }
 
 func getSecurityInfoHandler(w http.ResponseWriter, r *http.Request) {
@@ -935,38 +1529,43 @@ func getSecurityInfoHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user info by email
-	var username string
-	var securityQuestion string
-	err := db.QueryRow(`
-        SELECT username, security_question 
-        FROM users 
-        WHERE primary_contact_email = ? OR secondary_contact_emails LIKE ?
-    `, req.Email, "%"+req.Email+"%").Scan(&username, &securityQuestion)
-
+	// Only verified addresses count. Any other address gets made-up questions,
+	// so the response does not reveal whether it belongs to an account.
+	email := strings.TrimSpace(req.Email)
+	var questions []securityQuestion
+	userID, err := findUserIDByVerifiedEmail(email)
+	if err == nil {
+		questions, err = loadSecurityQuestions(userID)
+	}
+	if err == nil && len(questions) == 0 {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		questions, err = decoySecurityQuestions(email)
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			log.Printf("Database error in getSecurityInfoHandler: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
+		log.Printf("Database error in getSecurityInfoHandler: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	// Return the security question and username
+	// securityQuestion is the first question, for clients that only ask one.
+	// Answers go to /verify-security-answer with the same email.
 	response := struct {
-		Username         string `json:"username"`
-		SecurityQuestion string `json:"securityQuestion"`
+		SecurityQuestion  string             `json:"securityQuestion"`
+		SecurityQuestions []securityQuestion `json:"securityQuestions"`
 	}{
-		Username:         username,
-		SecurityQuestion: securityQuestion,
+		SecurityQuestion:  questions[0].Question,
+		SecurityQuestions: questions,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// resetPasswordHandler starts a password reset. If the email belongs to an
+// account, a single-use link to set a new password is sent to it. The response
+// is the same whether or not the address is known so accounts cannot be enumerated.
 func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	if handleOptions(w, r) {
@@ -983,56 +1582,22 @@ func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Look up user by primary_contact_email (or secondary_contact_emails if needed)
-	var userID int
-	var currentHash string
-	err := db.QueryRow("SELECT id, password FROM users WHERE primary_contact_email = ? OR secondary_contact_emails = ?", req.Email, req.Email).Scan(&userID, &currentHash)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
-	newPassword, err := generateRandomPassword(12)
-	if err != nil {
-		http.Error(w, "Error generating new password", http.StatusInternalServerError)
-		return
-	}
-
-	hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, "Error generating password", http.StatusInternalServerError)
-		return
-	}
-
-	_, err = db.Exec("UPDATE users SET password = ?, force_password_change = 1 WHERE id = ?", hashed, userID)
-	if err != nil {
-		http.Error(w, "Error updating password", http.StatusInternalServerError)
-		return
-	}
-
-	smtpHost := "smtp.gmail.com"
-	smtpPort := 587
-	senderEmail := "f3243329@gmail.com"
-	senderPassword := "auca xxpm lziz vrjg"
-
-	m := gomail.NewMessage()
-	m.SetHeader("From", senderEmail)
-	m.SetHeader("Subject", "Your New Password")
-	m.SetHeader("To", req.Email)
-	body := fmt.Sprintf("Hello,\n\nYour new password is: %s\n\nYou will be required to change your password on next login.", newPassword)
-	m.SetBody("text/plain", body)
-
-	d := gomail.NewDialer(smtpHost, smtpPort, senderEmail, senderPassword)
-	if err := d.DialAndSend(m); err != nil {
-		log.Printf("Failed to send email for user %s: %v", req.Email, err)
-		fmt.Println("Failed to send email")
-	} else {
-		fmt.Println("Succeeded")
+	email := strings.TrimSpace(req.Email)
+	userID, err := findUserIDByVerifiedEmail(email)
+	if err == nil {
+		token, err := createPasswordResetToken(userID)
+		if err != nil {
+			log.Printf("Error creating password reset token for user %d: %v", userID, err)
+		} else {
+			sendPasswordResetEmail(email, token)
+		}
+	} else if err != sql.ErrNoRows {
+		log.Printf("Error looking up user for password reset: %v", err)
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Password reset instructions have been sent to your email."))
+	w.Write([]byte("If an account uses that email, password reset instructions have been sent to it."))
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -1057,15 +1622,23 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ip := clientIP(r)
+	if throttled(w, ipAttemptKey(ip)) {
+		return
+	}
+
 	var storedPassword string
-	var forceChange bool
+	var forceChange, totpEnabled bool
 	var userID int
 
-	err := db.QueryRow("SELECT id, password, force_password_change FROM users WHERE username = ?",
-		credentials.Username).Scan(&userID, &storedPassword, &forceChange)
+	err := db.QueryRow("SELECT id, password, force_password_change, totp_enabled FROM users WHERE username = ?",
+		credentials.Username).Scan(&userID, &storedPassword, &forceChange, &totpEnabled)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		if err == sql.ErrNoRows {
+			if _, err := recordFailedAttempt(ipAttemptKey(ip), ipAttemptPolicy); err != nil {
+				log.Printf("Error recording failed attempt for %s: %v", ip, err)
+			}
 			json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
 		} else {
 			json.NewEncoder(w).Encode(map[string]string{"error": "Login error"})
@@ -1074,24 +1647,27 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if throttled(w, accountAttemptKey(userID)) {
+		return
+	}
+
 	if err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(credentials.Password)); err != nil {
+		recordAccountFailure(userID, ip)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusUnauthorized)
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid username or password"})
 		return
 	}
 
-	response := struct {
-		Message     string `json:"message"`
-		ForceChange bool   `json:"forceChange"`
-	}{
-		Message:     "Login successful",
-		ForceChange: forceChange,
+	// Accounts with two-factor authentication finish logging in at /login/2fa,
+	// so failed attempts are only cleared once the second factor succeeds.
+	if totpEnabled {
+		writeTwoFactorChallenge(w, userID, twoFactorLoginPurpose)
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+	clearFailedAttempts(accountAttemptKey(userID))
+	writeLoginSuccess(w, r, userID, forceChange)
 }
 
 func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
@@ -1102,8 +1678,11 @@ func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 	if !handlePost(w, r) {
 		return
 	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
 	var req struct {
-		Username    string `json:"username"`
 		NewPassword string `json:"newPassword"`
 	}
 
@@ -1123,8 +1702,8 @@ func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec("UPDATE users SET password = ?, force_password_change = 0 WHERE username = ?",
-		hashedPassword, req.Username)
+	result, err := db.Exec("UPDATE users SET password = ?, force_password_change = 0 WHERE id = ?",
+		hashedPassword, userID)
 	if err != nil {
 		http.Error(w, "Failed to update password", http.StatusInternalServerError)
 		return
@@ -1141,6 +1720,11 @@ func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Anyone signed in with the old password is signed out; this session stays.
+	if _, err := revokeOtherSessions(userID, currentSessionID(r)); err != nil {
+		log.Printf("Error revoking other sessions for user %d: %v", userID, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Password changed successfully"})
@@ -1155,90 +1739,53 @@ func uploadGiftHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse multipart form with 10MB limit
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "Error parsing form", http.StatusBadRequest)
-		return
-	}
-
-	// Get username directly from form data
-	username := r.FormValue("username")
-	if username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
-		return
-	}
-
-	// Query the user ID from the database directly
-	var userID int
-	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			log.Printf("Database error: %v", err)
-			http.Error(w, "Database error", http.StatusInternalServerError)
-		}
+	// Gifts are always stored for the signed-in user.
+	userID, ok := currentUserID(w, r)
+	if !ok {
 		return
 	}
 
 	// Check if user allows receiving gifts
-	var canReceiveGifts bool = true // default to true
-	err := db.QueryRow("SELECT can_receive_gifts FROM privacy_settings WHERE user_id = ?", userID).Scan(&canReceiveGifts)
-	if err == nil && !canReceiveGifts {
+	if !canReceiveGifts(userID) {
 		http.Error(w, "User has disabled gift receiving", http.StatusForbidden)
 		return
 	}
 
-	// Get file from form data
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	// Read file data
-	fileData, err := io.ReadAll(file)
+	// Stream the file into blob storage as it arrives
+	upload, err := receiveGiftUpload(w, r, userID)
 	if err != nil {
-		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		writeUploadError(w, err)
 		return
 	}
 
-	// Get custom message
-	customMessage := r.FormValue("emailMessage")
-
 	// Store in database
-	result, err := db.Exec(
-		"INSERT INTO gifts (user_id, file_name, file_data, custom_message, pending) VALUES (?, ?, ?, ?, 1)",
-		userID, header.Filename, fileData, customMessage,
-	)
+	giftID, err := insertGift(userID, upload)
 	if err != nil {
-		log.Printf("Database insert error: %v", err)
 		http.Error(w, "Failed to store gift", http.StatusInternalServerError)
 		return
 	}
-
-	// Get the inserted gift ID
-	giftID, err := result.LastInsertId()
-	if err != nil {
-		log.Printf("Error getting last insert ID: %v", err)
-		http.Error(w, "Failed to retrieve gift ID", http.StatusInternalServerError)
-		return
-	}
+	queueThumbnails(giftID)
 
 	// Return success response with gift ID
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"message": "File uploaded successfully",
 		"giftId":  giftID,
-	})
+	}
+	if upload.Metadata != nil {
+		response["metadata"] = upload.Metadata
+	}
+	json.NewEncoder(w).Encode(response)
 }
 
+// stopPendingGiftHandler cancels the delivery of a gift, keeping the gift.
+// Setting up its receivers again schedules it anew; /delete-gift deletes it.
 func stopPendingGiftHandler(w http.ResponseWriter, r *http.Request) {
 	enableCors(&w)
 	if handleOptions(w, r) {
 		return
 	}
-	if r.Method != http.MethodDelete {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
 	}
@@ -1259,18 +1806,14 @@ func stopPendingGiftHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Ensure gift exists before deleting
-	var exists bool
-	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM gifts WHERE id = ?)", id).Scan(&exists)
-	if err != nil || !exists {
-		http.Error(w, "Gift not found", http.StatusNotFound)
+	// Ensure the gift exists and the caller may manage it before stopping it
+	if _, ok := authorizeGift(w, r, id, giftActionManage); !ok {
 		return
 	}
 
-	// Delete gift from database
-	_, err = db.Exec("DELETE FROM gifts WHERE id = ?", id)
-	if err != nil {
-		http.Error(w, "Failed to delete gift", http.StatusInternalServerError)
+	// Scheduled sends check the flag before sending.
+	if _, err := db.Exec("UPDATE gifts SET cancelled = 1 WHERE id = ?", id); err != nil {
+		http.Error(w, "Failed to stop gift", http.StatusInternalServerError)
 		return
 	}
 
@@ -1299,12 +1842,14 @@ func setupReceiversHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate that the gift exists and retrieve its details.
+	// Validate that the gift exists and the caller may manage it.
+	if _, ok := authorizeGift(w, r, req.GiftID, giftActionManage); !ok {
+		return
+	}
+
+	// Retrieve the gift's details.
 	var userID int
-	var fileName string
-	var fileData []byte
-	err := db.QueryRow("SELECT user_id, file_name, file_data FROM gifts WHERE id = ?", req.GiftID).
-		Scan(&userID, &fileName, &fileData)
+	err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ?", req.GiftID).Scan(&userID)
 	if err != nil {
 		log.Printf("Error retrieving gift: %v", err)
 		http.Error(w, "Gift not found", http.StatusNotFound)
@@ -1334,11 +1879,11 @@ func setupReceiversHandler(w http.ResponseWriter, r *http.Request) {
 	var updateErr error
 	if scheduledTimeSQL.Valid {
 		_, updateErr = db.Exec(
-			"UPDATE gifts SET receivers = ?, scheduled_release = ? WHERE id = ?",
+			"UPDATE gifts SET receivers = ?, scheduled_release = ?, cancelled = 0, schedule_generation = schedule_generation + 1 WHERE id = ?",
 			req.Receivers, scheduledTimeSQL.String, req.GiftID)
 	} else {
 		_, updateErr = db.Exec(
-			"UPDATE gifts SET receivers = ? WHERE id = ?",
+			"UPDATE gifts SET receivers = ?, cancelled = 0, schedule_generation = schedule_generation + 1 WHERE id = ?",
 			req.Receivers, req.GiftID)
 	}
 	if updateErr != nil {
@@ -1347,13 +1892,20 @@ func setupReceiversHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve the custom message stored in the gift record.
-	var storedCustomMessage string
-	err = db.QueryRow("SELECT custom_message FROM gifts WHERE id = ?", req.GiftID).Scan(&storedCustomMessage)
+	// Retrieve the custom message stored in the gift record, and the schedule
+	// this call set up.
+	var customMessage sql.NullString
+	var generation int
+	err = db.QueryRow("SELECT custom_message, schedule_generation FROM gifts WHERE id = ?", req.GiftID).Scan(&customMessage, &generation)
 	if err != nil {
-		log.Printf("Error retrieving custom message for gift %d: %v", req.GiftID, err)
-		// Fallback to the provided custom message if retrieval fails.
-		storedCustomMessage = req.CustomMessage
+		log.Printf("Error retrieving gift %d: %v", req.GiftID, err)
+		http.Error(w, "Failed to update gift", http.StatusInternalServerError)
+		return
+	}
+	// Fallback to the provided custom message if the gift has none.
+	storedCustomMessage := req.CustomMessage
+	if customMessage.Valid {
+		storedCustomMessage = customMessage.String
 	}
 
 	// In a separate goroutine, schedule sending of the gift email.
@@ -1381,19 +1933,33 @@ func setupReceiversHandler(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Waiting %v before sending gift email for gift %d", delay, req.GiftID)
 		time.Sleep(delay)
 
-		// Final check: verify the gift is still pending.
-		var stillPending bool
-		if err := db.QueryRow("SELECT pending FROM gifts WHERE id = ?", req.GiftID).Scan(&stillPending); err != nil {
+		// Final check: verify the gift is still pending, was not stopped or
+		// deleted, and was not scheduled again while waiting.
+		current, err := scheduledSendCurrent(req.GiftID, generation)
+		if err != nil {
 			log.Printf("Error checking pending status for gift %d: %v", req.GiftID, err)
 			return
 		}
-		if !stillPending {
-			log.Printf("Gift %d is no longer pending; aborting send.", req.GiftID)
+		if !current {
+			log.Printf("Gift %d is no longer pending or was rescheduled; aborting send.", req.GiftID)
+			return
+		}
+
+		// Load the whole bundle as it is now; attachments may have changed while waiting.
+		attachments, err := loadGiftAttachments(req.GiftID)
+		if err != nil {
+			log.Printf("Error reading attachments of gift %d: %v", req.GiftID, err)
+			return
+		}
+
+		memory, err := loadTextMemory(req.GiftID)
+		if err != nil {
+			log.Printf("Error reading memory of gift %d: %v", req.GiftID, err)
 			return
 		}
 
 		// Send the gift email to the receivers.
-		if err := sendGiftEmailToReceivers(fileName, fileData, storedCustomMessage, req.Receivers); err != nil {
+		if err := sendGiftEmailToReceivers(attachments, memory, storedCustomMessage, req.Receivers); err != nil {
 			log.Printf("Error sending gift email for gift %d: %v", req.GiftID, err)
 		} else {
 			// Mark the gift as no longer pending.
@@ -1410,7 +1976,19 @@ func setupReceiversHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Receivers set up successfully. Gift scheduled."))
 }
 
-func sendGiftEmailToReceivers(fileName string, fileData []byte, customMessage, receiversParam string) error {
+// scheduledSendCurrent reports whether the send scheduled by the
+// /setup-receivers call that left the gift at generation should still go out.
+// Stopping a gift and setting up its receivers again starts a new schedule, so
+// the earlier one must not send to its receivers at its time.
+func scheduledSendCurrent(giftID, generation int) (bool, error) {
+	var current bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM gifts WHERE id = ? AND schedule_generation = ? AND "+deliverableGiftSQL+")", giftID, generation).Scan(&current)
+	return current, err
+}
+
+// sendGiftEmailToReceivers emails every attachment of a gift bundle to its
+// receivers, or for a text gift its memory in the body.
+func sendGiftEmailToReceivers(attachments []giftAttachment, memory *textMemory, customMessage, receiversParam string) error {
 	// Parse the receivers from the comma-separated string.
 	var recipients []string
 	if receiversParam != "" {
@@ -1436,16 +2014,24 @@ func sendGiftEmailToReceivers(fileName string, fileData []byte, customMessage, r
 	m.SetHeader("To", recipients...)
 
 	var body string
+	var memories []textMemory
+	if memory != nil {
+		memories = append(memories, *memory)
+	}
 	if customMessage != "" {
 		body = customMessage
+	} else if memory != nil {
+		body = "Hello,\n\nA memory has been left for you: " + memory.Title
 	} else {
-		body = fmt.Sprintf("Hello,\n\nPlease find attached your parting gift: %s", fileName)
+		names := make([]string, len(attachments))
+		for i, a := range attachments {
+			names[i] = a.FileName
+		}
+		body = fmt.Sprintf("Hello,\n\nPlease find attached your parting gift: %s", strings.Join(names, ", "))
 	}
-	m.SetBody("text/plain", body)
-	m.Attach(fileName, gomail.SetCopyFunc(func(w io.Writer) error {
-		_, err := w.Write(fileData)
-		return err
-	}))
+	body += attachmentCaptions(attachments)
+	setGiftEmailBody(m, body, memories)
+	attachBundle(m, attachments)
 
 	d := gomail.NewDialer(smtpHost, smtpPort, senderEmail, senderPassword)
 	if err := d.DialAndSend(m); err != nil {
@@ -1466,27 +2052,13 @@ func GetReceiverHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request method"})
 		return
 	}
-	// Get username from query parameters.
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(map[string]string{"error": "Username is required"})
-		return
-	}
-
-	// First, retrieve the user ID based on the username.
-	var userID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
-	if err != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
+	userID, ok := currentUserID(w, r)
+	if !ok {
 		return
 	}
 
 	// Now query the gifts table for all receivers linked to this user.
-	rows, err := db.Query("SELECT receivers FROM gifts WHERE user_id = ? AND receivers IS NOT NULL AND receivers <> ''", userID)
+	rows, err := db.Query("SELECT receivers FROM gifts WHERE user_id = ? AND receivers IS NOT NULL AND receivers <> '' AND deleted_at IS NULL", userID)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -1531,30 +2103,35 @@ func scheduleInactivityCheckHandler(w http.ResponseWriter, r *http.Request) {
 	if !handlePost(w, r) {
 		return
 	}
-	// Expect payload with username and customMessage.
+	userID, username, ok := currentUsername(w, r)
+	if !ok {
+		return
+	}
+	// Expect payload with customMessage.
 	var req struct {
-		Username      string `json:"username"`
 		CustomMessage string `json:"customMessage"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	// Get the user's primary email and id.
-	var primaryEmail string
-	var userID int
-	err := db.QueryRow("SELECT id, primary_contact_email FROM users WHERE username = ?", req.Username).Scan(&userID, &primaryEmail)
+	// Check-ins only go to a verified primary email.
+	primaryEmail, err := verifiedPrimaryEmail(userID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
+	if primaryEmail == "" {
+		http.Error(w, "Please verify your primary contact email before scheduling a check-in", http.StatusConflict)
+		return
+	}
 
 	// Schedule the inactivity check and gift sending in a separate goroutine.
 	go func() {
 		// A helper to check if there is any pending gift for this user.
 		hasPending := func() bool {
 			var exists bool
-			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM gifts WHERE user_id = ? AND pending = 1)", userID).Scan(&exists)
+			err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM gifts WHERE user_id = ? AND "+deliverableGiftSQL+")", userID).Scan(&exists)
 			return err != nil || exists
 		}
 
@@ -1563,14 +2140,20 @@ func scheduleInactivityCheckHandler(w http.ResponseWriter, r *http.Request) {
 			time.Sleep(10 * time.Second)
 			// If there are no pending gifts, abort.
 			if !hasPending() {
-				log.Printf("No pending gifts for user %s; aborting inactivity check.", req.Username)
+				log.Printf("No pending gifts for user %s; aborting inactivity check.", username)
 				return
 			}
 		}
 
 		// Before sending the inactivity check email, re-check.
 		if !hasPending() {
-			log.Printf("No pending gifts for user %s; aborting inactivity check email.", req.Username)
+			log.Printf("No pending gifts for user %s; aborting inactivity check email.", username)
+			return
+		}
+
+		// The address may have been changed since the check-in was scheduled.
+		if current, err := verifiedPrimaryEmail(userID); err != nil || current != primaryEmail {
+			log.Printf("Primary email for user %s changed or is unverified; aborting inactivity check email.", username)
 			return
 		}
 
@@ -1587,37 +2170,51 @@ func scheduleInactivityCheckHandler(w http.ResponseWriter, r *http.Request) {
 		for i := 0; i < 6; i++ {
 			time.Sleep(10 * time.Second)
 			if !hasPending() {
-				log.Printf("No pending gifts for user %s; aborting gift email send.", req.Username)
+				log.Printf("No pending gifts for user %s; aborting gift email send.", username)
 				return
 			}
 		}
 
 		// Retrieve the latest receivers.
 		var latestReceivers string
-		if err := db.QueryRow("SELECT receivers FROM users WHERE username = ?", req.Username).Scan(&latestReceivers); err != nil {
-			log.Printf("Error retrieving receivers for user %s: %v", req.Username, err)
+		if err := db.QueryRow("SELECT receivers FROM users WHERE id = ?", userID).Scan(&latestReceivers); err != nil {
+			log.Printf("Error retrieving receivers for user %s: %v", username, err)
 			return
 		}
 		// Retrieve all pending gifts for this user.
-		rows, err := db.Query("SELECT file_name, file_data, custom_message FROM gifts WHERE user_id = ? AND pending = 1", userID)
+		rows, err := db.Query("SELECT id, custom_message FROM gifts WHERE user_id = ? AND "+deliverableGiftSQL, userID)
 		if err != nil {
-			log.Printf("Error retrieving pending gifts for user %s: %v", req.Username, err)
+			log.Printf("Error retrieving pending gifts for user %s: %v", username, err)
 			return
 		}
-		defer rows.Close()
 		var gifts []Gift
 		for rows.Next() {
 			var g Gift
-			if err := rows.Scan(&g.FileName, &g.FileData, &g.CustomMessage); err != nil {
+			if err := rows.Scan(&g.ID, &g.CustomMessage); err != nil {
 				continue
 			}
 			gifts = append(gifts, g)
 		}
+		rows.Close()
+		// Load the bundles once the gift rows have been read.
+		loaded := gifts[:0]
+		for _, g := range gifts {
+			if g.Attachments, err = loadGiftAttachments(g.ID); err != nil {
+				log.Printf("Error reading gift %d for user %s: %v", g.ID, username, err)
+				continue
+			}
+			if g.Memory, err = loadTextMemory(g.ID); err != nil {
+				log.Printf("Error reading memory of gift %d for user %s: %v", g.ID, username, err)
+				continue
+			}
+			loaded = append(loaded, g)
+		}
+		gifts = loaded
 		// Send the gift email with all pending gifts attached.
 		if err := sendAllGiftsEmail(primaryEmail, gifts, req.CustomMessage, latestReceivers); err != nil {
-			log.Printf("Error sending gift email for user %s: %v", req.Username, err)
+			log.Printf("Error sending gift email for user %s: %v", username, err)
 		} else {
-			log.Printf("Gift email sent successfully to receivers for user %s", req.Username)
+			log.Printf("Gift email sent successfully to receivers for user %s", username)
 		}
 	}()
 	w.Header().Set("Content-Type", "text/plain")
@@ -1647,13 +2244,17 @@ func sendAllGiftsEmail(primaryEmail string, gifts []Gift, customMessage, receive
 	if customMessage != "" {
 		body = fmt.Sprintf("%s\n\n%s", body, customMessage)
 	}
-	m.SetBody("text/plain", body)
+	var attachments []giftAttachment
+	var memories []textMemory
 	for _, g := range gifts {
-		m.Attach(g.FileName, gomail.SetCopyFunc(func(w io.Writer) error {
-			_, err := w.Write(g.FileData)
-			return err
-		}))
+		attachments = append(attachments, g.Attachments...)
+		if g.Memory != nil {
+			memories = append(memories, *g.Memory)
+		}
 	}
+	body += attachmentCaptions(attachments)
+	setGiftEmailBody(m, body, memories)
+	attachBundle(m, attachments)
 	d := gomail.NewDialer(smtpHost, smtpPort, senderEmail, senderPassword)
 	return d.DialAndSend(m)
 }
@@ -1682,23 +2283,17 @@ func giftCalendarHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleGet(w, r) {
 		return
 	}
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
 
-	// Get all gifts with scheduled release dates
-	rows, err := db.Query(`
-        SELECT id, file_name, custom_message, scheduled_release, pending, receivers
-        FROM gifts 
-        WHERE user_id = ? 
-        ORDER BY scheduled_release ASC
-    `, userID)
+	// Soonest release first unless asked otherwise, see giftlistings.go.
+	query, err := parseGiftListQuery(r.URL.Query(), userID, "scheduledRelease", "asc")
 	if err != nil {
-		http.Error(w, "Error retrieving gift calendar", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer rows.Close()
 
 	type CalendarEvent struct {
 		ID          int    `json:"id"`
@@ -1710,16 +2305,14 @@ func giftCalendarHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	events := make([]CalendarEvent, 0)
-	rowCount := 0
-	for rows.Next() {
-		rowCount++
+	page, err := listGiftPage(query, "g.id, g.file_name, g.custom_message, g.scheduled_release, g.pending, g.receivers", func(rows *sql.Rows) (int, error) {
 		var fileName, message, releaseDate sql.NullString
 		var receivers sql.NullString
 		var pending bool
 		var id int
 
 		if err := rows.Scan(&id, &fileName, &message, &releaseDate, &pending, &receivers); err != nil {
-			continue
+			return 0, err
 		}
 
 		title := "Gift"
@@ -1746,15 +2339,17 @@ func giftCalendarHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		events = append(events, event)
-	}
-	if err = rows.Err(); err != nil {
-		log.Printf("Error after row iteration: %v", err)
-		http.Error(w, "Error processing gift data", http.StatusInternalServerError)
+		return id, nil
+	})
+	if err != nil {
+		log.Printf("Error listing the gift calendar: %v", err)
+		http.Error(w, "Error retrieving gift calendar", http.StatusInternalServerError)
 		return
 	}
+	page.Items = events
 
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(events); err != nil {
+	if err := json.NewEncoder(w).Encode(page); err != nil {
 		http.Error(w, "Error generating response", http.StatusInternalServerError)
 		return
 	}
@@ -1768,7 +2363,7 @@ func getFollowersHandler(w http.ResponseWriter, r *http.Request) {
 	if !handleGet(w, r) {
 		return
 	}
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
@@ -1827,9 +2422,9 @@ func getFollowingHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
-		return // Error response already sent by QueryUser
+		return // Error response already sent by currentUserID
 	}
 
 	var followingList string
@@ -1887,9 +2482,9 @@ func discoverUsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
-		return // Error response already sent by QueryUser
+		return // Error response already sent by currentUserID
 	}
 
 	// Get the list of users the current user is already following
@@ -2005,8 +2600,12 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
 	var req struct {
-		Username       string `json:"username"`
 		FriendUsername string `json:"friendUsername"`
 	}
 
@@ -2015,15 +2614,9 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the user IDs
-	var userID, friendID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
-	err = db.QueryRow("SELECT id FROM users WHERE username = ?", req.FriendUsername).Scan(&friendID)
+	// Get the friend's user ID
+	var friendID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.FriendUsername).Scan(&friendID)
 	if err != nil {
 		http.Error(w, "Friend not found", http.StatusNotFound)
 		return
@@ -2102,8 +2695,12 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
 	var req struct {
-		Username       string `json:"username"`
 		FriendUsername string `json:"friendUsername"`
 	}
 
@@ -2112,15 +2709,9 @@ func unfollowUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get the user IDs
-	var userID, friendID int
-	err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.Username).Scan(&userID)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
-
-	err = db.QueryRow("SELECT id FROM users WHERE username = ?", req.FriendUsername).Scan(&friendID)
+	// Get the friend's user ID
+	var friendID int
+	err := db.QueryRow("SELECT id FROM users WHERE username = ?", req.FriendUsername).Scan(&friendID)
 	if err != nil {
 		http.Error(w, "Friend not found", http.StatusNotFound)
 		return
@@ -2269,7 +2860,7 @@ func getEligibleMessagingUsersHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID, boolval := QueryUser(w, r)
+	userID, boolval := currentUserID(w, r)
 	if !boolval {
 		return
 	}
@@ -2375,18 +2966,3 @@ func handlePost(w http.ResponseWriter, r *http.Request) bool {
 	}
 	return true
 }
-
-func QueryUser(w http.ResponseWriter, r *http.Request) (int, bool) {
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		http.Error(w, "Username is required", http.StatusBadRequest)
-		return 0, false
-	}
-
-	var userID int
-	if err := db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID); err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return 0, false
-	}
-	return userID, true
-}
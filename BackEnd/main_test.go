@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -77,6 +78,15 @@ func setupTestDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Add any tables the handlers rely on that are not declared above.
+	if err := createTables(db); err != nil {
+		return nil, err
+	}
+	// Gift files go to a blob table in the same in-memory database.
+	if giftStore, err = newSQLiteBlobStore(db); err != nil {
+		return nil, err
+	}
+
 	return db, nil
 }
 
@@ -89,6 +99,26 @@ func performRequest(handlerFunc http.HandlerFunc, method, url string, body []byt
 	return recorder
 }
 
+// authenticate signs the request in as the given user.
+func authenticate(req *http.Request, userID int) {
+	token, _, err := createSession(req, userID)
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+}
+
+// performAuthenticatedRequest simulates an HTTP request from a signed-in user
+// through the authentication middleware.
+func performAuthenticatedRequest(handlerFunc http.HandlerFunc, method, url string, body []byte, userID int) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	authenticate(req, userID)
+	recorder := httptest.NewRecorder()
+	requireAuth(handlerFunc)(recorder, req)
+	return recorder
+}
+
 // Test create account handler.
 func TestCreateAccountHandler(t *testing.T) {
 	db, _ = setupTestDB()
@@ -107,8 +137,8 @@ func TestPersonalDetailsHandler(t *testing.T) {
 
 	_, _ = db.Exec("INSERT INTO users (username, password, primary_contact_email) VALUES (?, ?, ?)", "testuser", "password", "test@example.com")
 
-	requestBody := `{"username": "testuser", "primary_contact_email": "new@example.com", "secondary_contact_emails": "alt@example.com"}`
-	rec := performRequest(personalDetailsHandler, "POST", "/update-emails", []byte(requestBody))
+	requestBody := `{"primary_contact_email": "new@example.com", "secondary_contact_emails": "alt@example.com"}`
+	rec := performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", []byte(requestBody), 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", rec.Code)
@@ -122,7 +152,6 @@ func TestUploadGiftHandler(t *testing.T) {
 
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
-	_ = writer.WriteField("username", "testuser")
 	_ = writer.WriteField("emailMessage", "Hello, this is a test email.")
 
 	part, _ := writer.CreateFormFile("file", "example.txt")
@@ -131,9 +160,10 @@ func TestUploadGiftHandler(t *testing.T) {
 
 	req := httptest.NewRequest("POST", "/upload-gift", body)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	authenticate(req, 1)
 	rec := httptest.NewRecorder()
 
-	uploadGiftHandler(rec, req)
+	requireAuth(uploadGiftHandler)(rec, req)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", rec.Code)
@@ -155,6 +185,25 @@ func TestLoginHandler(t *testing.T) {
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", rec.Code)
 	}
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	token, _ := response["token"].(string)
+	if userID, err := parseSessionToken(token, time.Now()); err != nil || userID != 1 {
+		t.Errorf("Expected a valid session token for user 1, got %d (%v)", userID, err)
+	}
+
+	var sessionCookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil || !sessionCookie.HttpOnly || sessionCookie.Value != token {
+		t.Errorf("Expected an HttpOnly session cookie carrying the token, got %+v", sessionCookie)
+	}
 }
 
 // Test setting up receivers.
@@ -165,12 +214,50 @@ func TestSetupReceiversHandler(t *testing.T) {
 	_, _ = db.Exec("INSERT INTO gifts (user_id, file_name) VALUES (1, 'testfile.txt')")
 
 	requestBody := `{"giftId": 1, "receivers": "receiver@example.com", "customMessage": "Gift Message"}`
-	rec := performRequest(setupReceiversHandler, "POST", "/setup-receivers", []byte(requestBody))
+	rec := performAuthenticatedRequest(setupReceiversHandler, "POST", "/setup-receivers", []byte(requestBody), 1)
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", rec.Code)
 	}
 }
 
+// Stopping a gift and setting up its receivers again replaces the earlier
+// scheduled send rather than letting it go out at its old time.
+func TestSetupReceiversAfterStopReplacesSchedule(t *testing.T) {
+	db, _ = setupTestDB()
+	_, _ = db.Exec("INSERT INTO users (username, password, primary_contact_email) VALUES (?, ?, ?)", "testuser", "password", "test@example.com")
+	_, _ = db.Exec("INSERT INTO gifts (user_id, file_name) VALUES (1, 'testfile.txt')")
+
+	setup := func(receivers string) {
+		body := []byte(`{"giftId": 1, "receivers": "` + receivers + `", "scheduledTime": "2999-01-01T10:00"}`)
+		if rec := performAuthenticatedRequest(setupReceiversHandler, "POST", "/setup-receivers", body, 1); rec.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", rec.Code)
+		}
+	}
+	setup("old@example.com")
+	var first int
+	_ = db.QueryRow("SELECT schedule_generation FROM gifts WHERE id = 1").Scan(&first)
+	if current, err := scheduledSendCurrent(1, first); err != nil || !current {
+		t.Fatalf("Expected the scheduled send to be current, got %v %v", current, err)
+	}
+
+	if rec := performAuthenticatedRequest(stopPendingGiftHandler, "DELETE", "/stop-pending-gift?id=1", nil, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	if current, _ := scheduledSendCurrent(1, first); current {
+		t.Errorf("Expected a stopped gift not to be sent")
+	}
+
+	setup("new@example.com")
+	var second int
+	_ = db.QueryRow("SELECT schedule_generation FROM gifts WHERE id = 1").Scan(&second)
+	if current, _ := scheduledSendCurrent(1, first); current {
+		t.Errorf("Expected the earlier schedule to give up after receivers were set up again")
+	}
+	if current, err := scheduledSendCurrent(1, second); err != nil || !current {
+		t.Errorf("Expected the new schedule to be current, got %v %v", current, err)
+	}
+}
+
 // Test gift count handler.
 func TestGiftCountHandler(t *testing.T) {
 	testDB, err := setupTestDB()
@@ -189,7 +276,7 @@ func TestGiftCountHandler(t *testing.T) {
 		t.Fatalf("Failed to insert test gift: %v", err)
 	}
 
-	rec := performRequest(giftCountHandler, "GET", "/gift-count?username=testuser", nil)
+	rec := performAuthenticatedRequest(giftCountHandler, "GET", "/gift-count", nil, 1)
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", rec.Code)
 	}
@@ -224,7 +311,7 @@ func TestDownloadGiftHandler(t *testing.T) {
 		t.Fatalf("Failed to insert test gift: %v", err)
 	}
 
-	rec := performRequest(downloadGiftHandler, "GET", "/download-gift?id=1", nil)
+	rec := performAuthenticatedRequest(downloadGiftHandler, "GET", "/download-gift?id=1", nil, 1)
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d. Response: %s", rec.Code, rec.Body.String())
 	}
@@ -245,21 +332,25 @@ func TestStopPendingGiftHandler(t *testing.T) {
 	_, _ = db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", "testuser", "password")
 	_, _ = db.Exec("INSERT INTO gifts (user_id, file_name) VALUES (1, 'testfile.txt')")
 
-	rec := performRequest(stopPendingGiftHandler, "DELETE", "/stop-pending-gift?id=1", nil)
+	rec := performAuthenticatedRequest(stopPendingGiftHandler, "DELETE", "/stop-pending-gift?id=1", nil, 1)
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", rec.Code)
 	}
 
-	var count int
-	_ = db.QueryRow("SELECT COUNT(*) FROM gifts WHERE id = 1").Scan(&count)
-	if count != 0 {
-		t.Errorf("Expected 0 gifts remaining, found %d", count)
+	// Stopping only cancels the delivery; the gift is kept.
+	var cancelled bool
+	if err := db.QueryRow("SELECT cancelled FROM gifts WHERE id = 1").Scan(&cancelled); err != nil || !cancelled {
+		t.Errorf("Expected the gift to be kept and cancelled, got %v %v", cancelled, err)
 	}
 }
 
 // Test sending gift emails.
 func TestSendGiftEmailToReceivers(t *testing.T) {
-	err := sendGiftEmailToReceivers("testfile.txt", []byte("test data"), "Test Message", "recipient@example.com")
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = uploadTestFile("testfile.txt", "test data")
+	attachments, _ := loadGiftAttachments(1)
+	err := sendGiftEmailToReceivers(attachments, nil, "Test Message", "recipient@example.com")
 	if err != nil {
 		t.Errorf("Failed to send email: %v", err)
 	}
@@ -292,9 +383,9 @@ func TestChangePasswordHandler(t *testing.T) {
 	}
 
 	newPassword := "NewPass@1234"
-	requestBody := fmt.Sprintf(`{"username": "testuser", "newPassword": "%s"}`, newPassword)
+	requestBody := fmt.Sprintf(`{"newPassword": "%s"}`, newPassword)
 
-	recorder := performRequest(changePasswordHandler, "POST", "/change-password", []byte(requestBody))
+	recorder := performAuthenticatedRequest(changePasswordHandler, "POST", "/change-password", []byte(requestBody), 1)
 	if recorder.Code != http.StatusOK {
 		t.Errorf("Expected status 200, got %d", recorder.Code)
 	}
@@ -333,9 +424,7 @@ func TestGetMessagesHandler(t *testing.T) {
 	encrypted, _ := encrypt("Hello!")
 	_, _ = db.Exec("INSERT INTO messages (sender_id, receiver_id, content) VALUES (?, ?, ?)", 2, 1, encrypted)
 
-	req := httptest.NewRequest("GET", "/get-messages?username=testuser", nil)
-	rec := httptest.NewRecorder()
-	getMessagesHandler(rec, req)
+	rec := performAuthenticatedRequest(getMessagesHandler, "GET", "/get-messages", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -349,10 +438,7 @@ func TestGetPrivacyHandler(t *testing.T) {
 	_, _ = db.Exec("INSERT INTO privacy_settings (user_id, can_receive_messages, can_be_seen, can_receive_gifts) VALUES (?, ?, ?, ?)",
 		1, true, false, true)
 
-	req := httptest.NewRequest("GET", "/get-privacy?username=testuser", nil)
-	rec := httptest.NewRecorder()
-
-	getPrivacyHandler(rec, req)
+	rec := performAuthenticatedRequest(getPrivacyHandler, "GET", "/get-privacy", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -364,23 +450,22 @@ func TestUpdatePrivacyHandler(t *testing.T) {
 	_, _ = db.Exec("INSERT INTO users (id, username) VALUES (?, ?)", 1, "testuser")
 
 	body := []byte(`{
-    "username": "testuser",
     "canReceiveMessages": true,
     "canBeSeen": false,
     "canReceiveGifts": true
     }`)
 
-	rec := performRequest(updatePrivacyHandler, "POST", "/update-privacy", body)
+	rec := performAuthenticatedRequest(updatePrivacyHandler, "POST", "/update-privacy", body, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
 	}
 }
 func TestGetMessageNotificationHandler(t *testing.T) {
-	req := httptest.NewRequest("GET", "/notifications?username=testuser", nil)
-	rec := httptest.NewRecorder()
+	db, _ = setupTestDB()
+	_, _ = db.Exec("INSERT INTO users (id, username) VALUES (?, ?)", 1, "testuser")
 
-	getMessageNotificationHandler(rec, req)
+	rec := performAuthenticatedRequest(getMessageNotificationHandler, "GET", "/notifications", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -389,13 +474,10 @@ func TestGetMessageNotificationHandler(t *testing.T) {
 func TestScheduleInactivityCheckHandler(t *testing.T) {
 	db, _ = setupTestDB()
 	_, _ = db.Exec("INSERT INTO users (username, primary_contact_email) VALUES (?, ?)", "testuser", "test@example.com")
+	_ = markEmailVerified(1, "test@example.com")
 
-	body := []byte(`{"username": "testuser", "customMessage": "Check for inactivity"}`)
-	req := httptest.NewRequest("POST", "/schedule-check", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-
-	rec := httptest.NewRecorder()
-	scheduleInactivityCheckHandler(rec, req)
+	body := []byte(`{"customMessage": "Check for inactivity"}`)
+	rec := performAuthenticatedRequest(scheduleInactivityCheckHandler, "POST", "/schedule-check", body, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -410,10 +492,7 @@ func TestGetReceiversHandler(t *testing.T) {
 	// Insert gift with receivers
 	_, _ = db.Exec("INSERT INTO gifts (user_id, receivers) VALUES (?, ?)", 1, "a@example.com,b@example.com")
 
-	req := httptest.NewRequest("GET", "/get-receivers?username=testuser", nil)
-	rec := httptest.NewRecorder()
-
-	GetReceiverHandler(rec, req)
+	rec := performAuthenticatedRequest(GetReceiverHandler, "GET", "/get-receivers", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -421,7 +500,8 @@ func TestGetReceiversHandler(t *testing.T) {
 }
 func TestVerifySecurityAnswerHandler(t *testing.T) {
 	db, _ = setupTestDB()
-	_, _ = db.Exec("INSERT INTO users (username, security_question, security_answer) VALUES (?, ?, ?)", "testuser", "Pet?", "fluffy")
+	_, _ = db.Exec("INSERT INTO users (id, username) VALUES (?, ?)", 1, "testuser")
+	_ = replaceSecurityQuestions(1, []securityQuestionInput{{Question: "Pet?", Answer: "fluffy"}})
 
 	body := []byte(`{"username": "testuser", "securityAnswer": "fluffy"}`)
 
@@ -433,7 +513,8 @@ func TestVerifySecurityAnswerHandler(t *testing.T) {
 }
 func TestGetSecurityInfoHandler(t *testing.T) {
 	db, _ = setupTestDB()
-	_, _ = db.Exec("INSERT INTO users (username, primary_contact_email, security_question) VALUES (?, ?, ?)", "testuser", "test@example.com", "Your color?")
+	_, _ = db.Exec("INSERT INTO users (id, username, primary_contact_email) VALUES (?, ?, ?)", 1, "testuser", "test@example.com")
+	_ = replaceSecurityQuestions(1, []securityQuestionInput{{Question: "Your color?", Answer: "blue"}})
 
 	body := []byte(`{"email": "test@example.com"}`)
 	req := httptest.NewRequest("POST", "/get-security-info", bytes.NewBuffer(body))
@@ -504,8 +585,8 @@ func TestSendMessageHandler(t *testing.T) {
 	fmt.Println("User2 (Friend) follows:", u2Following, "| followers:", u2Followers)
 
 	// Attempt to send message
-	reqBody := []byte(`{"sender": "Sahil_1234", "receiver": "Friend_5678", "content": "Hi!"}`)
-	rec := performRequest(sendMessageHandler, "POST", "/send-message", reqBody)
+	reqBody := []byte(`{"receiver": "Friend_5678", "content": "Hi!"}`)
+	rec := performAuthenticatedRequest(sendMessageHandler, "POST", "/send-message", reqBody, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -519,7 +600,7 @@ func TestGetMessageNotificationHandler_WithUnreadMessages(t *testing.T) {
 	encrypted, _ := encrypt("Hey!")
 	_, _ = db.Exec("INSERT INTO messages (sender_id, receiver_id, content, is_read) VALUES (?, ?, ?, 0)", 2, 1, encrypted)
 
-	rec := performRequest(getMessageNotificationHandler, "GET", "/notifications?username=Friend_5678", nil)
+	rec := performAuthenticatedRequest(getMessageNotificationHandler, "GET", "/notifications", nil, 1)
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
 	}
@@ -531,7 +612,7 @@ func TestGiftCalendarHandler(t *testing.T) {
 	_, _ = db.Exec(`INSERT INTO gifts (user_id, file_name, custom_message, scheduled_release, receivers) 
                     VALUES (1, 'file.pdf', 'Bye Friend', '2030-01-01 10:00:00', 'a@b.com')`)
 
-	rec := performRequest(giftCalendarHandler, "GET", "/gift-calendar?username=Sahil_1234", nil)
+	rec := performAuthenticatedRequest(giftCalendarHandler, "GET", "/gift-calendar", nil, 1)
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
 	}
@@ -543,15 +624,15 @@ func TestFollowAndUnfollowHandler(t *testing.T) {
 	_ = insertUserWithID(2, "Friend_5678", "pass")
 
 	// Follow
-	reqFollow := []byte(`{"username": "Sahil_1234", "friendUsername": "Friend_5678"}`)
-	recFollow := performRequest(followUserHandler, "POST", "/users/follow", reqFollow)
+	reqFollow := []byte(`{"friendUsername": "Friend_5678"}`)
+	recFollow := performAuthenticatedRequest(followUserHandler, "POST", "/users/follow", reqFollow, 1)
 	if recFollow.Code != http.StatusOK {
 		t.Errorf("Follow failed: got %d", recFollow.Code)
 	}
 
 	// Unfollow
-	reqUnfollow := []byte(`{"username": "Sahil_1234", "friendUsername": "Friend_5678"}`)
-	recUnfollow := performRequest(unfollowUserHandler, "POST", "/users/unfollow", reqUnfollow)
+	reqUnfollow := []byte(`{"friendUsername": "Friend_5678"}`)
+	recUnfollow := performAuthenticatedRequest(unfollowUserHandler, "POST", "/users/unfollow", reqUnfollow, 1)
 	if recUnfollow.Code != http.StatusOK {
 		t.Errorf("Unfollow failed: got %d", recUnfollow.Code)
 	}
@@ -564,9 +645,7 @@ func TestDiscoverUsersHandler(t *testing.T) {
 	_ = insertUserWithID(3, "Another_1", "pass")
 	_, _ = db.Exec("UPDATE users SET following = '2' WHERE id = 1") // Sahil follows Friend
 
-	req := httptest.NewRequest("GET", "/users/discover?username=Sahil_1234", nil)
-	rec := httptest.NewRecorder()
-	discoverUsersHandler(rec, req)
+	rec := performAuthenticatedRequest(discoverUsersHandler, "GET", "/users/discover", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -586,7 +665,7 @@ func TestGetEligibleMessagingUsersHandler(t *testing.T) {
 	_, _ = db.Exec("UPDATE users SET following = '2', followers = '2' WHERE id = 1")
 	_, _ = db.Exec("UPDATE users SET following = '1', followers = '1' WHERE id = 2")
 
-	rec := performRequest(getEligibleMessagingUsersHandler, "GET", "/users/eligible-messaging?username=Sahil_1234", nil)
+	rec := performAuthenticatedRequest(getEligibleMessagingUsersHandler, "GET", "/users/eligible-messaging", nil, 1)
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
 	}
@@ -602,24 +681,24 @@ func TestGetGiftsHandler(t *testing.T) {
                            (1, 'gift2.pdf', 'Second gift')`)
 
 	// Make request
-	req := httptest.NewRequest("GET", "/gifts?username=Sahil_1234", nil)
-	rec := httptest.NewRecorder()
-
-	getGiftsHandler(rec, req)
+	rec := performAuthenticatedRequest(getGiftsHandler, "GET", "/gifts", nil, 1)
 
 	// Validate response
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
 	}
 
-	var gifts []map[string]interface{}
-	err := json.Unmarshal(rec.Body.Bytes(), &gifts)
+	var page struct {
+		Items []map[string]interface{} `json:"items"`
+		Total int                      `json:"total"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &page)
 	if err != nil {
 		t.Errorf("Failed to parse response JSON: %v", err)
 	}
 
-	if len(gifts) != 2 {
-		t.Errorf("Expected 2 gifts, got %d", len(gifts))
+	if len(page.Items) != 2 || page.Total != 2 {
+		t.Errorf("Expected 2 gifts, got %d", len(page.Items))
 	}
 }
 
@@ -630,7 +709,7 @@ func TestPendingGiftsHandler(t *testing.T) {
 	// One pending gift
 	_, _ = db.Exec("INSERT INTO gifts (user_id, file_name, pending) VALUES (1, 'gift.txt', 1)")
 
-	rec := performRequest(pendingGiftsHandler, "GET", "/dashboard/pending-gifts?username=Sahil_1234", nil)
+	rec := performAuthenticatedRequest(pendingGiftsHandler, "GET", "/dashboard/pending-gifts", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -643,10 +722,7 @@ func TestSearchUsersHandler(t *testing.T) {
 	_ = insertUserWithID(2, "SahilFriend", "pass")
 	_ = insertUserWithID(3, "SomeoneElse", "pass")
 
-	req := httptest.NewRequest("GET", "/users/search?query=Sahil", nil)
-	rec := httptest.NewRecorder()
-
-	searchUsersHandler(rec, req)
+	rec := performAuthenticatedRequest(searchUsersHandler, "GET", "/users/search?query=Sahil", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -672,10 +748,7 @@ func TestGetFollowersHandler(t *testing.T) {
 	_, _ = db.Exec("UPDATE users SET followers = '2' WHERE id = 1")
 	_, _ = db.Exec("UPDATE users SET following = '1' WHERE id = 2")
 
-	req := httptest.NewRequest("GET", "/friends/followers?username=Sahil_1234", nil)
-	rec := httptest.NewRecorder()
-
-	getFollowersHandler(rec, req)
+	rec := performAuthenticatedRequest(getFollowersHandler, "GET", "/friends/followers", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -695,10 +768,7 @@ func TestGetFollowingHandler(t *testing.T) {
 	_, _ = db.Exec("UPDATE users SET following = '2' WHERE id = 1")
 	_, _ = db.Exec("UPDATE users SET followers = '1' WHERE id = 2")
 
-	req := httptest.NewRequest("GET", "/friends/following?username=Sahil_1234", nil)
-	rec := httptest.NewRecorder()
-
-	getFollowingHandler(rec, req)
+	rec := performAuthenticatedRequest(getFollowingHandler, "GET", "/friends/following", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
@@ -716,15 +786,12 @@ func TestGetPersonalDetailsHandler(t *testing.T) {
 	// Add contact email and security question
 	_, _ = db.Exec(`UPDATE users 
 		SET primary_contact_email = 'dhananisahil@ufl.edu', 
-		    secondary_contact_emails = 'alt@example.com', 
-		    security_question = 'Your favorite color?' 
+		    secondary_contact_emails = 'alt@example.com' 
 		WHERE id = 1`)
+	_ = replaceSecurityQuestions(1, []securityQuestionInput{{Question: "Your favorite color?", Answer: "blue"}})
 
 	// Send GET request
-	req := httptest.NewRequest("GET", "/update-emails?username=Sahil_1234", nil)
-	rec := httptest.NewRecorder()
-
-	personalDetailsHandler(rec, req)
+	rec := performAuthenticatedRequest(personalDetailsHandler, "GET", "/update-emails", nil, 1)
 
 	if rec.Code != http.StatusOK {
 		t.Errorf("Expected 200 OK, got %d", rec.Code)
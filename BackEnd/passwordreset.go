@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordResetTTL is how long a reset link stays valid.
+var passwordResetTTL = time.Hour
+
+// Correct security answers do not sign the user in. They earn a token for
+// /reset-password/confirm instead, valid once for securityResetTTL.
+var securityResetTTL = 15 * time.Minute
+
+const securityResetPurpose = "security-reset"
+
+var errInvalidResetToken = errors.New("invalid or expired password reset token")
+
+func hashResetSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// createPasswordResetToken stores a new reset request and returns the signed
+// token to put in the link. Only a hash of its random part is kept.
+func createPasswordResetToken(userID int) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(raw)
+	expiresAt := timeNow().Add(passwordResetTTL)
+	if _, err := db.Exec("INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?)",
+		userID, hashResetSecret(secret), expiresAt.Unix()); err != nil {
+		return "", err
+	}
+	return signPayload(fmt.Sprintf("reset:%d:%s", userID, secret)), nil
+}
+
+// consumePasswordResetToken checks the token and marks it, and every other
+// outstanding reset for the same user, as used. It returns the user id.
+func consumePasswordResetToken(token string) (int, error) {
+	payload, err := verifySignedPayload(token)
+	if err != nil {
+		return 0, errInvalidResetToken
+	}
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 || parts[0] != "reset" {
+		return 0, errInvalidResetToken
+	}
+
+	var resetID, userID int
+	var expiresAt int64
+	err = db.QueryRow("SELECT id, user_id, expires_at FROM password_resets WHERE token_hash = ? AND used_at IS NULL",
+		hashResetSecret(parts[2])).Scan(&resetID, &userID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	if strconv.Itoa(userID) != parts[1] || !timeNow().Before(time.Unix(expiresAt, 0)) {
+		return 0, errInvalidResetToken
+	}
+
+	res, err := db.Exec("UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", resetID)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, errInvalidResetToken
+	}
+	if _, err := db.Exec("UPDATE password_resets SET used_at = CURRENT_TIMESTAMP WHERE user_id = ? AND used_at IS NULL", userID); err != nil {
+		log.Printf("Error invalidating outstanding password resets for user %d: %v", userID, err)
+	}
+	return userID, nil
+}
+
+// consumeAnyResetToken accepts the token of a reset link or one earned with
+// security answers, and returns the user id.
+func consumeAnyResetToken(token string) (int, error) {
+	userID, err := consumePurposeToken(token, securityResetPurpose)
+	switch err {
+	case nil:
+		return userID, nil
+	case errInvalidToken, errExpiredToken:
+		return consumePasswordResetToken(token)
+	}
+	return 0, err
+}
+
+// writeSecurityResetToken answers correct security answers, and the second
+// factor that follows them for 2FA accounts.
+func writeSecurityResetToken(w http.ResponseWriter, userID int) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Security answer verified. Choose a new password.",
+		"resetToken": issuePurposeToken(securityResetPurpose, userID, securityResetTTL),
+		"expiresIn":  int(securityResetTTL.Seconds()),
+	})
+}
+
+// sendPasswordResetEmail emails the reset link. It runs in the background so the
+// response time does not reveal whether the address has an account.
+func sendPasswordResetEmail(email, token string) {
+	link := fmt.Sprintf("%s/reset-password?token=%s", frontendBaseURL, url.QueryEscape(token))
+	subject := "Reset your Parting Gifts password"
+	body := fmt.Sprintf("Hello,\n\nWe received a request to reset your password. Open this link to choose a new one:\n%s\n\n"+
+		"The link can be used once and expires in %d minutes. If you did not ask for a reset you can ignore this email.",
+		link, int(passwordResetTTL.Minutes()))
+	go func() {
+		if err := sendCheckEmail(email, subject, body); err != nil {
+			log.Printf("Failed to send password reset email: %v", err)
+		}
+	}()
+}
+
+// confirmPasswordResetHandler sets a new password using the token from a reset
+// link or from /verify-security-answer.
+func confirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	var req struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !isValidPassword(req.NewPassword) {
+		http.Error(w, "Invalid Password. Must be at least 8 characters with a mix of letters, numbers and special characters.", http.StatusBadRequest)
+		return
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		http.Error(w, "Error hashing password", http.StatusInternalServerError)
+		return
+	}
+
+	userID, err := consumeAnyResetToken(req.Token)
+	if err != nil {
+		if err != errInvalidResetToken {
+			log.Printf("Error checking password reset token: %v", err)
+		}
+		http.Error(w, "This reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET password = ?, force_password_change = 0 WHERE id = ?", hashedPassword, userID); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+	clearFailedAttempts(accountAttemptKey(userID))
+	if _, err := revokeOtherSessions(userID, ""); err != nil {
+		log.Printf("Error revoking sessions for user %d: %v", userID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset. You can now sign in."})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestResetPasswordResponseDoesNotRevealAccounts(t *testing.T) {
+	db, _ = setupTestDB()
+	_, _ = db.Exec("INSERT INTO users (username, primary_contact_email, secondary_contact_emails, password) VALUES (?, ?, ?, ?)",
+		"testuser", "test@example.com", "alt@example.com,other@example.com", "oldpass")
+	_ = markEmailVerified(1, "other@example.com")
+
+	known := performRequest(resetPasswordHandler, "POST", "/reset-password", []byte(`{"email": "other@example.com"}`))
+	unknown := performRequest(resetPasswordHandler, "POST", "/reset-password", []byte(`{"email": "nobody@example.com"}`))
+	if known.Code != unknown.Code || known.Body.String() != unknown.Body.String() {
+		t.Errorf("Expected identical responses, got %d %q and %d %q", known.Code, known.Body.String(), unknown.Code, unknown.Body.String())
+	}
+
+	var pending int
+	_ = db.QueryRow("SELECT COUNT(*) FROM password_resets WHERE user_id = 1").Scan(&pending)
+	if pending != 1 {
+		t.Errorf("Expected a reset token for the secondary address, found %d", pending)
+	}
+	var password string
+	_ = db.QueryRow("SELECT password FROM users WHERE id = 1").Scan(&password)
+	if password != "oldpass" {
+		t.Errorf("Requesting a reset must not change the password")
+	}
+}
+
+func TestConfirmPasswordReset(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "OldPass@123")
+	clock := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFixedClock(t, clock)
+
+	first, _ := createPasswordResetToken(1)
+	second, _ := createPasswordResetToken(1)
+	signedIn, _ := newSessionRequest("GET", "/gift-count", 1, "Stolen laptop")
+
+	body := []byte(fmt.Sprintf(`{"token": "%s", "newPassword": "NewPass@1234"}`, first))
+	rec := performRequest(confirmPasswordResetHandler, "POST", "/reset-password/confirm", body)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %s", rec.Code, rec.Body.String())
+	}
+	var hash string
+	_ = db.QueryRow("SELECT password FROM users WHERE id = 1").Scan(&hash)
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("NewPass@1234")) != nil {
+		t.Errorf("Password was not updated")
+	}
+	if rec := serve(giftCountHandler, signedIn); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected existing sessions to be revoked by the reset, got %d", rec.Code)
+	}
+
+	// The same link cannot be used twice and other outstanding links are revoked.
+	for name, token := range map[string]string{"reused": first, "outstanding": second} {
+		body := []byte(fmt.Sprintf(`{"token": "%s", "newPassword": "Other@12345"}`, token))
+		if rec := performRequest(confirmPasswordResetHandler, "POST", "/reset-password/confirm", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s token: expected 400, got %d", name, rec.Code)
+		}
+	}
+
+	// Links expire.
+	expired, _ := createPasswordResetToken(1)
+	useFixedClock(t, clock.Add(passwordResetTTL))
+	body = []byte(fmt.Sprintf(`{"token": "%s", "newPassword": "Other@12345"}`, expired))
+	if rec := performRequest(confirmPasswordResetHandler, "POST", "/reset-password/confirm", body); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expired token: expected 400, got %d", rec.Code)
+	}
+
+	// Tampered tokens are rejected.
+	body = []byte(`{"token": "bm90LWEtdG9rZW4.abc", "newPassword": "Other@12345"}`)
+	if rec := performRequest(confirmPasswordResetHandler, "POST", "/reset-password/confirm", body); rec.Code != http.StatusBadRequest {
+		t.Errorf("Forged token: expected 400, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// Photos are stripped of embedded metadata as they are uploaded, since it can
+// reveal where a photo was taken and on which device, and gifts are mailed to
+// other people. Only the metadata is removed; the image data is copied
+// through unchanged, so nothing is re-encoded.
+//
+// JPEG: EXIF, XMP, IPTC, comments and other application segments are
+// dropped, as is anything after the end of the image (such as the video of a
+// motion photo). Colour profiles and the JFIF and Adobe segments needed to
+// show the image correctly are kept.
+// PNG: eXIf, text (where XMP lives) and modification time chunks are dropped.
+
+// photoPrivacy is what a user keeps in the photos they upload; see privacy_settings.
+type photoPrivacy struct {
+	KeepMetadata    bool // store photos exactly as uploaded
+	KeepOrientation bool // keep the EXIF orientation so rotated photos still show upright
+}
+
+// loadPhotoPrivacy returns the user's settings, which default to stripping
+// everything but the orientation.
+func loadPhotoPrivacy(userID int) photoPrivacy {
+	privacy := photoPrivacy{KeepOrientation: true}
+	db.QueryRow("SELECT keep_photo_metadata, keep_photo_orientation FROM privacy_settings WHERE user_id = ?", userID).
+		Scan(&privacy.KeepMetadata, &privacy.KeepOrientation)
+	return privacy
+}
+
+// metadataReport says what was removed from one photo.
+type metadataReport struct {
+	Removed         []string `json:"removed"` // kinds of metadata, such as "EXIF" or "GPS location"
+	BytesRemoved    int64    `json:"bytesRemoved"`
+	OrientationKept bool     `json:"orientationKept"`
+}
+
+func (m *metadataReport) add(kind string, size int64) {
+	m.BytesRemoved += size
+	for _, k := range m.Removed {
+		if k == kind {
+			return
+		}
+	}
+	m.Removed = append(m.Removed, kind)
+}
+
+// column is the report as stored in gift_attachments.metadata_removed.
+func (m *metadataReport) column() sql.NullString {
+	if m == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: strings.Join(m.Removed, ","), Valid: true}
+}
+
+// stripPhotoMetadata returns a reader for the photo read from r with its
+// metadata removed, and a report that is complete once that reader has been
+// read to the end. Other types are returned unchanged with a nil report.
+func stripPhotoMetadata(contentType string, r io.Reader, keepOrientation bool) (io.Reader, *metadataReport) {
+	s := &metadataStripper{
+		src:             bufio.NewReaderSize(r, 70<<10), // room to peek at a whole JPEG segment
+		report:          &metadataReport{Removed: []string{}},
+		keepOrientation: keepOrientation,
+	}
+	switch {
+	case mediaTypeMatches(contentType, []string{"image/jpeg"}):
+		s.step = s.jpegStep
+	case mediaTypeMatches(contentType, []string{"image/png"}):
+		s.step = s.pngStep
+	default:
+		return r, nil
+	}
+	return s, s.report
+}
+
+var errMalformedImage = errors.New("malformed image")
+
+type stripState int
+
+const (
+	stripParsing  stripState = iota // step works out what comes next
+	stripScanning                   // JPEG image data, copied until the end of image marker
+	stripTrailer                    // after the end of the image; discarded
+	stripPassing                    // copied unchanged, for files that cannot be parsed
+)
+
+// metadataStripper copies a photo through, leaving out its metadata. step
+// looks at the next segment or chunk and either discards it, queues
+// replacement bytes in out, or has copyN bytes copied through unchanged.
+type metadataStripper struct {
+	src             *bufio.Reader
+	report          *metadataReport
+	keepOrientation bool
+	step            func() error
+	state           stripState // what to do once out and copyN are used up
+	started         bool
+	out             []byte
+	copyN           int64
+}
+
+func (s *metadataStripper) Read(p []byte) (int, error) {
+	for {
+		switch {
+		case len(s.out) > 0:
+			n := copy(p, s.out)
+			s.out = s.out[n:]
+			return n, nil
+		case s.copyN > 0:
+			if int64(len(p)) > s.copyN {
+				p = p[:s.copyN]
+			}
+			n, err := s.src.Read(p)
+			s.copyN -= int64(n)
+			return n, err
+		case s.state == stripPassing:
+			return s.src.Read(p)
+		case s.state == stripScanning:
+			if _, err := s.src.Peek(2); err == io.EOF {
+				s.state = stripPassing
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			// Copy up to the next marker; 0xFF in the image data is followed
+			// by 0x00 or a restart marker.
+			data, _ := s.src.Peek(s.src.Buffered())
+			end := len(data) - 1 // the last byte may start a marker
+			for i := 0; i < len(data)-1; i++ {
+				if next := data[i+1]; data[i] == 0xFF && next != 0x00 && next != 0xFF && (next < 0xD0 || next > 0xD7) {
+					end = i
+					break
+				}
+			}
+			if end == 0 {
+				s.state = stripParsing
+				continue
+			}
+			n := copy(p, data[:end])
+			s.src.Discard(n)
+			return n, nil
+		case s.state == stripTrailer:
+			n, err := io.Copy(io.Discard, s.src)
+			if n > 0 {
+				s.report.add("data after the image", n)
+			}
+			s.state = stripPassing
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		default:
+			err := s.step()
+			if err == errMalformedImage || err == io.EOF && s.src.Buffered() > 0 {
+				// Leave the rest as it is rather than break the file.
+				s.state = stripPassing
+			} else if err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+func (s *metadataStripper) jpegStep() error {
+	head, err := s.src.Peek(4)
+	if len(head) < 2 {
+		return err
+	}
+	if head[0] != 0xFF {
+		return errMalformedImage
+	}
+	switch marker := head[1]; {
+	case marker == 0xFF: // padding before a marker
+		s.copyN = 1
+		return nil
+	case marker == 0xD8 || marker == 0x01 || marker >= 0xD0 && marker <= 0xD7: // markers without a segment
+		s.copyN = 2
+		return nil
+	case marker == 0xD9: // end of image
+		s.copyN, s.state = 2, stripTrailer
+		return nil
+	}
+	if len(head) < 4 {
+		return errMalformedImage
+	}
+	length := int(binary.BigEndian.Uint16(head[2:]))
+	if length < 2 {
+		return errMalformedImage
+	}
+	segment, err := s.src.Peek(2 + length)
+	if err != nil {
+		return errMalformedImage
+	}
+	marker, payload := head[1], segment[4:]
+
+	kind := ""
+	switch {
+	case marker == 0xDA: // start of scan: the image data follows the header, up to the next marker
+		s.copyN, s.state = int64(2+length), stripScanning
+		return nil
+	case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+		kind = "EXIF"
+		s.noteExif(payload[6:], func(tiff []byte) []byte {
+			app1 := append([]byte("Exif\x00\x00"), tiff...)
+			return append([]byte{0xFF, 0xE1, byte((len(app1) + 2) >> 8), byte(len(app1) + 2)}, app1...)
+		})
+	case marker == 0xE1 && bytes.HasPrefix(payload, []byte("http://ns.adobe.com/")):
+		kind = "XMP"
+	case marker == 0xED:
+		kind = "IPTC"
+	case marker == 0xFE:
+		kind = "comments"
+	case marker == 0xE2 && bytes.HasPrefix(payload, []byte("MPF\x00")):
+		kind = "extra images"
+	case marker >= 0xE0 && marker <= 0xEF && !keptJPEGSegment(marker, payload):
+		kind = "other metadata"
+	}
+	if kind == "" {
+		s.copyN = int64(2 + length)
+		return nil
+	}
+	s.report.add(kind, int64(2+length))
+	_, err = s.src.Discard(2 + length)
+	return err
+}
+
+// keptJPEGSegment reports whether an application segment is needed to show
+// the image correctly: JFIF, colour profiles and Adobe colour transforms.
+func keptJPEGSegment(marker byte, payload []byte) bool {
+	switch marker {
+	case 0xE0:
+		return bytes.HasPrefix(payload, []byte("JFIF\x00")) || bytes.HasPrefix(payload, []byte("JFXX\x00"))
+	case 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case 0xEE:
+		return bytes.HasPrefix(payload, []byte("Adobe"))
+	}
+	return false
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+func (s *metadataStripper) pngStep() error {
+	if !s.started {
+		signature, err := s.src.Peek(len(pngSignature))
+		if err != nil || !bytes.Equal(signature, pngSignature) {
+			return errMalformedImage
+		}
+		s.started, s.copyN = true, int64(len(pngSignature))
+		return nil
+	}
+	head, err := s.src.Peek(8)
+	if err != nil {
+		return err
+	}
+	length := int64(binary.BigEndian.Uint32(head))
+	total := 8 + length + 4 // length, type, data and CRC
+
+	kind := ""
+	switch chunkType := string(head[4:8]); chunkType {
+	case "IEND":
+		s.copyN, s.state = total, stripTrailer
+		return nil
+	case "eXIf":
+		kind = "EXIF"
+		if chunk, err := s.src.Peek(int(min(total, int64(s.src.Size())))); err == nil && int64(len(chunk)) == total {
+			s.noteExif(chunk[8:8+length], func(tiff []byte) []byte { return pngChunk("eXIf", tiff) })
+		}
+	case "tEXt", "zTXt", "iTXt":
+		kind = "text"
+		if keyword, _ := s.src.Peek(int(8 + min(length, 80))); bytes.HasPrefix(keyword[8:], []byte("XML:com.adobe.xmp\x00")) {
+			kind = "XMP"
+		}
+	case "tIME":
+		kind = "modification time"
+	default:
+		s.copyN = total
+		return nil
+	}
+	s.report.add(kind, total)
+	_, err = s.src.Discard(int(total))
+	return err
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// noteExif records what an EXIF block being removed held and, if the
+// orientation is to be kept, queues a replacement holding only that, wrapped
+// by wrap into a JPEG segment or PNG chunk.
+func (s *metadataStripper) noteExif(tiff []byte, wrap func(tiff []byte) []byte) {
+	info := parseExif(tiff)
+	s.report.add("EXIF", 0)
+	if info.gps {
+		s.report.add("GPS location", 0)
+	}
+	if info.camera {
+		s.report.add("camera make and model", 0)
+	}
+	if s.keepOrientation && info.orientation > 1 && info.orientation <= 8 {
+		replacement := wrap(orientationOnlyExif(info.orientation))
+		s.out = append(s.out, replacement...)
+		s.report.BytesRemoved -= int64(len(replacement))
+		s.report.OrientationKept = true
+	}
+}
+
+type exifInfo struct {
+	orientation int
+	gps         bool
+	camera      bool
+}
+
+// parseExif reads the first directory of a TIFF-structured EXIF block.
+func parseExif(tiff []byte) exifInfo {
+	var info exifInfo
+	if len(tiff) < 8 {
+		return info
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return info
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return info
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		switch order.Uint16(tiff[entry:]) {
+		case 0x0112: // orientation, a SHORT stored in the entry itself
+			info.orientation = int(order.Uint16(tiff[entry+8:]))
+		case 0x8825: // pointer to the GPS directory
+			info.gps = true
+		case 0x010F, 0x0110: // make, model
+			info.camera = true
+		}
+	}
+	return info
+}
+
+// orientationOnlyExif builds a TIFF-structured EXIF block holding nothing but the orientation.
+func orientationOnlyExif(orientation int) []byte {
+	return []byte{
+		'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08, // big endian, first directory at 8
+		0x00, 0x01, // one entry
+		0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, byte(orientation >> 8), byte(orientation), 0x00, 0x00, // orientation, SHORT, 1 value
+		0x00, 0x00, 0x00, 0x00, // no further directories
+	}
+}
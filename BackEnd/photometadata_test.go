@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+)
+
+// testExif is a little-endian EXIF block with a camera make, an orientation
+// and a GPS directory.
+func testExif(orientation uint16) []byte {
+	le := binary.LittleEndian
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	tiff = le.AppendUint16(tiff, 3)
+	tiff = append(le.AppendUint16(le.AppendUint16(tiff, 0x010F), 2), 6, 0, 0, 0, 50, 0, 0, 0) // make, ASCII at 50
+	tiff = append(le.AppendUint16(le.AppendUint16(tiff, 0x0112), 3), 1, 0, 0, 0, byte(orientation), 0, 0, 0)
+	tiff = append(le.AppendUint16(le.AppendUint16(tiff, 0x8825), 4), 1, 0, 0, 0, 56, 0, 0, 0) // GPS directory at 56
+	tiff = append(tiff, 0, 0, 0, 0)
+	tiff = append(tiff, "Canon\x00"...)
+	return append(tiff, 0, 0, 0, 0, 0, 0) // empty GPS directory
+}
+
+func jpegSegment(marker byte, payload string) string {
+	return string([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}) + payload
+}
+
+// testJPEG is a real JPEG with EXIF, XMP and a comment added after the start
+// of image marker and a video appended after its end.
+func testJPEG(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 32, 16)), nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.String()
+	return plain[:2] +
+		jpegSegment(0xE1, "Exif\x00\x00"+string(testExif(6))) +
+		jpegSegment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>Secret Cove</x:xmpmeta>") +
+		jpegSegment(0xFE, "taken at home") +
+		plain[2:] + "motion photo video"
+}
+
+func stripAll(t *testing.T, contentType, content string, keepOrientation bool) (string, *metadataReport) {
+	r, report := stripPhotoMetadata(contentType, strings.NewReader(content), keepOrientation)
+	stripped, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(stripped), report
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	photo := testJPEG(t)
+	for _, keepOrientation := range []bool{true, false} {
+		stripped, report := stripAll(t, "image/jpeg", photo, keepOrientation)
+		for _, leaked := range []string{"Canon", "Secret Cove", "taken at home", "motion photo"} {
+			if strings.Contains(stripped, leaked) {
+				t.Errorf("Expected %q to be removed", leaked)
+			}
+		}
+		if _, err := jpeg.Decode(strings.NewReader(stripped)); err != nil {
+			t.Errorf("Expected the stripped photo to decode: %v", err)
+		}
+		want := []string{"EXIF", "GPS location", "camera make and model", "XMP", "comments", "data after the image"}
+		if strings.Join(report.Removed, ",") != strings.Join(want, ",") {
+			t.Errorf("Unexpected report %v", report.Removed)
+		}
+		if report.BytesRemoved != int64(len(photo)-len(stripped)) {
+			t.Errorf("Expected %d bytes removed, reported %d", len(photo)-len(stripped), report.BytesRemoved)
+		}
+
+		info := exifInfo{}
+		if i := strings.Index(stripped, "Exif\x00\x00"); i >= 0 {
+			info = parseExif([]byte(stripped[i+6:]))
+		}
+		if report.OrientationKept != keepOrientation || keepOrientation != (info.orientation == 6) || info.gps || info.camera {
+			t.Errorf("keepOrientation %v: unexpected EXIF left behind %+v", keepOrientation, info)
+		}
+	}
+}
+
+func TestStripPNGMetadata(t *testing.T) {
+	plain := testPNG(8, 8)
+	exif := testExif(3)
+	photo := plain[:33] + // signature and IHDR
+		string(pngChunk("tEXt", []byte("Comment\x00from the beach"))) +
+		string(pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"))) +
+		string(pngChunk("eXIf", exif)) +
+		plain[33:]
+
+	stripped, report := stripAll(t, "image/png", photo, true)
+	if strings.Contains(stripped, "beach") || strings.Contains(stripped, "xmpmeta") || strings.Contains(stripped, "Canon") {
+		t.Error("Expected the text chunks and camera details to be removed")
+	}
+	if _, err := png.Decode(strings.NewReader(stripped)); err != nil {
+		t.Errorf("Expected the stripped photo to decode: %v", err)
+	}
+	if got := strings.Join(report.Removed, ","); got != "text,XMP,EXIF,GPS location,camera make and model" || !report.OrientationKept {
+		t.Errorf("Unexpected report %s %+v", got, report)
+	}
+}
+
+func TestStripLeavesMalformedPhotosAlone(t *testing.T) {
+	for _, photo := range []string{"\xFF\xD8\xFF\xE1\x00", "\xFF\xD8garbage", "\x89PNG\r\n\x1a\n" + "rest of the image"} {
+		contentType := detectContentType([]byte(photo))
+		if stripped, _ := stripAll(t, contentType, photo, true); stripped != photo {
+			t.Errorf("Expected %q to be kept as it is, got %q", photo, stripped)
+		}
+	}
+}
+
+func TestUploadStripsPhotoMetadata(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	photo := testJPEG(t)
+
+	rec := uploadTestFile("beach.jpg", photo)
+	var response struct {
+		Metadata metadataReport `json:"metadata"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || len(response.Metadata.Removed) == 0 {
+		t.Fatalf("Expected a report of what was removed, got %d %s", rec.Code, rec.Body.String())
+	}
+	download := downloadGift(nil).Body.String()
+	if strings.Contains(download, "Secret Cove") || len(download) != len(photo)-int(response.Metadata.BytesRemoved) {
+		t.Error("Expected the stored photo to be stripped")
+	}
+	attachments := listTestAttachments(t)
+	sum := sha256.Sum256([]byte(download))
+	if attachments[0].SHA256 != hex.EncodeToString(sum[:]) || attachments[0].Size != int64(len(download)) {
+		t.Error("Expected the checksum and size of the stripped photo")
+	}
+	if !strings.Contains(strings.Join(attachments[0].MetadataRemoved, ","), "GPS location") {
+		t.Errorf("Expected the attachment to say what was removed, got %v", attachments[0].MetadataRemoved)
+	}
+}
+
+func TestKeepPhotoMetadataSetting(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	performAuthenticatedRequest(updatePrivacyHandler, "POST", "/update-privacy",
+		[]byte(`{"canReceiveMessages":true,"canBeSeen":true,"canReceiveGifts":true,"keepPhotoMetadata":true}`), 1)
+	// Clients that do not know the photo settings leave them alone.
+	performAuthenticatedRequest(updatePrivacyHandler, "POST", "/update-privacy",
+		[]byte(`{"canReceiveMessages":true,"canBeSeen":false,"canReceiveGifts":true}`), 1)
+	rec := performAuthenticatedRequest(getPrivacyHandler, "GET", "/get-privacy", nil, 1)
+	var settings map[string]bool
+	_ = json.Unmarshal(rec.Body.Bytes(), &settings)
+	if !settings["keepPhotoMetadata"] || !settings["keepPhotoOrientation"] || settings["canBeSeen"] {
+		t.Fatalf("Unexpected settings %v", settings)
+	}
+
+	photo := testJPEG(t)
+	rec = uploadTestFile("beach.jpg", photo)
+	if strings.Contains(rec.Body.String(), "metadata") || downloadGift(nil).Body.String() != photo {
+		t.Error("Expected the photo to be stored as uploaded")
+	}
+}
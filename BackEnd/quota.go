@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Every user is on a storage plan, "free" unless users.plan says otherwise,
+// and may store up to that plan's quota. STORAGE_QUOTA_BYTES sets the free
+// quota; STORAGE_PLAN_QUOTAS adds or overrides plans as "name=bytes" pairs,
+// e.g. "plus=10737418240,family=53687091200". A quota of 0 means unlimited.
+// users.storage_quota, when set, overrides the plan for that one user.
+const defaultStoragePlan = "free"
+
+var storagePlanQuotas = loadStoragePlanQuotas()
+
+func loadStoragePlanQuotas() map[string]int64 {
+	quotas := map[string]int64{defaultStoragePlan: envBytes("STORAGE_QUOTA_BYTES", 2<<30)}
+	for _, entry := range strings.Split(os.Getenv("STORAGE_PLAN_QUOTAS"), ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		quota, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if name == "" || err != nil || quota < 0 {
+			log.Printf("Ignoring invalid STORAGE_PLAN_QUOTAS entry %q", entry)
+			continue
+		}
+		quotas[name] = quota
+	}
+	return quotas
+}
+
+// storageUsage is what /gift-usage reports. QuotaBytes and BytesRemaining are
+// null when the user's storage is unlimited.
+type storageUsage struct {
+	Plan               string `json:"plan"`
+	BytesUsed          int64  `json:"bytesUsed"`
+	FileCount          int    `json:"fileCount"`
+	VersionBytes       int64  `json:"versionBytes"`       // part of BytesUsed kept for earlier versions
+	PendingUploadBytes int64  `json:"pendingUploadBytes"` // reserved by unfinished resumable uploads
+	QuotaBytes         *int64 `json:"quotaBytes"`
+	BytesRemaining     *int64 `json:"bytesRemaining"`
+}
+
+// remaining returns how many more bytes the user may store, and false if
+// there is no limit.
+func (u storageUsage) remaining() (int64, bool) {
+	if u.BytesRemaining == nil {
+		return 0, false
+	}
+	return *u.BytesRemaining, true
+}
+
+// loadStorageUsage works out how much a user stores against their quota.
+// Every file counts at its full size, even when deduplication means its
+// content is stored only once, so a user's usage never depends on what
+// others have uploaded.
+func loadStorageUsage(userID int) (storageUsage, error) {
+	var usage storageUsage
+	var plan sql.NullString
+	var override sql.NullInt64
+	err := db.QueryRow("SELECT plan, storage_quota FROM users WHERE id = ?", userID).Scan(&plan, &override)
+	if err != nil {
+		return usage, err
+	}
+
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(file_size), 0) FROM (`+blobReferencesSQL+`) WHERE user_id = ?`,
+		userID).Scan(&usage.FileCount, &usage.BytesUsed)
+	if err != nil {
+		return usage, err
+	}
+	// Gifts from before blob storage still hold their payload in the row.
+	var legacyFiles int
+	var legacyBytes int64
+	err = db.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(LENGTH(file_data)), 0) FROM gifts
+		WHERE user_id = ? AND storage_key IS NULL AND file_data IS NOT NULL`, userID).Scan(&legacyFiles, &legacyBytes)
+	if err != nil {
+		return usage, err
+	}
+	usage.FileCount += legacyFiles
+	usage.BytesUsed += legacyBytes
+
+	// Earlier versions' files are not files the user sees, so they add to
+	// the bytes used but not to the file count.
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(file_size), 0) FROM (`+versionReferencesSQL+`) WHERE user_id = ?`,
+		userID).Scan(&usage.VersionBytes)
+	if err != nil {
+		return usage, err
+	}
+	usage.BytesUsed += usage.VersionBytes
+
+	err = db.QueryRow(`
+		SELECT COALESCE(SUM(length), 0) FROM tus_uploads
+		WHERE user_id = ? AND gift_id IS NULL AND expires_at > ?`, userID, timeNow().Unix()).Scan(&usage.PendingUploadBytes)
+	if err != nil {
+		return usage, err
+	}
+
+	usage.Plan = defaultStoragePlan
+	if plan.Valid && plan.String != "" {
+		usage.Plan = plan.String
+	}
+	quota, known := storagePlanQuotas[strings.ToLower(usage.Plan)]
+	if !known {
+		log.Printf("User %d is on unknown storage plan %q; applying the %s quota", userID, usage.Plan, defaultStoragePlan)
+		quota = storagePlanQuotas[defaultStoragePlan]
+	}
+	if override.Valid {
+		quota = override.Int64
+	}
+	if quota > 0 {
+		remaining := max(quota-usage.BytesUsed-usage.PendingUploadBytes, 0)
+		usage.QuotaBytes, usage.BytesRemaining = &quota, &remaining
+	}
+	return usage, nil
+}
+
+// quotaExceededError is the 413 answered when an upload does not fit.
+func quotaExceededError(usage storageUsage) error {
+	return &uploadError{http.StatusRequestEntityTooLarge, fmt.Sprintf(
+		"Storage quota exceeded: %d of %d bytes remaining on the %s plan", *usage.BytesRemaining, *usage.QuotaBytes, usage.Plan)}
+}
+
+// checkStorageQuota refuses an upload of size bytes that would take the user
+// over their quota.
+func checkStorageQuota(userID int, size int64) error {
+	usage, err := loadStorageUsage(userID)
+	if err != nil {
+		return err
+	}
+	if remaining, limited := usage.remaining(); limited && size > remaining {
+		return quotaExceededError(usage)
+	}
+	return nil
+}
+
+// giftUsageHandler reports the signed-in user's storage use for the dashboard.
+func giftUsageHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handleGet(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
+	usage, err := loadStorageUsage(userID)
+	if err != nil {
+		log.Printf("Error loading storage usage for user %d: %v", userID, err)
+		http.Error(w, "Error retrieving storage usage", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func loadTestUsage(t *testing.T, userID int) storageUsage {
+	rec := performAuthenticatedRequest(giftUsageHandler, "GET", "/gift-usage", nil, userID)
+	var usage storageUsage
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &usage) != nil {
+		t.Fatalf("Expected usage, got %d: %s", rec.Code, rec.Body.String())
+	}
+	return usage
+}
+
+func TestUploadsStopAtStorageQuota(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_, _ = db.Exec("UPDATE users SET storage_quota = 30 WHERE id = 1")
+
+	if rec := uploadTestFile("first.txt", strings.Repeat("a", 20)); rec.Code != http.StatusOK {
+		t.Fatalf("Expected upload within quota to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	rec := uploadTestFile("second.txt", strings.Repeat("b", 20))
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "Storage quota exceeded") {
+		t.Fatalf("Expected 413 over quota, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := countRows("blobs"); n != 1 {
+		t.Errorf("Expected the rejected file not to be kept, found %d blobs", n)
+	}
+	// Attachments count too, even when identical content is stored once.
+	if rec := addAttachmentRequest("1", "copy.txt", strings.Repeat("a", 20), ""); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected attachment over quota to be refused, got %d", rec.Code)
+	}
+
+	usage := loadTestUsage(t, 1)
+	if usage.BytesUsed != 20 || usage.FileCount != 1 || *usage.QuotaBytes != 30 || *usage.BytesRemaining != 10 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+}
+
+func TestEarlierVersionsCountAgainstQuota(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_, _ = db.Exec("UPDATE users SET storage_quota = 50 WHERE id = 1")
+	if rec := uploadTestFile("first.txt", strings.Repeat("a", 20)); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+	if rec := replaceGiftFileRequest("1", "second.txt", strings.Repeat("b", 20), nil); rec.Code != http.StatusOK {
+		t.Fatalf("Expected a replacement within quota to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+	usage := loadTestUsage(t, 1)
+	if usage.BytesUsed != 40 || usage.VersionBytes != 20 || usage.FileCount != 1 || *usage.BytesRemaining != 10 {
+		t.Errorf("Expected the earlier version's file to be counted, got %+v", usage)
+	}
+
+	rec := replaceGiftFileRequest("1", "third.txt", strings.Repeat("c", 20), nil)
+	if rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), "Storage quota exceeded") {
+		t.Fatalf("Expected a replacement over quota to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+	restore := func() int {
+		body := []byte(`{"giftId": 1, "version": 1}`)
+		return performAuthenticatedRequest(giftVersionRestoreHandler, "POST", "/gift-versions/restore", body, 1).Code
+	}
+	if code := restore(); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a restore over quota to be refused, got %d", code)
+	}
+	if versions := listTestVersions(t); len(versions) != 1 {
+		t.Errorf("Expected refused edits to keep no version, got %d", len(versions))
+	}
+
+	_, _ = db.Exec("UPDATE users SET storage_quota = 60 WHERE id = 1")
+	if code := restore(); code != http.StatusOK {
+		t.Errorf("Expected a restore within quota to succeed, got %d", code)
+	}
+}
+
+func TestStoragePlans(t *testing.T) {
+	setupTusTest(t)
+	previous := storagePlanQuotas
+	storagePlanQuotas = map[string]int64{defaultStoragePlan: 8, "plus": 100, "unlimited": 0}
+	t.Cleanup(func() { storagePlanQuotas = previous })
+
+	if rec := tusRequest("POST", "/uploads", 1, map[string]string{"Upload-Length": "10"}, ""); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected the free plan to refuse 10 bytes, got %d", rec.Code)
+	}
+	_, _ = db.Exec("UPDATE users SET plan = 'plus' WHERE id = 1")
+	createTestTusUpload(t, "10")
+	// The unfinished upload holds its space.
+	usage := loadTestUsage(t, 1)
+	if usage.Plan != "plus" || usage.PendingUploadBytes != 10 || *usage.BytesRemaining != 90 {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+
+	_, _ = db.Exec("UPDATE users SET plan = 'unlimited' WHERE id = 1")
+	if usage := loadTestUsage(t, 1); usage.QuotaBytes != nil || usage.BytesRemaining != nil {
+		t.Errorf("Expected no limit on the unlimited plan, got %+v", usage)
+	}
+}
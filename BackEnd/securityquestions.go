@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxSecurityQuestions is how many security questions one account may set.
+const maxSecurityQuestions = 3
+
+var (
+	errSecurityAnswerRequired   = errors.New("every new security question needs an answer")
+	errTooManySecurityQuestions = fmt.Errorf("at most %d security questions are allowed", maxSecurityQuestions)
+)
+
+// securityQuestion is what the API shows about a question. Answers never leave the server.
+type securityQuestion struct {
+	ID       int    `json:"id"`
+	Question string `json:"question"`
+}
+
+// securityQuestionInput is a question as submitted by the user. An empty answer
+// keeps the stored answer of an existing question with the same text.
+type securityQuestionInput struct {
+	Question string `json:"question"`
+	Answer   string `json:"answer"`
+}
+
+// normalizeSecurityAnswer makes answers compare the same regardless of case and spacing.
+func normalizeSecurityAnswer(answer string) string {
+	return strings.Join(strings.Fields(strings.ToLower(answer)), " ")
+}
+
+// hashSecurityAnswer returns a bcrypt hash of the normalized answer. The answer is
+// digested with SHA-256 first so long answers stay within bcrypt's 72 byte limit.
+func hashSecurityAnswer(answer string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword(securityAnswerDigest(answer), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func securityAnswerDigest(answer string) []byte {
+	sum := sha256.Sum256([]byte(normalizeSecurityAnswer(answer)))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+func securityAnswerMatches(hash, answer string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), securityAnswerDigest(answer)) == nil
+}
+
+// decoyQuestions are the questions the personal details page offers. Addresses
+// without an account are shown one of them.
+var decoyQuestions = []string{
+	"What is your mother's maiden name?",
+	"What was the name of your first pet?",
+	"What is your favorite teacher's name?",
+	"What was the make of your first car?",
+	"What city were you born in?",
+}
+
+// decoySecurityQuestions makes up the questions of an address without an
+// account. They are the same every time for one address, and their id looks
+// like one of a real question.
+func decoySecurityQuestions(email string) ([]securityQuestion, error) {
+	var maxID int
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM security_questions").Scan(&maxID); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte("security-decoy:" + normalizeEmail(email)))
+	n := binary.BigEndian.Uint64(mac.Sum(nil))
+	return []securityQuestion{{
+		ID:       1 + int(n%uint64(max(maxID, 1))),
+		Question: decoyQuestions[n%uint64(len(decoyQuestions))],
+	}}, nil
+}
+
+var (
+	decoyAnswerHash     string
+	decoyAnswerHashOnce sync.Once
+)
+
+// checkDecoySecurityAnswer takes as long as checking a real answer, for
+// requests about addresses without an account.
+func checkDecoySecurityAnswer(answer string) {
+	decoyAnswerHashOnce.Do(func() {
+		decoyAnswerHash, _ = hashSecurityAnswer("decoy")
+	})
+	securityAnswerMatches(decoyAnswerHash, answer)
+}
+
+// loadSecurityQuestions returns the user's questions in the order they were set.
+func loadSecurityQuestions(userID int) ([]securityQuestion, error) {
+	rows, err := db.Query("SELECT id, question FROM security_questions WHERE user_id = ? ORDER BY position", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	questions := []securityQuestion{}
+	for rows.Next() {
+		var q securityQuestion
+		if err := rows.Scan(&q.ID, &q.Question); err != nil {
+			return nil, err
+		}
+		questions = append(questions, q)
+	}
+	return questions, rows.Err()
+}
+
+// loadSecurityAnswerHashes maps each of the user's question ids to its answer hash.
+func loadSecurityAnswerHashes(userID int) (map[int]string, error) {
+	rows, err := db.Query("SELECT id, answer_hash FROM security_questions WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := map[int]string{}
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return nil, err
+		}
+		hashes[id] = hash
+	}
+	return hashes, rows.Err()
+}
+
+// replaceSecurityQuestions stores the given questions as the user's full set.
+// Entries with an empty question are dropped.
+func replaceSecurityQuestions(userID int, inputs []securityQuestionInput) error {
+	// Remember existing hashes so unchanged questions can be resubmitted without their answer.
+	rows, err := db.Query("SELECT question, answer_hash FROM security_questions WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	existing := map[string]string{}
+	for rows.Next() {
+		var question, hash string
+		if err := rows.Scan(&question, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[question] = hash
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	type storedQuestion struct{ question, hash string }
+	var questions []storedQuestion
+	for _, input := range inputs {
+		question := strings.TrimSpace(input.Question)
+		if question == "" {
+			continue
+		}
+		var hash string
+		if normalizeSecurityAnswer(input.Answer) != "" {
+			if hash, err = hashSecurityAnswer(input.Answer); err != nil {
+				return err
+			}
+		} else if hash = existing[question]; hash == "" {
+			return errSecurityAnswerRequired
+		}
+		questions = append(questions, storedQuestion{question, hash})
+	}
+	if len(questions) > maxSecurityQuestions {
+		return errTooManySecurityQuestions
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM security_questions WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for position, q := range questions {
+		if _, err := tx.Exec("INSERT INTO security_questions (user_id, position, question, answer_hash) VALUES (?, ?, ?, ?)",
+			userID, position, q.question, q.hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// setPrimarySecurityQuestion replaces the user's first question and keeps the rest.
+// It backs the single question fields of the personal details form.
+func setPrimarySecurityQuestion(userID int, input securityQuestionInput) error {
+	current, err := loadSecurityQuestions(userID)
+	if err != nil {
+		return err
+	}
+	inputs := []securityQuestionInput{input}
+	for i, q := range current {
+		if i > 0 {
+			inputs = append(inputs, securityQuestionInput{Question: q.Question})
+		}
+	}
+	return replaceSecurityQuestions(userID, inputs)
+}
+
+// checkSecurityAnswers reports whether answers, keyed by question id, correctly
+// answer every question the user has set. A user without questions never passes.
+func checkSecurityAnswers(userID int, answers map[int]string) (bool, error) {
+	hashes, err := loadSecurityAnswerHashes(userID)
+	if err != nil || len(hashes) == 0 {
+		return false, err
+	}
+	correct := true
+	for id, hash := range hashes {
+		// Check every answer so the response time does not reveal which one was wrong.
+		if !securityAnswerMatches(hash, answers[id]) {
+			correct = false
+		}
+	}
+	return correct, nil
+}
+
+// migrateSecurityAnswers moves plaintext answers left in the users table by older
+// versions into security_questions as hashes and clears the plaintext copy.
+func migrateSecurityAnswers(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(security_question, ''), security_answer FROM users
+		WHERE security_answer IS NOT NULL AND security_answer != ''`)
+	if err != nil {
+		return fmt.Errorf("failed to read legacy security answers: %w", err)
+	}
+	type legacyAnswer struct {
+		userID           int
+		question, answer string
+	}
+	var legacy []legacyAnswer
+	for rows.Next() {
+		var a legacyAnswer
+		if err := rows.Scan(&a.userID, &a.question, &a.answer); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, a)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	for _, a := range legacy {
+		hash, err := hashSecurityAnswer(a.answer)
+		if err != nil {
+			return err
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(a.question) != "" {
+			_, err = tx.Exec(`
+				INSERT INTO security_questions (user_id, position, question, answer_hash)
+				SELECT ?, 0, ?, ? WHERE NOT EXISTS (SELECT 1 FROM security_questions WHERE user_id = ?)`,
+				a.userID, strings.TrimSpace(a.question), hash, a.userID)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE users SET security_question = NULL, security_answer = NULL WHERE id = ?", a.userID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to migrate security answer for user %d: %w", a.userID, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if len(legacy) > 0 {
+		log.Printf("Migrated %d plaintext security answers to hashes", len(legacy))
+	}
+	return nil
+}
+
+// securityQuestionsHandler lists (GET) or replaces (PUT/POST) the signed-in
+// user's security questions. Only the questions are ever returned.
+func securityQuestionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Questions []securityQuestionInput `json:"questions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := replaceSecurityQuestions(userID, req.Questions); err != nil {
+			if err == errSecurityAnswerRequired || err == errTooManySecurityQuestions {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("Error saving security questions for user %d: %v", userID, err)
+			http.Error(w, "Failed to save security questions", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	questions, err := loadSecurityQuestions(userID)
+	if err != nil {
+		log.Printf("Error loading security questions for user %d: %v", userID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"questions": questions})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLegacySecurityAnswersAreMigrated(t *testing.T) {
+	db, _ = setupTestDB()
+	_, _ = db.Exec("INSERT INTO users (id, username, security_question, security_answer) VALUES (1, 'testuser', 'Pet?', 'Fluffy')")
+
+	if err := migrateSecurityAnswers(db); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+	var legacy int
+	_ = db.QueryRow("SELECT COUNT(*) FROM users WHERE security_answer IS NOT NULL").Scan(&legacy)
+	if legacy != 0 {
+		t.Errorf("Expected plaintext answers to be cleared")
+	}
+	var hash string
+	_ = db.QueryRow("SELECT answer_hash FROM security_questions WHERE user_id = 1").Scan(&hash)
+	if hash == "" || strings.Contains(strings.ToLower(hash), "fluffy") {
+		t.Fatalf("Expected a hashed answer, got %q", hash)
+	}
+
+	// Answers are compared after normalizing case and spacing.
+	body := []byte(`{"username": "testuser", "securityAnswer": "  FLUFFY "}`)
+	if rec := performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", body); rec.Code != http.StatusOK {
+		t.Errorf("Expected migrated answer to verify, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMultipleSecurityQuestions(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	body := []byte(`{"questions": [{"question": "Pet?", "answer": "rex"}, {"question": "City?", "answer": "Gainesville"}]}`)
+	rec := performAuthenticatedRequest(securityQuestionsHandler, "PUT", "/security-questions", body, 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Saving questions failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(strings.ToLower(rec.Body.String()), "gainesville") {
+		t.Errorf("Answers must not be returned: %s", rec.Body.String())
+	}
+	var saved struct {
+		Questions []securityQuestion `json:"questions"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &saved)
+	if len(saved.Questions) != 2 {
+		t.Fatalf("Expected 2 questions, got %v", saved.Questions)
+	}
+	pet, city := saved.Questions[0].ID, saved.Questions[1].ID
+
+	// Every question has to be answered correctly.
+	partial := []byte(fmt.Sprintf(`{"username": "Sahil_1234", "answers": {"%d": "rex"}}`, pet))
+	if rec := performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", partial); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a missing answer to fail, got %d", rec.Code)
+	}
+	full := []byte(fmt.Sprintf(`{"username": "Sahil_1234", "answers": {"%d": "rex", "%d": "gainesville"}}`, pet, city))
+	if rec := performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", full); rec.Code != http.StatusOK {
+		t.Errorf("Expected all answers to verify, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// An unchanged question keeps its answer when resubmitted without one; a new one needs an answer.
+	keep := []byte(`{"questions": [{"question": "Pet?"}, {"question": "City?", "answer": "Miami"}]}`)
+	if rec := performAuthenticatedRequest(securityQuestionsHandler, "PUT", "/security-questions", keep, 1); rec.Code != http.StatusOK {
+		t.Errorf("Expected resubmitted question to keep its answer, got %d", rec.Code)
+	}
+	missing := []byte(`{"questions": [{"question": "School?"}]}`)
+	if rec := performAuthenticatedRequest(securityQuestionsHandler, "PUT", "/security-questions", missing, 1); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a new question without answer to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestPersonalDetailsNeverReturnsSecurityAnswer(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	body := []byte(`{"primary_contact_email": "a@example.com", "security_question": "Pet?", "security_answer": "rex"}`)
+	if rec := performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", body, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Update failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec := performAuthenticatedRequest(personalDetailsHandler, "GET", "/update-emails", nil, 1)
+	if strings.Contains(rec.Body.String(), "security_answer") || strings.Contains(rec.Body.String(), "rex") {
+		t.Errorf("Expected no security answer in response, got %s", rec.Body.String())
+	}
+
+	// Saving the form again with the answer left blank keeps the stored answer.
+	body = []byte(`{"primary_contact_email": "b@example.com", "security_question": "Pet?", "security_answer": ""}`)
+	if rec := performAuthenticatedRequest(personalDetailsHandler, "POST", "/update-emails", body, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Update failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if ok, _ := checkSecurityAnswers(1, map[int]string{}); ok {
+		t.Errorf("Expected an empty answer to fail")
+	}
+	questions, _ := loadSecurityQuestions(1)
+	if ok, _ := checkSecurityAnswers(1, map[int]string{questions[0].ID: "Rex"}); !ok {
+		t.Errorf("Expected the stored answer to be kept")
+	}
+}
+
+func TestSecurityAnswerOnlyAllowsPasswordReset(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "OldPass@123")
+	_ = replaceSecurityQuestions(1, []securityQuestionInput{{Question: "Pet?", Answer: "fluffy"}})
+
+	rec := performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", []byte(`{"username": "Sahil_1234", "securityAnswer": "fluffy"}`))
+	var verified map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &verified)
+	resetToken, _ := verified["resetToken"].(string)
+	if rec.Code != http.StatusOK || resetToken == "" || verified["token"] != nil || len(rec.Result().Cookies()) != 0 {
+		t.Fatalf("Expected only a reset token, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// The token is no session.
+	req := httptest.NewRequest("GET", "/gift-count", nil)
+	req.Header.Set("Authorization", "Bearer "+resetToken)
+	if rec := serve(giftCountHandler, req); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the reset token not to sign in, got %d", rec.Code)
+	}
+
+	body := []byte(fmt.Sprintf(`{"token": "%s", "newPassword": "NewPass@1234"}`, resetToken))
+	if rec := performRequest(confirmPasswordResetHandler, "POST", "/reset-password/confirm", body); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the password to be reset, got %d %s", rec.Code, rec.Body.String())
+	}
+	var hash string
+	_ = db.QueryRow("SELECT password FROM users WHERE id = 1").Scan(&hash)
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte("NewPass@1234")) != nil {
+		t.Errorf("Password was not updated")
+	}
+	body = []byte(fmt.Sprintf(`{"token": "%s", "newPassword": "Other@12345"}`, resetToken))
+	if rec := performRequest(confirmPasswordResetHandler, "POST", "/reset-password/confirm", body); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the reset token to work once, got %d", rec.Code)
+	}
+
+	// With 2FA on, the second factor leads to a reset token too.
+	_, _ = db.Exec("UPDATE users SET totp_enabled = 1 WHERE id = 1")
+	codes, _ := generateRecoveryCodes(1)
+	rec = performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", []byte(`{"username": "Sahil_1234", "securityAnswer": "fluffy"}`))
+	var challenge map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &challenge)
+	if challenge["twoFactorRequired"] != true {
+		t.Fatalf("Expected a 2FA challenge, got %s", rec.Body.String())
+	}
+	body = []byte(fmt.Sprintf(`{"challenge": "%s", "recoveryCode": "%s"}`, challenge["challenge"], codes[0]))
+	rec = performRequest(loginTwoFactorHandler, "POST", "/login/2fa", body)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"resetToken"`) || strings.Contains(rec.Body.String(), `"token"`) {
+		t.Errorf("Expected a reset token after the second factor, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestSecurityInfoDoesNotRevealAccounts(t *testing.T) {
+	db, _ = setupTestDB()
+	_, _ = db.Exec("INSERT INTO users (id, username, primary_contact_email, secondary_contact_emails) VALUES (1, 'testuser', 'test@example.com', 'alt@example.com')")
+	_ = replaceSecurityQuestions(1, []securityQuestionInput{{Question: "Your color?", Answer: "blue"}})
+	_ = markEmailVerified(1, "test@example.com")
+
+	info := func(email string) map[string]interface{} {
+		rec := performRequest(getSecurityInfoHandler, "POST", "/get-security-info", []byte(`{"email": "`+email+`"}`))
+		var response map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("Unexpected security info for %s: %d %s", email, rec.Code, rec.Body.String())
+		}
+		return response
+	}
+	if known := info("test@example.com"); known["securityQuestion"] != "Your color?" || known["username"] != nil {
+		t.Errorf("Expected the account's question and no username, got %v", known)
+	}
+	// Unverified and unknown addresses get made-up questions, the same each time.
+	for _, email := range []string{"alt@example.com", "nobody@example.com"} {
+		decoy := info(email)
+		if decoy["securityQuestion"] == "" || decoy["securityQuestion"] == "Your color?" || fmt.Sprint(decoy) != fmt.Sprint(info(email)) {
+			t.Errorf("Expected stable made-up questions for %s, got %v", email, decoy)
+		}
+	}
+
+	for _, email := range []string{"alt@example.com", "nobody@example.com"} {
+		body := []byte(`{"email": "` + email + `", "securityAnswer": "blue"}`)
+		if rec := performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", body); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected %s to fail like a wrong answer, got %d", email, rec.Code)
+		}
+	}
+	body := []byte(`{"email": "TEST@example.com", "securityAnswer": "blue"}`)
+	if rec := performRequest(verifySecurityAnswerHandler, "POST", "/verify-security-answer", body); rec.Code != http.StatusOK {
+		t.Errorf("Expected the verified address to be answered, got %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sessionTouchInterval limits how often a session's last activity is written back.
+const sessionTouchInterval = time.Minute
+
+// createSession issues a session token for the user and records the session
+// together with the client's address and user agent.
+func createSession(r *http.Request, userID int) (string, time.Time, error) {
+	token, sid, expiresAt, err := issueSessionToken(userID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := timeNow().Unix()
+	if _, err := db.Exec(`
+		INSERT INTO sessions (id, user_id, created_at, last_seen_at, expires_at, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		sid, userID, now, now, expiresAt.Unix(), clientIP(r), r.UserAgent()); err != nil {
+		return "", time.Time{}, err
+	}
+	// Expired sessions are of no further use; forget them while we are here.
+	if _, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND expires_at <= ?", userID, now); err != nil {
+		log.Printf("Error removing expired sessions for user %d: %v", userID, err)
+	}
+	return token, expiresAt, nil
+}
+
+// sessionActive reports whether the session exists, belongs to the user and
+// has not been revoked, and records the request as its latest activity.
+func sessionActive(sid string, userID int, r *http.Request) bool {
+	var owner int
+	var revoked bool
+	var lastSeen int64
+	err := db.QueryRow("SELECT user_id, revoked_at IS NOT NULL, last_seen_at FROM sessions WHERE id = ?", sid).
+		Scan(&owner, &revoked, &lastSeen)
+	if err != nil || owner != userID || revoked {
+		return false
+	}
+	now := timeNow()
+	if now.Sub(time.Unix(lastSeen, 0)) >= sessionTouchInterval {
+		if _, err := db.Exec("UPDATE sessions SET last_seen_at = ?, ip = ? WHERE id = ?", now.Unix(), clientIP(r), sid); err != nil {
+			log.Printf("Error updating session activity: %v", err)
+		}
+	}
+	return true
+}
+
+// currentSessionID returns the id of the session the request was made with.
+func currentSessionID(r *http.Request) string {
+	sid, _ := r.Context().Value(sessionIDContextKey).(string)
+	return sid
+}
+
+// revokeSession ends one of the user's sessions and reports whether it was active.
+func revokeSession(userID int, sid string) bool {
+	res, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		timeNow().Unix(), sid, userID)
+	if err != nil {
+		log.Printf("Error revoking session for user %d: %v", userID, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+// revokeOtherSessions ends every session of the user except keepSID ("" ends them all).
+func revokeOtherSessions(userID int, keepSID string) (int64, error) {
+	res, err := db.Exec("UPDATE sessions SET revoked_at = ? WHERE user_id = ? AND id != ? AND revoked_at IS NULL",
+		timeNow().Unix(), userID, keepSID)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// sessionsHandler lists the signed-in user's active sessions (GET) or revokes
+// one of them (DELETE ?id=).
+func sessionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := db.Query(`
+			SELECT id, created_at, last_seen_at, expires_at, ip, user_agent FROM sessions
+			WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+			ORDER BY last_seen_at DESC`, userID, timeNow().Unix())
+		if err != nil {
+			http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		type session struct {
+			ID         string `json:"id"`
+			Device     string `json:"device"`
+			IP         string `json:"ip"`
+			CreatedAt  string `json:"createdAt"`
+			LastSeenAt string `json:"lastSeenAt"`
+			ExpiresAt  string `json:"expiresAt"`
+			Current    bool   `json:"current"`
+		}
+		sessions := []session{}
+		for rows.Next() {
+			var s session
+			var created, lastSeen, expires int64
+			if err := rows.Scan(&s.ID, &created, &lastSeen, &expires, &s.IP, &s.Device); err != nil {
+				http.Error(w, "Error retrieving sessions", http.StatusInternalServerError)
+				return
+			}
+			s.CreatedAt = time.Unix(created, 0).UTC().Format(time.RFC3339)
+			s.LastSeenAt = time.Unix(lastSeen, 0).UTC().Format(time.RFC3339)
+			s.ExpiresAt = time.Unix(expires, 0).UTC().Format(time.RFC3339)
+			s.Current = s.ID == currentSessionID(r)
+			sessions = append(sessions, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sessions)
+
+	case http.MethodDelete:
+		sid := r.URL.Query().Get("id")
+		if sid == "" {
+			http.Error(w, "Missing session id", http.StatusBadRequest)
+			return
+		}
+		if !revokeSession(userID, sid) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		if sid == currentSessionID(r) {
+			clearSessionCookie(w)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"message": "Session revoked"})
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// revokeAllSessionsHandler signs the user out everywhere except the current session.
+func revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	revoked, err := revokeOtherSessions(userID, currentSessionID(r))
+	if err != nil {
+		log.Printf("Error revoking sessions for user %d: %v", userID, err)
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Other sessions revoked", "revoked": revoked})
+}
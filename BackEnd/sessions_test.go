@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newSessionRequest creates a request signed in with a fresh session and returns the session id.
+func newSessionRequest(method, url string, userID int, userAgent string) (*http.Request, string) {
+	req := httptest.NewRequest(method, url, nil)
+	req.Header.Set("User-Agent", userAgent)
+	token, _, err := createSession(req, userID)
+	if err != nil {
+		panic(err)
+	}
+	_, sid, _ := parseSessionClaims(token, timeNow())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req, sid
+}
+
+func serve(handler http.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	requireAuth(handler)(rec, req)
+	return rec
+}
+
+func TestListAndRevokeSessions(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	laptop, laptopSID := newSessionRequest("GET", "/sessions", 1, "Laptop browser")
+	phone, phoneSID := newSessionRequest("GET", "/gift-count", 1, "Phone app")
+
+	rec := serve(sessionsHandler, laptop)
+	var sessions []struct {
+		ID      string `json:"id"`
+		Device  string `json:"device"`
+		Current bool   `json:"current"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &sessions)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %s", rec.Body.String())
+	}
+	for _, s := range sessions {
+		if s.Current != (s.ID == laptopSID) {
+			t.Errorf("Wrong current flag on %+v", s)
+		}
+	}
+
+	revoke := httptest.NewRequest("DELETE", "/sessions?id="+phoneSID, nil)
+	revoke.Header.Set("Authorization", laptop.Header.Get("Authorization"))
+	if rec := serve(sessionsHandler, revoke); rec.Code != http.StatusOK {
+		t.Fatalf("Revoke failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(giftCountHandler, phone); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked session to be rejected, got %d", rec.Code)
+	}
+
+	// Another user's session cannot be revoked.
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	_, otherSID := newSessionRequest("GET", "/", 2, "Other")
+	revoke = httptest.NewRequest("DELETE", "/sessions?id="+otherSID, nil)
+	revoke.Header.Set("Authorization", laptop.Header.Get("Authorization"))
+	if rec := serve(sessionsHandler, revoke); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user's session, got %d", rec.Code)
+	}
+}
+
+func TestRevokeAllAndPasswordChangeKeepCurrentSession(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	current, _ := newSessionRequest("POST", "/sessions/revoke-all", 1, "Laptop")
+	other, _ := newSessionRequest("GET", "/gift-count", 1, "Phone")
+	if rec := serve(revokeAllSessionsHandler, current); rec.Code != http.StatusOK {
+		t.Fatalf("Revoke all failed: %d", rec.Code)
+	}
+	if rec := serve(giftCountHandler, other); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected other session to be revoked, got %d", rec.Code)
+	}
+
+	other, _ = newSessionRequest("GET", "/gift-count", 1, "Phone")
+	change := httptest.NewRequest("POST", "/change-password", strings.NewReader(`{"newPassword": "NewPass@1234"}`))
+	change.Header.Set("Authorization", current.Header.Get("Authorization"))
+	if rec := serve(changePasswordHandler, change); rec.Code != http.StatusOK {
+		t.Fatalf("Change password failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := serve(giftCountHandler, other); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected password change to revoke other sessions, got %d", rec.Code)
+	}
+	still := httptest.NewRequest("GET", "/gift-count", nil)
+	still.Header.Set("Authorization", current.Header.Get("Authorization"))
+	if rec := serve(giftCountHandler, still); rec.Code != http.StatusOK {
+		t.Errorf("Expected the current session to survive, got %d", rec.Code)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	req, _ := newSessionRequest("POST", "/logout", 1, "Laptop")
+	logoutHandler(httptest.NewRecorder(), req)
+
+	after := httptest.NewRequest("GET", "/gift-count", nil)
+	after.Header.Set("Authorization", req.Header.Get("Authorization"))
+	if rec := serve(giftCountHandler, after); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected logged out token to be rejected, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gopkg.in/gomail.v2"
+)
+
+// Text memories are gifts written in the app instead of uploaded. They have
+// no file: the gift row keeps the memory's sanitized HTML and a plain text
+// rendering of it, and its file_name holds the memory's title. Emails carry a
+// memory in the body, as HTML with the plain text as the alternative, and
+// /download-gift serves it as an HTML file.
+
+const (
+	giftTypeFile = "file"
+	giftTypeText = "text"
+)
+
+// maxMemoryBytes caps the HTML of a text memory, from GIFT_MAX_MEMORY_BYTES.
+var maxMemoryBytes = envBytes("GIFT_MAX_MEMORY_BYTES", 1<<20)
+
+var errGiftType = errors.New("edit does not apply to this type of gift")
+
+// textMemory is the content of a text gift.
+type textMemory struct {
+	Title string `json:"title"`
+	HTML  string `json:"html"` // sanitized, see sanitizeMemoryHTML
+	Text  string `json:"text"` // plain text rendering of HTML
+}
+
+// newTextMemory sanitizes a memory as written in the editor.
+func newTextMemory(title, rawHTML string) (textMemory, error) {
+	memory := textMemory{Title: strings.TrimSpace(title)}
+	if memory.Title == "" {
+		memory.Title = "Memory"
+	}
+	if int64(len(memory.Title)) > maxGiftFieldBytes {
+		return textMemory{}, &uploadError{http.StatusRequestEntityTooLarge, "Title is too long"}
+	}
+	var err error
+	memory.HTML, memory.Text, err = sanitizeMemory(rawHTML)
+	return memory, err
+}
+
+// sanitizeMemory returns the sanitized HTML of a memory and its plain text,
+// refusing memories that are too long or have no text.
+func sanitizeMemory(rawHTML string) (string, string, error) {
+	if int64(len(rawHTML)) > maxMemoryBytes {
+		return "", "", &uploadError{http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("Memory is too long; the limit is %d bytes", maxMemoryBytes)}
+	}
+	sanitized := sanitizeMemoryHTML(rawHTML)
+	text := memoryPlainText(sanitized)
+	if text == "" {
+		return "", "", &uploadError{http.StatusBadRequest, "Memory cannot be empty"}
+	}
+	return sanitized, text, nil
+}
+
+// insertTextGift records a memory as a new pending gift, sealed with the
+// user's data key when encryption is on (see sealMemory).
+func insertTextGift(userID int, memory textMemory, customMessage string) (int64, error) {
+	memoryHTML, memoryText, memoryTerms, err := sealTextMemory(userID, memory.HTML, memory.Text)
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(`
+		INSERT INTO gifts (user_id, file_name, custom_message, pending, gift_type, memory_html, memory_text, memory_terms)
+		VALUES (?, ?, ?, 1, ?, ?, ?, ?)`,
+		userID, memory.Title, customMessage, giftTypeText, memoryHTML, memoryText, memoryTerms)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// sealTextMemory seals a memory's HTML and plain text for storing, and
+// returns the memory_terms that keep the sealed text searchable.
+func sealTextMemory(ownerID int, memoryHTML, memoryText string) (sealedHTML, sealedText, terms interface{}, err error) {
+	if sealedHTML, err = sealMemory(ownerID, memoryHTML); err != nil {
+		return nil, nil, nil, err
+	}
+	if sealedText, err = sealMemory(ownerID, memoryText); err != nil {
+		return nil, nil, nil, err
+	}
+	terms, err = memorySearchTerms(ownerID, memoryText)
+	return sealedHTML, sealedText, terms, err
+}
+
+// loadTextMemory returns the memory of a text gift, or nil for a file gift.
+func loadTextMemory(giftID int) (*textMemory, error) {
+	var memory textMemory
+	var giftType string
+	var ownerID int
+	var memoryHTML, memoryText interface{}
+	err := db.QueryRow("SELECT user_id, COALESCE(gift_type, ?), COALESCE(file_name, ''), memory_html, memory_text FROM gifts WHERE id = ?",
+		giftTypeFile, giftID).Scan(&ownerID, &giftType, &memory.Title, &memoryHTML, &memoryText)
+	if err != nil {
+		return nil, err
+	}
+	if giftType != giftTypeText {
+		return nil, nil
+	}
+	if memory.HTML, err = openMemory(ownerID, memoryHTML); err != nil {
+		return nil, err
+	}
+	if memory.Text, err = openMemory(ownerID, memoryText); err != nil {
+		return nil, err
+	}
+	return &memory, nil
+}
+
+// memoryDocument is a complete HTML document showing the intro, if any,
+// followed by each memory under its title.
+func memoryDocument(intro string, memories []textMemory) string {
+	var b strings.Builder
+	b.WriteString(`<!DOCTYPE html><html><head><meta charset="utf-8">`)
+	if len(memories) == 1 {
+		b.WriteString("<title>" + html.EscapeString(memories[0].Title) + "</title>")
+	}
+	b.WriteString("</head><body>")
+	if intro != "" {
+		paragraphs := strings.Split(strings.ReplaceAll(intro, "\r\n", "\n"), "\n\n")
+		for _, p := range paragraphs {
+			b.WriteString("<p>" + strings.ReplaceAll(html.EscapeString(p), "\n", "<br>") + "</p>")
+		}
+	}
+	for _, memory := range memories {
+		b.WriteString("<h2>" + html.EscapeString(memory.Title) + "</h2>")
+		b.WriteString(memory.HTML)
+	}
+	b.WriteString("</body></html>")
+	return b.String()
+}
+
+// setGiftEmailBody sets the body of a gift email. Memories follow the text of
+// body, and make the message multipart/alternative so that mail clients show
+// their formatting and fall back to the plain text.
+func setGiftEmailBody(m *gomail.Message, body string, memories []textMemory) {
+	if len(memories) == 0 {
+		m.SetBody("text/plain", body)
+		return
+	}
+	plain := body
+	for _, memory := range memories {
+		plain += "\n\n" + memory.Title + "\n\n" + memory.Text
+	}
+	m.SetBody("text/plain", plain)
+	m.AddAlternative("text/html", memoryDocument(body, memories))
+}
+
+// textGiftHandler creates and reads text memories:
+//
+//	POST /text-gift       {"title": "...", "html": "...", "customMessage": "..."}
+//	GET  /text-gift?id=1  the memory's title, sanitized HTML and plain text
+//
+// Memories are edited through /edit-gift with an "html" field.
+func textGiftHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		giftID, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+			return
+		}
+		if _, ok := authorizeGift(w, r, giftID, giftActionView); !ok {
+			return
+		}
+		memory, err := loadTextMemory(giftID)
+		if err != nil {
+			http.Error(w, "Error retrieving memory", http.StatusInternalServerError)
+			return
+		}
+		if memory == nil {
+			http.Error(w, "Gift is not a text memory", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(memory)
+
+	case http.MethodPost:
+		userID, ok := currentUserID(w, r)
+		if !ok {
+			return
+		}
+		if !canReceiveGifts(userID) {
+			http.Error(w, "User has disabled gift receiving", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Title         string `json:"title"`
+			HTML          string `json:"html"`
+			CustomMessage string `json:"customMessage"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxMemoryBytes+2*maxGiftFieldBytes+1024)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if int64(len(req.CustomMessage)) > maxGiftFieldBytes {
+			writeUploadError(w, &uploadError{http.StatusRequestEntityTooLarge, "Message is too long"})
+			return
+		}
+		memory, err := newTextMemory(req.Title, req.HTML)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		giftID, err := insertTextGift(userID, memory, req.CustomMessage)
+		if err != nil {
+			log.Printf("Error storing memory for user %d: %v", userID, err)
+			http.Error(w, "Failed to store memory", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Memory saved successfully",
+			"giftId":  giftID,
+			"text":    memory.Text,
+		})
+
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"gopkg.in/gomail.v2"
+)
+
+func createTestMemory(t *testing.T, body string) *textMemory {
+	t.Helper()
+	rec := performAuthenticatedRequest(textGiftHandler, "POST", "/text-gift", []byte(body), 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the memory to be saved, got %d: %s", rec.Code, rec.Body.String())
+	}
+	return loadTestMemory(t)
+}
+
+func loadTestMemory(t *testing.T) *textMemory {
+	t.Helper()
+	rec := performAuthenticatedRequest(textGiftHandler, "GET", "/text-gift?id=1", nil, 1)
+	var memory textMemory
+	if err := json.Unmarshal(rec.Body.Bytes(), &memory); err != nil {
+		t.Fatalf("Unexpected memory %d: %s", rec.Code, rec.Body.String())
+	}
+	return &memory
+}
+
+func TestCreateTextMemory(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+
+	memory := createTestMemory(t, `{"title": " Our summer ", "html": "<p>The <strong>lake</strong><script>steal()</script></p><p onclick=\"x\">Love</p>"}`)
+	if memory.Title != "Our summer" || memory.HTML != "<p>The <strong>lake</strong></p><p>Love</p>" || memory.Text != "The lake\n\nLove" {
+		t.Fatalf("Unexpected memory %+v", memory)
+	}
+
+	if gifts := listTestGifts(t, "?type=text").Items; len(gifts) != 1 || gifts[0].Type != giftTypeText || gifts[0].FileName != "Our summer" {
+		t.Errorf("Expected the memory listed as a text gift, got %+v", gifts)
+	}
+
+	download := downloadGift(nil)
+	if download.Code != http.StatusOK || !strings.HasPrefix(download.Header().Get("Content-Type"), "text/html") ||
+		!strings.HasPrefix(download.Header().Get("Content-Disposition"), "attachment") ||
+		!strings.Contains(download.Body.String(), memory.HTML) {
+		t.Errorf("Expected the memory to download as an HTML file, got %d %v", download.Code, download.Header())
+	}
+	if blobs := countRows("blobs"); blobs != 0 {
+		t.Errorf("Expected nothing in the file store, found %d blobs", blobs)
+	}
+}
+
+func TestTextMemoryRefusals(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+
+	for _, body := range []string{`{"title": "Empty", "html": "<p> </p><script>x</script>"}`, `{"html": `} {
+		if rec := performAuthenticatedRequest(textGiftHandler, "POST", "/text-gift", []byte(body), 1); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, rec.Code)
+		}
+	}
+	long, _ := json.Marshal(map[string]string{"html": "<p>" + strings.Repeat("a", int(maxMemoryBytes)) + "</p>"})
+	if rec := performAuthenticatedRequest(textGiftHandler, "POST", "/text-gift", long, 1); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected long memories to be refused, got %d", rec.Code)
+	}
+	if countRows("gifts") != 0 {
+		t.Fatal("Expected nothing stored")
+	}
+
+	createTestMemory(t, `{"html": "<p>Private</p>"}`)
+	if rec := performAuthenticatedRequest(textGiftHandler, "GET", "/text-gift?id=1", nil, 2); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected other users to be refused, got %d", rec.Code)
+	}
+	_ = uploadTestFile("letter.txt", "a file")
+	if rec := performAuthenticatedRequest(textGiftHandler, "GET", "/text-gift?id=2", nil, 1); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected file gifts not to be memories, got %d", rec.Code)
+	}
+}
+
+func TestEditTextMemoryKeepsVersions(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	createTestMemory(t, `{"title": "Draft", "html": "<p>First</p>"}`)
+
+	rec := performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1",
+		[]byte(`{"fileName": "Final", "html": "<p>Second <a href=\"javascript:x\">link</a></p>"}`), 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the memory to be edited, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if memory := loadTestMemory(t); memory.Title != "Final" || memory.HTML != "<p>Second <a>link</a></p>" || memory.Text != "Second link" {
+		t.Errorf("Unexpected memory %+v", memory)
+	}
+
+	versions := listTestVersions(t)
+	if len(versions) != 1 || versions[0].FileName != "Draft" || versions[0].HTML != "<p>First</p>" {
+		t.Fatalf("Unexpected versions %+v", versions)
+	}
+	rec = performAuthenticatedRequest(giftVersionRestoreHandler, "POST", "/gift-versions/restore", []byte(`{"giftId": 1, "version": 1}`), 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the version to be restored, got %d", rec.Code)
+	}
+	if memory := loadTestMemory(t); memory.Title != "Draft" || memory.Text != "First" {
+		t.Errorf("Expected the first version back, got %+v", memory)
+	}
+
+	if rec := replaceGiftFileRequest("1", "photo.txt", "a file", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a file not to replace a memory, got %d", rec.Code)
+	}
+	if rec := performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=1", []byte(`{"html": "<br>"}`), 1); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an empty memory to be refused, got %d", rec.Code)
+	}
+	_ = uploadTestFile("letter.txt", "a file")
+	if rec := performAuthenticatedRequest(editGiftHandler, "PATCH", "/edit-gift?id=2", []byte(`{"html": "<p>x</p>"}`), 1); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected file gifts to refuse HTML, got %d", rec.Code)
+	}
+	if blobs := countRows("blobs"); blobs != 1 {
+		t.Errorf("Expected the refused file not to be kept, found %d blobs", blobs)
+	}
+}
+
+func TestGiftEmailCarriesMemories(t *testing.T) {
+	memory := textMemory{Title: "Our summer", HTML: "<p>The <strong>lake</strong></p>", Text: "The lake"}
+	m := gomail.NewMessage()
+	setGiftEmailBody(m, "Hello,\n\n<Sam>", []textMemory{memory})
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Undo the quoted-printable soft line breaks.
+	email := strings.ReplaceAll(buf.String(), "=\r\n", "")
+	for _, want := range []string{
+		"multipart/alternative",
+		"Hello,\r\n\r\n<Sam>\r\n\r\nOur summer\r\n\r\nThe lake",
+		"<p>Hello,</p><p>&lt;Sam&gt;</p><h2>Our summer</h2><p>The <strong>lake</strong></p>",
+	} {
+		if !strings.Contains(email, want) {
+			t.Errorf("Expected the email to contain %q:\n%s", want, email)
+		}
+	}
+
+	m = gomail.NewMessage()
+	setGiftEmailBody(m, "Hello", nil)
+	buf.Reset()
+	_, _ = m.WriteTo(&buf)
+	if strings.Contains(buf.String(), "text/html") {
+		t.Error("Expected a plain text email without memories")
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif" // registered for image.Decode
+	"image/jpeg"
+	_ "image/png" // registered for image.Decode
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Image attachments get scaled-down JPEG previews so the dashboard does not
+// have to fetch the originals. Each attachment's thumbnail_state records
+// progress: NULL until it has been looked at, then "ready", "none" for files
+// that are not images, or "failed" for images that could not be decoded.
+
+type thumbnailSize struct {
+	name    string
+	maxSide int // length of the longest side in pixels
+}
+
+// thumbnailSizes are listed largest first; each is scaled from the one before.
+var thumbnailSizes = []thumbnailSize{{"medium", 640}, {"small", 160}}
+
+const (
+	// maxThumbnailSourcePixels skips images too large to decode safely, such
+	// as a small file that claims enormous dimensions.
+	maxThumbnailSourcePixels = 50_000_000
+	thumbnailQuality         = 82
+	thumbnailSweepInterval   = 10 * time.Minute
+)
+
+// thumbnailTypes are the image types that can be decoded.
+var thumbnailTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+var errImageTooLarge = errors.New("image is too large to make thumbnails of")
+
+// thumbnailQueue holds gifts with new files. runThumbnailJob works through it
+// and also sweeps for files it missed, such as those uploaded before
+// thumbnails existed or while the queue was full.
+var thumbnailQueue = make(chan int, 256)
+
+// queueThumbnails asks for thumbnails of the gift's new files without waiting for them.
+func queueThumbnails(giftID int64) {
+	select {
+	case thumbnailQueue <- int(giftID):
+	default:
+		// The next sweep will find them.
+	}
+}
+
+// runThumbnailJob makes thumbnails for queued gifts as they arrive and for any
+// others every thumbnailSweepInterval.
+func runThumbnailJob() {
+	ticker := time.NewTicker(thumbnailSweepInterval)
+	defer ticker.Stop()
+	for {
+		if made, err := generateMissingThumbnails(); err != nil {
+			log.Printf("Error generating thumbnails: %v", err)
+		} else if made > 0 {
+			log.Printf("Made thumbnails for %d files", made)
+		}
+	wait:
+		for {
+			select {
+			case giftID := <-thumbnailQueue:
+				if _, err := generateGiftThumbnails(giftID); err != nil {
+					log.Printf("Error generating thumbnails for gift %d: %v", giftID, err)
+				}
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+// generateMissingThumbnails looks at every file that has not been looked at
+// yet. It returns how many files got thumbnails.
+func generateMissingThumbnails() (int, error) {
+	// Gifts from before bundles have no attachment rows to track progress on.
+	legacy, err := queryGiftIDs(`SELECT id FROM gifts g WHERE (storage_key IS NOT NULL OR file_data IS NOT NULL)
+		AND NOT EXISTS (SELECT 1 FROM gift_attachments a WHERE a.gift_id = g.id)`)
+	if err != nil {
+		return 0, err
+	}
+	for _, giftID := range legacy {
+		if err := ensureGiftAttachments(giftID); err != nil {
+			return 0, err
+		}
+	}
+
+	giftIDs, err := queryGiftIDs("SELECT DISTINCT gift_id FROM gift_attachments WHERE thumbnail_state IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	made := 0
+	for _, giftID := range giftIDs {
+		n, err := generateGiftThumbnails(giftID)
+		made += n
+		if err != nil {
+			return made, err
+		}
+	}
+	return made, nil
+}
+
+func queryGiftIDs(query string, args ...interface{}) ([]int, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// generateGiftThumbnails makes thumbnails for the gift's files that have not
+// been looked at yet. It returns how many files got thumbnails.
+func generateGiftThumbnails(giftID int) (int, error) {
+	var ownerID int
+	if err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ?", giftID).Scan(&ownerID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	rows, err := db.Query(`SELECT id, file_name, COALESCE(mime_type, ''), storage_key FROM gift_attachments
+		WHERE gift_id = ? AND thumbnail_state IS NULL ORDER BY position`, giftID)
+	if err != nil {
+		return 0, err
+	}
+	var pending []giftAttachment
+	for rows.Next() {
+		var a giftAttachment
+		if err := rows.Scan(&a.ID, &a.FileName, &a.MimeType, &a.storageKey); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, a)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	made := 0
+	for _, a := range pending {
+		state := "ready"
+		contentType := a.MimeType
+		if contentType == "" {
+			contentType = contentTypeFromName(a.FileName)
+		}
+		if !mediaTypeMatches(contentType, thumbnailTypes) {
+			state = "none"
+		} else if err := generateAttachmentThumbnails(giftID, ownerID, a); err != nil {
+			log.Printf("Could not make thumbnails of attachment %d: %v", a.ID, err)
+			state = "failed"
+		} else {
+			made++
+		}
+		if _, err := db.Exec("UPDATE gift_attachments SET thumbnail_state = ? WHERE id = ?", state, a.ID); err != nil {
+			return made, err
+		}
+	}
+	return made, nil
+}
+
+// generateAttachmentThumbnails decodes an image attachment and stores a
+// thumbnail of it in every size.
+func generateAttachmentThumbnails(giftID, ownerID int, a giftAttachment) error {
+	rc, err := openAttachmentData(giftID, a)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailSourcePixels {
+		return errImageTooLarge
+	}
+
+	rc, err = openAttachmentData(giftID, a)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	for _, size := range thumbnailSizes {
+		img = scaleDown(img, size.maxSide)
+		if err := storeThumbnail(ownerID, a.ID, size.name, img); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeThumbnail encodes img as a JPEG and stores it like a gift file, encrypted
+// for the gift's owner.
+func storeThumbnail(ownerID, attachmentID int, size string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	upload := giftUpload{MimeType: "image/jpeg", SHA256: hex.EncodeToString(sum[:])}
+	if err := putGiftBlob(&upload, ownerID, bytes.NewReader(buf.Bytes())); err != nil {
+		return err
+	}
+	bounds := img.Bounds()
+	return storeDeduplicated(&upload, func() error {
+		_, err := db.Exec(`
+			INSERT INTO gift_thumbnails (attachment_id, size, storage_key, width, height, file_size, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			attachmentID, size, upload.StorageKey, bounds.Dx(), bounds.Dy(), upload.Size, timeNow().Unix())
+		return err
+	})
+}
+
+// scaleDown shrinks img so its longest side is at most maxSide, averaging all
+// the source pixels behind each output pixel. Transparency is flattened onto
+// white since JPEG has none. Images that are already small keep their size.
+func scaleDown(img image.Image, maxSide int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	tw, th := w, h
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			tw, th = maxSide, max(1, h*maxSide/w)
+		} else {
+			tw, th = max(1, w*maxSide/h), maxSide
+		}
+	}
+
+	type sum struct{ r, g, b, a, n uint64 }
+	sums := make([]sum, tw*th)
+	fast, _ := img.(image.RGBA64Image) // avoids boxing every pixel in a color.Color
+	for y := 0; y < h; y++ {
+		row := sums[y*th/h*tw:]
+		for x := 0; x < w; x++ {
+			var c color.RGBA64
+			if fast != nil {
+				c = fast.RGBA64At(bounds.Min.X+x, bounds.Min.Y+y)
+			} else {
+				r, g, b, a := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+				c = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+			}
+			s := &row[x*tw/w]
+			s.r += uint64(c.R)
+			s.g += uint64(c.G)
+			s.b += uint64(c.B)
+			s.a += uint64(c.A)
+			s.n++
+		}
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for i, s := range sums {
+		// Colours are premultiplied, so adding the uncovered part of white flattens them.
+		white := 0xffff - s.a/s.n
+		out.Pix[i*4] = uint8((s.r/s.n + white) >> 8)
+		out.Pix[i*4+1] = uint8((s.g/s.n + white) >> 8)
+		out.Pix[i*4+2] = uint8((s.b/s.n + white) >> 8)
+		out.Pix[i*4+3] = 0xff
+	}
+	return out
+}
+
+// giftThumbnailHandler serves a thumbnail of one of a gift's images:
+// GET /gift-thumbnail?id=1&attachment=5&size=small. Without attachment it
+// shows the gift's first file. It answers 404 while no thumbnail exists, for
+// example for files that are not images or have not been processed yet.
+func giftThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handleGet(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	giftID, err := strconv.Atoi(query.Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+		return
+	}
+	size := query.Get("size")
+	if size == "" {
+		size = "small"
+	}
+	known := false
+	for _, s := range thumbnailSizes {
+		known = known || s.name == size
+	}
+	if !known {
+		http.Error(w, "Unknown thumbnail size", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorizeGift(w, r, giftID, giftActionView); !ok {
+		return
+	}
+
+	var attachmentID int
+	if attachment := query.Get("attachment"); attachment != "" {
+		if attachmentID, err = strconv.Atoi(attachment); err != nil {
+			http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := ensureGiftAttachments(giftID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		err := db.QueryRow("SELECT id FROM gift_attachments WHERE gift_id = ? ORDER BY position, id LIMIT 1", giftID).Scan(&attachmentID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "No thumbnail for this file", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var (
+		file       giftFile
+		storageKey string
+		fileSize   int64
+		createdAt  int64
+	)
+	err = db.QueryRow(`
+		SELECT a.file_name, t.storage_key, t.file_size, t.created_at FROM gift_thumbnails t
+		JOIN gift_attachments a ON a.id = t.attachment_id
+		WHERE a.gift_id = ? AND a.id = ? AND t.size = ?`, giftID, attachmentID, size).
+		Scan(&file.Name, &storageKey, &fileSize, &createdAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "No thumbnail for this file", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = file.setStoredContent(storageKey, fileSize)
+	}
+	if err != nil {
+		log.Printf("Error retrieving thumbnail of attachment %d: %v", attachmentID, err)
+		http.Error(w, "Error retrieving thumbnail", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	file.Name = strings.TrimSuffix(file.Name, path.Ext(file.Name)) + "-" + size + ".jpg"
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", contentDisposition("image/jpeg", file.Name))
+	w.Header().Set("ETag", file.ETag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, file.Name, time.Unix(createdAt, 0), file.Content)
+}
+
+// discardClearThumbnails deletes the thumbnails of files that have any stored
+// unencrypted, so that the thumbnail job makes them again from the now
+// encrypted originals. contentBlobsMu must be held. It returns how many files
+// will get new thumbnails.
+func discardClearThumbnails() (int, error) {
+	attachmentIDs, err := queryGiftIDs(`SELECT DISTINCT attachment_id FROM gift_thumbnails t
+		WHERE NOT EXISTS (SELECT 1 FROM content_blobs c WHERE c.storage_key = t.storage_key AND c.owner_id != 0)`)
+	if err != nil {
+		return 0, err
+	}
+	for _, attachmentID := range attachmentIDs {
+		keys, err := thumbnailStorageKeys("attachment_id = ?", attachmentID)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := db.Exec("DELETE FROM gift_thumbnails WHERE attachment_id = ?", attachmentID); err != nil {
+			return 0, err
+		}
+		if _, err := db.Exec("UPDATE gift_attachments SET thumbnail_state = NULL WHERE id = ?", attachmentID); err != nil {
+			return 0, err
+		}
+		deleteUnreferencedBlobs(keys)
+	}
+	return len(attachmentIDs), nil
+}
+
+// thumbnailStorageKeys returns the storage keys of the thumbnails matched by where.
+func thumbnailStorageKeys(where string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query("SELECT storage_key FROM gift_thumbnails WHERE "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+func testPNG(w, h int) string {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 200, 255})
+		}
+	}
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, img)
+	return buf.String()
+}
+
+func fetchThumbnail(t *testing.T, query string) (*http.Response, image.Image) {
+	rec := performAuthenticatedRequest(giftThumbnailHandler, "GET", "/gift-thumbnail?"+query, nil, 1)
+	if rec.Code != http.StatusOK {
+		return rec.Result(), nil
+	}
+	img, err := jpeg.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("Expected a JPEG thumbnail: %v", err)
+	}
+	return rec.Result(), img
+}
+
+func TestThumbnailsForImageGifts(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	if rec := uploadTestFile("beach.png", testPNG(800, 400)); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+	addTestAttachment(t, "1", "letter.txt", "Not an image", "")
+	addTestAttachment(t, "1", "broken.png", "\x89PNG\r\n\x1a\nnot really", "")
+
+	if resp, _ := fetchThumbnail(t, "id=1"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected no thumbnail before the job ran, got %d", resp.StatusCode)
+	}
+	if made, err := generateMissingThumbnails(); made != 1 || err != nil {
+		t.Fatalf("Expected thumbnails for one file, got %d %v", made, err)
+	}
+
+	resp, img := fetchThumbnail(t, "id=1")
+	if img == nil || img.Bounds().Dx() != 160 || img.Bounds().Dy() != 80 {
+		t.Fatalf("Expected a 160x80 small thumbnail, got %d %v", resp.StatusCode, img)
+	}
+	if resp.Header.Get("ETag") == "" || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Unexpected headers %v", resp.Header)
+	}
+	if _, img := fetchThumbnail(t, "id=1&size=medium"); img == nil || img.Bounds().Dx() != 640 {
+		t.Errorf("Expected a 640 pixel wide medium thumbnail, got %v", img)
+	}
+	if resp, _ := fetchThumbnail(t, "id=1&size=huge"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an unknown size to be refused, got %d", resp.StatusCode)
+	}
+
+	attachments := listTestAttachments(t)
+	states := map[string]string{}
+	rows, _ := db.Query("SELECT file_name, thumbnail_state FROM gift_attachments")
+	for rows.Next() {
+		var name, state string
+		_ = rows.Scan(&name, &state)
+		states[name] = state
+	}
+	rows.Close()
+	if !attachments[0].Thumbnail || attachments[1].Thumbnail || states["letter.txt"] != "none" || states["broken.png"] != "failed" {
+		t.Errorf("Unexpected thumbnail states %v", states)
+	}
+
+	// Deleting the gift for good deletes the thumbnails with the files.
+	purgeTestGift(t, "1")
+	if blobs, thumbnails := countRows("blobs"), countRows("gift_thumbnails"); blobs != 0 || thumbnails != 0 {
+		t.Errorf("Expected everything deleted, found %d blobs and %d thumbnails", blobs, thumbnails)
+	}
+}
+
+func TestThumbnailsForLegacyEncryptedGifts(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	useTestMasterKey(t)
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, file_data) VALUES (1, 1, 'old.png', ?)", []byte(testPNG(100, 300)))
+
+	if made, err := generateMissingThumbnails(); made != 1 || err != nil {
+		t.Fatalf("Expected the legacy gift to get thumbnails, got %d %v", made, err)
+	}
+	if stored, _ := storedBlob(t); !bytes.HasPrefix(stored, []byte(sealedMagic)) {
+		t.Error("Expected thumbnails to be encrypted like the files they show")
+	}
+	// Images smaller than a size are not enlarged.
+	if _, img := fetchThumbnail(t, "id=1&size=medium"); img == nil || img.Bounds().Dx() != 100 || img.Bounds().Dy() != 300 {
+		t.Errorf("Expected the medium thumbnail to keep the original size, got %v", img)
+	}
+}
+
+func TestScaleDownFlattensTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	small := scaleDown(img, 2)
+	if got := small.At(0, 0); got != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("Expected transparent pixels to become white, got %v", got)
+	}
+}
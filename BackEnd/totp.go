@@ -0,0 +1,514 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTP parameters (RFC 6238 defaults understood by every authenticator app).
+const (
+	totpIssuer        = "PartingGifts"
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // accept codes from one step either side of now
+	recoveryCodeCount = 10
+)
+
+// twoFactorChallengeTTL is how long the user has to enter their code after the password step.
+var twoFactorChallengeTTL = 5 * time.Minute
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+var errInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+// totpCode computes the code for the given time step (RFC 4226 dynamic truncation).
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod)
+}
+
+// matchTOTP returns the time step the code belongs to, allowing for clock skew.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for delta := int64(-totpSkew); delta <= totpSkew; delta++ {
+		step := current + delta
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpProvisioningURI builds the otpauth:// URI that authenticator apps scan as a QR code.
+func totpProvisioningURI(username string, secret []byte) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", totpEncoding.EncodeToString(secret))
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// verifyUserTOTP checks a code against the user's stored secret and records the
+// step so the same code cannot be replayed.
+func verifyUserTOTP(userID int, code string) error {
+	var encodedSecret sql.NullString
+	var lastStep int64
+	if err := db.QueryRow("SELECT totp_secret, totp_last_step FROM users WHERE id = ?", userID).
+		Scan(&encodedSecret, &lastStep); err != nil {
+		return err
+	}
+	if !encodedSecret.Valid || encodedSecret.String == "" {
+		return errInvalidTwoFactorCode
+	}
+	secret, err := totpEncoding.DecodeString(encodedSecret.String)
+	if err != nil {
+		return err
+	}
+	step, ok := matchTOTP(secret, code, timeNow())
+	if !ok || step <= lastStep {
+		return errInvalidTwoFactorCode
+	}
+	res, err := db.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?", step, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// recoveryCodeBytes is the randomness in a recovery code (80 bits).
+const recoveryCodeBytes = 10
+
+// recoveryCodeDigest is the SHA-256 hex digest of the normalized code. Older
+// versions stored this digest directly; it is now only the input to bcrypt.
+func recoveryCodeDigest(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashRecoveryCode returns a bcrypt hash of the code's digest, like passwords
+// and security answers, so a leaked database cannot be searched for codes.
+func hashRecoveryCode(code string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(recoveryCodeDigest(code)), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// upgradeRecoveryCodeHashes wraps recovery code digests stored by older
+// versions in bcrypt, so existing codes keep working.
+func upgradeRecoveryCodeHashes(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, code_hash FROM recovery_codes WHERE code_hash NOT LIKE '$2%'")
+	if err != nil {
+		return err
+	}
+	digests := map[int]string{}
+	for rows.Next() {
+		var id int
+		var digest string
+		if err := rows.Scan(&id, &digest); err != nil {
+			rows.Close()
+			return err
+		}
+		digests[id] = digest
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	for id, digest := range digests {
+		hash, err := bcrypt.GenerateFromPassword([]byte(digest), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE recovery_codes SET code_hash = ? WHERE id = ?", string(hash), id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateRecoveryCodes replaces the user's recovery codes and returns the new
+// plaintext codes, formatted as four groups of five hex digits. Only their
+// hashes are stored.
+func generateRecoveryCodes(userID int) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := hex.EncodeToString(raw)
+		var groups []string
+		for len(encoded) > 0 {
+			groups = append(groups, encoded[:5])
+			encoded = encoded[5:]
+		}
+		codes[i] = strings.Join(groups, "-")
+		hash, err := hashRecoveryCode(codes[i])
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = hash
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash); err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// useRecoveryCode marks a matching unused recovery code as spent. Each hash
+// is salted, so the code is compared with every unused one.
+func useRecoveryCode(userID int, code string) error {
+	rows, err := db.Query("SELECT id, code_hash FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID)
+	if err != nil {
+		return err
+	}
+	digest := []byte(recoveryCodeDigest(code))
+	matched := 0
+	for rows.Next() {
+		var id int
+		var hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+		if matched == 0 && bcrypt.CompareHashAndPassword([]byte(hash), digest) == nil {
+			matched = id
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+	if matched == 0 {
+		return errInvalidTwoFactorCode
+	}
+
+	res, err := db.Exec("UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", matched)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code.
+func verifySecondFactor(userID int, code, recoveryCode string) error {
+	if recoveryCode != "" {
+		return useRecoveryCode(userID, recoveryCode)
+	}
+	return verifyUserTOTP(userID, code)
+}
+
+// Challenges for the second factor. One that follows security answers leads
+// to a password reset token rather than a session.
+const (
+	twoFactorLoginPurpose = "2fa"
+	twoFactorResetPurpose = "2fa-reset"
+)
+
+// writeTwoFactorChallenge answers a correct password or security answer for a
+// 2FA account with a short-lived challenge that must be exchanged at /login/2fa.
+func writeTwoFactorChallenge(w http.ResponseWriter, userID int, purpose string) {
+	challenge := issuePurposeToken(purpose, userID, twoFactorChallengeTTL)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":           "Two-factor authentication required",
+		"twoFactorRequired": true,
+		"challenge":         challenge,
+	})
+}
+
+// loginTwoFactorHandler completes a login for accounts with 2FA enabled.
+func loginTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	var req struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	purpose := twoFactorLoginPurpose
+	userID, err := parsePurposeToken(req.Challenge, purpose, timeNow())
+	if err == errInvalidToken {
+		purpose = twoFactorResetPurpose
+		userID, err = parsePurposeToken(req.Challenge, purpose, timeNow())
+	}
+	if err != nil {
+		http.Error(w, "Login challenge is invalid or has expired", http.StatusUnauthorized)
+		return
+	}
+
+	ip := clientIP(r)
+	if throttled(w, ipAttemptKey(ip), accountAttemptKey(userID)) {
+		return
+	}
+
+	if err := verifySecondFactor(userID, req.Code, req.RecoveryCode); err != nil {
+		if err != errInvalidTwoFactorCode {
+			log.Printf("Error verifying second factor for user %d: %v", userID, err)
+		}
+		recordAccountFailure(userID, ip)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid two-factor code"})
+		return
+	}
+
+	if purpose == twoFactorResetPurpose {
+		clearFailedAttempts(accountAttemptKey(userID))
+		writeSecurityResetToken(w, userID)
+		return
+	}
+
+	var forceChange bool
+	if err := db.QueryRow("SELECT force_password_change FROM users WHERE id = ?", userID).Scan(&forceChange); err != nil {
+		http.Error(w, "Login error", http.StatusInternalServerError)
+		return
+	}
+	clearFailedAttempts(accountAttemptKey(userID))
+	writeLoginSuccess(w, r, userID, forceChange)
+}
+
+// twoFactorEnrollHandler generates a new secret for the signed-in user. 2FA is
+// not switched on until the user proves their app works via twoFactorConfirmHandler.
+func twoFactorEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	userID, username, ok := currentUsername(w, r)
+	if !ok {
+		return
+	}
+
+	var enabled bool
+	if err := db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+	encoded := totpEncoding.EncodeToString(secret)
+	if _, err := db.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", encoded, userID); err != nil {
+		http.Error(w, "Failed to store secret", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":          encoded,
+		"provisioningUri": totpProvisioningURI(username, secret),
+	})
+}
+
+// twoFactorConfirmHandler turns 2FA on once the user submits a valid code and
+// returns the one-time recovery codes.
+func twoFactorConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := verifyUserTOTP(userID, req.Code); err != nil {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+	if _, err := db.Exec("UPDATE users SET totp_enabled = 1 WHERE id = ?", userID); err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	codes, err := generateRecoveryCodes(userID)
+	if err != nil {
+		log.Printf("Error generating recovery codes for user %d: %v", userID, err)
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Two-factor authentication enabled",
+		"recoveryCodes": codes,
+	})
+}
+
+// twoFactorDisableHandler switches 2FA off. It requires the password and a current code.
+func twoFactorDisableHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var storedPassword string
+	if err := db.QueryRow("SELECT password FROM users WHERE id = ?", userID).Scan(&storedPassword); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(req.Password)) != nil {
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+	if err := verifySecondFactor(userID, req.Code, req.RecoveryCode); err != nil {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE users SET totp_enabled = 0, totp_secret = NULL, totp_last_step = 0 WHERE id = ?", userID); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		log.Printf("Error deleting recovery codes for user %d: %v", userID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// recoveryCodesHandler replaces the user's recovery codes after checking a current TOTP code.
+func recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var enabled bool
+	if err := db.QueryRow("SELECT totp_enabled FROM users WHERE id = ?", userID).Scan(&enabled); err != nil || !enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	if err := verifyUserTOTP(userID, req.Code); err != nil {
+		http.Error(w, "Invalid two-factor code", http.StatusUnauthorized)
+		return
+	}
+	codes, err := generateRecoveryCodes(userID)
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recoveryCodes": codes})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useFixedClock pins timeNow for the duration of a test.
+func useFixedClock(t *testing.T, at time.Time) {
+	previous := timeNow
+	timeNow = func() time.Time { return at }
+	t.Cleanup(func() { timeNow = previous })
+}
+
+func TestTOTPCodeMatchesRFC6238Vectors(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range vectors {
+		if got := totpCode(secret, unix/totpPeriod); got != want {
+			t.Errorf("At %d expected %s, got %s", unix, want, got)
+		}
+	}
+
+	// Codes from the neighbouring step are accepted, older ones are not.
+	now := time.Unix(1111111109, 0)
+	if _, ok := matchTOTP(secret, totpCode(secret, now.Unix()/totpPeriod-1), now); !ok {
+		t.Errorf("Expected code from previous step to be accepted")
+	}
+	if _, ok := matchTOTP(secret, totpCode(secret, now.Unix()/totpPeriod-3), now); ok {
+		t.Errorf("Expected stale code to be rejected")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := totpProvisioningURI("Sahil_1234", []byte("12345678901234567890"))
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("Invalid URI %q: %v", uri, err)
+	}
+	if parsed.Scheme != "otpauth" || parsed.Host != "totp" || parsed.Path != "/PartingGifts:Sahil_1234" {
+		t.Errorf("Unexpected URI %q", uri)
+	}
+	if parsed.Query().Get("secret") != "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" || parsed.Query().Get("issuer") != "PartingGifts" {
+		t.Errorf("Unexpected URI parameters %q", parsed.RawQuery)
+	}
+}
+
+func TestTwoFactorLoginFlow(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "Sahil@1234")
+	clock := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFixedClock(t, clock)
+
+	// Enroll and confirm.
+	rec := performAuthenticatedRequest(twoFactorEnrollHandler, "POST", "/2fa/enroll", nil, 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Enroll failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var enrollment map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &enrollment)
+	if !strings.HasPrefix(enrollment["provisioningUri"], "otpauth://totp/") {
+		t.Errorf("Expected otpauth URI, got %q", enrollment["provisioningUri"])
+	}
+	secret, _ := totpEncoding.DecodeString(enrollment["secret"])
+	codeAt := func(at time.Time) string { return totpCode(secret, at.Unix()/totpPeriod) }
+
+	body := []byte(fmt.Sprintf(`{"code": "%s"}`, codeAt(clock)))
+	rec = performAuthenticatedRequest(twoFactorConfirmHandler, "POST", "/2fa/confirm", body, 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Confirm failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var confirmation struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &confirmation)
+	if len(confirmation.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", recoveryCodeCount, len(confirmation.RecoveryCodes))
+	}
+	var plaintextStored int
+	_ = db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE code_hash = ?", confirmation.RecoveryCodes[0]).Scan(&plaintextStored)
+	if plaintextStored != 0 {
+		t.Errorf("Recovery codes must not be stored in plaintext")
+	}
+	var storedHash string
+	_ = db.QueryRow("SELECT code_hash FROM recovery_codes LIMIT 1").Scan(&storedHash)
+	if !strings.HasPrefix(storedHash, "$2") || len(strings.ReplaceAll(confirmation.RecoveryCodes[0], "-", "")) != 2*recoveryCodeBytes {
+		t.Errorf("Expected long codes stored with bcrypt, got %q for %q", storedHash, confirmation.RecoveryCodes[0])
+	}
+
+	// The password alone now only yields a challenge.
+	rec = performRequest(loginHandler, "POST", "/login", []byte(`{"username": "Sahil_1234", "password": "Sahil@1234"}`))
+	var loginResp map[string]interface{}
+	_ = json.Unmarshal(rec.Body.Bytes(), &loginResp)
+	if loginResp["twoFactorRequired"] != true || loginResp["token"] != nil {
+		t.Fatalf("Expected a 2FA challenge instead of a session, got %v", loginResp)
+	}
+	challenge := loginResp["challenge"].(string)
+
+	// The code from the confirm step was already used and cannot be replayed.
+	replay := []byte(fmt.Sprintf(`{"challenge": "%s", "code": "%s"}`, challenge, codeAt(clock)))
+	if rec = performRequest(loginTwoFactorHandler, "POST", "/login/2fa", replay); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected replayed code to be rejected, got %d", rec.Code)
+	}
+
+	later := clock.Add(time.Minute)
+	useFixedClock(t, later)
+	next := []byte(fmt.Sprintf(`{"challenge": "%s", "code": "%s"}`, challenge, codeAt(later)))
+	rec = performRequest(loginTwoFactorHandler, "POST", "/login/2fa", next)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"token"`) {
+		t.Errorf("Expected session after valid code, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Recovery codes work exactly once.
+	recovery := []byte(fmt.Sprintf(`{"challenge": "%s", "recoveryCode": "%s"}`, challenge, strings.ToUpper(confirmation.RecoveryCodes[0])))
+	if rec = performRequest(loginTwoFactorHandler, "POST", "/login/2fa", recovery); rec.Code != http.StatusOK {
+		t.Errorf("Expected recovery code to be accepted, got %d", rec.Code)
+	}
+	if rec = performRequest(loginTwoFactorHandler, "POST", "/login/2fa", recovery); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected used recovery code to be rejected, got %d", rec.Code)
+	}
+
+	// Challenges expire.
+	useFixedClock(t, later.Add(twoFactorChallengeTTL))
+	if rec = performRequest(loginTwoFactorHandler, "POST", "/login/2fa", next); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected expired challenge to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestTwoFactorDisableAndRegenerate(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "Sahil@1234")
+	clock := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFixedClock(t, clock)
+
+	secret := []byte("12345678901234567890")
+	_, _ = db.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 1 WHERE id = 1", totpEncoding.EncodeToString(secret))
+	oldCodes, _ := generateRecoveryCodes(1)
+
+	body := []byte(fmt.Sprintf(`{"code": "%s"}`, totpCode(secret, clock.Unix()/totpPeriod)))
+	rec := performAuthenticatedRequest(recoveryCodesHandler, "POST", "/2fa/recovery-codes", body, 1)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Regenerate failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := useRecoveryCode(1, oldCodes[0]); err != errInvalidTwoFactorCode {
+		t.Errorf("Expected old recovery codes to be invalidated, got %v", err)
+	}
+
+	wrongPassword := []byte(fmt.Sprintf(`{"password": "nope", "recoveryCode": "%s"}`, oldCodes[1]))
+	if rec = performAuthenticatedRequest(twoFactorDisableHandler, "POST", "/2fa/disable", wrongPassword, 1); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong password to be rejected, got %d", rec.Code)
+	}
+
+	useFixedClock(t, clock.Add(time.Minute))
+	disable := []byte(fmt.Sprintf(`{"password": "Sahil@1234", "code": "%s"}`, totpCode(secret, clock.Add(time.Minute).Unix()/totpPeriod)))
+	if rec = performAuthenticatedRequest(twoFactorDisableHandler, "POST", "/2fa/disable", disable, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Disable failed: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = performRequest(loginHandler, "POST", "/login", []byte(`{"username": "Sahil_1234", "password": "Sahil@1234"}`))
+	if !strings.Contains(rec.Body.String(), `"token"`) {
+		t.Errorf("Expected a plain login after disabling 2FA, got %s", rec.Body.String())
+	}
+}
+
+func TestLegacyRecoveryCodeHashesAreUpgraded(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "Sahil@1234")
+	// Older versions stored the bare SHA-256 digest.
+	_, _ = db.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (1, ?)", recoveryCodeDigest("abcde-12345"))
+
+	if err := upgradeRecoveryCodeHashes(db); err != nil {
+		t.Fatal(err)
+	}
+	var legacy int
+	_ = db.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE code_hash NOT LIKE '$2%'").Scan(&legacy)
+	if legacy != 0 {
+		t.Errorf("Expected every digest to be wrapped in bcrypt, %d left", legacy)
+	}
+	if err := useRecoveryCode(1, "ABCDE-12345"); err != nil {
+		t.Errorf("Expected the existing code to keep working, got %v", err)
+	}
+	if err := useRecoveryCode(1, "abcde-12345"); err != errInvalidTwoFactorCode {
+		t.Errorf("Expected the code to work once, got %v", err)
+	}
+}
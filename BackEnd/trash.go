@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Stopping a gift and deleting it are separate operations. Stopping
+// (/stop-pending-gift) only cancels its delivery: the gift is kept, marked
+// cancelled, until its receivers are set up again. Deleting (/delete-gift)
+// moves it to the trash, where it is hidden from everything but /gift-trash
+// and can be restored until it is purged, giftTrashRetention after it was
+// deleted or sooner if the owner empties it from the trash.
+
+// giftTrashRetention is how long deleted gifts stay in the trash, from
+// GIFT_TRASH_RETENTION_DAYS (default 30).
+var giftTrashRetention = time.Duration(envBytes("GIFT_TRASH_RETENTION_DAYS", 30)) * 24 * time.Hour
+
+// giftTrashPurgeInterval is how often the purge job looks for gifts that are due.
+const giftTrashPurgeInterval = time.Hour
+
+// deliverableGiftSQL matches gifts still waiting to be sent: not delivered,
+// not cancelled and not in the trash.
+const deliverableGiftSQL = "pending = 1 AND cancelled = 0 AND deleted_at IS NULL"
+
+// trashedGift is a gift listed by /gift-trash.
+type trashedGift struct {
+	ID            int    `json:"id"`
+	FileName      string `json:"fileName"`
+	CustomMessage string `json:"customMessage"`
+	Pending       bool   `json:"pending"`   // deleted before it was delivered
+	DeletedAt     int64  `json:"deletedAt"` // unix seconds
+	PurgeAt       int64  `json:"purgeAt"`   // unix seconds from when the purge job deletes it for good
+}
+
+// trashGift moves a gift to the trash, which also cancels its delivery.
+func trashGift(giftID int) error {
+	_, err := db.Exec("UPDATE gifts SET deleted_at = ?, cancelled = 1 WHERE id = ? AND deleted_at IS NULL", timeNow().Unix(), giftID)
+	return err
+}
+
+// trashedGiftOwner returns the owner of a gift in the trash, or
+// errGiftNotFound if the gift does not exist or is not in the trash.
+func trashedGiftOwner(giftID int) (int, error) {
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM gifts WHERE id = ? AND deleted_at IS NOT NULL", giftID).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		return 0, errGiftNotFound
+	}
+	return ownerID, err
+}
+
+// purgeGift deletes a gift for good: its row, attachments, thumbnails,
+// versions and executor assignments, then any stored files no other gift uses.
+func purgeGift(giftID int) error {
+	storageKeys, err := giftStorageKeys("id = ?", giftID)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, query := range []string{
+		"DELETE FROM gift_executors WHERE gift_id = ?",
+		"DELETE FROM gift_thumbnails WHERE attachment_id IN (SELECT id FROM gift_attachments WHERE gift_id = ?)",
+		"DELETE FROM gift_attachments WHERE gift_id = ?",
+		"DELETE FROM gift_versions WHERE gift_id = ?",
+		"DELETE FROM gifts WHERE id = ?",
+	} {
+		if _, err := tx.Exec(query, giftID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// Files shared with other gifts are kept.
+	deleteGiftBlobs(storageKeys)
+	return nil
+}
+
+// purgeExpiredGifts deletes gifts that have been in the trash for longer than
+// giftTrashRetention and returns how many it deleted.
+func purgeExpiredGifts() (int, error) {
+	ids, err := queryGiftIDs("SELECT id FROM gifts WHERE deleted_at IS NOT NULL AND deleted_at <= ?",
+		timeNow().Add(-giftTrashRetention).Unix())
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, id := range ids {
+		if err := purgeGift(id); err != nil {
+			log.Printf("Error purging gift %d from the trash: %v", id, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// runGiftTrashJob periodically purges gifts whose time in the trash is up.
+func runGiftTrashJob() {
+	for {
+		if purged, err := purgeExpiredGifts(); err != nil {
+			log.Printf("Error running gift trash job: %v", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d gifts from the trash", purged)
+		}
+		time.Sleep(giftTrashPurgeInterval)
+	}
+}
+
+// deleteGiftHandler handles DELETE /delete-gift?id=1, moving the gift to the
+// trash. Owners can restore it from /gift-trash until it is purged. Only the
+// owner may do so: executors cannot restore or purge it, so for them a
+// delete could not be undone.
+func deleteGiftHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	giftID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorizeGift(w, r, giftID, giftActionAdminister); !ok {
+		return
+	}
+	if err := trashGift(giftID); err != nil {
+		log.Printf("Error moving gift %d to the trash: %v", giftID, err)
+		http.Error(w, "Failed to delete gift", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Gift moved to the trash"))
+}
+
+// giftTrashHandler manages the signed-in user's trash:
+//
+//	GET    /gift-trash       lists deleted gifts, most recently deleted first
+//	DELETE /gift-trash?id=1  deletes one for good
+//	DELETE /gift-trash       empties the trash
+func giftTrashHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Listed below.
+	case http.MethodDelete:
+		var ids []int
+		var err error
+		if id := r.URL.Query().Get("id"); id != "" {
+			giftID, convErr := strconv.Atoi(id)
+			if convErr != nil {
+				http.Error(w, "Invalid gift ID", http.StatusBadRequest)
+				return
+			}
+			if ownerID, err := trashedGiftOwner(giftID); err == errGiftNotFound || err == nil && ownerID != userID {
+				http.Error(w, "Gift not found in the trash", http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			ids = []int{giftID}
+		} else if ids, err = queryGiftIDs("SELECT id FROM gifts WHERE user_id = ? AND deleted_at IS NOT NULL", userID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for _, id := range ids {
+			if err := purgeGift(id); err != nil {
+				log.Printf("Error purging gift %d from the trash: %v", id, err)
+				http.Error(w, "Failed to delete gift", http.StatusInternalServerError)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, COALESCE(file_name, ''), COALESCE(custom_message, ''), pending, deleted_at
+		FROM gifts WHERE user_id = ? AND deleted_at IS NOT NULL ORDER BY deleted_at DESC, id DESC`, userID)
+	if err != nil {
+		http.Error(w, "Error retrieving the trash", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	gifts := []trashedGift{}
+	for rows.Next() {
+		var g trashedGift
+		if err := rows.Scan(&g.ID, &g.FileName, &g.CustomMessage, &g.Pending, &g.DeletedAt); err != nil {
+			http.Error(w, "Error retrieving the trash", http.StatusInternalServerError)
+			return
+		}
+		g.PurgeAt = g.DeletedAt + int64(giftTrashRetention/time.Second)
+		gifts = append(gifts, g)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Error retrieving the trash", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gifts)
+}
+
+// giftTrashRestoreHandler handles POST /gift-trash/restore with {"giftId": 1}.
+// The gift comes back with its delivery still cancelled; set up its receivers
+// again to send it.
+func giftTrashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	if handleOptions(w, r) {
+		return
+	}
+	if !handlePost(w, r) {
+		return
+	}
+	var req struct {
+		GiftID int `json:"giftId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+	if ownerID, err := trashedGiftOwner(req.GiftID); err == errGiftNotFound || err == nil && ownerID != userID {
+		http.Error(w, "Gift not found in the trash", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec("UPDATE gifts SET deleted_at = NULL WHERE id = ?", req.GiftID); err != nil {
+		http.Error(w, "Failed to restore gift", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Gift restored"))
+}
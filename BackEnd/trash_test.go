@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// purgeTestGift deletes a gift of user 1 and empties it from the trash.
+func purgeTestGift(t *testing.T, giftID string) {
+	t.Helper()
+	if rec := performAuthenticatedRequest(deleteGiftHandler, "DELETE", "/delete-gift?id="+giftID, nil, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Delete failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := performAuthenticatedRequest(giftTrashHandler, "DELETE", "/gift-trash?id="+giftID, nil, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Purge failed: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func listTestTrash(t *testing.T, userID int) []trashedGift {
+	rec := performAuthenticatedRequest(giftTrashHandler, "GET", "/gift-trash", nil, userID)
+	var gifts []trashedGift
+	if err := json.Unmarshal(rec.Body.Bytes(), &gifts); err != nil {
+		t.Fatalf("Unexpected trash %d: %s", rec.Code, rec.Body.String())
+	}
+	return gifts
+}
+
+func TestDeleteGiftMovesItToTheTrash(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	deletedAt := time.Unix(1700000000, 0)
+	useFixedClock(t, deletedAt)
+	if rec := uploadTestFile("letter.txt", "dear friend"); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+
+	if rec := performAuthenticatedRequest(deleteGiftHandler, "DELETE", "/delete-gift?id=1", nil, 2); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected other users to be refused, got %d", rec.Code)
+	}
+	if rec := performAuthenticatedRequest(deleteGiftHandler, "DELETE", "/delete-gift?id=1", nil, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the gift to be deleted, got %d", rec.Code)
+	}
+
+	// Trashed gifts are hidden everywhere else.
+	if page := listTestGifts(t, ""); len(page.Items) != 0 || page.Total != 0 {
+		t.Errorf("Expected no gifts listed, got %+v", page)
+	}
+	if rec := downloadGift(nil); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected trashed gifts not to download, got %d", rec.Code)
+	}
+
+	trash := listTestTrash(t, 1)
+	if len(trash) != 1 || trash[0].FileName != "letter.txt" || !trash[0].Pending ||
+		trash[0].PurgeAt != deletedAt.Add(giftTrashRetention).Unix() {
+		t.Fatalf("Unexpected trash %+v", trash)
+	}
+	if trash := listTestTrash(t, 2); len(trash) != 0 {
+		t.Errorf("Expected the trash to be private, got %+v", trash)
+	}
+
+	// Only the owner can restore it, and it comes back cancelled.
+	body := []byte(`{"giftId": 1}`)
+	if rec := performAuthenticatedRequest(giftTrashRestoreHandler, "POST", "/gift-trash/restore", body, 2); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected other users to be refused, got %d", rec.Code)
+	}
+	if rec := performAuthenticatedRequest(giftTrashRestoreHandler, "POST", "/gift-trash/restore", body, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the gift to be restored, got %d", rec.Code)
+	}
+	if rec := downloadGift(nil); rec.Body.String() != "dear friend" {
+		t.Errorf("Expected the restored gift to download, got %d", rec.Code)
+	}
+	var cancelled bool
+	_ = db.QueryRow("SELECT cancelled FROM gifts WHERE id = 1").Scan(&cancelled)
+	if !cancelled || len(listTestTrash(t, 1)) != 0 {
+		t.Errorf("Expected the gift out of the trash and still cancelled")
+	}
+	if rec := performAuthenticatedRequest(giftTrashRestoreHandler, "POST", "/gift-trash/restore", body, 1); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected gifts outside the trash not to be restored, got %d", rec.Code)
+	}
+}
+
+func TestStopGiftKeepsIt(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	if rec := uploadTestFile("letter.txt", "dear friend"); rec.Code != http.StatusOK {
+		t.Fatalf("Upload failed: %d", rec.Code)
+	}
+	if rec := performAuthenticatedRequest(stopPendingGiftHandler, "DELETE", "/stop-pending-gift?id=1", nil, 1); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the gift to be stopped, got %d", rec.Code)
+	}
+
+	if gifts := listTestGifts(t, "?status=cancelled").Items; len(gifts) != 1 || !gifts[0].Cancelled || !gifts[0].Pending {
+		t.Errorf("Expected the gift listed as cancelled, got %+v", gifts)
+	}
+	var deliverable int
+	_ = db.QueryRow("SELECT COUNT(*) FROM gifts WHERE " + deliverableGiftSQL).Scan(&deliverable)
+	if deliverable != 0 || len(listTestTrash(t, 1)) != 0 {
+		t.Errorf("Expected the gift neither deliverable nor in the trash")
+	}
+}
+
+func TestEmptyTrashDeletesFiles(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	for _, name := range []string{"one.txt", "two.txt", "three.txt"} {
+		if rec := uploadTestFile(name, "content of "+name); rec.Code != http.StatusOK {
+			t.Fatalf("Upload failed: %d", rec.Code)
+		}
+	}
+	for _, id := range []string{"1", "2"} {
+		performAuthenticatedRequest(deleteGiftHandler, "DELETE", "/delete-gift?id="+id, nil, 1)
+	}
+	if blobs := countRows("blobs"); blobs != 3 {
+		t.Fatalf("Expected trashed files to be kept, found %d blobs", blobs)
+	}
+
+	if rec := performAuthenticatedRequest(giftTrashHandler, "DELETE", "/gift-trash?id=3", nil, 1); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected gifts outside the trash to be refused, got %d", rec.Code)
+	}
+	rec := performAuthenticatedRequest(giftTrashHandler, "DELETE", "/gift-trash", nil, 1)
+	if rec.Code != http.StatusOK || rec.Body.String() != "[]\n" {
+		t.Fatalf("Expected an empty trash, got %d %s", rec.Code, rec.Body.String())
+	}
+	if gifts, blobs := countRows("gifts"), countRows("blobs"); gifts != 1 || blobs != 1 {
+		t.Errorf("Expected only the remaining gift, found %d gifts and %d blobs", gifts, blobs)
+	}
+}
+
+func TestPurgeExpiredGifts(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	now := time.Unix(1700000000, 0)
+	_, _ = db.Exec("INSERT INTO gifts (id, user_id, file_name, pending, deleted_at) VALUES (1, 1, 'old.txt', 1, ?), (2, 1, 'new.txt', 1, ?), (3, 1, 'kept.txt', 1, NULL)",
+		now.Add(-giftTrashRetention-time.Minute).Unix(), now.Add(-time.Hour).Unix())
+	useFixedClock(t, now)
+
+	purged, err := purgeExpiredGifts()
+	if err != nil || purged != 1 {
+		t.Fatalf("Expected one gift purged, got %d %v", purged, err)
+	}
+	var remaining int
+	_ = db.QueryRow("SELECT COUNT(*) FROM gifts WHERE id IN (2, 3)").Scan(&remaining)
+	if remaining != 2 || countRows("gifts") != 2 {
+		t.Errorf("Expected only the expired gift purged")
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads follow the tus 1.0.0 protocol (https://tus.io) with the
+// creation, expiration and termination extensions. A client creates an upload
+// with POST /uploads, sends the file in PATCH /uploads/{id} requests and, after
+// a dropped connection, asks HEAD /uploads/{id} where to carry on. Chunks are
+// staged in tusUploadDir because blob stores cannot append; once the last byte
+// arrives the file moves to giftStore and becomes a pending gift, just like one
+// sent to /upload-gift.
+
+const tusVersion = "1.0.0"
+
+var (
+	// tusUploadDir holds partially uploaded files.
+	tusUploadDir = envOrDefault("TUS_UPLOAD_DIR", "./upload-staging")
+	// tusUploadTTL is how long an upload may sit idle before it is abandoned.
+	tusUploadTTL = 24 * time.Hour
+	// tusCleanupInterval is how often abandoned uploads are removed.
+	tusCleanupInterval = time.Hour
+)
+
+// tusLocks keeps two requests from writing to the same upload at once.
+var tusLocks sync.Map
+
+// tusUpload is a row of the tus_uploads table.
+type tusUpload struct {
+	ID            string
+	UserID        int
+	FileName      string
+	CustomMessage string
+	Length        int64
+	Offset        int64
+	ExpiresAt     time.Time
+	GiftID        sql.NullInt64
+}
+
+func newTusUploadID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// tusStagingPath returns the staging file of an upload. Ids are generated
+// here, so anything that is not plain hex is refused.
+func tusStagingPath(id string) (string, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", errors.New("invalid upload id")
+	}
+	return filepath.Join(tusUploadDir, id), nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma-separated
+// "key base64value" pairs, where the value may be omitted.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		switch len(fields) {
+		case 0:
+			continue
+		case 1:
+			metadata[fields[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				return nil, err
+			}
+			metadata[fields[0]] = string(value)
+		default:
+			return nil, errors.New("malformed Upload-Metadata")
+		}
+	}
+	return metadata, nil
+}
+
+// loadTusUpload returns the caller's upload, or sql.ErrNoRows if it does not
+// exist, belongs to someone else or has expired.
+func loadTusUpload(id string, userID int) (*tusUpload, error) {
+	u := tusUpload{ID: id}
+	var expiresAt int64
+	err := db.QueryRow(`
+		SELECT user_id, file_name, custom_message, length, upload_offset, expires_at, gift_id
+		FROM tus_uploads WHERE id = ?`, id).
+		Scan(&u.UserID, &u.FileName, &u.CustomMessage, &u.Length, &u.Offset, &expiresAt, &u.GiftID)
+	if err != nil {
+		return nil, err
+	}
+	u.ExpiresAt = time.Unix(expiresAt, 0)
+	if u.UserID != userID || !timeNow().Before(u.ExpiresAt) {
+		return nil, sql.ErrNoRows
+	}
+	return &u, nil
+}
+
+// tusUploadHandler serves POST /uploads and HEAD, PATCH and DELETE /uploads/{id}.
+func tusUploadHandler(w http.ResponseWriter, r *http.Request) {
+	enableCors(&w)
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,expiration,termination")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxGiftUploadBytes, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+	userID, ok := currentUserID(w, r)
+	if !ok {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads"), "/")
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		createTusUpload(w, r, userID)
+		return
+	}
+	if strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Requests for one upload are handled one at a time.
+	lock, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	if !lock.(*sync.Mutex).TryLock() {
+		http.Error(w, "Upload is busy with another request", http.StatusLocked)
+		return
+	}
+	defer lock.(*sync.Mutex).Unlock()
+
+	upload, err := loadTusUpload(id, userID)
+	if err == sql.ErrNoRows {
+		tusLocks.Delete(id)
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading upload %s: %v", id, err)
+		http.Error(w, "Error loading upload", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		writeTusUploadHeaders(w, upload)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		patchTusUpload(w, r, upload)
+	case http.MethodDelete:
+		if err := removeTusUpload(id); err != nil {
+			log.Printf("Error removing upload %s: %v", id, err)
+			http.Error(w, "Error removing upload", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeTusUploadHeaders reports where an upload stands, including the gift it
+// became once complete.
+func writeTusUploadHeaders(w http.ResponseWriter, u *tusUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+	w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+	if u.GiftID.Valid {
+		w.Header().Set("Gift-Id", strconv.FormatInt(u.GiftID.Int64, 10))
+	}
+}
+
+// createTusUpload handles POST /uploads. The file name and email message
+// travel in Upload-Metadata as "filename" and "emailMessage".
+func createTusUpload(w http.ResponseWriter, r *http.Request, userID int) {
+	if !canReceiveGifts(userID) {
+		http.Error(w, "User has disabled gift receiving", http.StatusForbidden)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "A positive Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > maxGiftUploadBytes {
+		http.Error(w, "File is too large; the limit is "+strconv.FormatInt(maxGiftUploadBytes, 10)+" bytes", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// The declared length is reserved against the quota until the upload finishes or expires.
+	if err := checkStorageQuota(userID, length); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	if int64(len(metadata["emailMessage"])) > maxGiftFieldBytes {
+		http.Error(w, "Email message is too long", http.StatusRequestEntityTooLarge)
+		return
+	}
+	// The content itself is checked once it has all arrived.
+	if err := checkGiftFileName(metadata["filename"]); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	id, err := newTusUploadID()
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	upload := &tusUpload{
+		ID:            id,
+		UserID:        userID,
+		FileName:      metadata["filename"],
+		CustomMessage: metadata["emailMessage"],
+		Length:        length,
+		ExpiresAt:     timeNow().Add(tusUploadTTL),
+	}
+	// The row goes in first so the cleanup job never sees a staging file without one.
+	_, err = db.Exec(`
+		INSERT INTO tus_uploads (id, user_id, file_name, custom_message, length, upload_offset, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, 0, ?, ?)`,
+		id, userID, upload.FileName, upload.CustomMessage, length, timeNow().Unix(), upload.ExpiresAt.Unix())
+	if err != nil {
+		log.Printf("Error creating upload: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	path, _ := tusStagingPath(id)
+	if err := os.MkdirAll(tusUploadDir, 0o700); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("Error creating staging file for upload %s: %v", id, err)
+		removeTusUpload(id)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", apiBaseURL+"/uploads/"+id)
+	writeTusUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchTusUpload appends one chunk. Whatever arrives before a connection
+// drops is kept, so the client can resume from the reported offset.
+func patchTusUpload(w http.ResponseWriter, r *http.Request, upload *tusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		writeTusUploadHeaders(w, upload)
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+	if upload.GiftID.Valid {
+		writeTusUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	path, _ := tusStagingPath(upload.ID)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0o600)
+	if err == nil {
+		_, err = f.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		log.Printf("Error opening staging file for upload %s: %v", upload.ID, err)
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		return
+	}
+	// Bytes past the declared length are never written.
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, upload.Length-offset))
+	if closeErr := f.Close(); copyErr == nil {
+		copyErr = closeErr
+	}
+
+	upload.Offset += n
+	upload.ExpiresAt = timeNow().Add(tusUploadTTL)
+	if _, err := db.Exec("UPDATE tus_uploads SET upload_offset = ?, expires_at = ? WHERE id = ?",
+		upload.Offset, upload.ExpiresAt.Unix(), upload.ID); err != nil {
+		log.Printf("Error recording offset of upload %s: %v", upload.ID, err)
+		http.Error(w, "Error writing upload", http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("Upload %s interrupted at %d bytes: %v", upload.ID, upload.Offset, copyErr)
+		writeTusUploadHeaders(w, upload)
+		http.Error(w, "Error reading upload data", http.StatusBadRequest)
+		return
+	}
+
+	if upload.Offset == upload.Length {
+		if err := finishTusUpload(upload); err != nil {
+			var ue *uploadError
+			if errors.As(err, &ue) {
+				// A rejected file cannot be fixed by resuming, so the upload is dropped.
+				removeTusUpload(upload.ID)
+				writeUploadError(w, err)
+				return
+			}
+			log.Printf("Error finishing upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to store gift", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeTusUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishTusUpload moves a complete upload into giftStore and creates its gift.
+// The row is kept until it expires so that a client whose last response was
+// lost can still learn the gift id with HEAD.
+func finishTusUpload(upload *tusUpload) error {
+	path, _ := tusStagingPath(upload.ID)
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	content, info, err := inspectGiftContent(upload.FileName, f, loadPhotoPrivacy(upload.UserID))
+	if err != nil {
+		return err
+	}
+	stored := giftUpload{
+		FileName:      upload.FileName,
+		CustomMessage: upload.CustomMessage,
+	}
+	if err := putGiftBlob(&stored, upload.UserID, content); err != nil {
+		return err
+	}
+	stored.MimeType, stored.SHA256, stored.Metadata = info.MimeType, info.SHA256(), info.Metadata
+	giftID, err := insertGift(upload.UserID, stored)
+	if err != nil {
+		return err
+	}
+	queueThumbnails(giftID)
+	upload.GiftID = sql.NullInt64{Int64: giftID, Valid: true}
+	if _, err := db.Exec("UPDATE tus_uploads SET gift_id = ? WHERE id = ?", giftID, upload.ID); err != nil {
+		return err
+	}
+	f.Close()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing staging file of upload %s: %v", upload.ID, err)
+	}
+	return nil
+}
+
+// removeTusUpload deletes an upload and its staging file.
+func removeTusUpload(id string) error {
+	if _, err := db.Exec("DELETE FROM tus_uploads WHERE id = ?", id); err != nil {
+		return err
+	}
+	tusLocks.Delete(id)
+	path, err := tusStagingPath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// purgeExpiredUploads removes uploads that have sat idle past their expiry,
+// and staging files left without an upload (for example after an account was
+// deleted). It returns how many uploads were removed.
+func purgeExpiredUploads() (int, error) {
+	rows, err := db.Query("SELECT id FROM tus_uploads WHERE expires_at <= ?", timeNow().Unix())
+	if err != nil {
+		return 0, err
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		expired = append(expired, id)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	rows.Close()
+
+	removed := 0
+	for _, id := range expired {
+		if err := removeTusUpload(id); err != nil {
+			log.Printf("Error removing expired upload %s: %v", id, err)
+			continue
+		}
+		removed++
+	}
+
+	entries, err := os.ReadDir(tusUploadDir)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+	for _, entry := range entries {
+		var exists int
+		if err := db.QueryRow("SELECT COUNT(*) FROM tus_uploads WHERE id = ?", entry.Name()).Scan(&exists); err != nil {
+			return removed, err
+		}
+		if exists == 0 {
+			if path, err := tusStagingPath(entry.Name()); err == nil {
+				os.Remove(path)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// runTusCleanupJob periodically removes abandoned uploads.
+func runTusCleanupJob() {
+	for {
+		if removed, err := purgeExpiredUploads(); err != nil {
+			log.Printf("Error removing expired uploads: %v", err)
+		} else if removed > 0 {
+			log.Printf("Removed %d abandoned uploads", removed)
+		}
+		time.Sleep(tusCleanupInterval)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupTusTest(t *testing.T) {
+	db, _ = setupTestDB()
+	_ = insertUserWithID(1, "Sahil_1234", "pass")
+	_ = insertUserWithID(2, "Friend_5678", "pass")
+	previous := tusUploadDir
+	tusUploadDir = t.TempDir()
+	t.Cleanup(func() { tusUploadDir = previous })
+}
+
+func tusRequest(method, target string, userID int, headers map[string]string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	authenticate(req, userID)
+	rec := httptest.NewRecorder()
+	requireAuth(tusUploadHandler)(rec, req)
+	return rec
+}
+
+func createTestTusUpload(t *testing.T, length string) string {
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("memory.mp4")) +
+		",emailMessage " + base64.StdEncoding.EncodeToString([]byte("Watch this"))
+	rec := tusRequest("POST", "/uploads", 1, map[string]string{"Upload-Length": length, "Upload-Metadata": metadata}, "")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 creating upload, got %d: %s", rec.Code, rec.Body.String())
+	}
+	location := rec.Header().Get("Location")
+	return "/uploads/" + location[strings.LastIndex(location, "/")+1:]
+}
+
+func patchHeaders(offset string) map[string]string {
+	return map[string]string{"Content-Type": "application/offset+octet-stream", "Upload-Offset": offset}
+}
+
+func TestTusUploadResumesAndBecomesGift(t *testing.T) {
+	setupTusTest(t)
+	target := createTestTusUpload(t, "10")
+
+	if rec := tusRequest("PATCH", target, 1, patchHeaders("0"), "01234"); rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != "5" {
+		t.Fatalf("Expected first chunk accepted at offset 5, got %d %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	// After a dropped connection the client asks where to continue.
+	rec := tusRequest("HEAD", target, 1, nil, "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "5" || rec.Header().Get("Upload-Length") != "10" {
+		t.Fatalf("Unexpected HEAD response: %d %v", rec.Code, rec.Header())
+	}
+	if rec := tusRequest("PATCH", target, 1, patchHeaders("3"), "34567"); rec.Code != http.StatusConflict {
+		t.Errorf("Expected a stale offset to be rejected with 409, got %d", rec.Code)
+	}
+	rec = tusRequest("PATCH", target, 1, patchHeaders("5"), "56789")
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Gift-Id") == "" {
+		t.Fatalf("Expected the final chunk to create a gift, got %d %v", rec.Code, rec.Header())
+	}
+
+	var name, message string
+	var size int64
+	_ = db.QueryRow("SELECT file_name, custom_message, file_size FROM gifts WHERE user_id = 1 AND pending = 1").Scan(&name, &message, &size)
+	if name != "memory.mp4" || message != "Watch this" || size != 10 {
+		t.Errorf("Unexpected gift from upload: %q %q %d", name, message, size)
+	}
+	if _, data, err := readGiftData(1); err != nil || string(data) != "0123456789" {
+		t.Errorf("Expected the uploaded bytes in storage, got %q %v", data, err)
+	}
+	if entries, _ := os.ReadDir(tusUploadDir); len(entries) != 0 {
+		t.Errorf("Expected the staging file to be removed, found %d files", len(entries))
+	}
+}
+
+func TestTusUploadRequiresProtocolAndOwnership(t *testing.T) {
+	setupTusTest(t)
+	target := createTestTusUpload(t, "4")
+
+	req := httptest.NewRequest("HEAD", target, nil)
+	authenticate(req, 1)
+	rec := httptest.NewRecorder()
+	requireAuth(tusUploadHandler)(rec, req)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 without Tus-Resumable, got %d", rec.Code)
+	}
+	if rec := tusRequest("HEAD", target, 2, nil, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected another user's upload to be hidden, got %d", rec.Code)
+	}
+	if rec := tusRequest("PATCH", target, 1, map[string]string{"Upload-Offset": "0"}, "abcd"); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected 415 without the tus content type, got %d", rec.Code)
+	}
+
+	previous := maxGiftUploadBytes
+	maxGiftUploadBytes = 100
+	t.Cleanup(func() { maxGiftUploadBytes = previous })
+	if rec := tusRequest("POST", "/uploads", 1, map[string]string{"Upload-Length": "101"}, ""); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for an upload over the limit, got %d", rec.Code)
+	}
+}
+
+func TestTusAbandonedUploadsExpire(t *testing.T) {
+	setupTusTest(t)
+	clock := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	useFixedClock(t, clock)
+	target := createTestTusUpload(t, "10")
+	tusRequest("PATCH", target, 1, patchHeaders("0"), "012")
+	_ = os.WriteFile(filepath.Join(tusUploadDir, "abcdef"), []byte("orphan"), 0o600)
+
+	useFixedClock(t, clock.Add(tusUploadTTL))
+	if rec := tusRequest("HEAD", target, 1, nil, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected an expired upload to be gone, got %d", rec.Code)
+	}
+	if n, err := purgeExpiredUploads(); err != nil || n != 1 {
+		t.Fatalf("Expected one expired upload removed, got %d %v", n, err)
+	}
+	if entries, _ := os.ReadDir(tusUploadDir); len(entries) != 0 {
+		t.Errorf("Expected staging files to be cleaned up, found %d", len(entries))
+	}
+}
@@ -7,9 +7,18 @@ describe("Forgot Password Page", () => {
     cy.contains("Forgot Password").should("be.visible");
   });
 
-  it("should toggle between Email Reset and Security Question", () => {
+  it("should show the account's security questions", () => {
+    cy.intercept("POST", "http://localhost:8080/get-security-info", {
+      statusCode: 200,
+      body: {
+        securityQuestion: "What is your mother's maiden name?",
+        securityQuestions: [{ id: 1, question: "What is your mother's maiden name?" }],
+      },
+    });
+
+    cy.get("input#email").should("exist").type("test@example.com");
     cy.get("button").contains("Security Question").click();
-    cy.get("select#securityQuestion").should("be.visible");
+    cy.contains("What is your mother's maiden name?").should("be.visible");
   });
 
   it("should show validation error when submitting without an email", () => {
@@ -20,10 +29,21 @@ describe("Forgot Password Page", () => {
     cy.contains("Please enter your email address.", { timeout: 8000 }).should("be.visible");
   });
 
-  it("should allow selecting a security question and entering an answer", () => {
+  it("should continue to the reset page after answering the questions", () => {
+    cy.intercept("POST", "http://localhost:8080/get-security-info", {
+      statusCode: 200,
+      body: { securityQuestions: [{ id: 1, question: "What is your mother's maiden name?" }] },
+    });
+    cy.intercept("POST", "http://localhost:8080/verify-security-answer", {
+      statusCode: 200,
+      body: { resetToken: "reset-token", expiresIn: 900 },
+    });
+
+    cy.get("input#email").should("exist").type("test@example.com");
     cy.get("button").contains("Security Question").click();
-    cy.get("select#securityQuestion").should("exist").select("What is your mother's maiden name?");
-    cy.get("input#securityAnswer").should("exist").type("Charlie").should("have.value", "Charlie");
+    cy.get("input#securityAnswer-1").should("exist").type("Charlie").should("have.value", "Charlie");
+    cy.get("button").contains("Verify Answer").click();
+    cy.url().should("include", "/reset-password?token=reset-token");
   });
 
   it("should submit the form successfully (mock API response)", () => {
@@ -1,4 +1,5 @@
 import React, { useEffect, useState } from "react";
+import { apiFetch } from "../utils/api";
 
 export default function MessageNotification({ username }) {
   const [unreadCount, setUnreadCount] = useState(0);
@@ -11,8 +12,8 @@ export default function MessageNotification({ username }) {
     const fetchNotificationData = async () => {
       try {
         const [notifRes, msgRes] = await Promise.all([
-          fetch(`http://localhost:8080/notifications?username=${encodeURIComponent(username)}`),
-          fetch(`http://localhost:8080/get-messages?username=${encodeURIComponent(username)}`)
+          apiFetch("/notifications"),
+          apiFetch("/get-messages")
         ]);
 
         if (notifRes.ok) {
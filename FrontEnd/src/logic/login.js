@@ -1,8 +1,12 @@
+import { apiFetch } from "../utils/api";
+
 export default async (e, router) => {
     e.preventDefault();
 
     try {
-      const response = await fetch("http://localhost:8080/login", {
+      // The session comes back as a cookie, which the browser only keeps
+      // because apiFetch sends credentials.
+      const response = await apiFetch("/login", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify({ username: username.value, password: password.value }),
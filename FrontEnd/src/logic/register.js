@@ -1,3 +1,5 @@
+import { apiFetch } from '../utils/api';
+
 export default async (router) => {
     try {
       // Create a payload matching your backend's expected fields:
@@ -10,7 +12,7 @@ export default async (router) => {
         primary_contact_email: email.value,
       };
 
-      const response = await fetch('http://localhost:8080/create-account', {
+      const response = await apiFetch('/create-account', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json',
@@ -1,5 +1,6 @@
 // ChatIcon.jsx - With additional debugging
 import React, { useState, useEffect, useRef } from "react";
+import { apiFetch } from "../utils/api";
 
 const ChatIcon = ({ username }) => {
     const [isOpen, setIsOpen] = useState(false);
@@ -49,10 +50,7 @@ const ChatIcon = ({ username }) => {
     const fetchMessages = async () => {
         try {
             console.log(`Fetching messages for ${username}...`);
-            const url = `http://localhost:8080/get-messages?username=${encodeURIComponent(username)}`;
-            console.log("Request URL:", url);
-
-            const response = await fetch(url);
+            const response = await apiFetch("/get-messages");
             console.log("Message response status:", response.status);
 
             if (!response.ok) {
@@ -74,10 +72,7 @@ const ChatIcon = ({ username }) => {
     const fetchEligibleUsers = async () => {
         try {
             console.log(`Fetching eligible messaging users for ${username}...`);
-            const url = `http://localhost:8080/users/eligible-messaging?username=${encodeURIComponent(username)}`;
-            console.log("Request URL:", url);
-
-            const response = await fetch(url);
+            const response = await apiFetch("/users/eligible-messaging");
             console.log("Eligible users response status:", response.status);
 
             if (!response.ok) {
@@ -104,11 +99,10 @@ const ChatIcon = ({ username }) => {
 
         try {
             console.log(`Sending message from ${username} to ${recipient}: ${newMessage}`);
-            const response = await fetch("http://localhost:8080/send-message", {
+            const response = await apiFetch("/send-message", {
                 method: "POST",
                 headers: { "Content-Type": "application/json" },
                 body: JSON.stringify({
-                    sender: username,
                     receiver: recipient,
                     content: newMessage,
                 }),
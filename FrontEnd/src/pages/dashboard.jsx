@@ -7,6 +7,7 @@ import MessageNotification from "../components/MessageNotification";
 import { format, parseISO, addDays } from "date-fns";
 import ChatIcon from "./ChatIcon.jsx";
 import { UserHeader } from "../components/user-header.jsx";
+import { apiFetch, fetchAllPages } from "../utils/api";
 
 
 // Calendar Component
@@ -30,13 +31,8 @@ const GiftCalendar = ({ username, onClose }) => {
 
       try {
         setLoading(true);
-        const response = await fetch(`http://localhost:8080/gift-calendar?username=${username}`);
-
-        if (!response.ok) {
-          throw new Error('Failed to fetch calendar data');
-        }
-
-        const data = await response.json();
+        // The calendar is paged; collect every page before grouping by date.
+        const data = await fetchAllPages("/gift-calendar?limit=200");
         setCalendarData(data);
 
         // Group events by date for easier display
@@ -424,14 +420,14 @@ const Dashboard = () => {
         // Fetch everything in parallel
         const [
           giftCountResponse,
-          giftsResponse,
+          giftsData,
           receiversResponse,
           pendingResponse,
         ] = await Promise.all([
-          fetch(`http://localhost:8080/gift-count?username=${storedUsername}`),
-          fetch(`http://localhost:8080/gifts?username=${storedUsername}`),
-          fetch(`http://localhost:8080/get-receivers?username=${storedUsername}`),
-          fetch(`http://localhost:8080/dashboard/pending-gifts?username=${storedUsername}`),
+          apiFetch("/gift-count"),
+          fetchAllPages("/gifts?limit=200"),
+          apiFetch("/get-receivers"),
+          apiFetch("/dashboard/pending-gifts"),
         ]);
 
         // Process gift count
@@ -440,9 +436,8 @@ const Dashboard = () => {
         setGiftCount(giftCountData.count || 0);
 
         // Process gifts - always start with unwrapped: false
-        const giftsData = await giftsResponse.json();
         console.log("Gifts data:", giftsData);
-        setGifts((giftsData || []).map((g) => ({
+        setGifts(giftsData.map((g) => ({
           ...g,
           unwrapped: false // Always start as unwrapped: false
         })));
@@ -466,8 +461,8 @@ const Dashboard = () => {
         setPendingMessages(pendingData.pending_messages || 0);
 
         // NEW: Fetch followers and following data
-        await fetchFollowers(storedUsername);
-        await fetchFollowing(storedUsername);
+        await fetchFollowers();
+        await fetchFollowing();
 
       } catch (error) {
         console.error("Error fetching data:", error);
@@ -491,9 +486,9 @@ const Dashboard = () => {
     fetchData();
   }, []);
 
-  const fetchFollowers = async (user) => {
+  const fetchFollowers = async () => {
     try {
-      const response = await fetch(`http://localhost:8080/friends/followers?username=${user}`);
+      const response = await apiFetch("/friends/followers");
       const data = await response.json();
       setFollowers(Array.isArray(data) ? data : []);
       console.log("Followers loaded:", data);
@@ -503,9 +498,9 @@ const Dashboard = () => {
     }
   };
 
-  const fetchFollowing = async (user) => {
+  const fetchFollowing = async () => {
     try {
-      const response = await fetch(`http://localhost:8080/friends/following?username=${user}`);
+      const response = await apiFetch("/friends/following");
       const data = await response.json();
       setFollowing(Array.isArray(data) ? data : []);
       console.log("Following loaded:", data);
@@ -522,8 +517,8 @@ const Dashboard = () => {
       return;
     }
     try {
-      const response = await fetch(
-        `http://localhost:8080/stop-pending-gift?id=${giftId}`,
+      const response = await apiFetch(
+        `/stop-pending-gift?id=${giftId}`,
         { method: "DELETE" }
       );
       if (!response.ok) {
@@ -1,6 +1,7 @@
 import React, { useState, useEffect, act } from "react";
 import { useRouter } from "next/router";
 import { UserHeader } from "../components/user-header";
+import { apiFetch } from "../utils/api";
 
 
 const FileMemory = () => {
@@ -57,18 +58,16 @@ const FileMemory = () => {
 
 
    const formData = new FormData();
-   formData.append("username", storedUsername);
    formData.append("file", selectedFile);
    formData.append("emailMessage", customMessage);
 
 
-   console.log("Sending username:", storedUsername);
    console.log("File name:", selectedFile.name);
    // Removed scheduledTime field so it's only set later in memory-uploaded.
 
 
    try {
-     const response = await fetch("http://localhost:8080/upload-gift", {
+     const response = await apiFetch("/upload-gift", {
        method: "POST",
        body: formData,
      });
@@ -1,5 +1,6 @@
 import React, { useState, useEffect } from "react";
 import { useRouter } from "next/router";
+import { apiFetch } from "../utils/api";
 
 const ForceChange = () => {
     const [username, setUsername] = useState("");
@@ -69,11 +70,10 @@ const ForceChange = () => {
         }
 
         try {
-            const response = await fetch("http://localhost:8080/change-password", {
+            const response = await apiFetch("/change-password", {
                 method: "POST",
                 headers: { "Content-Type": "application/json" },
                 body: JSON.stringify({
-                    username: username,
                     newPassword: newPassword,
                 }),
             });
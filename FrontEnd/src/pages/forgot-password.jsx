@@ -1,30 +1,23 @@
 import React, { useState } from "react";
 import { useRouter } from "next/router";
 import { Button } from "../components/ui/button";
+import { apiFetch } from "../utils/api";
 
 const ForgotPassword = () => {
   const [email, setEmail] = useState("");
-  const [securityQuestionIndex, setSecurityQuestionIndex] = useState(-1); // Index of selected security question
-  const [securityAnswer, setSecurityAnswer] = useState("");
+  const [questions, setQuestions] = useState([]); // The account's questions, as { id, question }
+  const [answers, setAnswers] = useState({}); // Answers keyed by question id
   const [message, setMessage] = useState("");
   const [showQuestions, setShowQuestions] = useState(false); // Control display of security questions
   const router = useRouter();
 
-  const securityQuestions = [
-    "What is your mother's maiden name?",
-    "What was the name of your first pet?",
-    "What is your favorite teacher's name?",
-    "What was the make of your first car?",
-    "What city were you born in?"
-  ];
-
   const handleResetPassword = async () => {
     if (!email) {
       setMessage("Please enter your email address.");
       return;
     }
     try {
-      const response = await fetch("http://localhost:8080/reset-password", {
+      const response = await apiFetch("/reset-password", {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
@@ -42,32 +35,58 @@ const ForgotPassword = () => {
     }
   };
 
-  const handleSelectQuestion = (index) => {
-    setSecurityQuestionIndex(index);
-    setShowQuestions(true);
+  // Loads the questions set up for the email's account.
+  const handleShowQuestions = async () => {
+    if (showQuestions) {
+      setShowQuestions(false);
+      return;
+    }
+    if (!email) {
+      setMessage("Please enter your email address.");
+      return;
+    }
+    try {
+      const response = await apiFetch("/get-security-info", {
+        method: "POST",
+        headers: {
+          "Content-Type": "application/json",
+        },
+        body: JSON.stringify({ email }),
+      });
+      if (!response.ok) {
+        setMessage("Unable to load security questions. Please try again later.");
+        return;
+      }
+      const data = await response.json();
+      setQuestions(data.securityQuestions || []);
+      setAnswers({});
+      setMessage("");
+      setShowQuestions(true);
+    } catch (error) {
+      setMessage("Unable to load security questions. Please try again later.");
+    }
   };
 
+  // Every question has to be answered. Correct answers earn a short-lived
+  // reset token, which the reset password page exchanges for a new password.
   const verifySecurityAnswer = async () => {
-    if (securityQuestionIndex === -1 || !securityAnswer) {
-      setMessage("Please select a security question and provide an answer.");
+    if (questions.length === 0 || questions.some((q) => !(answers[q.id] || "").trim())) {
+      setMessage("Please answer every security question.");
       return;
     }
     try {
-      const response = await fetch("http://localhost:8080/verify-security-answer", {
+      const response = await apiFetch("/verify-security-answer", {
         method: "POST",
         headers: {
           "Content-Type": "application/json",
         },
-        body: JSON.stringify({
-          email,
-          question: securityQuestions[securityQuestionIndex],
-          answer: securityAnswer,
-        }),
+        body: JSON.stringify({ email, answers }),
       });
 
       if (response.ok) {
+        const data = await response.json();
         setMessage("Security answer verified successfully. You can now reset your password.");
-        router.push("/reset-password"); // Assuming '/reset-password' is the route to change the password
+        router.push(`/reset-password?token=${encodeURIComponent(data.resetToken)}`);
       } else {
         setMessage("Incorrect answer to security question.");
       }
@@ -109,36 +128,28 @@ const ForgotPassword = () => {
             </Button>
           </div>
           <div className="flex mb-4 space-x-4">
-            <Button className="w-full h-12 text-white" onClick={() => setShowQuestions(!showQuestions)}>
+            <Button className="w-full h-12 text-white" onClick={handleShowQuestions}>
               Security Question
             </Button>
           </div>
           {showQuestions && (
             <div className="flex flex-col mb-4">
-              <label htmlFor="securityQuestion" className="text-sm font-medium text-black">
-                Choose a Security Question
-              </label>
-              <select
-                id="securityQuestion"
-                value={securityQuestionIndex}
-                onChange={(e) => setSecurityQuestionIndex(e.target.value)}
-                className="border-gray-600 border rounded-lg p-2 mt-1 focus:outline-none focus:ring focus:ring-blue-300"
-                required
-              >
-                {securityQuestions.map((question, index) => (
-                  <option key={index} value={index}>
-                    {question}
-                  </option>
-                ))}
-              </select>
-              <input
-                type="text"
-                value={securityAnswer}
-                onChange={(e) => setSecurityAnswer(e.target.value)}
-                placeholder="Enter your answer"
-                className="border-gray-600 border rounded-lg p-2 mt-1 focus:outline-none focus:ring focus:ring-blue-300"
-                required
-              />
+              {questions.map((q) => (
+                <div key={q.id} className="flex flex-col mb-2">
+                  <label htmlFor={`securityAnswer-${q.id}`} className="text-sm font-medium text-black">
+                    {q.question}
+                  </label>
+                  <input
+                    type="text"
+                    id={`securityAnswer-${q.id}`}
+                    value={answers[q.id] || ""}
+                    onChange={(e) => setAnswers({ ...answers, [q.id]: e.target.value })}
+                    placeholder="Enter your answer"
+                    className="border-gray-600 border rounded-lg p-2 mt-1 focus:outline-none focus:ring focus:ring-blue-300"
+                    required
+                  />
+                </div>
+              ))}
               <Button className="w-full h-12 text-white mt-4" onClick={verifySecurityAnswer}>
                 Verify Answer
               </Button>
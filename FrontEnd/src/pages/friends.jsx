@@ -38,7 +38,7 @@ export default function Friends() {
 
     const fetchFollowers = async (user) => {
         try {
-            const response = await ApiClient.get(`/friends/followers?username=${user}`);
+            const response = await ApiClient.get('/friends/followers');
             // Ensure we always set an array even if API returns null or undefined
             setFollowers(Array.isArray(response.data) ? response.data : []);
         } catch (error) {
@@ -49,7 +49,7 @@ export default function Friends() {
 
     const fetchFollowing = async (user) => {
         try {
-            const response = await ApiClient.get(`/friends/following?username=${user}`);
+            const response = await ApiClient.get('/friends/following');
             // Ensure we always set an array even if API returns null or undefined
             setFollowing(Array.isArray(response.data) ? response.data : []);
         } catch (error) {
@@ -61,7 +61,7 @@ export default function Friends() {
     const fetchDiscoveredUsers = async (user) => {
         setIsLoading(true);
         try {
-            const response = await ApiClient.get(`/users/discover?username=${user}`);
+            const response = await ApiClient.get('/users/discover');
             // Ensure we always set an array even if API returns null or undefined
             setDiscoveredUsers(Array.isArray(response.data) ? response.data : []);
         } catch (error) {
@@ -77,7 +77,7 @@ export default function Friends() {
 
         setIsSearching(true);
         try {
-            const response = await ApiClient.get(`/users/search?username=${username}&query=${searchQuery}`);
+            const response = await ApiClient.get('/users/search', { params: { query: searchQuery } });
             // Ensure we always set an array even if API returns null or undefined
             setSearchResults(Array.isArray(response.data) ? response.data : []);
         } catch (error) {
@@ -91,7 +91,6 @@ export default function Friends() {
     const handleFollow = async (friendUsername) => {
         try {
             await ApiClient.post('/users/follow', {
-                username: username,
                 friendUsername: friendUsername
             });
             // Update lists after following
@@ -105,7 +104,6 @@ export default function Friends() {
     const handleUnfollow = async (friendUsername) => {
         try {
             await ApiClient.post('/users/unfollow', {
-                username: username,
                 friendUsername: friendUsername
             });
             // Update lists after unfollowing
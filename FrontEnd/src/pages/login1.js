@@ -1,6 +1,7 @@
 import React from "react";
 import { useState } from "react";
 import { useRouter } from "next/router";
+import { apiFetch } from "../utils/api";
 
 export default function Home() {
   const [user, setUser] = useState({ username: '', password: '' });
@@ -21,7 +22,7 @@ export default function Home() {
 
   const loginUser = async () => {
     try {
-      const response = await fetch('http://localhost:8080/login', {
+      const response = await apiFetch('/login', {
         method: 'POST',
         headers: {
           'Content-Type': 'application/json'
@@ -1,6 +1,7 @@
 import React, { useState } from "react";
 import { useRouter } from "next/router";
 import { UserHeader } from "../components/user-header";
+import { apiFetch } from "../utils/api";
 
 const MemoryUploaded = () => {
   const [receiverInfo, setReceiverInfo] = useState({
@@ -29,7 +30,6 @@ const MemoryUploaded = () => {
 
     // Build payload for the inactivity check
     const inactivityPayload = {
-      username,
       customMessage: receiverInfo.comments,
     };
 
@@ -44,7 +44,7 @@ const MemoryUploaded = () => {
     try {
       // First, call the inactivity check handler
       if (!scheduledTime) {
-        const inactivityResponse = await fetch("http://localhost:8080/schedule-check", {
+        const inactivityResponse = await apiFetch("/schedule-check", {
           method: "POST",
           headers: { "Content-Type": "application/json" },
           body: JSON.stringify(inactivityPayload),
@@ -57,7 +57,7 @@ const MemoryUploaded = () => {
         console.log("Inactivity check scheduled successfully.");
       }
       // Then, call the setup receivers handler
-      const setupResponse = await fetch("http://localhost:8080/setup-receivers", {
+      const setupResponse = await apiFetch("/setup-receivers", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify(setupPayload),
@@ -1,6 +1,7 @@
 import React, { useState, useEffect } from "react";
 import { useRouter } from "next/router";
 import { UserHeader } from "../components/user-header";
+import { apiFetch } from "../utils/api";
 
 export default function PersonalDetails() {
   const securityQuestions = [
@@ -52,7 +53,7 @@ export default function PersonalDetails() {
 
     console.log("Fetching details for username:", username);
     try {
-      const response = await fetch(`http://localhost:8080/update-emails?username=${username}`);
+      const response = await apiFetch("/update-emails");
       if (response.ok) {
         const data = await response.json();
         console.log("Fetched user details:", data);
@@ -110,7 +111,6 @@ export default function PersonalDetails() {
     try {
       console.log("Submitted details:", details);
       const payload = {
-        username: details.username,
         primary_contact_email: details.primaryContact,
         secondary_contact_emails: details.secondaryContacts.filter(email => email.trim() !== "").join(","),
         security_question: details.securityQuestion,
@@ -119,7 +119,7 @@ export default function PersonalDetails() {
 
       console.log("Sending payload:", payload);
 
-      const response = await fetch("http://localhost:8080/update-emails", {
+      const response = await apiFetch("/update-emails", {
         method: "POST",
         headers: { "Content-Type": "application/json" },
         body: JSON.stringify(payload),
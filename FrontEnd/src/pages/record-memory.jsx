@@ -2,6 +2,7 @@ import React, { useRef, useState, useEffect } from "react";
 import { useRouter } from "next/router";
 import Image from "next/image";
 import { UserHeader } from "../components/user-header";
+import { apiFetch } from "../utils/api";
 
 const RecordMemory = () => {
   const videoRef = useRef(null);
@@ -104,11 +105,10 @@ const RecordMemory = () => {
     }
 
     const formData = new FormData();
-    formData.append("username", currentUsername);
     formData.append("file", videoBlob, "memory.mp4");
 
     try {
-      const response = await fetch(`http://localhost:8080/upload-gift?username=${currentUsername}`, {
+      const response = await apiFetch("/upload-gift", {
         method: "POST",
         body: formData,
       });
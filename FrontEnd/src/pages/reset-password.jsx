@@ -0,0 +1,153 @@
+import React, { useState, useEffect } from "react";
+import { useRouter } from "next/router";
+import { apiFetch } from "../utils/api";
+
+// Sets a new password with the token from a reset email or from answering
+// the security questions.
+const ResetPassword = () => {
+    const [newPassword, setNewPassword] = useState("");
+    const [confirmPassword, setConfirmPassword] = useState("");
+    const [passwordRequirements, setPasswordRequirements] = useState({
+        length: false,
+        letter: false,
+        number: false,
+        special: false
+    });
+    const [error, setError] = useState("");
+    const [message, setMessage] = useState("");
+    const router = useRouter();
+    const { token } = router.query;
+
+    // Check password requirements as user types
+    useEffect(() => {
+        setPasswordRequirements({
+            length: newPassword.length >= 8,
+            letter: /[a-zA-Z]/.test(newPassword),
+            number: /[0-9]/.test(newPassword),
+            special: /[^a-zA-Z0-9]/.test(newPassword)
+        });
+    }, [newPassword]);
+
+    const handleResetPassword = async (e) => {
+        e.preventDefault();
+        setError("");
+        setMessage("");
+
+        const allRequirementsMet = Object.values(passwordRequirements).every(req => req);
+        if (!allRequirementsMet) {
+            setError("Please ensure your password meets all the requirements.");
+            return;
+        }
+
+        if (newPassword !== confirmPassword) {
+            setError("Passwords do not match.");
+            return;
+        }
+
+        try {
+            const response = await apiFetch("/reset-password/confirm", {
+                method: "POST",
+                headers: { "Content-Type": "application/json" },
+                body: JSON.stringify({ token, newPassword }),
+            });
+
+            if (!response.ok) {
+                setError("This reset link is invalid or has expired. Please request a new one.");
+                return;
+            }
+
+            setMessage("Password reset successfully. Please log in.");
+            setTimeout(() => {
+                router.push("/login?passwordChanged=true");
+            }, 1500);
+        } catch (err) {
+            console.error("Error resetting password:", err);
+            setError("Something went wrong. Please try again later.");
+        }
+    };
+
+    return (
+        <div className="flex items-center justify-center min-h-screen bg-blue-100">
+            <div className="w-full max-w-md p-8 bg-white rounded-lg shadow-md">
+                <div className="text-center mb-6">
+                    <img
+                        src="https://i.postimg.cc/VsRBMLgn/pglogo.png"
+                        alt="Parting Gifts Logo"
+                        className="mx-auto mb-4 w-24"
+                    />
+                    <h1 className="text-xl font-bold text-black">Reset Your Password</h1>
+                </div>
+                {message && <p className="mb-4 text-sm text-center text-green-600">{message}</p>}
+                <form onSubmit={handleResetPassword}>
+                    <div className="mb-4">
+                        <label className="block text-sm font-medium text-black">
+                            New Password
+                        </label>
+                        <input
+                            type="password"
+                            value={newPassword}
+                            onChange={(e) => setNewPassword(e.target.value)}
+                            className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring focus:ring-blue-300"
+                            placeholder="Enter your new password"
+                            required
+                        />
+
+                        {/* Password requirements */}
+                        <div className="mt-2 text-sm">
+                            <p className="font-semibold mb-1">Password must have:</p>
+                            <ul>
+                                <li className={passwordRequirements.length ? "text-green-500" : "text-red-500"}>
+                                    ✓ At least 8 characters
+                                </li>
+                                <li className={passwordRequirements.letter ? "text-green-500" : "text-red-500"}>
+                                    ✓ At least one letter
+                                </li>
+                                <li className={passwordRequirements.number ? "text-green-500" : "text-red-500"}>
+                                    ✓ At least one number
+                                </li>
+                                <li className={passwordRequirements.special ? "text-green-500" : "text-red-500"}>
+                                    ✓ At least one special character
+                                </li>
+                            </ul>
+                        </div>
+                    </div>
+                    <div className="mb-4">
+                        <label className="block text-sm font-medium text-black">
+                            Confirm New Password
+                        </label>
+                        <input
+                            type="password"
+                            value={confirmPassword}
+                            onChange={(e) => setConfirmPassword(e.target.value)}
+                            className="w-full px-3 py-2 border rounded-md focus:outline-none focus:ring focus:ring-blue-300"
+                            placeholder="Confirm your new password"
+                            required
+                        />
+                        {confirmPassword && newPassword !== confirmPassword && (
+                            <p className="text-sm text-red-600 mt-1">Passwords do not match</p>
+                        )}
+                    </div>
+                    {error && <p className="mb-4 text-sm text-red-600">{error}</p>}
+                    <button
+                        type="submit"
+                        disabled={!token}
+                        className={`w-full px-4 py-2 text-white rounded-md focus:outline-none focus:ring focus:ring-blue-300
+                            ${token ? "bg-blue-500 hover:bg-blue-600" : "bg-gray-400 cursor-not-allowed"}`}
+                    >
+                        Reset Password
+                    </button>
+                </form>
+                <div className="text-center mt-4">
+                    <a
+                        onClick={() => router.push("/login")}
+                        className="text-sm text-blue-500 hover:underline cursor-pointer"
+                    >
+                        Back to Log in
+                    </a>
+                </div>
+            </div>
+        </div>
+    );
+};
+
+export default ResetPassword;
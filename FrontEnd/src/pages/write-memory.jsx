@@ -12,6 +12,7 @@ import htmlToPdfMake from "html-to-pdfmake";
 import { Document, Page, Text, View, PDFDownloadLink, pdf } from "@react-pdf/renderer";
 import RichTextEditor from "../components/TiptapEditor";
 import { UserHeader } from "../components/user-header";
+import { apiFetch } from "../utils/api";
 
 const ExportedPDF = ({ content }) => (
     <Document>
@@ -48,11 +49,10 @@ const WriteMemory = () => {
 
     // Create FormData for Upload
     const formData = new FormData();
-    formData.append("username", username);
     formData.append("file", pdfBlob, `${title || "Memory"}.pdf`);
 
     try {
-      const response = await fetch("http://localhost:8080/upload-gift", {
+      const response = await apiFetch("/upload-gift", {
         method: "POST",
         body: formData,
       });
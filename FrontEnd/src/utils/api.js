@@ -1,13 +1,38 @@
 // utils/api.js
 import axios from 'axios';
 
-const baseURL = 'http://localhost:8080';
+export const baseURL = 'http://localhost:8080';
 
+// The backend keeps the session in an HttpOnly cookie set by /login, so every
+// request sends credentials and the server works out who is signed in.
 const ApiClient = axios.create({
     baseURL,
+    withCredentials: true,
     headers: {
         'Content-Type': 'application/json'
     }
 });
 
-export default ApiClient;
\ No newline at end of file
+// apiFetch is fetch for backend paths, sending the session cookie.
+export const apiFetch = (path, options = {}) =>
+    fetch(`${baseURL}${path}`, { credentials: 'include', ...options });
+
+// fetchAllPages follows the nextCursor of a paged listing such as /gifts or
+// /gift-calendar and returns the items of every page.
+export const fetchAllPages = async (path) => {
+    const items = [];
+    let cursor = null;
+    do {
+        const separator = path.includes('?') ? '&' : '?';
+        const response = await apiFetch(cursor ? `${path}${separator}cursor=${encodeURIComponent(cursor)}` : path);
+        if (!response.ok) {
+            throw new Error(`Failed to fetch ${path}: ${response.status}`);
+        }
+        const page = await response.json();
+        items.push(...(page.items || []));
+        cursor = page.nextCursor;
+    } while (cursor);
+    return items;
+};
+
+export default ApiClient;
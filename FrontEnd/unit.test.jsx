@@ -107,9 +107,16 @@ vi.mock("lucide-react", () => ({
 // Stub global fetch for endpoints used by Dashboard and others.
 vi.stubGlobal("fetch", async (url, options) => {
   if (typeof url === "string") {
+    // Gift listings answer a page at a time.
+    if (url.includes("/gifts") || url.includes("/gift-calendar")) {
+      return {
+        ok: true,
+        status: 200,
+        json: async () => ({ items: [], nextCursor: null, total: 0 }),
+      };
+    }
     // For endpoints Dashboard uses.
     if (
-      url.includes("gifts") ||
       url.includes("giftCount") ||
       url.includes("receivers") ||
       url.includes("pending-messages")
@@ -129,7 +136,7 @@ vi.stubGlobal("fetch", async (url, options) => {
       };
     }
     // For PersonalDetails GET request.
-    if (url.includes("update-emails?username=")) {
+    if (url.includes("update-emails")) {
       return {
         ok: true,
         status: 200,
@@ -465,10 +472,14 @@ describe("MemoryUploaded Component", () => {
           return {
             ok: true,
             status: 200,
-            json: async () => ([
-              { id: 1, file_name: "test.jpg", pending: false, content_type: "image/jpeg" },
-              { id: 2, file_name: "test2.txt", pending: false, content_type: "text/plain" }
-            ]),
+            json: async () => ({
+              items: [
+                { id: 1, file_name: "test.jpg", pending: false, content_type: "image/jpeg" },
+                { id: 2, file_name: "test2.txt", pending: false, content_type: "text/plain" }
+              ],
+              nextCursor: null,
+              total: 2,
+            }),
           };
         }
         return { ok: true, status: 200, json: async () => ([]) };